@@ -0,0 +1,92 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "time"
+)
+
+// pendingAck is a require_ack broadcast delivered to a client and not yet acknowledged.
+type pendingAck struct {
+    frame    []byte
+    attempts int // Deliveries made so far, including the first
+    timer    *time.Timer
+}
+
+// newMessageID returns a server-unique ID for a broadcast requiring acknowledgment.
+func (s *WebSocketServer) newMessageID() string {
+    return fmt.Sprintf("msg-%d", s.messageSeq.Add(1))
+}
+
+// trackAckLocked starts waiting for the client to acknowledge a frame it was just sent.
+// The caller must hold s.Mutex.
+func (s *WebSocketServer) trackAckLocked(client *Client, messageID string, frame []byte) {
+    client.mu.Lock()
+    defer client.mu.Unlock()
+    if client.pendingAcks == nil {
+        client.pendingAcks = make(map[string]*pendingAck)
+    }
+    client.pendingAcks[messageID] = &pendingAck{
+        frame:    frame,
+        attempts: 1,
+        timer:    time.AfterFunc(s.AckTimeout, func() { s.ackTimedOut(client, messageID) }),
+    }
+}
+
+// ackTimedOut redelivers an unacknowledged frame, or gives up once AckRetries redeliveries
+// have gone unanswered.
+func (s *WebSocketServer) ackTimedOut(client *Client, messageID string) {
+    s.Mutex.RLock()
+    if !s.Clients[client] {
+        s.Mutex.RUnlock()
+        return
+    }
+
+    client.mu.Lock()
+    pending, ok := client.pendingAcks[messageID]
+    if !ok {
+        client.mu.Unlock()
+        s.Mutex.RUnlock()
+        return
+    }
+    if pending.attempts > s.AckRetries {
+        delete(client.pendingAcks, messageID)
+        client.mu.Unlock()
+        s.Mutex.RUnlock()
+        log.Printf("Message %s undelivered to client %s after %d attempts", messageID, client.ID, pending.attempts)
+        if s.OnUndelivered != nil {
+            s.OnUndelivered(client, messageID)
+        }
+        return
+    }
+    pending.attempts++
+    pending.timer.Reset(s.AckTimeout)
+    client.mu.Unlock()
+
+    // A full queue is left to the next broadcast to detect; the retry still counts
+    s.enqueue(client, pending.frame)
+    s.Mutex.RUnlock()
+}
+
+// acknowledge stops tracking a message the client has confirmed. It reports whether the
+// message was still pending.
+func (c *Client) acknowledge(messageID string) bool {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    pending, ok := c.pendingAcks[messageID]
+    if ok {
+        pending.timer.Stop()
+        delete(c.pendingAcks, messageID)
+    }
+    return ok
+}
+
+// dropPendingAcks abandons every acknowledgment the client still owes, as when it disconnects.
+func (c *Client) dropPendingAcks() {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    for id, pending := range c.pendingAcks {
+        pending.timer.Stop()
+        delete(c.pendingAcks, id)
+    }
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "sync"
+    "time"
+)
+
+// AgentController carries out agent control commands on behalf of the WebSocket server.
+type AgentController interface {
+    // Execute runs command against the agent and returns the agent's resulting status.
+    Execute(ctx context.Context, agentID, command string, params map[string]interface{}) (string, error)
+}
+
+// AgentConfigurer is implemented by controllers that apply update_config themselves and
+// report the agent's resulting configuration, which is returned to the client.
+type AgentConfigurer interface {
+    // UpdateConfig merges params into the agent's configuration, or replaces it with params
+    // for ConfigReplace, and returns the effective configuration.
+    UpdateConfig(ctx context.Context, agentID string, params map[string]interface{}, mode ConfigMode) (map[string]interface{}, error)
+}
+
+// AgentDryRunner is implemented by controllers that can check a command without carrying it
+// out, for agent_control requests with dry_run set.
+type AgentDryRunner interface {
+    // DryRun validates the command and its params and returns the status it would produce
+    // and, for update_config, the configuration that would result. It must have no side effects.
+    DryRun(ctx context.Context, request AgentControlPayload) (string, map[string]interface{}, error)
+}
+
+// AgentHealthReporter is implemented by controllers that can report an agent's health, which
+// is returned with each agent_control response so clients need not poll for it.
+type AgentHealthReporter interface {
+    // Health returns a snapshot of the agent's health as it stands after its latest command.
+    Health(ctx context.Context, agentID string) (AgentHealth, error)
+}
+
+// AgentHealth is a snapshot of an agent's health.
+type AgentHealth struct {
+    UptimeSeconds int64   `json:"uptime_seconds"`       // Time since the agent last started; 0 while stopped
+    LastError     string  `json:"last_error,omitempty"` // Most recent error the agent reported, if any
+    CPUPercent    float64 `json:"cpu_percent"`
+    MemoryBytes   uint64  `json:"memory_bytes"`
+}
+
+// placeholderAgentController simulates command execution until agents are wired in,
+// keeping agent configurations and start times in memory.
+type placeholderAgentController struct {
+    mu      sync.Mutex
+    clock   Clock
+    configs map[string]map[string]interface{}
+    started map[string]time.Time // When each running agent was started, by clock
+}
+
+func newPlaceholderAgentController(clock Clock) *placeholderAgentController {
+    return &placeholderAgentController{
+        clock:   clock,
+        configs: make(map[string]map[string]interface{}),
+        started: make(map[string]time.Time),
+    }
+}
+
+// UpdateConfig applies params to the agent's in-memory configuration.
+func (c *placeholderAgentController) UpdateConfig(ctx context.Context, agentID string, params map[string]interface{}, mode ConfigMode) (map[string]interface{}, error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    config := c.configs[agentID]
+    if config == nil || mode == ConfigReplace {
+        config = make(map[string]interface{}, len(params))
+    }
+    for key, value := range params {
+        config[key] = value
+    }
+    c.configs[agentID] = config
+    log.Printf("Updated config for agent %s (%s): %v", agentID, mode, config)
+
+    effective := make(map[string]interface{}, len(config))
+    for key, value := range config {
+        effective[key] = value
+    }
+    return effective, nil
+}
+
+// DryRun reports the status the command would produce and, for update_config, the
+// configuration that would result, leaving the stored configuration untouched.
+func (c *placeholderAgentController) DryRun(ctx context.Context, request AgentControlPayload) (string, map[string]interface{}, error) {
+    status := placeholderStatus(request.Command)
+    if request.Command != "update_config" {
+        return status, nil, nil
+    }
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    config := make(map[string]interface{})
+    if request.Mode != ConfigReplace {
+        for key, value := range c.configs[request.AgentID] {
+            config[key] = value
+        }
+    }
+    for key, value := range request.Params {
+        config[key] = value
+    }
+    return status, config, nil
+}
+
+// Execute logs the command, records when the agent starts or stops, and reports the status it
+// would produce.
+func (c *placeholderAgentController) Execute(ctx context.Context, agentID, command string, params map[string]interface{}) (string, error) {
+    switch command {
+    case "start":
+        log.Printf("Starting agent %s", agentID)
+        c.mu.Lock()
+        c.started[agentID] = c.clock.Now()
+        c.mu.Unlock()
+    case "stop":
+        log.Printf("Stopping agent %s", agentID)
+        c.mu.Lock()
+        delete(c.started, agentID)
+        c.mu.Unlock()
+    default:
+        log.Printf("Updating config for agent %s with params: %v", agentID, params)
+    }
+    return placeholderStatus(command), nil
+}
+
+// Health reports the agent's uptime since its last start. The placeholder measures no
+// resource usage.
+func (c *placeholderAgentController) Health(ctx context.Context, agentID string) (AgentHealth, error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    var health AgentHealth
+    if started, ok := c.started[agentID]; ok {
+        health.UptimeSeconds = int64(c.clock.Now().Sub(started) / time.Second)
+    }
+    return health, nil
+}
+
+// placeholderStatus returns the status the placeholder reports for command.
+func placeholderStatus(command string) string {
+    switch command {
+    case "start":
+        return "started"
+    case "stop":
+        return "stopped"
+    default:
+        return "config_updated"
+    }
+}
+
+// agentCommand is a control request waiting in an agent's queue.
+type agentCommand struct {
+    client   *Client
+    request  AgentControlPayload
+    position uint64
+    issued   time.Time // When the command was received
+}
+
+// agentQueue serializes the commands for one agent so they run in the order received. It is
+// removed from agentQueues once drained, so positions restart when the agent was idle.
+type agentQueue struct {
+    agentID  string
+    mu       sync.Mutex
+    pending  []agentCommand
+    running  bool   // Whether a worker goroutine is draining pending
+    sequence uint64 // Position assigned to the most recently queued command
+}
+
+// enqueueAgentCommand appends a command to its agent's queue, starting a worker if the queue
+// was idle. ack runs with the queue locked, so it happens before the command can execute.
+// It returns false if the queue already holds AgentQueueDepth pending commands.
+func (s *WebSocketServer) enqueueAgentCommand(client *Client, request AgentControlPayload, ack func(position uint64)) bool {
+    s.agentQueuesMu.Lock()
+    queue, ok := s.agentQueues[request.AgentID]
+    if !ok {
+        queue = &agentQueue{agentID: request.AgentID}
+        s.agentQueues[request.AgentID] = queue
+    }
+    // Locked before agentQueuesMu is released so a draining worker cannot remove it meanwhile
+    queue.mu.Lock()
+    s.agentQueuesMu.Unlock()
+    defer queue.mu.Unlock()
+    if s.AgentQueueDepth > 0 && len(queue.pending) >= s.AgentQueueDepth {
+        return false
+    }
+    queue.sequence++
+    queue.pending = append(queue.pending, agentCommand{client: client, request: request, position: queue.sequence, issued: s.Clock.Now()})
+    ack(queue.sequence)
+    if !queue.running {
+        queue.running = true
+        go s.drainAgentQueue(queue)
+    }
+    return true
+}
+
+// drainAgentQueue executes an agent's pending commands one at a time until the queue is empty,
+// then removes the queue.
+func (s *WebSocketServer) drainAgentQueue(queue *agentQueue) {
+    for {
+        queue.mu.Lock()
+        if len(queue.pending) == 0 {
+            // Relocked in lock order; a command may be queued in between
+            queue.mu.Unlock()
+            s.agentQueuesMu.Lock()
+            queue.mu.Lock()
+            drained := len(queue.pending) == 0
+            if drained {
+                queue.running = false
+                delete(s.agentQueues, queue.agentID)
+            }
+            queue.mu.Unlock()
+            s.agentQueuesMu.Unlock()
+            if drained {
+                return
+            }
+            continue
+        }
+        command := queue.pending[0]
+        queue.pending = queue.pending[1:]
+        queue.mu.Unlock()
+
+        s.executeAgentCommand(command)
+    }
+}
+
+// executeAgentCommand runs a queued command through the AgentController and reports the result.
+// A command outlasting AgentCommandTimeout is abandoned with its context cancelled, and the
+// client is sent an agent_control_update with status "timeout" and a 504 error. A dry run is answered with
+// status "dry_run" and the status it would have produced as "result", and is not broadcast.
+// Other successful commands carry the agent's health when the Controller reports it.
+func (s *WebSocketServer) executeAgentCommand(command agentCommand) {
+    agentID, name := command.request.AgentID, command.request.Command
+    log.Printf("Processing agent control command: %s for agent: %s (position %d)", name, agentID, command.position)
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    if s.AgentCommandTimeout > 0 {
+        var cancelTimeout context.CancelFunc
+        ctx, cancelTimeout = context.WithTimeout(ctx, s.AgentCommandTimeout)
+        defer cancelTimeout()
+    }
+
+    type result struct {
+        status string
+        config map[string]interface{}
+        err    error
+    }
+    // Buffered so a controller that ignores cancellation does not leak its goroutine
+    done := make(chan result, 1)
+    go func() {
+        var r result
+        r.status, r.config, r.err = s.runAgentCommand(ctx, command.request)
+        done <- r
+    }()
+
+    // The outcome is whichever fired first; a result that beats the deadline counts
+    var r result
+    timedOut := false
+    select {
+    case r = <-done:
+    case <-ctx.Done():
+        timedOut = true
+    }
+    status, err := r.status, r.err
+    if timedOut {
+        log.Printf("Agent control command %s for agent %s timed out after %v", name, agentID, s.AgentCommandTimeout)
+        s.logCommand(command.client.Principal, command.issued, command.request, "timeout", nil)
+        s.sendSignedResponseToClient(command.client, ResponseMessage{
+            Type:    "agent_control_update",
+            Success: false,
+            Error:   &ErrorResponse{Code: int(CodeTimeout), Message: fmt.Sprintf("Agent command %s timed out after %v", name, s.AgentCommandTimeout)},
+            Data: map[string]interface{}{
+                "agent_id": agentID,
+                "command":  name,
+                "status":   "timeout",
+                "position": command.position,
+            },
+        })
+        return
+    }
+    if err != nil && command.request.DryRun {
+        s.logCommand(command.client.Principal, command.issued, command.request, "rejected", err)
+        s.sendErrorMessage(command.client, CodeBadRequest, "Dry run of "+name+" rejected: "+err.Error(), nil)
+        return
+    }
+    if err != nil {
+        s.logCommand(command.client.Principal, command.issued, command.request, "failed", err)
+        s.sendInternalErrorToClient(command.client, CodeInternal, "Agent command failed: "+name, err)
+        return
+    }
+    if command.request.DryRun {
+        s.logCommand(command.client.Principal, command.issued, command.request, "dry_run", nil)
+        data := map[string]interface{}{
+            "agent_id": agentID,
+            "command":  name,
+            "status":   "dry_run",
+            "result":   status,
+            "position": command.position,
+        }
+        if r.config != nil {
+            data["config"] = r.config
+        }
+        s.sendSignedResponseToClient(command.client, ResponseMessage{
+            Type:    "agent_control_response",
+            Success: true,
+            Data:    data,
+        })
+        return
+    }
+
+    s.logCommand(command.client.Principal, command.issued, command.request, status, nil)
+    // Broadcast an agent status update (optional, based on your use case)
+    s.SendAgentStatusUpdate(agentID, status, "Command processed")
+    data := map[string]interface{}{
+        "agent_id": agentID,
+        "command":  name,
+        "status":   status,
+        "position": command.position,
+    }
+    if r.config != nil {
+        data["config"] = r.config
+    }
+    if health, ok := s.agentHealth(ctx, agentID); ok {
+        data["health"] = health
+    }
+    s.sendSignedResponseToClient(command.client, ResponseMessage{
+        Type:    "agent_control_response",
+        Success: true,
+        Data:    data,
+    })
+}
+
+// agentHealth asks the Controller for the agent's health if it is an AgentHealthReporter.
+// A failed snapshot is logged and left out rather than failing the command it follows.
+func (s *WebSocketServer) agentHealth(ctx context.Context, agentID string) (AgentHealth, bool) {
+    reporter, ok := s.Controller.(AgentHealthReporter)
+    if !ok {
+        return AgentHealth{}, false
+    }
+    health, err := reporter.Health(ctx, agentID)
+    if err != nil {
+        log.Printf("Failed to get health of agent %s: %v", agentID, err)
+        return AgentHealth{}, false
+    }
+    return health, true
+}
+
+// runAgentCommand carries out one command through the Controller. update_config goes through
+// UpdateConfig when the Controller is an AgentConfigurer, which also yields the effective config.
+// Dry runs go through DryRun, which handleAgentControl only admits for an AgentDryRunner.
+func (s *WebSocketServer) runAgentCommand(ctx context.Context, request AgentControlPayload) (string, map[string]interface{}, error) {
+    if request.DryRun {
+        return s.Controller.(AgentDryRunner).DryRun(ctx, request)
+    }
+    if configurer, ok := s.Controller.(AgentConfigurer); ok && request.Command == "update_config" {
+        config, err := configurer.UpdateConfig(ctx, request.AgentID, request.Params, request.Mode)
+        return "config_updated", config, err
+    }
+    status, err := s.Controller.Execute(ctx, request.AgentID, request.Command, request.Params)
+    return status, nil, err
+}
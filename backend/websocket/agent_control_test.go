@@ -0,0 +1,536 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+)
+
+// recordingController records the commands it executes, blocking each until released.
+type recordingController struct {
+    mu       sync.Mutex
+    executed []string
+    started  chan string
+    release  chan struct{}
+}
+
+func newRecordingController() *recordingController {
+    return &recordingController{started: make(chan string, 16), release: make(chan struct{})}
+}
+
+func (c *recordingController) Execute(ctx context.Context, agentID, command string, params map[string]interface{}) (string, error) {
+    c.started <- command
+    <-c.release
+    c.mu.Lock()
+    c.executed = append(c.executed, command)
+    c.mu.Unlock()
+    return command + "ed", nil
+}
+
+func TestAgentCommandsExecuteInOrder(t *testing.T) {
+    s := NewWebSocketServer()
+    go s.Start()
+    controller := newRecordingController()
+    s.Controller = controller
+    s.AgentQueueDepth = 3
+    first := newRegisteredClient(s)
+    second := newRegisteredClient(s)
+
+    send := func(client *Client, command string) {
+        s.HandleClientMessage(client, []byte(`{"type":"agent_control","payload":{"agent_id":"agent-1","command":"`+command+`"}}`))
+    }
+
+    // The first command occupies the worker so the rest queue up behind it
+    send(first, "start")
+    assert.Equal(t, float64(1), readResponse(t, first).Data.(map[string]interface{})["position"])
+    require.Equal(t, "start", <-controller.started)
+
+    send(second, "stop")
+    send(first, "update_config")
+    send(second, "start")
+    assert.Equal(t, float64(2), readResponse(t, second).Data.(map[string]interface{})["position"])
+    assert.Equal(t, float64(3), readResponse(t, first).Data.(map[string]interface{})["position"])
+    assert.Equal(t, float64(4), readResponse(t, second).Data.(map[string]interface{})["position"])
+
+    // Depth is three pending commands; the next one is refused
+    send(first, "stop")
+    response := readResponse(t, first)
+    require.NotNil(t, response.Error)
+    assert.Equal(t, 429, response.Error.Code)
+
+    close(controller.release)
+    for _, client := range []*Client{first, second} {
+        for response := readResponse(t, client); response.Type != "agent_control_response"; response = readResponse(t, client) {
+        }
+    }
+    assert.Eventually(t, func() bool {
+        controller.mu.Lock()
+        defer controller.mu.Unlock()
+        return len(controller.executed) == 4
+    }, time.Second, 10*time.Millisecond)
+    assert.Equal(t, []string{"start", "stop", "update_config", "start"}, controller.executed)
+
+    // A drained queue is removed rather than kept for every agent ever named
+    assert.Eventually(t, func() bool {
+        s.agentQueuesMu.Lock()
+        defer s.agentQueuesMu.Unlock()
+        return len(s.agentQueues) == 0
+    }, time.Second, 10*time.Millisecond)
+}
+
+// hangingController never finishes "start", reporting when its context is cancelled.
+type hangingController struct {
+    cancelled chan struct{}
+}
+
+func (c hangingController) Execute(ctx context.Context, agentID, command string, params map[string]interface{}) (string, error) {
+    if command != "start" {
+        return command + "ped", nil
+    }
+    <-ctx.Done()
+    close(c.cancelled)
+    select {} // Ignores the cancellation and never returns
+}
+
+func TestAgentCommandTimeoutFreesQueue(t *testing.T) {
+    s := NewWebSocketServer()
+    go s.Start()
+    controller := hangingController{cancelled: make(chan struct{})}
+    s.Controller = controller
+    s.AgentCommandTimeout = 50 * time.Millisecond
+    client := newRegisteredClient(s)
+
+    s.HandleClientMessage(client, []byte(`{"type":"agent_control","payload":{"agent_id":"agent-1","command":"start"}}`))
+    s.HandleClientMessage(client, []byte(`{"type":"agent_control","payload":{"agent_id":"agent-1","command":"stop"}}`))
+    assert.Equal(t, "agent_control_ack", readResponse(t, client).Type)
+    assert.Equal(t, "agent_control_ack", readResponse(t, client).Type)
+
+    update := readResponse(t, client)
+    require.Equal(t, "agent_control_update", update.Type)
+    require.NotNil(t, update.Error)
+    assert.Equal(t, 504, update.Error.Code)
+    assert.Equal(t, "timeout", update.Data.(map[string]interface{})["status"])
+    assert.Equal(t, "start", update.Data.(map[string]interface{})["command"])
+    select {
+    case <-controller.cancelled:
+    case <-time.After(time.Second):
+        t.Fatal("controller context was not cancelled")
+    }
+
+    // The queued command runs once the hung one is abandoned
+    for {
+        response := readResponse(t, client)
+        if response.Type == "agent_control_response" {
+            assert.Equal(t, "stop", response.Data.(map[string]interface{})["command"])
+            break
+        }
+    }
+}
+
+func TestUpdateConfigMergeAndReplace(t *testing.T) {
+    s := NewWebSocketServer()
+    go s.Start()
+    client := newRegisteredClient(s)
+    update := func(payload string) map[string]interface{} {
+        s.HandleClientMessage(client, []byte(`{"type":"agent_control","payload":{"agent_id":"agent-1","command":"update_config",`+payload+`}}`))
+        for {
+            response := readResponse(t, client)
+            if response.Type == "agent_control_response" {
+                return response.Data.(map[string]interface{})["config"].(map[string]interface{})
+            }
+        }
+    }
+
+    update(`"params":{"risk":"low","max_trade":10}`)
+
+    // Merging changes only the provided keys
+    assert.Equal(t, map[string]interface{}{"risk": "high", "max_trade": float64(10)}, update(`"params":{"risk":"high"}`))
+    assert.Equal(t, map[string]interface{}{"risk": "high", "max_trade": float64(20)}, update(`"mode":"merge","params":{"max_trade":20}`))
+
+    // Replacing swaps the whole configuration
+    assert.Equal(t, map[string]interface{}{"strategy": "grid"}, update(`"mode":"replace","params":{"strategy":"grid"}`))
+
+    s.HandleClientMessage(client, []byte(`{"type":"agent_control","payload":{"agent_id":"agent-1","command":"start","mode":"merge"}}`))
+    response := readResponse(t, client)
+    for response.Type == string(AgentStatusUpdate) {
+        // Status broadcasts from the updates may still be arriving
+        response = readResponse(t, client)
+    }
+    require.NotNil(t, response.Error)
+    assert.Equal(t, FieldErrors{"mode": "mode applies only to update_config"}, response.Error.Fields)
+}
+
+func TestAgentControlParamsValidatedAgainstSchema(t *testing.T) {
+    s := NewWebSocketServer()
+    go s.Start()
+    var schema ParamSchema
+    require.NoError(t, json.Unmarshal([]byte(`{
+        "type": "object",
+        "required": ["risk"],
+        "additionalProperties": false,
+        "properties": {
+            "risk": {"type": "string", "enum": ["low", "high"]},
+            "max_trade": {"type": "number", "minimum": 0}
+        }
+    }`), &schema))
+    s.CommandSchemas = map[string]*ParamSchema{"update_config": &schema}
+    client := newRegisteredClient(s)
+
+    s.HandleClientMessage(client, []byte(`{"type":"agent_control","payload":{"agent_id":"agent-1","command":"update_config","params":{"risk":"medium","max_trade":-1,"max_trde":5}}}`))
+    response := readResponse(t, client)
+    require.NotNil(t, response.Error)
+    assert.Equal(t, 422, response.Error.Code)
+    assert.Equal(t, FieldErrors{
+        "params.risk":      `params.risk must be one of "low", "high"`,
+        "params.max_trade": "params.max_trade must be at least 0",
+        "params.max_trde":  "params.max_trde is not a recognized parameter",
+    }, response.Error.Fields)
+
+    s.HandleClientMessage(client, []byte(`{"type":"agent_control","payload":{"agent_id":"agent-1","command":"update_config","params":{"max_trade":5}}}`))
+    response = readResponse(t, client)
+    require.NotNil(t, response.Error)
+    assert.Equal(t, FieldErrors{"params.risk": "params.risk is required"}, response.Error.Fields)
+
+    // Conforming params are dispatched, and commands without a schema are not checked
+    s.HandleClientMessage(client, []byte(`{"type":"agent_control","payload":{"agent_id":"agent-1","command":"update_config","params":{"risk":"low","max_trade":5}}}`))
+    assert.Equal(t, "agent_control_ack", readResponse(t, client).Type)
+    s.HandleClientMessage(client, []byte(`{"type":"agent_control","payload":{"agent_id":"agent-1","command":"start","params":{"anything":true}}}`))
+    assert.Equal(t, "agent_control_ack", readResponse(t, client).Type)
+}
+
+func TestAgentControlDryRunHasNoSideEffects(t *testing.T) {
+    s := NewWebSocketServer()
+    go s.Start()
+    controller := newPlaceholderAgentController(realClock{})
+    s.Controller = controller
+    client := newRegisteredClient(s)
+
+    s.HandleClientMessage(client, []byte(`{"type":"agent_control","payload":{"agent_id":"agent-1","command":"update_config","params":{"risk":"low"},"dry_run":true}}`))
+    assert.Equal(t, "agent_control_ack", readResponse(t, client).Type)
+    response := readResponse(t, client)
+    require.Equal(t, "agent_control_response", response.Type)
+    data := response.Data.(map[string]interface{})
+    assert.Equal(t, "dry_run", data["status"])
+    assert.Equal(t, "config_updated", data["result"])
+    assert.Equal(t, map[string]interface{}{"risk": "low"}, data["config"])
+
+    // Nothing was stored or broadcast
+    controller.mu.Lock()
+    assert.Empty(t, controller.configs)
+    controller.mu.Unlock()
+    assert.Empty(t, client.Send)
+
+    // A controller without a validate-only path refuses dry runs
+    s.Controller = newRecordingController()
+    s.HandleClientMessage(client, []byte(`{"type":"agent_control","payload":{"agent_id":"agent-1","command":"stop","dry_run":true}}`))
+    response = readResponse(t, client)
+    require.NotNil(t, response.Error)
+    assert.Equal(t, 400, response.Error.Code)
+}
+
+// healthController starts agents and reports a fixed health snapshot for them.
+type healthController struct {
+    health AgentHealth
+}
+
+func (c *healthController) Execute(ctx context.Context, agentID, command string, params map[string]interface{}) (string, error) {
+    return placeholderStatus(command), nil
+}
+
+func (c *healthController) Health(ctx context.Context, agentID string) (AgentHealth, error) {
+    return c.health, nil
+}
+
+func TestAgentControlResponseIncludesHealth(t *testing.T) {
+    s := NewWebSocketServer()
+    go s.Start()
+    s.Controller = &healthController{health: AgentHealth{UptimeSeconds: 3, LastError: "rpc timeout", CPUPercent: 12.5, MemoryBytes: 2048}}
+    client := newRegisteredClient(s)
+    // Subscribed elsewhere so the status broadcast does not interleave with the response
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"agent-2"}}`))
+    readResponse(t, client)
+
+    s.HandleClientMessage(client, []byte(`{"type":"agent_control","payload":{"agent_id":"agent-1","command":"start"}}`))
+    assert.Equal(t, "agent_control_ack", readResponse(t, client).Type)
+    response := readResponse(t, client)
+    require.Equal(t, "agent_control_response", response.Type)
+    data := response.Data.(map[string]interface{})
+    assert.Equal(t, "started", data["status"])
+    assert.Equal(t, map[string]interface{}{
+        "uptime_seconds": float64(3),
+        "last_error":     "rpc timeout",
+        "cpu_percent":    12.5,
+        "memory_bytes":   float64(2048),
+    }, data["health"])
+
+    // The placeholder reports no uptime for an agent it never started
+    clock := &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+    s.Controller = newPlaceholderAgentController(clock)
+    s.HandleClientMessage(client, []byte(`{"type":"agent_control","payload":{"agent_id":"agent-1","command":"update_config","params":{"risk":"low"}}}`))
+    readResponse(t, client)
+    data = readResponse(t, client).Data.(map[string]interface{})
+    assert.Equal(t, map[string]interface{}{"uptime_seconds": float64(0), "cpu_percent": float64(0), "memory_bytes": float64(0)}, data["health"])
+
+    // and measures uptime by its clock once it has
+    s.HandleClientMessage(client, []byte(`{"type":"agent_control","payload":{"agent_id":"agent-1","command":"start"}}`))
+    for response = readResponse(t, client); response.Type != "agent_control_response"; response = readResponse(t, client) {
+    }
+    clock.Advance(42 * time.Second)
+    s.HandleClientMessage(client, []byte(`{"type":"agent_control","payload":{"agent_id":"agent-1","command":"update_config","params":{"risk":"high"}}}`))
+    for response = readResponse(t, client); response.Type != "agent_control_response"; response = readResponse(t, client) {
+    }
+    assert.Equal(t, float64(42), response.Data.(map[string]interface{})["health"].(map[string]interface{})["uptime_seconds"])
+}
+
+// historyAuthorizer is a testAuthorizer that decides command history reads itself, letting
+// anyone read agents other than "private".
+type historyAuthorizer struct{ testAuthorizer }
+
+func (historyAuthorizer) CanViewCommandHistory(client *Client, agentID string) (bool, error) {
+    return agentID != "private", nil
+}
+
+func TestCommandHistoryListsRecentCommands(t *testing.T) {
+    s := NewWebSocketServer()
+    go s.Start()
+    s.Authorizer = historyAuthorizer{}
+    s.CommandLog = NewMemoryCommandLog(100, 0)
+    operator := newRegisteredClient(s)
+    operator.Principal = "operator"
+    viewer := newRegisteredClient(s)
+    viewer.Principal = "viewer"
+    // Subscribed elsewhere so status broadcasts do not interleave with the responses
+    for _, client := range []*Client{operator, viewer} {
+        s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"agent-2"}}`))
+        readResponse(t, client)
+    }
+
+    control := func(client *Client, command string) {
+        s.HandleClientMessage(client, []byte(`{"type":"agent_control","payload":{"agent_id":"agent-1","command":"`+command+`"}}`))
+        for response := readResponse(t, client); response.Type != "agent_control_response" && response.Error == nil; response = readResponse(t, client) {
+        }
+    }
+    control(viewer, "stop") // Refused, and not recorded for an agent without a trail
+    control(operator, "start")
+    control(viewer, "stop") // Refused, but recorded now the agent has a trail
+    s.HandleClientMessage(operator, []byte(`{"type":"agent_control","payload":{"agent_id":"agent-1","command":"update_config","params":{"risk":"low"}}}`))
+    for response := readResponse(t, operator); response.Type != "agent_control_response"; response = readResponse(t, operator) {
+    }
+
+    s.HandleClientMessage(viewer, []byte(`{"type":"command_history","payload":{"agent_id":"agent-1","limit":2}}`))
+    response := readResponse(t, viewer)
+    require.Equal(t, "command_history_response", response.Type)
+    data := response.Data.(map[string]interface{})
+    assert.Equal(t, float64(2), data["count"])
+    commands := data["commands"].([]interface{})
+    require.Len(t, commands, 2)
+    latest := commands[0].(map[string]interface{})
+    assert.Equal(t, "update_config", latest["command"])
+    assert.Equal(t, map[string]interface{}{"risk": "low"}, latest["params"])
+    assert.Equal(t, "operator", latest["issuer"])
+    assert.Equal(t, "config_updated", latest["result"])
+    assert.NotEmpty(t, latest["timestamp"])
+    refused := commands[1].(map[string]interface{})
+    assert.Equal(t, "stop", refused["command"])
+    assert.Equal(t, "viewer", refused["issuer"])
+    assert.Equal(t, "forbidden", refused["result"])
+
+    // Without a limit the default of 10 covers all three
+    s.HandleClientMessage(viewer, []byte(`{"type":"command_history","payload":{"agent_id":"agent-1"}}`))
+    assert.Equal(t, float64(3), readResponse(t, viewer).Data.(map[string]interface{})["count"])
+
+    // History the authorizer withholds is refused
+    s.HandleClientMessage(viewer, []byte(`{"type":"command_history","payload":{"agent_id":"private"}}`))
+    response = readResponse(t, viewer)
+    require.NotNil(t, response.Error)
+    assert.Equal(t, 403, response.Error.Code)
+
+    // Falling back to canSubscribe refuses agents the client may not subscribe to and
+    // redacts the params of the rest
+    s.Authorizer = testAuthorizer{}
+    s.HandleClientMessage(viewer, []byte(`{"type":"command_history","payload":{"agent_id":"secret-agent"}}`))
+    response = readResponse(t, viewer)
+    require.NotNil(t, response.Error)
+    assert.Equal(t, 403, response.Error.Code)
+    s.HandleClientMessage(viewer, []byte(`{"type":"command_history","payload":{"agent_id":"agent-1","limit":1}}`))
+    latest = readResponse(t, viewer).Data.(map[string]interface{})["commands"].([]interface{})[0].(map[string]interface{})
+    assert.Equal(t, "update_config", latest["command"])
+    assert.NotContains(t, latest, "params")
+
+    s.HandleClientMessage(viewer, []byte(`{"type":"command_history","payload":{"agent_id":"agent-1","limit":-1}}`))
+    response = readResponse(t, viewer)
+    require.NotNil(t, response.Error)
+    assert.Equal(t, 422, response.Error.Code)
+}
+
+func TestCommandHistoryIsOptIn(t *testing.T) {
+    s := NewWebSocketServer()
+    go s.Start()
+    assert.Nil(t, s.CommandLog)
+    client := newRegisteredClient(s)
+
+    s.HandleClientMessage(client, []byte(`{"type":"command_history","payload":{"agent_id":"agent-1"}}`))
+    response := readResponse(t, client)
+    require.NotNil(t, response.Error)
+    assert.Equal(t, 503, response.Error.Code)
+}
+
+func TestMemoryCommandLogForgetsLeastRecentlyCommandedAgents(t *testing.T) {
+    commandLog := NewMemoryCommandLog(2, 2)
+    recent := func(agentID string) []CommandLogEntry {
+        entries, err := commandLog.Recent(context.Background(), agentID, 0)
+        require.NoError(t, err)
+        return entries
+    }
+    commandLog.Record(CommandLogEntry{AgentID: "agent-1", Command: "start", Result: "started"})
+    commandLog.Record(CommandLogEntry{AgentID: "agent-2", Command: "start", Result: "started"})
+    commandLog.Record(CommandLogEntry{AgentID: "agent-1", Command: "stop", Result: "stopped"})
+    commandLog.Record(CommandLogEntry{AgentID: "agent-1", Command: "restart", Result: "restarted"})
+    commandLog.Record(CommandLogEntry{AgentID: "agent-3", Command: "start", Result: "started"})
+
+    assert.Empty(t, recent("agent-2"), "agent-2 was least recently commanded")
+    commands := recent("agent-1")
+    require.Len(t, commands, 2)
+    assert.Equal(t, "restart", commands[0].Command)
+    assert.Equal(t, "stop", commands[1].Command)
+    assert.Len(t, recent("agent-3"), 1)
+
+    // Forbidden attempts never open a trail, so they cannot push agent-1 out
+    commandLog.Record(CommandLogEntry{AgentID: "agent-4", Command: "stop", Result: "forbidden"})
+    assert.Empty(t, recent("agent-4"))
+    assert.Len(t, recent("agent-1"), 2)
+    assert.Len(t, recent("agent-3"), 1)
+}
+
+func TestScheduledCommandsRunWhenDueUnlessCancelled(t *testing.T) {
+    s := NewWebSocketServer()
+    go s.Start()
+    controller := newRecordingController()
+    s.Controller = controller
+    clock := &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+    s.Clock = clock
+    client := newRegisteredClient(s)
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"agent-2"}}`))
+    readResponse(t, client)
+
+    schedule := func(command, at string) map[string]interface{} {
+        s.HandleClientMessage(client, []byte(`{"type":"agent_control","payload":{"agent_id":"agent-1","command":"`+command+`","execute_at":"`+at+`"}}`))
+        response := readResponse(t, client)
+        require.Equal(t, "agent_control_ack", response.Type)
+        return response.Data.(map[string]interface{})
+    }
+    stop := schedule("stop", "2024-01-01T12:01:00Z")
+    assert.Equal(t, "scheduled", stop["status"])
+    require.NotEmpty(t, stop["command_id"])
+    start := schedule("start", "2024-01-01T12:02:00Z")
+
+    // Nothing runs before its time
+    s.runDueCommands()
+    select {
+    case command := <-controller.started:
+        t.Fatalf("%s ran before it was due", command)
+    case <-time.After(50 * time.Millisecond):
+    }
+
+    s.HandleClientMessage(client, []byte(`{"type":"cancel_command","payload":{"command_id":"`+start["command_id"].(string)+`"}}`))
+    response := readResponse(t, client)
+    require.Equal(t, "cancel_command_response", response.Type)
+    assert.Equal(t, "cancelled", response.Data.(map[string]interface{})["status"])
+
+    clock.Advance(5 * time.Minute)
+    s.runDueCommands()
+    response = readResponse(t, client)
+    require.Equal(t, "agent_control_ack", response.Type)
+    assert.Equal(t, float64(1), response.Data.(map[string]interface{})["position"])
+    require.Equal(t, "stop", <-controller.started)
+    close(controller.release)
+    for response = readResponse(t, client); response.Type != "agent_control_response"; response = readResponse(t, client) {
+    }
+    assert.Equal(t, "stoped", response.Data.(map[string]interface{})["status"])
+    select {
+    case command := <-controller.started:
+        t.Fatalf("cancelled %s ran", command)
+    case <-time.After(50 * time.Millisecond):
+    }
+
+    // A command that has already run can no longer be cancelled
+    s.HandleClientMessage(client, []byte(`{"type":"cancel_command","payload":{"command_id":"`+stop["command_id"].(string)+`"}}`))
+    response = readResponse(t, client)
+    require.NotNil(t, response.Error)
+    assert.Equal(t, 404, response.Error.Code)
+
+    s.HandleClientMessage(client, []byte(`{"type":"agent_control","payload":{"agent_id":"agent-1","command":"stop","execute_at":"2024-01-01T11:00:00Z"}}`))
+    response = readResponse(t, client)
+    require.NotNil(t, response.Error)
+    assert.Equal(t, 422, response.Error.Code)
+}
+
+func TestScheduledCommandsAreBoundedAndReauthorized(t *testing.T) {
+    s := NewWebSocketServer()
+    go s.Start()
+    controller := newRecordingController()
+    s.Controller = controller
+    clock := &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+    s.Clock = clock
+    s.MaxScheduled = 2
+    s.MaxScheduledPerAgent = 2
+    s.MaxScheduleHorizon = time.Hour
+    connect := func(principal string) *Client {
+        client := newTestClient()
+        client.Principal = principal
+        require.NoError(t, s.RegisterClient(client))
+        // Subscribed elsewhere so status broadcasts do not interleave with the responses
+        s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"agent-9"}}`))
+        readResponse(t, client)
+        return client
+    }
+    viewer, operator := connect("viewer"), connect("operator")
+    schedule := func(client *Client, agentID, command, at string) ResponseMessage {
+        s.HandleClientMessage(client, []byte(`{"type":"agent_control","payload":{"agent_id":"`+agentID+`","command":"`+command+`","execute_at":"`+at+`"}}`))
+        return readResponse(t, client)
+    }
+
+    response := schedule(viewer, "agent-1", "stop", "2024-01-01T13:30:00Z")
+    require.NotNil(t, response.Error)
+    assert.Equal(t, 422, response.Error.Code, "beyond the horizon")
+
+    assert.Equal(t, "agent_control_ack", schedule(viewer, "agent-1", "stop", "2024-01-01T12:01:00Z").Type)
+    assert.Equal(t, "agent_control_ack", schedule(viewer, "agent-2", "stop", "2024-01-01T12:01:00Z").Type)
+    response = schedule(viewer, "agent-3", "start", "2024-01-01T12:01:00Z")
+    require.NotNil(t, response.Error)
+    assert.Equal(t, 429, response.Error.Code, "over the principal's cap")
+    assert.Equal(t, "agent_control_ack", schedule(operator, "agent-1", "start", "2024-01-01T12:02:00Z").Type)
+    response = schedule(operator, "agent-1", "stop", "2024-01-01T12:03:00Z")
+    require.NotNil(t, response.Error)
+    assert.Equal(t, 429, response.Error.Code, "over the agent's cap")
+    assert.Contains(t, response.Error.Message, "agent-1")
+
+    // The viewer loses the right to stop agents and reconnects before its commands fall due;
+    // they are refused on the new connection and only the operator's command runs
+    s.Authorizer = testAuthorizer{}
+    s.UnregisterClient(viewer)
+    reconnected := connect("viewer")
+    clock.Advance(5 * time.Minute)
+    s.runDueCommands()
+    for i := 0; i < 2; i++ {
+        response = readResponse(t, reconnected)
+        require.NotNil(t, response.Error)
+        assert.Equal(t, 403, response.Error.Code)
+    }
+    assert.Equal(t, "agent_control_ack", readResponse(t, operator).Type)
+    require.Equal(t, "start", <-controller.started)
+    close(controller.release)
+    for response = readResponse(t, operator); response.Type != "agent_control_response"; response = readResponse(t, operator) {
+    }
+    assert.Equal(t, "started", response.Data.(map[string]interface{})["status"])
+    select {
+    case command := <-controller.started:
+        t.Fatalf("unauthorized %s ran", command)
+    case <-time.After(50 * time.Millisecond):
+    }
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+    "log"
+    "sort"
+    "sync"
+    "time"
+)
+
+// metricsTopicPrefix marks topics carrying an agent's aggregated transaction metrics,
+// e.g. "metrics:agent-1".
+const metricsTopicPrefix = "metrics:"
+
+// AgentMetricsPayload reports an agent's confirmed transactions over one aggregation window.
+type AgentMetricsPayload struct {
+    AgentID     string             `json:"agent_id"`
+    WindowStart time.Time          `json:"window_start"`
+    WindowEnd   time.Time          `json:"window_end"`
+    Confirmed   int                `json:"confirmed"` // Confirmed transactions published in the window
+    Volume      map[string]float64 `json:"volume"`    // Confirmed amount per currency; amounts without one are keyed ""
+}
+
+// volumeWindow accumulates one agent's confirmed transactions for the current window.
+type volumeWindow struct {
+    start     time.Time
+    confirmed int
+    volume    map[string]float64
+}
+
+// volumeAggregator keeps the open aggregation window of every agent with confirmed
+// transactions in it, and windows that ended before they were flushed.
+type volumeAggregator struct {
+    mu      sync.Mutex
+    windows map[string]*volumeWindow
+    ended   []AgentMetricsPayload
+}
+
+// metricsTopic returns the metrics topic of an agent.
+func metricsTopic(agentID string) string {
+    return metricsTopicPrefix + agentID
+}
+
+// report returns the metrics of the window for agentID.
+func (w *volumeWindow) report(agentID string, length time.Duration) AgentMetricsPayload {
+    return AgentMetricsPayload{
+        AgentID:     agentID,
+        WindowStart: w.start,
+        WindowEnd:   w.start.Add(length),
+        Confirmed:   w.confirmed,
+        Volume:      w.volume,
+    }
+}
+
+// recordVolume adds a published transaction to its agent's open window if it is confirmed.
+// Windows are aligned to multiples of MetricsWindow on the server clock.
+func (s *WebSocketServer) recordVolume(tx TransactionPayload) {
+    if s.MetricsWindow <= 0 || tx.AgentID == "" || tx.Status != "confirmed" {
+        return
+    }
+    start := s.Clock.Now().Truncate(s.MetricsWindow)
+
+    s.volumes.mu.Lock()
+    defer s.volumes.mu.Unlock()
+    window := s.volumes.windows[tx.AgentID]
+    if window != nil && !window.start.Equal(start) {
+        // The window ended without being flushed; it is reported on the next flush
+        s.volumes.ended = append(s.volumes.ended, window.report(tx.AgentID, s.MetricsWindow))
+        window = nil
+    }
+    if window == nil {
+        window = &volumeWindow{start: start, volume: make(map[string]float64)}
+        s.volumes.windows[tx.AgentID] = window
+    }
+    window.confirmed++
+    window.volume[tx.Currency] += tx.AmountValue
+}
+
+// flushMetricsAsync runs flushMetrics off the caller's goroutine so Heartbeat never waits on
+// the Broadcast channel. While a flush is still sending, later calls do nothing; the windows
+// they would have reported go out with the next flush.
+func (s *WebSocketServer) flushMetricsAsync() {
+    if s.MetricsWindow <= 0 || !s.flushing.CompareAndSwap(false, true) {
+        return
+    }
+    go func() {
+        defer s.flushing.Store(false)
+        s.flushMetrics()
+    }()
+}
+
+// flushMetrics broadcasts a metric_update on "metrics:<agent_id>" for every agent window that
+// has ended, oldest first and then by agent. An agent's next window opens with its next
+// confirmed transaction.
+func (s *WebSocketServer) flushMetrics() {
+    now := s.Clock.Now()
+    s.volumes.mu.Lock()
+    updates := s.volumes.ended
+    s.volumes.ended = nil
+    for agentID, window := range s.volumes.windows {
+        if now.Before(window.start.Add(s.MetricsWindow)) {
+            continue
+        }
+        delete(s.volumes.windows, agentID)
+        updates = append(updates, window.report(agentID, s.MetricsWindow))
+    }
+    s.volumes.mu.Unlock()
+    sort.SliceStable(updates, func(i, j int) bool {
+        if !updates[i].WindowStart.Equal(updates[j].WindowStart) {
+            return updates[i].WindowStart.Before(updates[j].WindowStart)
+        }
+        return updates[i].AgentID < updates[j].AgentID
+    })
+
+    // Broadcast outside the aggregator lock; the send blocks until Start takes it
+    for _, update := range updates {
+        s.Broadcast <- Message{Type: MetricUpdate, Payload: update}
+        log.Printf("Broadcasted metrics for agent %s: %d confirmed transactions", update.AgentID, update.Confirmed)
+    }
+}
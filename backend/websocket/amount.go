@@ -0,0 +1,52 @@
+package main
+
+import (
+    "log"
+    "strconv"
+    "strings"
+)
+
+// parseAmount splits a transaction amount such as "0.5 SOL" into its value and currency.
+// Amounts without a currency, such as "0.5", yield an empty currency. ok is false if the
+// amount does not start with a number.
+func parseAmount(amount string) (value float64, currency string, ok bool) {
+    parts := strings.Fields(amount)
+    if len(parts) == 0 || len(parts) > 2 {
+        return 0, "", false
+    }
+    value, err := strconv.ParseFloat(parts[0], 64)
+    if err != nil {
+        return 0, "", false
+    }
+    if len(parts) == 2 {
+        currency = parts[1]
+    }
+    return value, currency, true
+}
+
+// structureAmount fills in AmountValue and Currency from Amount, leaving them unset if it
+// cannot be parsed.
+func (tx *TransactionPayload) structureAmount() {
+    value, currency, ok := parseAmount(tx.Amount)
+    if !ok {
+        tx.AmountValue, tx.Currency = 0, ""
+        return
+    }
+    tx.AmountValue, tx.Currency = value, currency
+}
+
+// meetsMinAmount reports whether a broadcast payload passes the subscription's MinAmount.
+// Only transactions are checked; a transaction whose amount cannot be parsed is let through
+// with a warning rather than silently dropped.
+func (sub *Subscription) meetsMinAmount(payload interface{}) bool {
+    tx, ok := payload.(TransactionPayload)
+    if sub.MinAmount <= 0 || !ok {
+        return true
+    }
+    value, _, ok := parseAmount(tx.Amount)
+    if !ok {
+        log.Printf("Warning: delivering transaction %s with unparseable amount %q despite min_amount %v", tx.TxID, tx.Amount, sub.MinAmount)
+        return true
+    }
+    return value >= sub.MinAmount
+}
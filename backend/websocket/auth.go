@@ -0,0 +1,46 @@
+package main
+
+// Authorizer decides what an authenticated client may do. Both checks are called without
+// the server lock held, so implementations may use the server.
+type Authorizer interface {
+    // CanSubscribe reports whether the client may subscribe to a normalized topic.
+    CanSubscribe(client *Client, topic string) bool
+    // CanControl reports whether the client may send command to the agent. An error means
+    // the decision could not be made and the command is refused.
+    CanControl(client *Client, agentID, command string) (bool, error)
+}
+
+// canSubscribe applies the server's Authorizer, allowing everything when there is none.
+func (s *WebSocketServer) canSubscribe(client *Client, topic string) bool {
+    return s.Authorizer == nil || s.Authorizer.CanSubscribe(client, topic)
+}
+
+// canViewCommandHistory applies the server's Authorizer to a command_history request,
+// allowing everything when there is none.
+func (s *WebSocketServer) canViewCommandHistory(client *Client, agentID string) (bool, error) {
+    if s.Authorizer == nil {
+        return true, nil
+    }
+    if authorizer, ok := s.Authorizer.(CommandHistoryAuthorizer); ok {
+        return authorizer.CanViewCommandHistory(client, agentID)
+    }
+    return s.canSubscribe(client, agentID), nil
+}
+
+// commandParamsRedacted reports whether command_history responses omit command params, as
+// they do when only canSubscribe vouches for the reader.
+func (s *WebSocketServer) commandParamsRedacted() bool {
+    if s.Authorizer == nil {
+        return false
+    }
+    _, ok := s.Authorizer.(CommandHistoryAuthorizer)
+    return !ok
+}
+
+// canControl applies the server's Authorizer, allowing everything when there is none.
+func (s *WebSocketServer) canControl(client *Client, agentID, command string) (bool, error) {
+    if s.Authorizer == nil {
+        return true, nil
+    }
+    return s.Authorizer.CanControl(client, agentID, command)
+}
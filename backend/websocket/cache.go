@@ -0,0 +1,106 @@
+package main
+
+import (
+    "container/list"
+    "context"
+    "encoding/json"
+    "errors"
+    "log"
+    "sync"
+    "time"
+)
+
+// queryCache is a least-recently-used cache of transaction query results, keyed by query.
+type queryCache struct {
+    mu       sync.Mutex
+    capacity int
+    entries  map[string]*list.Element
+    order    *list.List // Most recently used first; values are *cachedResult
+}
+
+// cachedResult is the result of one query as the store last returned it.
+type cachedResult struct {
+    key          string
+    transactions []TransactionPayload
+    warnings     []string
+    storedAt     time.Time
+}
+
+// clone returns a copy of the result whose slices share no backing array with it, so callers
+// appending to or editing a result cannot change what the cache holds.
+func (r cachedResult) clone() cachedResult {
+    r.transactions = append([]TransactionPayload(nil), r.transactions...)
+    r.warnings = append([]string(nil), r.warnings...)
+    return r
+}
+
+func newQueryCache(capacity int) *queryCache {
+    return &queryCache{capacity: capacity, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+// get returns a copy of the cached result for key, marking it most recently used.
+func (c *queryCache) get(key string) (cachedResult, bool) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    element, ok := c.entries[key]
+    if !ok {
+        return cachedResult{}, false
+    }
+    c.order.MoveToFront(element)
+    return element.Value.(*cachedResult).clone(), true
+}
+
+// put stores a copy of a result under its key, evicting the least recently used result when full.
+func (c *queryCache) put(result cachedResult) {
+    result = result.clone()
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if element, ok := c.entries[result.key]; ok {
+        element.Value = &result
+        c.order.MoveToFront(element)
+        return
+    }
+    c.entries[result.key] = c.order.PushFront(&result)
+    if c.order.Len() > c.capacity {
+        oldest := c.order.Back()
+        c.order.Remove(oldest)
+        delete(c.entries, oldest.Value.(*cachedResult).key)
+    }
+}
+
+// queryCacheKey identifies the store results a query asks for, ignoring options that only
+// shape the response.
+func queryCacheKey(query TransactionQueryPayload) string {
+    query.Stream, query.Compress = false, false
+    query.Fields, query.IfModifiedSince = nil, nil
+    key, _ := json.Marshal(query)
+    return string(key)
+}
+
+// queryThroughCache runs a query through the result cache when QueryCacheSize is positive.
+// Results younger than QueryCacheTTL are served from the cache. Otherwise the store is
+// queried, and if it is unavailable the last cached result is served with stale set.
+func (s *WebSocketServer) queryThroughCache(ctx context.Context, query TransactionQueryPayload) (transactions []TransactionPayload, warnings []string, stale bool, err error) {
+    if s.QueryCacheSize <= 0 {
+        transactions, warnings, err = s.queryAcrossChains(ctx, query)
+        return transactions, warnings, false, err
+    }
+    s.queryCacheOnce.Do(func() { s.queryCache = newQueryCache(s.QueryCacheSize) })
+
+    key := queryCacheKey(query)
+    now := s.Clock.Now()
+    cached, ok := s.queryCache.get(key)
+    if ok && now.Sub(cached.storedAt) < s.QueryCacheTTL {
+        return cached.transactions, cached.warnings, false, nil
+    }
+
+    transactions, warnings, err = s.queryAcrossChains(ctx, query)
+    switch {
+    case err == nil:
+        s.queryCache.put(cachedResult{key: key, transactions: transactions, warnings: warnings, storedAt: now})
+    case ok && !errors.Is(err, ErrTransactionNotFound) && !errors.Is(err, ErrInvalidQuery):
+        log.Printf("Transaction store unavailable, serving result cached at %v: %v", cached.storedAt, err)
+        return cached.transactions, cached.warnings, true, nil
+    }
+    return transactions, warnings, false, err
+}
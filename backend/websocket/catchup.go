@@ -0,0 +1,82 @@
+package main
+
+import (
+    "context"
+    "log"
+    "sort"
+)
+
+// heldFrame is a live broadcast frame held for a subscription while it catches up.
+type heldFrame struct {
+    frame    []byte
+    sequence uint64 // Transaction sequence of the frame; 0 if it is not a recorded transaction
+}
+
+// transactionSequence returns the store sequence of a broadcast payload, or 0 if it is not a
+// recorded transaction.
+func transactionSequence(payload interface{}) uint64 {
+    if tx, ok := payload.(TransactionPayload); ok {
+        return tx.Sequence
+    }
+    return 0
+}
+
+// catchUp sends a new subscription up to limit of the agent's recorded transactions, oldest
+// first, then switches it to live delivery. Live frames are held from the moment the
+// subscription was created, so a transaction recorded around the handoff is either part of
+// the history or flushed afterwards; sequence numbers decide which, so it is sent exactly once.
+func (s *WebSocketServer) catchUp(client *Client, subscriptionID, agentID string, limit int) {
+    ctx := context.Background()
+    if s.QueryTimeout > 0 {
+        var cancel context.CancelFunc
+        ctx, cancel = context.WithTimeout(ctx, s.QueryTimeout)
+        defer cancel()
+    }
+
+    transactions := []TransactionPayload{}
+    if s.Store != nil {
+        history, err := s.queryStore(ctx, TransactionQueryPayload{AgentID: agentID, Direction: DirectionAny, Limit: limit})
+        if err != nil {
+            // The subscription still goes live; the client only misses the history
+            s.sendInternalErrorToClient(client, CodeUnavailable, "Transaction history unavailable for "+agentID, err)
+        } else if history != nil {
+            transactions = history
+        }
+    }
+    sort.SliceStable(transactions, func(i, j int) bool { return transactions[i].Sequence < transactions[j].Sequence })
+
+    var watermark uint64
+    if len(transactions) > 0 {
+        watermark = transactions[len(transactions)-1].Sequence
+    }
+    s.sendResponseToClient(client, ResponseMessage{
+        Type:    "transaction_history",
+        Success: true,
+        Data: map[string]interface{}{
+            "subscription_id": subscriptionID,
+            "topic":           agentID,
+            "transactions":    transactions,
+            "count":           len(transactions),
+        },
+    })
+
+    overflowed := false
+    s.Mutex.Lock()
+    if subscription, ok := client.Subscriptions[subscriptionID]; ok {
+        subscription.watermark = watermark
+        for _, held := range subscription.held {
+            if held.sequence == 0 || held.sequence > watermark {
+                overflowed = overflowed || !s.enqueue(client, held.frame)
+            }
+        }
+        subscription.held = nil
+        subscription.catchingUp = false
+    }
+    s.Mutex.Unlock()
+
+    if overflowed {
+        s.disconnectSlowClient(client)
+        return
+    }
+    log.Printf("Subscription %s caught up with %d transactions of history", subscriptionID, len(transactions))
+}
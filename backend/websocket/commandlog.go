@@ -0,0 +1,179 @@
+package main
+
+import (
+    "container/list"
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "sync"
+    "time"
+)
+
+// CommandLogEntry records one agent control command and how it ended.
+type CommandLogEntry struct {
+    AgentID   string                 `json:"agent_id"`
+    Command   string                 `json:"command"`
+    Params    map[string]interface{} `json:"params,omitempty"`
+    DryRun    bool                   `json:"dry_run,omitempty"`
+    Issuer    string                 `json:"issuer"`    // Principal of the client that sent the command
+    Timestamp time.Time              `json:"timestamp"` // When the server received the command
+    Result    string                 `json:"result"`    // Resulting status, or forbidden, queue_full, schedule_full, cancelled, timeout, rejected or failed
+    Error     string                 `json:"error,omitempty"`
+}
+
+// CommandLog keeps the audit trail of agent control commands behind command_history requests.
+type CommandLog interface {
+    // Record appends an entry to the agent's trail.
+    Record(entry CommandLogEntry)
+    // Recent returns up to limit of the agent's entries, newest first.
+    Recent(ctx context.Context, agentID string, limit int) ([]CommandLogEntry, error)
+}
+
+// CommandHistoryAuthorizer is implemented by Authorizers that decide who may read an agent's
+// command history. Other Authorizers grant it to clients that may subscribe to the agent, with
+// the params of each command redacted.
+type CommandHistoryAuthorizer interface {
+    CanViewCommandHistory(client *Client, agentID string) (bool, error)
+}
+
+// CommandHistoryPayload defines the payload of a command_history request.
+type CommandHistoryPayload struct {
+    AgentID string `json:"agent_id"`
+    Limit   int    `json:"limit,omitempty"` // Number of entries to return; defaults to 10
+}
+
+// MemoryCommandLog is an in-memory CommandLog keeping the latest entries of the most recently
+// commanded agents.
+type MemoryCommandLog struct {
+    mu       sync.RWMutex
+    trails   map[string]*list.Element
+    order    *list.List // Most recently recorded first; values are *commandTrail
+    perAgent int
+    agents   int
+}
+
+// commandTrail is one agent's entries, oldest first.
+type commandTrail struct {
+    agentID string
+    entries []CommandLogEntry
+}
+
+// NewMemoryCommandLog creates a log keeping up to perAgent entries for each of up to agents
+// agents, forgetting the agent least recently recorded when full. Zero or less for either
+// leaves it unbounded.
+func NewMemoryCommandLog(perAgent, agents int) *MemoryCommandLog {
+    return &MemoryCommandLog{trails: make(map[string]*list.Element), order: list.New(), perAgent: perAgent, agents: agents}
+}
+
+// Record appends an entry, dropping the agent's oldest once perAgent are kept. Forbidden
+// attempts are only kept for agents that already have a trail, so probing arbitrary agent IDs
+// cannot push real trails out of the log.
+func (m *MemoryCommandLog) Record(entry CommandLogEntry) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    element, ok := m.trails[entry.AgentID]
+    if !ok {
+        if entry.Result == "forbidden" {
+            return
+        }
+        element = m.order.PushFront(&commandTrail{agentID: entry.AgentID})
+        m.trails[entry.AgentID] = element
+        if m.agents > 0 && m.order.Len() > m.agents {
+            oldest := m.order.Back()
+            m.order.Remove(oldest)
+            delete(m.trails, oldest.Value.(*commandTrail).agentID)
+        }
+    }
+    m.order.MoveToFront(element)
+    trail := element.Value.(*commandTrail)
+    trail.entries = append(trail.entries, entry)
+    if m.perAgent > 0 && len(trail.entries) > m.perAgent {
+        trail.entries = trail.entries[len(trail.entries)-m.perAgent:]
+    }
+}
+
+// Recent returns up to limit of the agent's entries, newest first.
+func (m *MemoryCommandLog) Recent(ctx context.Context, agentID string, limit int) ([]CommandLogEntry, error) {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+    var entries []CommandLogEntry
+    if element, ok := m.trails[agentID]; ok {
+        entries = element.Value.(*commandTrail).entries
+    }
+    recent := make([]CommandLogEntry, 0, len(entries))
+    for i := len(entries) - 1; i >= 0 && (limit <= 0 || len(recent) < limit); i-- {
+        recent = append(recent, entries[i])
+    }
+    return recent, nil
+}
+
+// logCommand records a command's outcome in the CommandLog, if there is one.
+func (s *WebSocketServer) logCommand(issuer string, issued time.Time, request AgentControlPayload, result string, err error) {
+    if s.CommandLog == nil {
+        return
+    }
+    entry := CommandLogEntry{
+        AgentID:   request.AgentID,
+        Command:   request.Command,
+        Params:    request.Params,
+        DryRun:    request.DryRun,
+        Issuer:    issuer,
+        Timestamp: issued,
+        Result:    result,
+    }
+    if err != nil {
+        entry.Error = err.Error()
+    }
+    s.CommandLog.Record(entry)
+}
+
+// handleCommandHistory answers a command_history request with the agent's most recent
+// commands, newest first.
+func (s *WebSocketServer) handleCommandHistory(client *Client, payload json.RawMessage) {
+    data, ok := s.payloadObject(client, payload, "command history", &CommandHistoryPayload{})
+    if !ok {
+        return
+    }
+
+    request, errs := validateCommandHistory(data)
+    if len(errs) > 0 {
+        s.sendValidationErrorToClient(client, errs)
+        return
+    }
+    if s.CommandLog == nil {
+        s.sendErrorMessage(client, CodeUnavailable, "Command history is not recorded", nil)
+        return
+    }
+
+    allowed, err := s.canViewCommandHistory(client, request.AgentID)
+    if err != nil {
+        s.sendInternalErrorToClient(client, CodeInternal, "Authorization check failed", err)
+        return
+    }
+    if !allowed {
+        s.sendErrorMessage(client, CodeForbidden, fmt.Sprintf("Not authorized to view the command history of agent %s", request.AgentID), nil)
+        return
+    }
+
+    entries, err := s.CommandLog.Recent(context.Background(), request.AgentID, request.Limit)
+    if err != nil {
+        s.sendInternalErrorToClient(client, CodeUnavailable, "Command history unavailable", err)
+        return
+    }
+    if s.commandParamsRedacted() {
+        for i := range entries {
+            entries[i].Params = nil
+        }
+    }
+    log.Printf("Sent %d commands of history for agent %s to client %s", len(entries), request.AgentID, client.ID)
+    s.sendResponseToClient(client, ResponseMessage{
+        Type:    "command_history_response",
+        Success: true,
+        Data: map[string]interface{}{
+            "agent_id": request.AgentID,
+            "commands": entries,
+            "count":    len(entries),
+        },
+    })
+}
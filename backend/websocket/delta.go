@@ -0,0 +1,56 @@
+package main
+
+import (
+    "sync"
+)
+
+// AgentStatusDeltaPayload carries the fields of an agent's status that changed since the
+// previous update for the agent, keyed by their names in AgentStatusPayload.
+type AgentStatusDeltaPayload struct {
+    AgentID string                 `json:"agent_id"`
+    Changes map[string]interface{} `json:"changes"`
+}
+
+// statusTracker remembers the last status broadcast for each agent so later updates can be
+// sent as deltas.
+type statusTracker struct {
+    mu        sync.Mutex
+    last      map[string]AgentStatusPayload
+    sinceFull map[string]int // Deltas sent since the agent's last full snapshot
+}
+
+// statusDelta returns the message to deliver for an agent status update: the update itself
+// when deltas are off, when the agent has no earlier status, or when StatusSnapshotEvery
+// updates have passed since the last full snapshot, and otherwise an agent_status_delta
+// listing only the changed fields.
+func (s *WebSocketServer) statusDelta(message Message) Message {
+    status, ok := message.Payload.(AgentStatusPayload)
+    if !ok || s.StatusSnapshotEvery <= 0 {
+        return message
+    }
+
+    t := &s.statuses
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    previous, seen := t.last[status.AgentID]
+    t.last[status.AgentID] = status
+    if !seen || t.sinceFull[status.AgentID]+1 >= s.StatusSnapshotEvery {
+        t.sinceFull[status.AgentID] = 0
+        return message
+    }
+    t.sinceFull[status.AgentID]++
+
+    changes := make(map[string]interface{})
+    if status.Status != previous.Status {
+        changes["status"] = status.Status
+    }
+    if !status.LastUpdated.Equal(previous.LastUpdated) {
+        changes["last_updated"] = status.LastUpdated
+    }
+    if status.Details != previous.Details {
+        changes["details"] = status.Details
+    }
+    message.Type = AgentStatusDelta
+    message.Payload = AgentStatusDeltaPayload{AgentID: status.AgentID, Changes: changes}
+    return message
+}
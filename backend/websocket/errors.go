@@ -0,0 +1,84 @@
+package main
+
+import (
+    "log"
+    "net/http"
+)
+
+// ErrorCode is the numeric code of an error response. The codes follow their HTTP
+// counterparts so clients can treat them alike.
+type ErrorCode int
+
+const (
+    CodeBadRequest           ErrorCode = http.StatusBadRequest
+    CodeUnauthorized         ErrorCode = http.StatusUnauthorized
+    CodeForbidden            ErrorCode = http.StatusForbidden
+    CodeNotFound             ErrorCode = http.StatusNotFound
+    CodeUnsupportedMediaType ErrorCode = http.StatusUnsupportedMediaType
+    CodeValidationFailed     ErrorCode = http.StatusUnprocessableEntity
+    CodeTooManyRequests      ErrorCode = http.StatusTooManyRequests
+    CodeInternal             ErrorCode = http.StatusInternalServerError
+    CodeUnavailable          ErrorCode = http.StatusServiceUnavailable
+    CodeTimeout              ErrorCode = http.StatusGatewayTimeout
+)
+
+// Message returns the default message for the code.
+func (c ErrorCode) Message() string {
+    switch c {
+    case CodeValidationFailed:
+        return "Payload validation failed"
+    case CodeUnauthorized:
+        return "Authentication required"
+    }
+    return http.StatusText(int(c))
+}
+
+// sendError sends an error response with the given code and the code's message. details, if
+// any, carry machine-readable context.
+func (s *WebSocketServer) sendError(client *Client, code ErrorCode, details map[string]interface{}) {
+    s.sendErrorMessage(client, code, code.Message(), details)
+}
+
+// sendErrorMessage is sendError for call sites whose message adds specifics, such as the
+// offending ID, to what the code alone says.
+func (s *WebSocketServer) sendErrorMessage(client *Client, code ErrorCode, message string, details map[string]interface{}) {
+    s.sendErrorResponse(client, &ErrorResponse{Code: int(code), Message: message, Details: details})
+}
+
+// sendErrorResponse records an error as the client's last, counts it by code and sends it
+// ahead of queued data, unless the client has exceeded MaxErrorsPerInterval.
+func (s *WebSocketServer) sendErrorResponse(client *Client, errResp *ErrorResponse) {
+    now := s.Clock.Now()
+    client.recordError(errResp.Code, errResp.Message, now)
+    s.errorCountsMu.Lock()
+    s.errorCounts[ErrorCode(errResp.Code)]++
+    s.errorCountsMu.Unlock()
+
+    if s.MaxErrorsPerInterval > 0 {
+        switch count := client.countError(now, s.ErrorInterval); {
+        case count == 2*s.MaxErrorsPerInterval+1:
+            s.closeForErrors(client)
+            return
+        case count > s.MaxErrorsPerInterval:
+            return
+        }
+    }
+    s.sendPriorityResponseToClient(client, ResponseMessage{Type: "error", Success: false, Error: errResp})
+}
+
+// closeForErrors closes a client that keeps raising errors as rate limited.
+func (s *WebSocketServer) closeForErrors(client *Client) {
+    log.Printf("Closing client %s: more than %d errors within %v", client.ID, 2*s.MaxErrorsPerInterval, s.ErrorInterval)
+    s.disconnectWith(client, DisconnectRateLimited, "too many errors")
+}
+
+// ErrorCounts returns the number of error responses sent so far, by code.
+func (s *WebSocketServer) ErrorCounts() map[ErrorCode]uint64 {
+    s.errorCountsMu.Lock()
+    defer s.errorCountsMu.Unlock()
+    counts := make(map[ErrorCode]uint64, len(s.errorCounts))
+    for code, count := range s.errorCounts {
+        counts[code] = count
+    }
+    return counts
+}
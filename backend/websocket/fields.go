@@ -0,0 +1,81 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "log"
+    "reflect"
+    "strings"
+)
+
+// transactionFieldNames holds the JSON names of the TransactionPayload fields a query may select.
+var transactionFieldNames = jsonFieldNames(reflect.TypeOf(TransactionPayload{}))
+
+// jsonFieldNames returns the set of JSON names of a struct type's fields.
+func jsonFieldNames(t reflect.Type) map[string]bool {
+    names := make(map[string]bool, t.NumField())
+    for i := 0; i < t.NumField(); i++ {
+        name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+        if name != "" && name != "-" {
+            names[name] = true
+        }
+    }
+    return names
+}
+
+// transactionFields resolves the fields a query selected into the names known for
+// transactions, always including tx_id, and returns a warning for each unknown name. A nil
+// selection means every field and yields nil.
+func transactionFields(selected []string) ([]string, []string) {
+    if selected == nil {
+        return nil, nil
+    }
+    fields := []string{"tx_id"}
+    var warnings []string
+    for _, name := range uniqueStrings(selected) {
+        switch {
+        case name == "tx_id":
+        case transactionFieldNames[name]:
+            fields = append(fields, name)
+        default:
+            log.Printf("Ignoring unknown transaction field %q in query", name)
+            warnings = append(warnings, "unknown field ignored: "+name)
+        }
+    }
+    return fields, warnings
+}
+
+// unmarshalNumbers is json.Unmarshal keeping numbers as json.Number, so integers such as block
+// heights beyond 2^53 survive decoding into interface{} values exactly.
+func unmarshalNumbers(data []byte, v interface{}) error {
+    decoder := json.NewDecoder(bytes.NewReader(data))
+    decoder.UseNumber()
+    return decoder.Decode(v)
+}
+
+// sparseTransaction reduces a transaction to the given fields, keyed by JSON name.
+func sparseTransaction(tx TransactionPayload, fields []string) map[string]interface{} {
+    var all map[string]interface{}
+    if data, err := json.Marshal(tx); err == nil {
+        unmarshalNumbers(data, &all)
+    }
+    sparse := make(map[string]interface{}, len(fields))
+    for _, name := range fields {
+        if value, ok := all[name]; ok {
+            sparse[name] = value
+        }
+    }
+    return sparse
+}
+
+// sparseTransactions returns the transactions reduced to fields, or unchanged for nil fields.
+func sparseTransactions(transactions []TransactionPayload, fields []string) interface{} {
+    if fields == nil {
+        return transactions
+    }
+    sparse := make([]map[string]interface{}, len(transactions))
+    for i, tx := range transactions {
+        sparse[i] = sparseTransaction(tx, fields)
+    }
+    return sparse
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "math"
+    "math/big"
+    "strconv"
+    "strings"
+    "unicode"
+)
+
+// subscriptionFilter is a compiled subscription filter expression such as
+// `amount > 1.0 && status == "confirmed"`. Identifiers name fields of the broadcast payload
+// by their JSON keys. Expressions support ==, !=, <, <=, >, >=, &&, ||, ! and parentheses;
+// operands are numbers, double-quoted strings, true and false.
+type subscriptionFilter interface {
+    eval(fields map[string]interface{}) bool
+}
+
+// parseFilter compiles a filter expression, describing the first syntax error it finds.
+func parseFilter(expr string) (subscriptionFilter, error) {
+    tokens, err := tokenizeFilter(expr)
+    if err != nil {
+        return nil, err
+    }
+    p := &filterParser{tokens: tokens}
+    node, err := p.parseOr()
+    if err != nil {
+        return nil, err
+    }
+    if tok := p.peek(); tok.kind != tokenEnd {
+        return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+    }
+    return node, nil
+}
+
+type filterTokenKind int
+
+const (
+    tokenEnd filterTokenKind = iota
+    tokenIdent
+    tokenNumber
+    tokenString
+    tokenBool
+    tokenOperator
+    tokenLParen
+    tokenRParen
+)
+
+type filterToken struct {
+    kind filterTokenKind
+    text string
+    pos  int
+}
+
+// tokenizeFilter splits a filter expression into tokens.
+func tokenizeFilter(expr string) ([]filterToken, error) {
+    var tokens []filterToken
+    for i := 0; i < len(expr); {
+        c := rune(expr[i])
+        switch {
+        case unicode.IsSpace(c):
+            i++
+        case c == '(':
+            tokens = append(tokens, filterToken{tokenLParen, "(", i})
+            i++
+        case c == ')':
+            tokens = append(tokens, filterToken{tokenRParen, ")", i})
+            i++
+        case strings.ContainsRune("=!<>&|", c):
+            op := expr[i : i+1]
+            if i+1 < len(expr) {
+                if two := expr[i : i+2]; two == "==" || two == "!=" || two == "<=" || two == ">=" || two == "&&" || two == "||" {
+                    op = two
+                }
+            }
+            if op == "=" || op == "&" || op == "|" {
+                return nil, fmt.Errorf("unexpected %q at position %d", op, i)
+            }
+            tokens = append(tokens, filterToken{tokenOperator, op, i})
+            i += len(op)
+        case c == '"':
+            end := i + 1
+            for end < len(expr) && expr[end] != '"' {
+                if expr[end] == '\\' {
+                    end++
+                }
+                end++
+            }
+            if end >= len(expr) {
+                return nil, fmt.Errorf("unterminated string at position %d", i)
+            }
+            text, err := strconv.Unquote(expr[i : end+1])
+            if err != nil {
+                return nil, fmt.Errorf("invalid string at position %d", i)
+            }
+            tokens = append(tokens, filterToken{tokenString, text, i})
+            i = end + 1
+        case c == '-' || c == '.' || unicode.IsDigit(c):
+            end := i + 1
+            for end < len(expr) && (expr[end] == '.' || unicode.IsDigit(rune(expr[end]))) {
+                end++
+            }
+            if _, err := strconv.ParseFloat(expr[i:end], 64); err != nil {
+                return nil, fmt.Errorf("invalid number %q at position %d", expr[i:end], i)
+            }
+            tokens = append(tokens, filterToken{tokenNumber, expr[i:end], i})
+            i = end
+        case c == '_' || unicode.IsLetter(c):
+            end := i + 1
+            for end < len(expr) && (expr[end] == '_' || unicode.IsLetter(rune(expr[end])) || unicode.IsDigit(rune(expr[end]))) {
+                end++
+            }
+            word := expr[i:end]
+            kind := tokenIdent
+            if word == "true" || word == "false" {
+                kind = tokenBool
+            }
+            tokens = append(tokens, filterToken{kind, word, i})
+            i = end
+        default:
+            return nil, fmt.Errorf("unexpected %q at position %d", string(c), i)
+        }
+    }
+    return append(tokens, filterToken{tokenEnd, "end of filter", len(expr)}), nil
+}
+
+type filterParser struct {
+    tokens []filterToken
+    pos    int
+}
+
+func (p *filterParser) peek() filterToken {
+    return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() filterToken {
+    tok := p.tokens[p.pos]
+    if tok.kind != tokenEnd {
+        p.pos++
+    }
+    return tok
+}
+
+func (p *filterParser) parseOr() (subscriptionFilter, error) {
+    left, err := p.parseAnd()
+    if err != nil {
+        return nil, err
+    }
+    for p.peek().kind == tokenOperator && p.peek().text == "||" {
+        p.next()
+        right, err := p.parseAnd()
+        if err != nil {
+            return nil, err
+        }
+        left = orFilter{left, right}
+    }
+    return left, nil
+}
+
+func (p *filterParser) parseAnd() (subscriptionFilter, error) {
+    left, err := p.parseUnary()
+    if err != nil {
+        return nil, err
+    }
+    for p.peek().kind == tokenOperator && p.peek().text == "&&" {
+        p.next()
+        right, err := p.parseUnary()
+        if err != nil {
+            return nil, err
+        }
+        left = andFilter{left, right}
+    }
+    return left, nil
+}
+
+func (p *filterParser) parseUnary() (subscriptionFilter, error) {
+    tok := p.next()
+    switch {
+    case tok.kind == tokenOperator && tok.text == "!":
+        inner, err := p.parseUnary()
+        if err != nil {
+            return nil, err
+        }
+        return notFilter{inner}, nil
+    case tok.kind == tokenLParen:
+        inner, err := p.parseOr()
+        if err != nil {
+            return nil, err
+        }
+        if closing := p.next(); closing.kind != tokenRParen {
+            return nil, fmt.Errorf("expected ) at position %d, found %q", closing.pos, closing.text)
+        }
+        return inner, nil
+    case tok.kind == tokenIdent:
+        return p.parseComparison(tok.text)
+    }
+    return nil, fmt.Errorf("expected field name at position %d, found %q", tok.pos, tok.text)
+}
+
+func (p *filterParser) parseComparison(field string) (subscriptionFilter, error) {
+    op := p.next()
+    if op.kind != tokenOperator || !isComparisonOperator(op.text) {
+        return nil, fmt.Errorf("expected comparison operator after %q at position %d, found %q", field, op.pos, op.text)
+    }
+
+    operand := p.next()
+    cmp := comparisonFilter{field: field, op: op.text}
+    switch operand.kind {
+    case tokenNumber:
+        cmp.value, _ = strconv.ParseFloat(operand.text, 64)
+        cmp.exact, _ = new(big.Rat).SetString(operand.text)
+    case tokenString:
+        cmp.value = operand.text
+    case tokenBool:
+        cmp.value = operand.text == "true"
+    default:
+        return nil, fmt.Errorf("expected number, string or boolean at position %d, found %q", operand.pos, operand.text)
+    }
+    if _, numeric := cmp.value.(float64); !numeric && op.text != "==" && op.text != "!=" {
+        return nil, fmt.Errorf("operator %s at position %d requires a numeric operand", op.text, op.pos)
+    }
+    return cmp, nil
+}
+
+func isComparisonOperator(op string) bool {
+    switch op {
+    case "==", "!=", "<", "<=", ">", ">=":
+        return true
+    }
+    return false
+}
+
+type andFilter struct{ left, right subscriptionFilter }
+
+func (f andFilter) eval(fields map[string]interface{}) bool {
+    return f.left.eval(fields) && f.right.eval(fields)
+}
+
+type orFilter struct{ left, right subscriptionFilter }
+
+func (f orFilter) eval(fields map[string]interface{}) bool {
+    return f.left.eval(fields) || f.right.eval(fields)
+}
+
+type notFilter struct{ inner subscriptionFilter }
+
+func (f notFilter) eval(fields map[string]interface{}) bool {
+    return !f.inner.eval(fields)
+}
+
+// comparisonFilter compares one payload field with a literal. A missing field, or one whose
+// type does not fit the literal, never matches.
+type comparisonFilter struct {
+    field string
+    op    string
+    value interface{} // float64, string or bool
+    exact *big.Rat    // A numeric literal exactly, for comparing json.Number fields without rounding
+}
+
+func (f comparisonFilter) eval(fields map[string]interface{}) bool {
+    actual, ok := fields[f.field]
+    if !ok {
+        return false
+    }
+
+    switch want := f.value.(type) {
+    case float64:
+        order, ok := f.compareNumber(actual, want)
+        if !ok {
+            return false
+        }
+        switch f.op {
+        case "==":
+            return order == 0
+        case "!=":
+            return order != 0
+        case "<":
+            return order < 0
+        case "<=":
+            return order <= 0
+        case ">":
+            return order > 0
+        case ">=":
+            return order >= 0
+        }
+    case string:
+        got, ok := actual.(string)
+        return ok && (got == want) == (f.op == "==")
+    case bool:
+        got, ok := actual.(bool)
+        return ok && (got == want) == (f.op == "==")
+    }
+    return false
+}
+
+// compareNumber orders a field against the numeric literal want, returning -1, 0 or 1. Fields
+// decoded as json.Number are compared exactly, so large integers are not rounded to float64.
+func (f comparisonFilter) compareNumber(actual interface{}, want float64) (int, bool) {
+    if number, ok := actual.(json.Number); ok && f.exact != nil {
+        if got, ok := new(big.Rat).SetString(string(number)); ok {
+            return got.Cmp(f.exact), true
+        }
+    }
+    got, ok := numericValue(actual)
+    switch {
+    case !ok || math.IsNaN(got):
+        return 0, false
+    case got < want:
+        return -1, true
+    case got > want:
+        return 1, true
+    }
+    return 0, true
+}
+
+// numericValue reads a number from a payload field. Strings such as "0.5 SOL" yield their
+// leading number so amount fields can be compared numerically.
+func numericValue(v interface{}) (float64, bool) {
+    switch v := v.(type) {
+    case float64:
+        return v, true
+    case json.Number:
+        n, err := v.Float64()
+        return n, err == nil
+    case string:
+        parts := strings.Fields(v)
+        if len(parts) == 0 {
+            return 0, false
+        }
+        n, err := strconv.ParseFloat(parts[0], 64)
+        return n, err == nil
+    }
+    return 0, false
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+)
+
+func TestParseFilterEvaluatesPayloadFields(t *testing.T) {
+    filter, err := parseFilter(`amount > 1.0 && (status == "confirmed" || status == "finalized") && !(blockchain == "Ethereum")`)
+    require.NoError(t, err)
+
+    assert.True(t, filter.eval(map[string]interface{}{"amount": "2.5 SOL", "status": "confirmed", "blockchain": "Solana"}))
+    assert.True(t, filter.eval(map[string]interface{}{"amount": "1.5 SOL", "status": "finalized", "blockchain": "Solana"}))
+    assert.False(t, filter.eval(map[string]interface{}{"amount": "0.5 SOL", "status": "confirmed", "blockchain": "Solana"}))
+    assert.False(t, filter.eval(map[string]interface{}{"amount": "2.5 ETH", "status": "confirmed", "blockchain": "Ethereum"}))
+    assert.False(t, filter.eval(map[string]interface{}{"amount": "n/a", "status": "confirmed"}))
+}
+
+func TestParseFilterRejectsInvalidExpressions(t *testing.T) {
+    for _, expr := range []string{
+        `amount >`,
+        `amount = 1`,
+        `status > "confirmed"`,
+        `(amount > 1`,
+        `amount > 1 status == "x"`,
+        `"confirmed" == status`,
+        `status == "unterminated`,
+    } {
+        _, err := parseFilter(expr)
+        assert.Error(t, err, expr)
+    }
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "strings"
+)
+
+// fleetTopicPrefix marks topics naming a fleet of agents, e.g. "fleet:trading".
+const fleetTopicPrefix = "fleet:"
+
+// FleetResolver maps fleet names to the agents in them, letting one subscription to
+// "fleet:<name>" follow every agent of the fleet.
+type FleetResolver interface {
+    // FleetAgents returns the IDs of the agents currently in the named fleet.
+    FleetAgents(fleet string) ([]string, error)
+}
+
+// fleetName returns the fleet a topic names, if it is a fleet topic.
+func fleetName(topic string) (string, bool) {
+    if !strings.HasPrefix(topic, fleetTopicPrefix) {
+        return "", false
+    }
+    return strings.TrimPrefix(topic, fleetTopicPrefix), true
+}
+
+// resolveFleet returns the normalized agent IDs of a fleet as a set.
+func (s *WebSocketServer) resolveFleet(fleet string) (map[string]bool, error) {
+    if s.FleetResolver == nil {
+        return nil, fmt.Errorf("fleet topics are not supported")
+    }
+    agentIDs, err := s.FleetResolver.FleetAgents(fleet)
+    if err != nil {
+        return nil, err
+    }
+    members := make(map[string]bool, len(agentIDs))
+    for _, agentID := range agentIDs {
+        if normalized, err := s.normalizeTopic(agentID); err == nil {
+            members[normalized] = true
+        }
+    }
+    return members, nil
+}
+
+// authorizedMembers returns the members of a fleet the client may subscribe to on their own,
+// so a fleet subscription never delivers an agent the client is denied. It consults the
+// Authorizer, so the caller must not hold the server mutex.
+func (s *WebSocketServer) authorizedMembers(client *Client, members map[string]bool) map[string]bool {
+    allowed := make(map[string]bool, len(members))
+    for agentID := range members {
+        if s.canSubscribe(client, agentID) {
+            allowed[agentID] = true
+        }
+    }
+    return allowed
+}
+
+// RefreshFleet re-resolves a fleet's membership and applies it to every subscription to the
+// fleet, so agents that joined start being delivered and agents that left stop. Each
+// subscriber gets only the members it is authorized for. Call it whenever the
+// FleetResolver's answer for the fleet changes.
+func (s *WebSocketServer) RefreshFleet(fleet string) error {
+    topic, err := s.normalizeTopic(fleetTopicPrefix + fleet)
+    if err != nil {
+        return err
+    }
+    fleet, _ = fleetName(topic)
+    members, err := s.resolveFleet(fleet)
+    if err != nil {
+        return err
+    }
+
+    var subscribers []*Client
+    s.Mutex.RLock()
+    for client := range s.Clients {
+        if client.subscriptionByPattern(topic) != nil {
+            subscribers = append(subscribers, client)
+        }
+    }
+    s.Mutex.RUnlock()
+
+    // Authorization is consulted outside the lock so the callback may use the server
+    allowed := make(map[*Client]map[string]bool, len(subscribers))
+    for _, client := range subscribers {
+        allowed[client] = s.authorizedMembers(client, members)
+    }
+
+    s.Mutex.Lock()
+    defer s.Mutex.Unlock()
+    refreshed := 0
+    for client, agents := range allowed {
+        if subscription := client.subscriptionByPattern(topic); subscription != nil && s.Clients[client] {
+            subscription.agents = agents
+            refreshed++
+        }
+    }
+    log.Printf("Refreshed fleet %s with %d agents for %d subscriptions", fleet, len(members), refreshed)
+    return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import "strings"
+
+// FlowTopic is the topic a subscribe request names, together with from and to, to follow the
+// transactions between two parties.
+const FlowTopic = "flow"
+
+// flowTopicPrefix marks topics following a flow, e.g. "flow:agent-1->addr9". A flow
+// subscription's topic names its from and to, each an agent ID or an address.
+const flowTopicPrefix = "flow:"
+
+// isFlowTopic reports whether a client-supplied topic names flows directly, as a flow topic or
+// a wildcard over them. Only the FlowTopic with from and to, whose parties are both
+// authorized, may subscribe to a flow.
+func isFlowTopic(topic string) bool {
+    return strings.HasPrefix(strings.ToLower(strings.TrimSpace(topic)), flowTopicPrefix)
+}
+
+// flowTopic returns the topic of the flow from one party to another.
+func flowTopic(from, to string) string {
+    return flowTopicPrefix + from + "->" + to
+}
+
+// flowTopics returns the flow topics a transaction is addressed to: from its from_address,
+// and from its agent when known, to its to_address.
+func flowTopics(tx TransactionPayload) []string {
+    if tx.ToAddress == "" {
+        return nil
+    }
+    var topics []string
+    if tx.FromAddress != "" {
+        topics = append(topics, flowTopic(tx.FromAddress, tx.ToAddress))
+    }
+    if tx.AgentID != "" && tx.AgentID != tx.FromAddress {
+        topics = append(topics, flowTopic(tx.AgentID, tx.ToAddress))
+    }
+    return topics
+}
+
+// inFlow reports whether a broadcast payload passes the subscription's From and To, matched
+// against the transaction's sides as transaction queries match addresses. The topic alone
+// cannot tell which party an ID containing "->" belongs to. Subscriptions without a flow
+// let every payload through. With CaseInsensitiveTopics both sides are lowercased, as
+// normalizeTopic lowercases the flow topic, so the topic and the sides agree.
+func (sub *Subscription) inFlow(payload interface{}) bool {
+    if sub.From == "" {
+        return true
+    }
+    tx, ok := payload.(TransactionPayload)
+    if !ok {
+        return false
+    }
+    from, to := sub.From, sub.To
+    if sub.foldCase {
+        from, to = strings.ToLower(from), strings.ToLower(to)
+        tx.AgentID, tx.FromAddress, tx.ToAddress = strings.ToLower(tx.AgentID), strings.ToLower(tx.FromAddress), strings.ToLower(tx.ToAddress)
+    }
+    fromMatches := tx.AgentID == from || matchesAddress(tx, from, DirectionFrom)
+    return fromMatches && matchesAddress(tx, to, DirectionTo)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+    "bytes"
+    "compress/gzip"
+    "encoding/json"
+    "fmt"
+    "log"
+)
+
+// CompressedData replaces the data of a response the client asked to have compressed.
+// Clients base64-decode Data, gunzip it and parse the result as the response's usual data.
+type CompressedData struct {
+    Encoding string `json:"encoding"` // Always "gzip"
+    Data     []byte `json:"data"`     // Base64 in JSON
+}
+
+// compressData gzips the JSON encoding of data.
+func compressData(data interface{}) (CompressedData, error) {
+    jsonData, err := json.Marshal(data)
+    if err != nil {
+        return CompressedData{}, err
+    }
+    var buf bytes.Buffer
+    writer := gzip.NewWriter(&buf)
+    if _, err := writer.Write(jsonData); err != nil {
+        return CompressedData{}, err
+    }
+    if err := writer.Close(); err != nil {
+        return CompressedData{}, err
+    }
+    return CompressedData{Encoding: "gzip", Data: buf.Bytes()}, nil
+}
+
+// FrameChunkPayload carries one piece of a frame that exceeded MaxFrameBytes. Clients
+// concatenate the decoded Data of every chunk sharing a ChunkID, in Sequence order, and parse
+// the result once the chunk marked Final arrives.
+type FrameChunkPayload struct {
+    ChunkID  string `json:"chunk_id"`
+    Sequence int    `json:"sequence"` // Starts at 1
+    Final    bool   `json:"final"`
+    Data     []byte `json:"data"` // Base64 in JSON, so the split need not respect UTF-8 or JSON boundaries
+}
+
+// splitFrame returns jsonData as a single frame, or as frame_chunk messages of at most
+// MaxFrameBytes each when it is larger.
+func (s *WebSocketServer) splitFrame(jsonData []byte) [][]byte {
+    if s.MaxFrameBytes <= 0 || len(jsonData) <= s.MaxFrameBytes {
+        return [][]byte{jsonData}
+    }
+
+    chunkID := fmt.Sprintf("chunk-%d", s.chunkSeq.Add(1))
+    // Size the pieces against the envelope of the largest possible sequence number
+    envelope, err := json.Marshal(Message{
+        Type:    FrameChunk,
+        Payload: FrameChunkPayload{ChunkID: chunkID, Sequence: len(jsonData), Final: true, Data: []byte{}},
+    })
+    if err != nil {
+        log.Printf("Failed to marshal frame chunk envelope: %v", err)
+        return [][]byte{jsonData}
+    }
+    pieceSize := (s.MaxFrameBytes - len(envelope)) / 4 * 3
+    if pieceSize <= 0 {
+        log.Printf("MaxFrameBytes of %d is too small to chunk frames, sending %d bytes whole", s.MaxFrameBytes, len(jsonData))
+        return [][]byte{jsonData}
+    }
+
+    var frames [][]byte
+    for start, sequence := 0, 1; start < len(jsonData); start, sequence = start+pieceSize, sequence+1 {
+        end := start + pieceSize
+        if end > len(jsonData) {
+            end = len(jsonData)
+        }
+        frame, err := json.Marshal(Message{
+            Type: FrameChunk,
+            Payload: FrameChunkPayload{
+                ChunkID:  chunkID,
+                Sequence: sequence,
+                Final:    end == len(jsonData),
+                Data:     jsonData[start:end],
+            },
+        })
+        if err != nil {
+            log.Printf("Failed to marshal frame chunk: %v", err)
+            return [][]byte{jsonData}
+        }
+        frames = append(frames, frame)
+    }
+    return frames
+}
@@ -1,11 +1,15 @@
 package main
  
 import (
+    "bytes"
+    "context"
     "encoding/json"
+    "errors"
+    "fmt"
     "log"
+    "sort"
+    "strings"
     "time"
-
-    "github.com/gorilla/websocket"
 )
 
 // ClientMessageType defines the type of message received from clients.
@@ -17,17 +21,157 @@ const (
     AgentControlRequest ClientMessageType = "agent_control"
     TransactionQuery    ClientMessageType = "transaction_query"
     HeartbeatPong       ClientMessageType = "pong"
+    PingRequest         ClientMessageType = "ping" // Application-level latency probe, not the protocol heartbeat
+    ListSubscriptions   ClientMessageType = "list_subscriptions"
+    AckMessage          ClientMessageType = "ack" // Confirms receipt of a require_ack broadcast
+    ServerTimeRequest   ClientMessageType = "server_time"
+    HealthRequest       ClientMessageType = "health" // Liveness probe; also answered on unauthenticated connections
+    HelloRequest        ClientMessageType = "hello"  // Restores a previous connection's subscriptions by session token
+    PauseRequest        ClientMessageType = "pause"  // Stops deliveries to a subscription without removing it
+    ResumeRequest       ClientMessageType = "resume" // Restarts a paused subscription, replaying what it buffered
+    CommandHistory      ClientMessageType = "command_history"
+    CancelCommand       ClientMessageType = "cancel_command" // Cancels an agent_control scheduled with execute_at
 )
 
+// builtinMessageTypes lists the message types HandleClientMessage dispatches itself.
+var builtinMessageTypes = map[ClientMessageType]bool{
+    SubscribeRequest:    true,
+    UnsubscribeRequest:  true,
+    AgentControlRequest: true,
+    TransactionQuery:    true,
+    HeartbeatPong:       true,
+    PingRequest:         true,
+    ListSubscriptions:   true,
+    AckMessage:          true,
+    ServerTimeRequest:   true,
+    HealthRequest:       true,
+    HelloRequest:        true,
+    PauseRequest:        true,
+    ResumeRequest:       true,
+    CommandHistory:      true,
+    CancelCommand:       true,
+}
+
+// MessageHandler handles a client message type registered with RegisterHandler. payload is
+// the message's raw payload, empty if it had none.
+type MessageHandler func(client *Client, payload json.RawMessage)
+
+// ErrBuiltinMessageType is returned by RegisterHandler for a built-in message type when
+// AllowHandlerOverride is unset.
+var ErrBuiltinMessageType = errors.New("message type is handled by the server")
+
+// RegisterHandler adds a handler for an application-defined message type, replacing any
+// handler registered for it before. Built-in types can only be overridden when
+// AllowHandlerOverride is set.
+func (s *WebSocketServer) RegisterHandler(msgType ClientMessageType, handler MessageHandler) error {
+    if builtinMessageTypes[msgType] && !s.AllowHandlerOverride {
+        return fmt.Errorf("%w: %s", ErrBuiltinMessageType, msgType)
+    }
+    s.handlersMu.Lock()
+    defer s.handlersMu.Unlock()
+    s.handlers[msgType] = handler
+    return nil
+}
+
+// registeredHandler returns the handler registered for msgType, if any.
+func (s *WebSocketServer) registeredHandler(msgType ClientMessageType) (MessageHandler, bool) {
+    s.handlersMu.RLock()
+    defer s.handlersMu.RUnlock()
+    handler, ok := s.handlers[msgType]
+    return handler, ok
+}
+
+// protocolMessageTypes lists the message types that keep a connection working: heartbeats,
+// acknowledgements, session restores and probes. EnabledMessageTypes never disables them.
+var protocolMessageTypes = map[ClientMessageType]bool{
+    HeartbeatPong:     true,
+    PingRequest:       true,
+    AckMessage:        true,
+    ServerTimeRequest: true,
+    HealthRequest:     true,
+    HelloRequest:      true,
+}
+
+// messageTypeEnabled reports whether EnabledMessageTypes admits msgType. Protocol types are
+// always admitted, as are types the server does not know so they are still reported as unknown.
+func (s *WebSocketServer) messageTypeEnabled(msgType ClientMessageType) bool {
+    if s.EnabledMessageTypes == nil || s.EnabledMessageTypes[msgType] || protocolMessageTypes[msgType] {
+        return true
+    }
+    _, registered := s.registeredHandler(msgType)
+    return !registered && !builtinMessageTypes[msgType]
+}
+
 // ClientMessage represents the structure of a message received from a client.
 type ClientMessage struct {
-    Type    ClientMessageType `json:"type"`
-    Payload interface{}       `json:"payload"`
+    Type      ClientMessageType `json:"type"`
+    Payload   json.RawMessage   `json:"payload"`             // Decoded by the handler for Type
+    Signature string            `json:"signature,omitempty"` // Hex HMAC-SHA256 of type, '.', payload; required when SigningKeys is set
 }
 
 // SubscribePayload defines the payload for subscription requests.
 type SubscribePayload struct {
-    Topic string `json:"topic"` // e.g., agent_id or tx_id
+    Topic       string   `json:"topic,omitempty"`        // e.g., agent_id or tx_id; '*' matches any run of characters
+    Topics      []string `json:"topics,omitempty"`       // Subscribes to several topics at once, reporting each separately
+    MaxMessages int      `json:"max_messages,omitempty"` // Auto-unsubscribe after this many messages; 0 is unlimited
+    Filter      string   `json:"filter,omitempty"`       // e.g. `amount > 1.0 && status == "confirmed"`
+    History     int      `json:"history,omitempty"`      // Send up to this many of the agent's recorded transactions before live updates
+    MinLevel    string   `json:"min_level,omitempty"`    // For logs topics, the lowest log level sent: debug, info, warn or error
+    QoS         QoS      `json:"qos,omitempty"`          // Delivery guarantee when the client falls behind; defaults to at_most_once
+    MinAmount   float64  `json:"min_amount,omitempty"`   // Deliver only transactions of at least this amount, e.g. 0.5 for "0.5 SOL"
+    TTLSeconds  int      `json:"ttl_seconds,omitempty"`  // Expire the subscription this long after subscribing unless re-subscribed
+    Tail        bool     `json:"tail,omitempty"`         // Deliver only transactions recorded after subscribing, and no initial state
+    Statuses    []string `json:"statuses,omitempty"`     // Deliver agent status updates only for these statuses, e.g. ["error"]
+    From        string   `json:"from,omitempty"`         // With the flow topic, the sending agent ID or address to follow
+    To          string   `json:"to,omitempty"`           // With the flow topic, the receiving address to follow
+    AgentID     string   `json:"agent_id,omitempty"`     // With a mempool topic, deliver only this agent's transactions
+    Address     string   `json:"address,omitempty"`      // With a mempool topic, deliver only transactions from or to this address
+
+    restored bool // Re-subscribed from a saved session, whose state_diff replaces initial_state
+}
+
+// QoS selects what happens to a subscription's broadcasts when the client's send queue is full.
+type QoS string
+
+const (
+    QoSAtMostOnce  QoS = "at_most_once"  // Drop the broadcast, as for telemetry where the next update supersedes it
+    QoSAtLeastOnce QoS = "at_least_once" // Retain the broadcast and retry it; the client is disconnected only if MaxRetainedFrames is exceeded
+)
+
+// SubscribeStatus is the outcome of subscribing to one topic of a batch subscribe.
+type SubscribeStatus string
+
+const (
+    SubscribeSubscribed    SubscribeStatus = "subscribed"
+    SubscribeAlready       SubscribeStatus = "already"        // An existing subscription was refreshed
+    SubscribeDenied        SubscribeStatus = "denied"         // The Authorizer refused the topic
+    SubscribeLimitExceeded SubscribeStatus = "limit_exceeded" // The client holds MaxSubscriptionsPerClient subscriptions
+    SubscribeInvalid       SubscribeStatus = "invalid"        // The topic is blank or malformed
+    SubscribeClosed        SubscribeStatus = "closed"         // The topic was evicted and is cooling down
+)
+
+// SubscribeResult reports the outcome for one topic of a batch subscribe.
+type SubscribeResult struct {
+    Topic          string          `json:"topic"`
+    Status         SubscribeStatus `json:"status"`
+    SubscriptionID string          `json:"subscription_id,omitempty"`
+    Error          string          `json:"error,omitempty"`
+}
+
+// UnsubscribePayload defines the payload for unsubscription requests. SubscriptionID removes
+// exactly one subscription; Topic removes the subscription with that pattern.
+type UnsubscribePayload struct {
+    Topic          string `json:"topic,omitempty"`
+    SubscriptionID string `json:"subscription_id,omitempty"`
+}
+
+// PausePayload defines the payload for pause requests, which name a subscription as
+// UnsubscribePayload does. With Buffer set, broadcasts arriving while paused are kept, up to
+// PausedBufferSize, and replayed on resume; otherwise they are skipped.
+type PausePayload struct {
+    Topic          string `json:"topic,omitempty"`
+    SubscriptionID string `json:"subscription_id,omitempty"`
+    Buffer         bool   `json:"buffer,omitempty"`
 }
 
 // AgentControlPayload defines the payload for agent control commands.
@@ -35,40 +179,162 @@ type AgentControlPayload struct {
     AgentID string `json:"agent_id"`
     Command string `json:"command"` // e.g., "start", "stop", "update_config"
     Params  map[string]interface{} `json:"params,omitempty"`
+    Mode    ConfigMode             `json:"mode,omitempty"` // For update_config: merge (default) or replace
+    DryRun  bool                   `json:"dry_run,omitempty"` // Report what the command would do without carrying it out
+    ExecuteAt *time.Time           `json:"execute_at,omitempty"` // Hold the command until this time; it can be cancelled until then
 }
 
+// ConfigMode selects how update_config applies its params to the agent's configuration.
+type ConfigMode string
+
+const (
+    ConfigMerge   ConfigMode = "merge"   // Set only the provided keys, keeping the rest
+    ConfigReplace ConfigMode = "replace" // Replace the whole configuration with params
+)
+
 // TransactionQueryPayload defines the payload for transaction queries.
 type TransactionQueryPayload struct {
-    TxID       string `json:"tx_id,omitempty"`
-    AgentID    string `json:"agent_id,omitempty"`
-    Blockchain string `json:"blockchain,omitempty"` // e.g., "Solana"
-    Limit      int    `json:"limit,omitempty"`      // Number of transactions to return
+    TxID       string           `json:"tx_id,omitempty"`
+    TxIDs      []string         `json:"tx_ids,omitempty"` // Looks up many transactions at once; combines with no other filter
+    AgentID    string           `json:"agent_id,omitempty"`
+    Address    string           `json:"address,omitempty"`    // Wallet address matched against sender and/or receiver
+    Direction  AddressDirection `json:"direction,omitempty"`  // Which side Address must appear on; defaults to any
+    Blockchain BlockchainList   `json:"blockchain,omitempty"` // e.g., "Solana" or "Solana,Ethereum"
+    Limit      int              `json:"limit,omitempty"`      // Number of transactions to return
+    Stream     bool             `json:"stream,omitempty"`     // Deliver results as transaction_chunk messages
+    Fields     []string         `json:"fields,omitempty"`     // Return only these transaction fields, plus tx_id; unknown names are ignored
+    Compress   bool             `json:"compress,omitempty"`   // Gzip the response data, for large result sets
+
+    // IfModifiedSince answers with transaction_query_not_modified instead of the results when
+    // none of them is newer than this time.
+    IfModifiedSince *time.Time `json:"if_modified_since,omitempty"`
+    // FromBlock and ToBlock bound the block heights of the results, inclusive. Heights are
+    // per chain, so either requires a single blockchain.
+    FromBlock *uint64 `json:"from_block,omitempty"`
+    ToBlock   *uint64 `json:"to_block,omitempty"`
+}
+
+// AddressDirection selects which side of a transaction an address filter applies to.
+type AddressDirection string
+
+const (
+    DirectionAny  AddressDirection = "any"
+    DirectionFrom AddressDirection = "from"
+    DirectionTo   AddressDirection = "to"
+)
+
+// BlockchainList holds the chains a transaction query targets. On the wire it is either a
+// comma-separated string or an array of chain names.
+type BlockchainList []string
+
+// UnmarshalJSON accepts both the comma-separated string and the array form.
+func (b *BlockchainList) UnmarshalJSON(data []byte) error {
+    var joined string
+    if err := json.Unmarshal(data, &joined); err == nil {
+        *b = splitBlockchains(joined)
+        return nil
+    }
+    var names []string
+    if err := json.Unmarshal(data, &names); err != nil {
+        return err
+    }
+    *b = names
+    return nil
+}
+
+// AckPayload acknowledges a broadcast sent with require_ack.
+type AckPayload struct {
+    MessageID string `json:"message_id"`
+}
+
+// PingPayload defines the payload of a latency ping.
+type PingPayload struct {
+    ClientTimestamp int64 `json:"client_timestamp"` // Client send time in Unix milliseconds
+}
+
+// PongPayload defines the reply to a latency ping. ClientTimestamp is echoed unchanged so
+// the client can compute the round-trip time against its own clock.
+type PongPayload struct {
+    ClientTimestamp int64     `json:"client_timestamp"` // Client send time in Unix milliseconds
+    ServerTime      time.Time `json:"server_time"`      // When the server received the ping
+}
+
+// ServerTimePayload defines the reply to a server_time request, letting clients measure
+// their clock skew and render server timestamps in the server's zone.
+type ServerTimePayload struct {
+    ServerTime       time.Time `json:"server_time"`        // Server's current time, with its zone offset
+    UnixMillis       int64     `json:"unix_millis"`        // ServerTime in Unix milliseconds
+    Timezone         string    `json:"timezone"`           // Zone abbreviation, e.g. "UTC" or "CET"
+    UTCOffsetSeconds int       `json:"utc_offset_seconds"` // Offset of ServerTime's zone east of UTC
 }
 
 // ErrorResponse defines the structure for error messages sent to clients.
 type ErrorResponse struct {
-    Code    int    `json:"code"`
-    Message string `json:"message"`
+    Code    int                    `json:"code"`
+    Message string                 `json:"message"`
+    Fields  FieldErrors            `json:"fields,omitempty"`  // Per-field validation messages (code 422)
+    Details map[string]interface{} `json:"details,omitempty"` // Machine-readable context for the error
 }
 
 // ResponseMessage defines the structure for server responses to clients.
 type ResponseMessage struct {
-    Type    string      `json:"type"`
-    Success bool        `json:"success"`
-    Data    interface{} `json:"data,omitempty"`
-    Error   *ErrorResponse `json:"error,omitempty"`
+    V         int            `json:"v"` // Response schema version, ResponseVersion when sent
+    Type      string         `json:"type"`
+    Success   bool           `json:"success"`
+    Data      interface{}    `json:"data,omitempty"`
+    Error     *ErrorResponse `json:"error,omitempty"`
+    Signature string         `json:"signature,omitempty"` // Hex HMAC-SHA256 of type, '.', data, for signed responses
 }
 
+// ResponseVersion is the schema version stamped on every response as "v". It is raised when a
+// response changes in a way clients must branch on.
+const ResponseVersion = 1
+
 // HandleClientMessage processes incoming messages from a client and dispatches to appropriate handlers.
+// A client's messages are handled one at a time: the read loop calls it for each message in the
+// order read, and concurrent calls for the same client wait for one another. Each handler
+// finishes updating the client's state before returning, so after a burst of subscribes and
+// unsubscribes the client is left as its last message says; only transaction queries and agent
+// commands complete later. Handlers must not call HandleClientMessage for their own client.
 func (s *WebSocketServer) HandleClientMessage(client *Client, message []byte) {
+    client.dispatchMu.Lock()
+    defer client.dispatchMu.Unlock()
+
     var msg ClientMessage
-    if err := json.Unmarshal(message, &msg); err != nil {
+    if s.StrictDecoding {
+        if err := decodeStrict(message, &msg); err != nil {
+            log.Printf("Failed to decode client message: %v", err)
+            s.sendErrorMessage(client, CodeBadRequest, "Invalid message format: "+strings.TrimPrefix(err.Error(), "json: "), nil)
+            return
+        }
+    } else if err := json.Unmarshal(message, &msg); err != nil {
         log.Printf("Failed to unmarshal client message: %v", err)
-        s.sendErrorToClient(client, 400, "Invalid message format")
+        s.sendErrorMessage(client, CodeBadRequest, "Invalid message format", nil)
+        return
+    }
+
+    if !s.verifySignature(client, msg) {
+        return
+    }
+    if !s.messageTypeEnabled(msg.Type) {
+        log.Printf("Rejected %s message from client %s: message type disabled", msg.Type, client.ID)
+        s.sendErrorMessage(client, CodeForbidden, fmt.Sprintf("Message type %q is disabled", msg.Type), nil)
         return
     }
 
-    client.LastActive = time.Now()
+    client.LastActive = s.Clock.Now()
+    // Heartbeats alone do not show that a connection is in use
+    if msg.Type != HeartbeatPong && msg.Type != PingRequest {
+        client.engaged.Store(true)
+    }
+
+    start := time.Now()
+    defer func() { s.observeHandler(client, msg.Type, time.Since(start)) }()
+
+    if handler, ok := s.registeredHandler(msg.Type); ok {
+        handler(client, msg.Payload)
+        return
+    }
 
     switch msg.Type {
     case SubscribeRequest:
@@ -79,58 +345,332 @@ func (s *WebSocketServer) HandleClientMessage(client *Client, message []byte) {
         s.handleAgentControl(client, msg.Payload)
     case TransactionQuery:
         s.handleTransactionQuery(client, msg.Payload)
+    case PingRequest:
+        s.handlePing(client, msg.Payload)
+    case ListSubscriptions:
+        s.handleListSubscriptions(client)
+    case AckMessage:
+        s.handleAck(client, msg.Payload)
+    case ServerTimeRequest:
+        s.handleServerTime(client)
+    case HealthRequest:
+        s.handleHealth(client)
+    case HelloRequest:
+        s.handleHello(client, msg.Payload)
+    case PauseRequest:
+        s.handlePause(client, msg.Payload)
+    case ResumeRequest:
+        s.handleResume(client, msg.Payload)
+    case CommandHistory:
+        s.handleCommandHistory(client, msg.Payload)
+    case CancelCommand:
+        s.handleCancelCommand(client, msg.Payload)
     case HeartbeatPong:
-        // Heartbeat pong is handled in the readPump; no additional action needed here
+        // The protocol heartbeat is handled in the readPump; this pong only carries application data
         log.Printf("Received pong from client")
+        if s.OnPong != nil {
+            payload := msg.Payload
+            if bytes.Equal(payload, []byte("null")) {
+                payload = nil
+            }
+            s.OnPong(client, payload)
+        }
     default:
         log.Printf("Unknown message type received: %s", msg.Type)
-        s.sendErrorToClient(client, 400, "Unknown message type")
+        s.sendErrorMessage(client, CodeBadRequest, fmt.Sprintf("Unknown message type: %q", msg.Type), map[string]interface{}{
+            "received_type": msg.Type,
+        })
     }
 }
 
-// handleSubscribe processes a subscription request from a client.
-func (s *WebSocketServer) handleSubscribe(client *Client, payload interface{}) {
-    data, ok := payload.(map[string]interface{})
+// handleAck records a client's acknowledgment of a require_ack broadcast. Acks are not
+// answered; duplicates, as sent for a redelivered message, are ignored.
+func (s *WebSocketServer) handleAck(client *Client, payload json.RawMessage) {
+    data, ok := s.payloadObject(client, payload, "ack", &AckPayload{})
     if !ok {
-        s.sendErrorToClient(client, 400, "Invalid subscribe payload")
         return
     }
 
-    topic, ok := data["topic"].(string)
-    if !ok || topic == "" {
-        s.sendErrorToClient(client, 400, "Missing or invalid topic in subscribe request")
+    messageID, errs := validateAck(data)
+    if len(errs) > 0 {
+        s.sendValidationErrorToClient(client, errs)
         return
     }
 
-    s.Mutex.Lock()
-    client.Topics[topic] = true
-    s.Mutex.Unlock()
+    if !client.acknowledge(messageID) {
+        log.Printf("Ignoring ack for unknown or settled message %s", messageID)
+    }
+}
+
+// handlePing answers a latency ping immediately with a pong_response echoing the client timestamp.
+func (s *WebSocketServer) handlePing(client *Client, payload json.RawMessage) {
+    receivedAt := s.Clock.Now()
+
+    data, ok := s.payloadObject(client, payload, "ping", &PingPayload{})
+    if !ok {
+        return
+    }
+
+    timestamp, errs := validatePing(data)
+    if len(errs) > 0 {
+        s.sendValidationErrorToClient(client, errs)
+        return
+    }
+
+    response := ResponseMessage{
+        Type:    "pong_response",
+        Success: true,
+        Data: PongPayload{
+            ClientTimestamp: timestamp,
+            ServerTime:      receivedAt,
+        },
+    }
+    s.sendResponseToClient(client, response)
+}
+
+// handleServerTime replies with the server's current time and zone offset.
+func (s *WebSocketServer) handleServerTime(client *Client) {
+    now := s.Clock.Now()
+    zone, offset := now.Zone()
+    response := ResponseMessage{
+        Type:    "server_time_response",
+        Success: true,
+        Data: ServerTimePayload{
+            ServerTime:       now,
+            UnixMillis:       now.UnixMilli(),
+            Timezone:         zone,
+            UTCOffsetSeconds: offset,
+        },
+    }
+    s.sendResponseToClient(client, response)
+}
+
+// handleSubscribe processes a subscription request from a client. A request naming several
+// topics is answered with a status per topic rather than failing as a whole.
+func (s *WebSocketServer) handleSubscribe(client *Client, payload json.RawMessage) {
+    data, ok := s.payloadObject(client, payload, "subscribe", &SubscribePayload{})
+    if !ok {
+        return
+    }
+
+    request, errs := validateSubscribe(data)
+    if len(errs) > 0 {
+        s.sendValidationErrorToClient(client, errs)
+        return
+    }
+    var filter subscriptionFilter
+    if request.Filter != "" {
+        var err error
+        if filter, err = parseFilter(request.Filter); err != nil {
+            s.sendErrorMessage(client, CodeBadRequest, "Invalid filter: "+err.Error(), nil)
+            return
+        }
+    }
 
-    log.Printf("Client subscribed to topic: %s", topic)
+    if len(request.Topics) > 0 {
+        results := make([]SubscribeResult, 0, len(request.Topics))
+        for _, topic := range request.Topics {
+            results = append(results, s.subscribe(client, topic, request, filter))
+        }
+        response := ResponseMessage{
+            Type:    "subscribe_response",
+            Success: true,
+            Data:    map[string]interface{}{"results": results},
+        }
+        s.sendResponseToClient(client, response)
+        return
+    }
+
+    result := s.subscribe(client, request.Topic, request, filter)
+    switch result.Status {
+    case SubscribeInvalid:
+        s.sendErrorMessage(client, CodeBadRequest, result.Error, nil)
+        return
+    case SubscribeDenied:
+        s.sendErrorMessage(client, CodeForbidden, result.Error, nil)
+        return
+    case SubscribeLimitExceeded:
+        s.sendErrorMessage(client, CodeTooManyRequests, result.Error, nil)
+        return
+    case SubscribeClosed:
+        s.sendErrorMessage(client, CodeUnavailable, result.Error, nil)
+        return
+    }
     response := ResponseMessage{
         Type:    "subscribe_response",
         Success: true,
-        Data:    map[string]string{"topic": topic},
+        Data:    map[string]string{"topic": result.Topic, "subscription_id": result.SubscriptionID},
     }
     s.sendResponseToClient(client, response)
+
+    if request.History > 0 {
+        s.goClient(func() { s.catchUp(client, result.SubscriptionID, result.Topic, request.History) })
+    }
 }
 
-// handleUnsubscribe processes an unsubscription request from a client.
-func (s *WebSocketServer) handleUnsubscribe(client *Client, payload interface{}) {
-    data, ok := payload.(map[string]interface{})
+// subscribe subscribes the client to one topic with the request's budget and filter.
+// Re-subscribing to a pattern refreshes the existing subscription. A new subscription is
+// first sent the latest state of the topics it covers, ahead of the subscribe_response,
+// unless it is a tail subscription, which receives only transactions recorded after it.
+func (s *WebSocketServer) subscribe(client *Client, rawTopic string, request SubscribePayload, filter subscriptionFilter) SubscribeResult {
+    topic, err := s.normalizeTopic(rawTopic)
+    if err != nil {
+        return SubscribeResult{Topic: rawTopic, Status: SubscribeInvalid, Error: err.Error()}
+    }
+    // Authorization is consulted outside the lock so the callback may use the server
+    if !s.canSubscribe(client, topic) {
+        return SubscribeResult{Topic: topic, Status: SubscribeDenied, Error: "Not authorized to subscribe to topic: " + topic}
+    }
+    // A flow reveals the transactions of both its parties
+    if request.From != "" && (!s.canSubscribe(client, request.From) || !s.canSubscribe(client, request.To)) {
+        return SubscribeResult{Topic: topic, Status: SubscribeDenied, Error: "Not authorized to follow flow: " + topic}
+    }
+    var members map[string]bool
+    if fleet, ok := fleetName(topic); ok {
+        if members, err = s.resolveFleet(fleet); err != nil {
+            log.Printf("Failed to resolve fleet %s: %v", fleet, err)
+            return SubscribeResult{Topic: topic, Status: SubscribeInvalid, Error: "Cannot resolve fleet: " + fleet}
+        }
+        members = s.authorizedMembers(client, members)
+    }
+    var watermark uint64
+    if sequencer, ok := s.Store.(TransactionSequencer); ok && request.Tail {
+        watermark = sequencer.LastSequence()
+    }
+    var tail *logTail
+    if agentID, ok := logsAgentID(topic); ok {
+        if tail, err = s.openLogTail(agentID); err != nil {
+            return SubscribeResult{Topic: topic, Status: SubscribeInvalid, Error: err.Error()}
+        }
+    }
+    var mempool *mempoolStream
+    if blockchain, ok := mempoolChain(topic); ok {
+        if mempool, err = s.openMempoolStream(blockchain); err != nil {
+            return SubscribeResult{Topic: topic, Status: SubscribeInvalid, Error: err.Error()}
+        }
+    }
+
+    s.Mutex.Lock()
+    if !s.Clients[client] {
+        // Disconnected while the request was handled; its streams would never be stopped
+        s.Mutex.Unlock()
+        stopStreams(tail, mempool)
+        return SubscribeResult{Topic: topic, Status: SubscribeInvalid, Error: "Client is not connected"}
+    }
+    if until, evicted := s.evictedTopics[topic]; evicted && s.Clock.Now().Before(until) {
+        s.Mutex.Unlock()
+        stopStreams(tail, mempool)
+        return SubscribeResult{Topic: topic, Status: SubscribeClosed, Error: "Topic is closed: " + topic}
+    }
+    status := SubscribeAlready
+    subscription := client.subscriptionByPattern(topic)
+    if subscription == nil {
+        if s.MaxSubscriptionsPerClient > 0 && len(client.Subscriptions) >= s.MaxSubscriptionsPerClient {
+            s.Mutex.Unlock()
+            stopStreams(tail, mempool)
+            return SubscribeResult{Topic: topic, Status: SubscribeLimitExceeded, Error: fmt.Sprintf("Subscription limit of %d reached", s.MaxSubscriptionsPerClient)}
+        }
+        status = SubscribeSubscribed
+        subscription = &Subscription{ID: s.newSubscriptionID(), Pattern: topic}
+        s.addSubscriptionLocked(client, subscription)
+    }
+    // Re-subscribing replaces any message budget and filter, and restarts the count
+    subscription.MaxMessages = request.MaxMessages
+    subscription.Filter, subscription.filter = request.Filter, filter
+    subscription.delivered = 0
+    if members != nil {
+        subscription.agents = members
+    }
+    subscription.MinLevel = request.MinLevel
+    subscription.QoS = request.QoS
+    subscription.MinAmount = request.MinAmount
+    subscription.Statuses = request.Statuses
+    subscription.From, subscription.To = request.From, request.To
+    subscription.foldCase = s.CaseInsensitiveTopics
+    subscription.AgentID, subscription.Address = request.AgentID, request.Address
+    subscription.TTLSeconds, subscription.expiresAt = request.TTLSeconds, time.Time{}
+    if request.TTLSeconds > 0 {
+        subscription.expiresAt = s.Clock.Now().Add(time.Duration(request.TTLSeconds) * time.Second)
+    }
+    subscription.minLevel.Store(logLevels[request.MinLevel])
+    if tail != nil && subscription.tail != nil {
+        // Re-subscribing keeps the running tail
+        tail.stop()
+        tail = nil
+    } else if tail != nil {
+        subscription.tail = tail
+    }
+    if mempool != nil && subscription.mempool != nil {
+        // As does the running mempool stream
+        mempool.stop()
+        mempool = nil
+    } else if mempool != nil {
+        subscription.mempool, subscription.pending = mempool, newPendingTxs(s.MaxMempoolPending)
+    }
+    if request.History > 0 {
+        // Hold live frames from here on so none fall between the history query and live delivery
+        subscription.catchingUp = true
+    }
+    if request.Tail {
+        // Transactions recorded before now are history, even if their broadcast is still in flight
+        subscription.watermark = watermark
+    }
+    if status == SubscribeSubscribed && !request.Tail && !request.restored {
+        s.sendInitialStateLocked(client, subscription)
+    }
+    s.Mutex.Unlock()
+
+    if tail != nil {
+        s.goClient(func() { s.streamLogs(client, subscription, tail) })
+    }
+    if mempool != nil {
+        s.goClient(func() { s.streamMempool(client, subscription, mempool) })
+    }
+    log.Printf("Client subscribed to topic: %s (%s)", topic, subscription.ID)
+    return SubscribeResult{Topic: topic, Status: status, SubscriptionID: subscription.ID}
+}
+
+// handleUnsubscribe processes an unsubscription request from a client, by subscription ID or by topic.
+func (s *WebSocketServer) handleUnsubscribe(client *Client, payload json.RawMessage) {
+    data, ok := s.payloadObject(client, payload, "unsubscribe", &UnsubscribePayload{})
     if !ok {
-        s.sendErrorToClient(client, 400, "Invalid unsubscribe payload")
         return
     }
 
-    topic, ok := data["topic"].(string)
-    if !ok || topic == "" {
-        s.sendErrorToClient(client, 400, "Missing or invalid topic in unsubscribe request")
+    request, errs := validateUnsubscribe(data)
+    if len(errs) > 0 {
+        s.sendValidationErrorToClient(client, errs)
+        return
+    }
+
+    if request.SubscriptionID != "" {
+        s.Mutex.Lock()
+        subscription, found := s.removeSubscriptionLocked(client, request.SubscriptionID)
+        s.Mutex.Unlock()
+
+        if !found {
+            s.sendErrorMessage(client, CodeNotFound, "Unknown subscription_id: "+request.SubscriptionID, nil)
+            return
+        }
+        log.Printf("Client unsubscribed from topic: %s (%s)", subscription.Pattern, subscription.ID)
+        s.sendResponseToClient(client, ResponseMessage{
+            Type:    "unsubscribe_response",
+            Success: true,
+            Data:    map[string]string{"topic": subscription.Pattern, "subscription_id": subscription.ID},
+        })
+        return
+    }
+
+    topic, err := s.normalizeTopic(request.Topic)
+    if err != nil {
+        s.sendErrorMessage(client, CodeBadRequest, err.Error(), nil)
         return
     }
 
     s.Mutex.Lock()
-    delete(client.Topics, topic)
+    if subscription := client.subscriptionByPattern(topic); subscription != nil {
+        s.removeSubscriptionLocked(client, subscription.ID)
+    }
     s.Mutex.Unlock()
 
     log.Printf("Client unsubscribed from topic: %s", topic)
@@ -142,161 +682,395 @@ func (s *WebSocketServer) handleUnsubscribe(client *Client, payload interface{})
     s.sendResponseToClient(client, response)
 }
 
+// handleListSubscriptions returns the client's current topics, sorted.
+func (s *WebSocketServer) handleListSubscriptions(client *Client) {
+    s.Mutex.RLock()
+    topics := make([]string, 0, len(client.Subscriptions))
+    for _, subscription := range client.Subscriptions {
+        topics = append(topics, subscription.Pattern)
+    }
+    s.Mutex.RUnlock()
+    sort.Strings(topics)
+
+    response := ResponseMessage{
+        Type:    "subscriptions_response",
+        Success: true,
+        Data:    map[string]interface{}{"subscriptions": topics},
+    }
+    s.sendResponseToClient(client, response)
+}
+
 // handleAgentControl processes agent control commands from a client.
-func (s *WebSocketServer) handleAgentControl(client *Client, payload interface{}) {
-    data, ok := payload.(map[string]interface{})
+func (s *WebSocketServer) handleAgentControl(client *Client, payload json.RawMessage) {
+    data, ok := s.payloadObject(client, payload, "agent control", &AgentControlPayload{})
     if !ok {
-        s.sendErrorToClient(client, 400, "Invalid agent control payload")
         return
     }
 
-    agentID, ok := data["agent_id"].(string)
-    if !ok || agentID == "" {
-        s.sendErrorToClient(client, 400, "Missing or invalid agent_id in control request")
+    request, errs := validateAgentControl(data)
+    if len(errs) > 0 {
+        s.sendValidationErrorToClient(client, errs)
         return
     }
 
-    command, ok := data["command"].(string)
-    if !ok || command == "" {
-        s.sendErrorToClient(client, 400, "Missing or invalid command in control request")
+    if errs := s.validateCommandParams(request.Command, request.Params); len(errs) > 0 {
+        s.sendValidationErrorToClient(client, errs)
         return
     }
 
-    // Simulate processing the command (replace with actual logic for agent control)
-    log.Printf("Processing agent control command: %s for agent: %s", command, agentID)
-    success := true
-    errorMsg := ""
-    responseData := map[string]interface{}{
-        "agent_id": agentID,
-        "command":  command,
+    if _, ok := s.Controller.(AgentConfigurer); !ok && request.Mode == ConfigReplace {
+        s.sendErrorMessage(client, CodeBadRequest, "The agent controller cannot replace configurations", nil)
+        return
+    }
+    if _, ok := s.Controller.(AgentDryRunner); !ok && request.DryRun {
+        s.sendErrorMessage(client, CodeBadRequest, "The agent controller cannot dry-run commands", nil)
+        return
     }
 
-    switch command {
-    case "start":
-        // Placeholder: Start agent logic
-        log.Printf("Starting agent %s", agentID)
-        responseData["status"] = "started"
-    case "stop":
-        // Placeholder: Stop agent logic
-        log.Printf("Stopping agent %s", agentID)
-        responseData["status"] = "stopped"
-    case "update_config":
-        // Placeholder: Update agent configuration
-        params, _ := data["params"].(map[string]interface{})
-        log.Printf("Updating config for agent %s with params: %v", agentID, params)
-        responseData["status"] = "config_updated"
-    default:
-        success = false
-        errorMsg = "Unsupported command"
-        log.Printf("Unsupported command: %s for agent: %s", command, agentID)
+    allowed, err := s.canControl(client, request.AgentID, request.Command)
+    if err != nil {
+        s.sendInternalErrorToClient(client, CodeInternal, "Authorization check failed", err)
+        return
+    }
+    if !allowed {
+        s.logCommand(client.Principal, s.Clock.Now(), request, "forbidden", nil)
+        s.sendErrorMessage(client, CodeForbidden, fmt.Sprintf("Not authorized to %s agent %s", request.Command, request.AgentID), nil)
+        return
     }
 
-    if success {
-        // Broadcast an agent status update (optional, based on your use case)
-        s.SendAgentStatusUpdate(agentID, responseData["status"].(string), "Command processed")
-        response := ResponseMessage{
-            Type:    "agent_control_response",
-            Success: true,
-            Data:    responseData,
+    if request.ExecuteAt != nil {
+        now := s.Clock.Now()
+        if !request.ExecuteAt.After(now) {
+            s.sendValidationErrorToClient(client, FieldErrors{"execute_at": "execute_at must be in the future"})
+            return
         }
-        s.sendResponseToClient(client, response)
-    } else {
-        s.sendErrorToClient(client, 400, errorMsg)
+        if s.MaxScheduleHorizon > 0 && request.ExecuteAt.After(now.Add(s.MaxScheduleHorizon)) {
+            s.sendValidationErrorToClient(client, FieldErrors{"execute_at": fmt.Sprintf("execute_at must be within %v", s.MaxScheduleHorizon)})
+            return
+        }
+        s.scheduleAgentCommand(client, request)
+        return
+    }
+    s.queueAgentCommand(client, request)
+}
+
+// queueAgentCommand queues an authorized command on its agent's queue. Commands for one agent
+// run in the order queued; the client is acked with the command's position.
+func (s *WebSocketServer) queueAgentCommand(client *Client, request AgentControlPayload) {
+    queued := s.enqueueAgentCommand(client, request, func(position uint64) {
+        s.sendResponseToClient(client, ResponseMessage{
+            Type:    "agent_control_ack",
+            Success: true,
+            Data: map[string]interface{}{
+                "agent_id": request.AgentID,
+                "command":  request.Command,
+                "position": position,
+            },
+        })
+    })
+    if !queued {
+        s.logCommand(client.Principal, s.Clock.Now(), request, "queue_full", nil)
+        s.sendErrorMessage(client, CodeTooManyRequests, "Command queue full for agent "+request.AgentID, nil)
     }
 }
 
 // handleTransactionQuery processes transaction query requests from a client.
-func (s *WebSocketServer) handleTransactionQuery(client *Client, payload interface{}) {
-    data, ok := payload.(map[string]interface{})
+func (s *WebSocketServer) handleTransactionQuery(client *Client, payload json.RawMessage) {
+    data, ok := s.payloadObject(client, payload, "transaction query", &TransactionQueryPayload{})
     if !ok {
-        s.sendErrorToClient(client, 400, "Invalid transaction query payload")
         return
     }
 
-    txID, _ := data["tx_id"].(string)
-    agentID, _ := data["agent_id"].(string)
-    blockchain, _ := data["blockchain"].(string)
-    limitFloat, _ := data["limit"].(float64)
-    limit := int(limitFloat)
-    if limit <= 0 {
-        limit = 10 // Default limit if not specified or invalid
+    query, errs := s.validateTransactionQuery(data)
+    if _, badLimit := errs["limit"]; badLimit {
+        // A limit that is out of range, NaN or infinite is a bad request, not just a bad value
+        s.sendErrorResponse(client, &ErrorResponse{Code: int(CodeBadRequest), Message: CodeBadRequest.Message(), Fields: errs})
+        return
+    }
+    if len(errs) > 0 {
+        s.sendValidationErrorToClient(client, errs)
+        return
+    }
+    if query.FromBlock != nil && query.ToBlock != nil && *query.FromBlock > *query.ToBlock {
+        s.sendErrorMessage(client, CodeBadRequest, "from_block must not exceed to_block", nil)
+        return
     }
 
-    // Validate input
-    if txID == "" && agentID == "" {
-        s.sendErrorToClient(client, 400, "Must provide tx_id or agent_id for transaction query")
+    // Queries run off the read loop; cap how many a single client may have in flight
+    if !client.acquireQuerySlot() {
+        s.sendErrorMessage(client, CodeTooManyRequests, "Too many concurrent transaction queries", nil)
         return
     }
 
-    // Simulate fetching transaction data (replace with actual blockchain query logic)
-    log.Printf("Querying transactions for tx_id: %s, agent_id: %s, blockchain: %s, limit: %d", txID, agentID, blockchain, limit)
-    mockTransactions := []TransactionPayload{}
-    if txID != "" {
-        mockTransactions = append(mockTransactions, TransactionPayload{
-            TxID:        txID,
-            Status:      "confirmed",
-            Timestamp:   time.Now().Add(-10 * time.Minute),
-            Amount:      "0.5 SOL",
-            Blockchain:  "Solana",
-            FromAddress: "addr1",
-            ToAddress:   "addr2",
-        })
-    } else if agentID != "" {
-        for i := 0; i < limit && i < 3; i++ {
-            mockTransactions = append(mockTransactions, TransactionPayload{
-                TxID:        "tx-" + agentID + "-" + string(rune(i)),
-                Status:      "confirmed",
-                Timestamp:   time.Now().Add(time.Duration(-i-1) * time.Hour),
-                Amount:      "0.1 SOL",
-                Blockchain:  "Solana",
-                FromAddress: "addr1",
-                ToAddress:   "addr2",
-            })
+    s.goClient(func() {
+        defer client.releaseQuerySlot()
+
+        log.Printf("Querying transactions for tx_id: %s, agent_id: %s, address: %s (%s), blockchain: %v, limit: %d", query.TxID, query.AgentID, query.Address, query.Direction, query.Blockchain, query.Limit)
+        ctx := context.Background()
+        if s.QueryTimeout > 0 {
+            var cancel context.CancelFunc
+            ctx, cancel = context.WithTimeout(ctx, s.QueryTimeout)
+            defer cancel()
+        }
+        fields, fieldWarnings := transactionFields(query.Fields)
+        if len(query.TxIDs) > 0 {
+            s.answerTransactionBatch(ctx, client, query, fields, fieldWarnings)
+            return
+        }
+        transactions, warnings, stale, err := s.queryThroughCache(ctx, query)
+        if err != nil {
+            log.Printf("Transaction store query failed: %v", err)
+            switch {
+            case errors.Is(err, ErrTransactionNotFound):
+                s.sendErrorMessage(client, CodeNotFound, "Transaction not found", nil)
+            case errors.Is(err, ErrInvalidQuery):
+                s.sendErrorMessage(client, CodeBadRequest, err.Error(), nil)
+            default:
+                s.sendInternalErrorToClient(client, CodeUnavailable, "Transaction store unavailable", err)
+            }
+            return
+        }
+
+        if query.IfModifiedSince != nil && !anyNewer(transactions, *query.IfModifiedSince) {
+            s.sendResponseToClient(client, ResponseMessage{Type: "transaction_query_not_modified", Success: true})
+            return
+        }
+
+        warnings = append(warnings, fieldWarnings...)
+        if query.Stream {
+            s.streamTransactions(client, transactions, fields, warnings, stale)
+            return
         }
+
+        data := map[string]interface{}{
+            "transactions": sparseTransactions(transactions, fields),
+            "count":        len(transactions),
+        }
+        if len(warnings) > 0 {
+            data["warnings"] = warnings
+        }
+        if stale {
+            data["stale"] = true
+        }
+        s.sendQueryResult(client, "transaction_query_response", data, query.Compress)
+        log.Printf("Sent transaction query response with %d transactions", len(transactions))
+    })
+}
+
+// answerTransactionBatch looks up the query's tx_ids and answers with the transactions found,
+// keyed by tx_id and reduced to fields unless it is nil, and the ids the store does not hold.
+func (s *WebSocketServer) answerTransactionBatch(ctx context.Context, client *Client, query TransactionQueryPayload, fields []string, warnings []string) {
+    ids := query.TxIDs
+    found, err := s.fetchTransactions(ctx, ids)
+    if err != nil {
+        s.sendInternalErrorToClient(client, CodeUnavailable, "Transaction store unavailable", err)
+        return
     }
+    notFound := []string{}
+    for _, id := range ids {
+        if _, ok := found[id]; !ok {
+            notFound = append(notFound, id)
+        }
+    }
+    data := map[string]interface{}{
+        "transactions": found,
+        "not_found":    notFound,
+        "count":        len(found),
+    }
+    if fields != nil {
+        sparse := make(map[string]interface{}, len(found))
+        for id, tx := range found {
+            sparse[id] = sparseTransaction(tx, fields)
+        }
+        data["transactions"] = sparse
+    }
+    if len(warnings) > 0 {
+        data["warnings"] = warnings
+    }
+    s.sendQueryResult(client, "transaction_batch_response", data, query.Compress)
+    log.Printf("Sent transaction batch response with %d of %d transactions", len(found), len(ids))
+}
 
-    response := ResponseMessage{
-        Type:    "transaction_query_response",
-        Success: true,
-        Data:    map[string]interface{}{
-            "transactions": mockTransactions,
-            "count":        len(mockTransactions),
-        },
+// sendQueryResult sends the result of a transaction query, with its data gzipped into a
+// CompressedData when the query asked for compression.
+func (s *WebSocketServer) sendQueryResult(client *Client, responseType string, data map[string]interface{}, compress bool) {
+    response := ResponseMessage{Type: responseType, Success: true, Data: data}
+    if compress {
+        compressed, err := compressData(data)
+        if err != nil {
+            s.sendInternalErrorToClient(client, CodeInternal, "Failed to compress response", err)
+            return
+        }
+        response.Data = compressed
     }
     s.sendResponseToClient(client, response)
-    log.Printf("Sent transaction query response with %d transactions", len(mockTransactions))
+}
+
+// payloadObject returns the fields of a JSON object payload, reporting a missing payload and a
+// malformed one to the client with distinct 400 errors. With StrictDecoding enabled the
+// payload is also decoded into typed, rejecting keys the payload type does not declare.
+func (s *WebSocketServer) payloadObject(client *Client, payload json.RawMessage, kind string, typed interface{}) (rawFields, bool) {
+    if len(payload) == 0 || bytes.Equal(payload, []byte("null")) {
+        s.sendErrorMessage(client, CodeBadRequest, "payload is required for "+kind+" request", nil)
+        return nil, false
+    }
+    var data rawFields
+    if err := json.Unmarshal(payload, &data); err != nil || data == nil {
+        s.sendErrorMessage(client, CodeBadRequest, "Invalid "+kind+" payload", nil)
+        return nil, false
+    }
+
+    if s.StrictDecoding {
+        // Type mismatches are left to the validators, which report every bad field at once
+        if err := decodeStrict(payload, typed); err != nil && strings.HasPrefix(err.Error(), "json: unknown field") {
+            s.sendErrorMessage(client, CodeBadRequest, "Invalid "+kind+" payload: "+strings.TrimPrefix(err.Error(), "json: "), nil)
+            return nil, false
+        }
+    }
+    return data, true
+}
+
+// decodeStrict decodes data into v, failing on object keys v does not declare.
+func decodeStrict(data []byte, v interface{}) error {
+    decoder := json.NewDecoder(bytes.NewReader(data))
+    decoder.DisallowUnknownFields()
+    return decoder.Decode(v)
+}
+
+// anyNewer reports whether any transaction is timestamped after since.
+func anyNewer(transactions []TransactionPayload, since time.Time) bool {
+    for _, tx := range transactions {
+        if tx.Timestamp.After(since) {
+            return true
+        }
+    }
+    return false
+}
+
+// streamTransactions delivers query results as a series of transaction_chunk messages of at
+// most StreamChunkSize transactions, reduced to fields unless it is nil, followed by a
+// transaction_query_complete message, flagged stale for results served from the cache. All
+// messages share a query_id so clients can correlate concurrent streams.
+func (s *WebSocketServer) streamTransactions(client *Client, transactions []TransactionPayload, fields []string, warnings []string, stale bool) {
+    queryID := fmt.Sprintf("q-%d", s.querySeq.Add(1))
+    chunkSize := s.StreamChunkSize
+    if chunkSize <= 0 {
+        chunkSize = len(transactions)
+    }
+
+    chunks := 0
+    for start := 0; start < len(transactions); start += chunkSize {
+        end := start + chunkSize
+        if end > len(transactions) {
+            end = len(transactions)
+        }
+        s.sendResponseToClient(client, ResponseMessage{
+            Type:    "transaction_chunk",
+            Success: true,
+            Data: map[string]interface{}{
+                "query_id":     queryID,
+                "sequence":     chunks,
+                "transactions": sparseTransactions(transactions[start:end], fields),
+            },
+        })
+        chunks++
+    }
+
+    data := map[string]interface{}{
+        "query_id": queryID,
+        "count":    len(transactions),
+        "chunks":   chunks,
+    }
+    if len(warnings) > 0 {
+        data["warnings"] = warnings
+    }
+    if stale {
+        data["stale"] = true
+    }
+    s.sendResponseToClient(client, ResponseMessage{
+        Type:    "transaction_query_complete",
+        Success: true,
+        Data:    data,
+    })
+    log.Printf("Streamed %d transactions in %d chunks for query %s", len(transactions), chunks, queryID)
 }
 
 // sendResponseToClient sends a success response to the client.
 func (s *WebSocketServer) sendResponseToClient(client *Client, response ResponseMessage) {
+    response.V = ResponseVersion
     jsonData, err := json.Marshal(response)
     if err != nil {
         log.Printf("Failed to marshal response: %v", err)
         return
     }
 
-    if err := client.Conn.WriteMessage(websocket.TextMessage, jsonData); err != nil {
-        log.Printf("Failed to send response to client: %v", err)
-    }
+    s.queueToClient(client, jsonData)
 }
 
-// sendErrorToClient sends an error response to the client.
-func (s *WebSocketServer) sendErrorToClient(client *Client, code int, message string) {
-    response := ResponseMessage{
-        Type:    "error",
-        Success: false,
-        Error: &ErrorResponse{
-            Code:    code,
-            Message: message,
-        },
-    }
+// sendPriorityResponseToClient sends an error or control response ahead of queued data.
+func (s *WebSocketServer) sendPriorityResponseToClient(client *Client, response ResponseMessage) {
+    response.V = ResponseVersion
     jsonData, err := json.Marshal(response)
     if err != nil {
-        log.Printf("Failed to marshal error response: %v", err)
+        log.Printf("Failed to marshal response: %v", err)
         return
     }
 
-    if err := client.Conn.WriteMessage(websocket.TextMessage, jsonData); err != nil {
-        log.Printf("Failed to send error response to client: %v", err)
+    s.queuePriorityToClient(client, jsonData)
+}
+
+// sendInternalErrorToClient sends a 5xx error response for an internal failure. The detail of
+// err is logged under a correlation ID that the response carries in its details; it reaches
+// the client only when Verbose is set.
+func (s *WebSocketServer) sendInternalErrorToClient(client *Client, code ErrorCode, message string, err error) {
+    correlationID := fmt.Sprintf("err-%d", s.errorSeq.Add(1))
+    log.Printf("%s [%s]: %v", message, correlationID, err)
+    if s.Verbose {
+        message += ": " + err.Error()
+    }
+    s.sendErrorMessage(client, code, message, map[string]interface{}{"correlation_id": correlationID})
+}
+
+// sendValidationErrorToClient sends a 422 error listing every invalid payload field.
+func (s *WebSocketServer) sendValidationErrorToClient(client *Client, fields FieldErrors) {
+    s.sendErrorResponse(client, &ErrorResponse{
+        Code:    int(CodeValidationFailed),
+        Message: CodeValidationFailed.Message(),
+        Fields:  fields,
+    })
+}
+
+// queueToClient hands a serialized frame to the client's writePump, split into frame_chunk
+// messages if it exceeds MaxFrameBytes. Writes are funneled through the send channel
+// because the underlying connection supports a single writer.
+func (s *WebSocketServer) queueToClient(client *Client, jsonData []byte) {
+    s.queueFrames(client, jsonData, s.enqueue)
+}
+
+// queuePriorityToClient queues an error or control response on the client's priority lane,
+// ahead of any data already waiting to be written.
+func (s *WebSocketServer) queuePriorityToClient(client *Client, jsonData []byte) {
+    s.queueFrames(client, jsonData, s.enqueuePriority)
+}
+
+// queueFrames splits a response into frames and places them with enqueue, disconnecting the
+// client if its queue is full.
+func (s *WebSocketServer) queueFrames(client *Client, jsonData []byte, enqueue func(*Client, []byte) bool) {
+    s.Mutex.RLock()
+    if _, ok := s.Clients[client]; !ok {
+        s.Mutex.RUnlock()
+        log.Printf("Dropping response for unregistered client")
+        return
+    }
+    queued := true
+    for _, frame := range s.splitFrame(jsonData) {
+        if queued = enqueue(client, frame); !queued {
+            break
+        }
+    }
+    s.Mutex.RUnlock()
+
+    if !queued {
+        s.disconnectSlowClient(client)
     }
 }
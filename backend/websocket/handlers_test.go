@@ -0,0 +1,1790 @@
+package main
+
+import (
+    "bytes"
+    "compress/gzip"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+)
+
+// newRegisteredClient returns a test client registered with s.
+func newRegisteredClient(s *WebSocketServer) *Client {
+    client := newTestClient()
+    s.RegisterClient(client)
+    return client
+}
+
+// readResponse decodes the next frame queued for client.
+func readResponse(t *testing.T, client *Client) ResponseMessage {
+    t.Helper()
+    select {
+    case frame := <-client.Send:
+        var response ResponseMessage
+        require.NoError(t, json.Unmarshal(frame.Data, &response))
+        return response
+    case <-time.After(2 * time.Second):
+        t.Fatal("timed out waiting for response")
+        return ResponseMessage{}
+    }
+}
+
+func TestValidationReportsAllInvalidFields(t *testing.T) {
+    s := NewWebSocketServer()
+    client := newRegisteredClient(s)
+
+    s.HandleClientMessage(client, []byte(`{"type":"transaction_query","payload":{"agent_id":"agent-1","direction":"sideways","blockchain":"Dogechain"}}`))
+    response := readResponse(t, client)
+    require.NotNil(t, response.Error)
+    assert.Equal(t, 422, response.Error.Code)
+    assert.Len(t, response.Error.Fields, 2)
+    assert.Contains(t, response.Error.Fields, "direction")
+    assert.Contains(t, response.Error.Fields, "blockchain")
+
+    s.HandleClientMessage(client, []byte(`{"type":"agent_control","payload":{"command":"explode","params":"fast"}}`))
+    response = readResponse(t, client)
+    require.NotNil(t, response.Error)
+    assert.Equal(t, 422, response.Error.Code)
+    assert.Equal(t, FieldErrors{
+        "agent_id": "agent_id is required and must be a non-empty string",
+        "command":  "unsupported command: explode",
+        "params":   "params must be an object",
+    }, response.Error.Fields)
+
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":42}}`))
+    response = readResponse(t, client)
+    require.NotNil(t, response.Error)
+    assert.Equal(t, 422, response.Error.Code)
+    assert.Contains(t, response.Error.Fields, "topic")
+}
+
+func TestPingEchoesClientTimestamp(t *testing.T) {
+    s := NewWebSocketServer()
+    client := newRegisteredClient(s)
+    sent := time.Now().UnixMilli()
+
+    s.HandleClientMessage(client, []byte(`{"type":"ping","payload":{"client_timestamp":`+strconv.FormatInt(sent, 10)+`}}`))
+
+    response := readResponse(t, client)
+    assert.Equal(t, "pong_response", response.Type)
+    assert.True(t, response.Success)
+    data := response.Data.(map[string]interface{})
+    assert.Equal(t, float64(sent), data["client_timestamp"])
+    assert.NotEmpty(t, data["server_time"])
+}
+
+func TestResponsesCarrySchemaVersion(t *testing.T) {
+    s := NewWebSocketServer()
+    go s.Start()
+    client := newRegisteredClient(s)
+
+    // Compressed query results are versioned outside the gzipped data
+    for _, message := range []string{
+        `{"type":"server_time"}`,
+        `{"type":"no_such_type"}`,
+        `{"type":"transaction_query","payload":{"agent_id":"agent-1","limit":5,"compress":true}}`,
+    } {
+        s.HandleClientMessage(client, []byte(message))
+        var raw map[string]interface{}
+        require.NoError(t, json.Unmarshal((<-client.Send).Data, &raw))
+        assert.Equal(t, float64(1), raw["v"], message)
+    }
+
+    // As are signed responses, whose signature covers only the data
+    key := []byte("secret")
+    s.SigningKeys = testSigningKeys{"trader": key}
+    signer := newTestClient()
+    signer.Principal = "trader"
+    s.RegisterClient(signer)
+    payload := `{"agent_id":"agent-1","command":"start"}`
+    s.HandleClientMessage(signer, []byte(`{"type":"agent_control","payload":`+payload+`,"signature":"`+messageSignature(key, "agent_control", []byte(payload))+`"}`))
+    raw := readMessage(t, signer)
+    for raw["type"] != "agent_control_response" {
+        raw = readMessage(t, signer)
+    }
+    assert.NotEmpty(t, raw["signature"])
+    assert.Equal(t, float64(1), raw["v"])
+}
+
+func TestServerTimeReportsClock(t *testing.T) {
+    s := NewWebSocketServer()
+    now := time.Date(2024, 3, 1, 14, 30, 0, 0, time.FixedZone("CET", 3600))
+    s.Clock = &fakeClock{now: now}
+    client := newRegisteredClient(s)
+
+    s.HandleClientMessage(client, []byte(`{"type":"server_time"}`))
+
+    response := readResponse(t, client)
+    assert.Equal(t, "server_time_response", response.Type)
+    data := response.Data.(map[string]interface{})
+    serverTime, err := time.Parse(time.RFC3339Nano, data["server_time"].(string))
+    require.NoError(t, err)
+    assert.True(t, now.Equal(serverTime))
+    assert.Equal(t, float64(now.UnixMilli()), data["unix_millis"])
+    assert.Equal(t, "CET", data["timezone"])
+    assert.Equal(t, float64(3600), data["utc_offset_seconds"])
+}
+
+// storeFunc adapts a function to the TransactionStore interface.
+type storeFunc func(ctx context.Context, query TransactionQueryPayload) ([]TransactionPayload, error)
+
+func (f storeFunc) QueryTransactions(ctx context.Context, query TransactionQueryPayload) ([]TransactionPayload, error) {
+    return f(ctx, query)
+}
+
+func TestConcurrentTransactionQueriesAreCapped(t *testing.T) {
+    s := NewWebSocketServer()
+    s.MaxConcurrentQueries = 2
+    release := make(chan struct{})
+    started := make(chan struct{}, 8)
+    s.Store = storeFunc(func(ctx context.Context, query TransactionQueryPayload) ([]TransactionPayload, error) {
+        started <- struct{}{}
+        <-release
+        return []TransactionPayload{{TxID: query.TxID}}, nil
+    })
+    client := newRegisteredClient(s)
+
+    query := []byte(`{"type":"transaction_query","payload":{"tx_id":"tx-1"}}`)
+    for i := 0; i < 5; i++ {
+        s.HandleClientMessage(client, query)
+    }
+    <-started
+    <-started
+
+    for i := 0; i < 3; i++ {
+        response := readResponse(t, client)
+        require.NotNil(t, response.Error)
+        assert.Equal(t, 429, response.Error.Code)
+    }
+
+    close(release)
+    for i := 0; i < 2; i++ {
+        response := readResponse(t, client)
+        assert.Equal(t, "transaction_query_response", response.Type)
+    }
+
+    // Slots are free again once the slow queries complete
+    s.HandleClientMessage(client, query)
+    assert.Equal(t, "transaction_query_response", readResponse(t, client).Type)
+}
+
+func TestTransactionQueryAggregatesChains(t *testing.T) {
+    s := NewWebSocketServer()
+    s.SupportedBlockchains = append(s.SupportedBlockchains, "Polygon")
+    now := time.Now()
+    s.Store = storeFunc(func(ctx context.Context, query TransactionQueryPayload) ([]TransactionPayload, error) {
+        switch query.Blockchain[0] {
+        case "Solana":
+            return []TransactionPayload{
+                {TxID: "sol-old", Blockchain: "Solana", Timestamp: now.Add(-3 * time.Hour)},
+                {TxID: "sol-new", Blockchain: "Solana", Timestamp: now.Add(-1 * time.Hour)},
+            }, nil
+        case "Ethereum":
+            return []TransactionPayload{{TxID: "eth-mid", Blockchain: "Ethereum", Timestamp: now.Add(-2 * time.Hour)}}, nil
+        default:
+            return nil, errors.New("rpc timeout")
+        }
+    })
+    client := newRegisteredClient(s)
+
+    s.HandleClientMessage(client, []byte(`{"type":"transaction_query","payload":{"agent_id":"agent-1","blockchain":"Solana, Ethereum","limit":2}}`))
+    response := readResponse(t, client)
+    require.True(t, response.Success)
+    data := response.Data.(map[string]interface{})
+    txs := data["transactions"].([]interface{})
+    require.Len(t, txs, 2)
+    assert.Equal(t, "sol-new", txs[0].(map[string]interface{})["tx_id"])
+    assert.Equal(t, "eth-mid", txs[1].(map[string]interface{})["tx_id"])
+    assert.NotContains(t, data, "warnings")
+
+    s.HandleClientMessage(client, []byte(`{"type":"transaction_query","payload":{"agent_id":"agent-1","blockchain":["Solana","Polygon"]}}`))
+    response = readResponse(t, client)
+    require.True(t, response.Success)
+    data = response.Data.(map[string]interface{})
+    assert.Equal(t, float64(2), data["count"])
+    assert.Equal(t, []interface{}{"Polygon: transaction store unavailable"}, data["warnings"])
+}
+
+func TestMissingPayloadIsReported(t *testing.T) {
+    s := NewWebSocketServer()
+    client := newRegisteredClient(s)
+
+    for msgType, kind := range map[string]string{
+        "subscribe":         "subscribe",
+        "unsubscribe":       "unsubscribe",
+        "agent_control":     "agent control",
+        "transaction_query": "transaction query",
+        "ping":              "ping",
+    } {
+        s.HandleClientMessage(client, []byte(`{"type":"`+msgType+`"}`))
+        response := readResponse(t, client)
+        require.NotNil(t, response.Error, msgType)
+        assert.Equal(t, 400, response.Error.Code, msgType)
+        assert.Equal(t, "payload is required for "+kind+" request", response.Error.Message)
+    }
+
+    // A present but malformed payload keeps its own message
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":"agent-1"}`))
+    assert.Equal(t, "Invalid subscribe payload", readResponse(t, client).Error.Message)
+}
+
+func TestUnknownMessageTypeEchoesType(t *testing.T) {
+    s := NewWebSocketServer()
+    client := newRegisteredClient(s)
+
+    s.HandleClientMessage(client, []byte(`{"type":"subscirbe","payload":{"topic":"agent-1"}}`))
+
+    response := readResponse(t, client)
+    require.NotNil(t, response.Error)
+    assert.Equal(t, 400, response.Error.Code)
+    assert.Contains(t, response.Error.Message, "subscirbe")
+    assert.Equal(t, map[string]interface{}{"received_type": "subscirbe"}, response.Error.Details)
+}
+
+func TestListSubscriptions(t *testing.T) {
+    s := NewWebSocketServer()
+    client := newRegisteredClient(s)
+    for _, msg := range []string{
+        `{"type":"subscribe","payload":{"topic":"tx-9"}}`,
+        `{"type":"subscribe","payload":{"topic":"agent-2"}}`,
+        `{"type":"subscribe","payload":{"topic":"agent-1"}}`,
+        `{"type":"unsubscribe","payload":{"topic":"agent-2"}}`,
+    } {
+        s.HandleClientMessage(client, []byte(msg))
+        readResponse(t, client)
+    }
+
+    s.HandleClientMessage(client, []byte(`{"type":"list_subscriptions"}`))
+
+    response := readResponse(t, client)
+    assert.Equal(t, "subscriptions_response", response.Type)
+    assert.Equal(t, []interface{}{"agent-1", "tx-9"}, response.Data.(map[string]interface{})["subscriptions"])
+}
+
+func TestSubscribeNormalizesTopics(t *testing.T) {
+    s := NewWebSocketServer()
+    s.CaseInsensitiveTopics = true
+    go s.Start()
+    client := newRegisteredClient(s)
+
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"  Agent-1 "}}`))
+    response := readResponse(t, client)
+    assert.Equal(t, "agent-1", response.Data.(map[string]interface{})["topic"])
+    assert.NotNil(t, client.subscriptionByPattern("agent-1"))
+
+    // Broadcast IDs are normalized the same way before matching
+    s.SendAgentStatusUpdate("AGENT-1", "active", "")
+    assert.Equal(t, "agent_status", readMessage(t, client)["type"])
+
+    // A broadcast with no valid topic reaches no one, not even clients without subscriptions
+    other := newRegisteredClient(s)
+    s.SendAgentStatusUpdate("agent\u0007bell", "active", "")
+    s.SendAgentStatusUpdate("agent-1", "idle", "")
+    assert.Equal(t, "idle", readMessage(t, other)["payload"].(map[string]interface{})["status"])
+    readMessage(t, client)
+
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"agent\u0007bell"}}`))
+    response = readResponse(t, client)
+    require.NotNil(t, response.Error)
+    assert.Equal(t, 400, response.Error.Code)
+    assert.Equal(t, errTopicControlChars.Error(), response.Error.Message)
+    assert.Len(t, client.Subscriptions, 1)
+}
+
+func TestSubscribeKeepsCaseByDefault(t *testing.T) {
+    s := NewWebSocketServer()
+    client := newRegisteredClient(s)
+
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"\tAgent-1\n"}}`))
+    assert.Equal(t, "Agent-1", readResponse(t, client).Data.(map[string]interface{})["topic"])
+}
+
+// txIDs extracts the tx_id of every transaction in a transaction_query_response.
+func txIDs(t *testing.T, response ResponseMessage) []string {
+    t.Helper()
+    require.True(t, response.Success, "query failed: %+v", response.Error)
+    var ids []string
+    for _, tx := range response.Data.(map[string]interface{})["transactions"].([]interface{}) {
+        ids = append(ids, tx.(map[string]interface{})["tx_id"].(string))
+    }
+    return ids
+}
+
+func TestTransactionQueryByAddress(t *testing.T) {
+    s := NewWebSocketServer()
+    store := NewMemoryTransactionStore()
+    now := time.Now()
+    store.Add("agent-1", TransactionPayload{TxID: "tx-out", FromAddress: "wallet-a", ToAddress: "wallet-b", Blockchain: "Solana", Timestamp: now.Add(-time.Hour)})
+    store.Add("agent-1", TransactionPayload{TxID: "tx-in", FromAddress: "wallet-c", ToAddress: "wallet-a", Blockchain: "Solana", Timestamp: now})
+    store.Add("agent-2", TransactionPayload{TxID: "tx-other", FromAddress: "wallet-b", ToAddress: "wallet-c", Blockchain: "Solana", Timestamp: now})
+    store.Add("agent-2", TransactionPayload{TxID: "tx-agent2", FromAddress: "wallet-a", ToAddress: "wallet-d", Blockchain: "Solana", Timestamp: now.Add(-2 * time.Hour)})
+    s.Store = store
+    client := newRegisteredClient(s)
+
+    for _, tc := range []struct {
+        payload string
+        want    []string
+    }{
+        {`{"address":"wallet-a"}`, []string{"tx-in", "tx-out", "tx-agent2"}},
+        {`{"address":"wallet-a","direction":"from"}`, []string{"tx-out", "tx-agent2"}},
+        {`{"address":"wallet-a","direction":"to"}`, []string{"tx-in"}},
+        {`{"address":"wallet-a","agent_id":"agent-2"}`, []string{"tx-agent2"}},
+    } {
+        s.HandleClientMessage(client, []byte(`{"type":"transaction_query","payload":`+tc.payload+`}`))
+        assert.Equal(t, tc.want, txIDs(t, readResponse(t, client)), tc.payload)
+    }
+
+    s.HandleClientMessage(client, []byte(`{"type":"transaction_query","payload":{"address":"wallet-a","direction":"sideways"}}`))
+    response := readResponse(t, client)
+    require.NotNil(t, response.Error)
+    assert.Contains(t, response.Error.Fields, "direction")
+}
+
+func TestTransactionQueryLimitBounds(t *testing.T) {
+    s := NewWebSocketServer()
+    s.MaxTxLimit = 500
+    s.Store = NewMemoryTransactionStore()
+    client := newRegisteredClient(s)
+
+    for limit, want := range map[string]string{
+        `501`:                  "limit must be at most 500",
+        `9223372036854775807`:  "limit must be at most 500",
+        `1e300`:                "limit must be a positive integer",
+        `99999999999999999999`: "limit must be a positive integer",
+        `-1`:                   "limit must be a positive integer",
+        `"NaN"`:                "limit must be a positive integer",
+        `"Infinity"`:           "limit must be a positive integer",
+    } {
+        s.HandleClientMessage(client, []byte(`{"type":"transaction_query","payload":{"agent_id":"agent-1","limit":`+limit+`}}`))
+        response := readResponse(t, client)
+        require.NotNil(t, response.Error, limit)
+        assert.Equal(t, 400, response.Error.Code, limit)
+        assert.Equal(t, FieldErrors{"limit": want}, response.Error.Fields, limit)
+    }
+
+    // A bare NaN is not JSON, so the whole message is refused
+    s.HandleClientMessage(client, []byte(`{"type":"transaction_query","payload":{"agent_id":"agent-1","limit":NaN}}`))
+    response := readResponse(t, client)
+    require.NotNil(t, response.Error)
+    assert.Equal(t, 400, response.Error.Code)
+
+    s.HandleClientMessage(client, []byte(`{"type":"transaction_query","payload":{"agent_id":"agent-1","limit":500}}`))
+    assert.True(t, readResponse(t, client).Success)
+}
+
+func TestTransactionQueryByBlockRange(t *testing.T) {
+    s := NewWebSocketServer()
+    store := NewMemoryTransactionStore()
+    now := time.Now()
+    for i, height := range []uint64{100, 101, 102, 103} {
+        txID := fmt.Sprintf("tx-%d", height)
+        store.Add("agent-1", TransactionPayload{TxID: txID, Blockchain: "Solana", BlockHeight: height, Timestamp: now.Add(time.Duration(i) * time.Minute)})
+    }
+    store.Add("agent-1", TransactionPayload{TxID: "tx-eth", Blockchain: "Ethereum", BlockHeight: 101, Timestamp: now})
+    s.Store = store
+    client := newRegisteredClient(s)
+
+    for _, tc := range []struct {
+        payload string
+        want    []string
+    }{
+        {`{"agent_id":"agent-1","blockchain":"Solana","from_block":101,"to_block":102}`, []string{"tx-102", "tx-101"}},
+        {`{"agent_id":"agent-1","blockchain":"Solana","from_block":102}`, []string{"tx-103", "tx-102"}},
+        {`{"agent_id":"agent-1","blockchain":"Solana","to_block":100}`, []string{"tx-100"}},
+        {`{"agent_id":"agent-1","blockchain":"Ethereum","from_block":101,"to_block":101}`, []string{"tx-eth"}},
+    } {
+        s.HandleClientMessage(client, []byte(`{"type":"transaction_query","payload":`+tc.payload+`}`))
+        assert.Equal(t, tc.want, txIDs(t, readResponse(t, client)), tc.payload)
+    }
+
+    s.HandleClientMessage(client, []byte(`{"type":"transaction_query","payload":{"agent_id":"agent-1","blockchain":"Solana","from_block":103,"to_block":101}}`))
+    response := readResponse(t, client)
+    require.NotNil(t, response.Error)
+    assert.Equal(t, 400, response.Error.Code)
+
+    // Heights are per chain, so a range needs exactly one
+    s.HandleClientMessage(client, []byte(`{"type":"transaction_query","payload":{"agent_id":"agent-1","from_block":101}}`))
+    response = readResponse(t, client)
+    require.NotNil(t, response.Error)
+    assert.Equal(t, "from_block requires a single blockchain", response.Error.Fields["from_block"])
+}
+
+func TestUnsubscribeBySubscriptionID(t *testing.T) {
+    s := NewWebSocketServer()
+    go s.Start()
+    client := newRegisteredClient(s)
+
+    ids := map[string]string{}
+    for _, topic := range []string{"agent.1", "agent.*", "*.1"} {
+        s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"`+topic+`"}}`))
+        data := readResponse(t, client).Data.(map[string]interface{})
+        require.NotEmpty(t, data["subscription_id"])
+        ids[topic] = data["subscription_id"].(string)
+    }
+    assert.Len(t, client.Subscriptions, 3)
+
+    // Subscribing to the same pattern again returns the existing subscription
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"agent.*"}}`))
+    assert.Equal(t, ids["agent.*"], readResponse(t, client).Data.(map[string]interface{})["subscription_id"])
+
+    s.HandleClientMessage(client, []byte(`{"type":"unsubscribe","payload":{"subscription_id":"`+ids["agent.1"]+`"}}`))
+    response := readResponse(t, client)
+    assert.Equal(t, "agent.1", response.Data.(map[string]interface{})["topic"])
+    assert.NotContains(t, client.Subscriptions, ids["agent.1"])
+    assert.Contains(t, client.Subscriptions, ids["agent.*"])
+    assert.Contains(t, client.Subscriptions, ids["*.1"])
+
+    // The overlapping wildcards still deliver agent.1 updates
+    s.SendAgentStatusUpdate("agent.1", "active", "")
+    assert.Equal(t, "agent_status", readMessage(t, client)["type"])
+
+    // Topic-based unsubscribe keeps working
+    s.HandleClientMessage(client, []byte(`{"type":"unsubscribe","payload":{"topic":"agent.*"}}`))
+    readResponse(t, client)
+    assert.Len(t, client.Subscriptions, 1)
+
+    s.HandleClientMessage(client, []byte(`{"type":"unsubscribe","payload":{"subscription_id":"sub-missing"}}`))
+    assert.Equal(t, 404, readResponse(t, client).Error.Code)
+}
+
+func TestTopicMatches(t *testing.T) {
+    assert.True(t, topicMatches("agent.1", "agent.1"))
+    assert.False(t, topicMatches("agent.1", "agent.10"))
+    assert.True(t, topicMatches("agent.*", "agent.10"))
+    assert.True(t, topicMatches("*", "anything"))
+    assert.True(t, topicMatches("*.eth.*", "tx.eth.42"))
+    assert.False(t, topicMatches("a*a", "a"))
+    assert.False(t, topicMatches("agent.*", "tx.1"))
+}
+
+func TestStrictDecodingRejectsUnknownFields(t *testing.T) {
+    s := NewWebSocketServer()
+    client := newRegisteredClient(s)
+    subscribe := []byte(`{"type":"subscribe","payload":{"topic":"agent-1","topc":"agent-2"}}`)
+
+    // Lenient by default
+    s.HandleClientMessage(client, subscribe)
+    assert.True(t, readResponse(t, client).Success)
+
+    s.StrictDecoding = true
+    s.HandleClientMessage(client, subscribe)
+    response := readResponse(t, client)
+    require.NotNil(t, response.Error)
+    assert.Equal(t, 400, response.Error.Code)
+    assert.Contains(t, response.Error.Message, `unknown field "topc"`)
+
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"agent-1"},"extra":true}`))
+    response = readResponse(t, client)
+    require.NotNil(t, response.Error)
+    assert.Contains(t, response.Error.Message, `unknown field "extra"`)
+
+    // Well-formed payloads, including the string form of blockchain, still pass
+    s.HandleClientMessage(client, []byte(`{"type":"transaction_query","payload":{"agent_id":"agent-1","blockchain":"Solana,Ethereum","limit":2}}`))
+    assert.Equal(t, "transaction_query_response", readResponse(t, client).Type)
+}
+
+func TestStreamedTransactionQuery(t *testing.T) {
+    s := NewWebSocketServer()
+    s.StreamChunkSize = 2
+    store := NewMemoryTransactionStore()
+    now := time.Now()
+    for i := 0; i < 5; i++ {
+        store.Add("agent-1", TransactionPayload{TxID: fmt.Sprintf("tx-%d", i), Timestamp: now.Add(-time.Duration(i) * time.Minute)})
+    }
+    s.Store = store
+    client := newRegisteredClient(s)
+
+    s.HandleClientMessage(client, []byte(`{"type":"transaction_query","payload":{"agent_id":"agent-1","limit":50,"stream":true}}`))
+
+    var queryID string
+    var received []string
+    for sequence := 0; sequence < 3; sequence++ {
+        response := readResponse(t, client)
+        require.Equal(t, "transaction_chunk", response.Type)
+        data := response.Data.(map[string]interface{})
+        if queryID == "" {
+            queryID = data["query_id"].(string)
+        }
+        assert.Equal(t, queryID, data["query_id"])
+        assert.Equal(t, float64(sequence), data["sequence"])
+        chunk := data["transactions"].([]interface{})
+        assert.LessOrEqual(t, len(chunk), 2)
+        for _, tx := range chunk {
+            received = append(received, tx.(map[string]interface{})["tx_id"].(string))
+        }
+    }
+    assert.Equal(t, []string{"tx-0", "tx-1", "tx-2", "tx-3", "tx-4"}, received)
+
+    complete := readResponse(t, client)
+    assert.Equal(t, "transaction_query_complete", complete.Type)
+    data := complete.Data.(map[string]interface{})
+    assert.Equal(t, queryID, data["query_id"])
+    assert.Equal(t, float64(5), data["count"])
+    assert.Equal(t, float64(3), data["chunks"])
+}
+
+func TestSubscriptionAutoUnsubscribesAfterMaxMessages(t *testing.T) {
+    s := NewWebSocketServer()
+    go s.Start()
+    client := newRegisteredClient(s)
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"agent-1","max_messages":2}}`))
+    subscriptionID := readResponse(t, client).Data.(map[string]interface{})["subscription_id"]
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"agent-2"}}`))
+    readResponse(t, client)
+
+    s.SendAgentStatusUpdate("agent-1", "starting", "")
+    s.SendAgentStatusUpdate("agent-1", "active", "")
+    s.SendAgentStatusUpdate("agent-1", "stopped", "")
+    s.SendAgentStatusUpdate("agent-2", "active", "")
+
+    assert.Equal(t, "starting", readMessage(t, client)["payload"].(map[string]interface{})["status"])
+    assert.Equal(t, "active", readMessage(t, client)["payload"].(map[string]interface{})["status"])
+    notice := readMessage(t, client)
+    assert.Equal(t, "auto_unsubscribed", notice["type"])
+    assert.Equal(t, subscriptionID, notice["payload"].(map[string]interface{})["subscription_id"])
+
+    // The third agent-1 update is not delivered; the agent-2 subscription is unaffected
+    next := readMessage(t, client)["payload"].(map[string]interface{})
+    assert.Equal(t, "agent-2", next["agent_id"])
+    assert.Len(t, client.Subscriptions, 1)
+}
+
+func TestSubscriptionFilter(t *testing.T) {
+    s := NewWebSocketServer()
+    go s.Start()
+    client := newRegisteredClient(s)
+
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"tx-*","filter":"amount >"}}`))
+    response := readResponse(t, client)
+    require.NotNil(t, response.Error)
+    assert.Equal(t, 400, response.Error.Code)
+    assert.Contains(t, response.Error.Message, "Invalid filter")
+    assert.Empty(t, client.Subscriptions)
+
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"tx-*","filter":"amount > 1.0 && status == \"confirmed\""}}`))
+    require.True(t, readResponse(t, client).Success)
+
+    s.SendTransactionUpdate("tx-1", "confirmed", "0.5 SOL", "Solana", "a", "b")
+    s.SendTransactionUpdate("tx-2", "pending", "5 SOL", "Solana", "a", "b")
+    s.SendTransactionUpdate("tx-3", "confirmed", "2.0 SOL", "Solana", "a", "b")
+
+    assert.Equal(t, "tx-3", readMessage(t, client)["payload"].(map[string]interface{})["tx_id"])
+    assert.Empty(t, client.Send)
+}
+
+func TestRegisterHandlerDispatchesCustomType(t *testing.T) {
+    s := NewWebSocketServer()
+    client := newRegisteredClient(s)
+
+    require.NoError(t, s.RegisterHandler("echo", func(client *Client, payload json.RawMessage) {
+        var data map[string]interface{}
+        require.NoError(t, json.Unmarshal(payload, &data))
+        s.sendResponseToClient(client, ResponseMessage{Type: "echo_response", Success: true, Data: data})
+    }))
+    s.HandleClientMessage(client, []byte(`{"type":"echo","payload":{"text":"hello"}}`))
+    response := readResponse(t, client)
+    assert.Equal(t, "echo_response", response.Type)
+    assert.Equal(t, map[string]interface{}{"text": "hello"}, response.Data)
+
+    // Built-in types are protected unless overriding is allowed
+    ping := func(client *Client, payload json.RawMessage) {
+        s.sendResponseToClient(client, ResponseMessage{Type: "custom_pong", Success: true})
+    }
+    assert.ErrorIs(t, s.RegisterHandler(PingRequest, ping), ErrBuiltinMessageType)
+    s.AllowHandlerOverride = true
+    require.NoError(t, s.RegisterHandler(PingRequest, ping))
+    s.HandleClientMessage(client, []byte(`{"type":"ping"}`))
+    assert.Equal(t, "custom_pong", readResponse(t, client).Type)
+}
+
+func TestHandlersDecodeTypedPayloads(t *testing.T) {
+    s := NewWebSocketServer()
+    queries := make(chan TransactionQueryPayload, 1)
+    s.Store = storeFunc(func(ctx context.Context, query TransactionQueryPayload) ([]TransactionPayload, error) {
+        queries <- query
+        return []TransactionPayload{}, nil
+    })
+    client := newRegisteredClient(s)
+
+    s.HandleClientMessage(client, []byte(`{"type":"transaction_query","payload":{"address":"addr1","direction":"to","blockchain":[" Solana "],"limit":25,"stream":false}}`))
+    query := <-queries
+    assert.Equal(t, 25, query.Limit)
+    assert.Equal(t, DirectionTo, query.Direction)
+    assert.Equal(t, BlockchainList{"Solana"}, query.Blockchain)
+    readResponse(t, client)
+
+    s.HandleClientMessage(client, []byte(`{"type":"transaction_query","payload":{"agent_id":"agent-1","limit":2.5}}`))
+    response := readResponse(t, client)
+    require.NotNil(t, response.Error)
+    assert.Equal(t, FieldErrors{"limit": "limit must be a positive integer"}, response.Error.Fields)
+
+    // Timestamps beyond float64 precision are echoed exactly
+    s.HandleClientMessage(client, []byte(`{"type":"ping","payload":{"client_timestamp":9007199254740993}}`))
+    assert.Contains(t, string((<-client.Send).Data), `"client_timestamp":9007199254740993`)
+
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"agent-1","max_messages":3,"filter":"amount > 1"}}`))
+    require.True(t, readResponse(t, client).Success)
+    subscription := client.subscriptionByPattern("agent-1")
+    require.NotNil(t, subscription)
+    assert.Equal(t, 3, subscription.MaxMessages)
+    assert.Equal(t, "amount > 1", subscription.Filter)
+
+    s.HandleClientMessage(client, []byte(`{"type":"unsubscribe","payload":{"subscription_id":"`+subscription.ID+`"}}`))
+    assert.True(t, readResponse(t, client).Success)
+
+    s.HandleClientMessage(client, []byte(`{"type":"agent_control","payload":{"agent_id":"agent-1","command":"start","params":"fast"}}`))
+    response = readResponse(t, client)
+    require.NotNil(t, response.Error)
+    assert.Equal(t, FieldErrors{"params": "params must be an object"}, response.Error.Fields)
+}
+
+func TestTransactionQueryRetriesTransientStoreErrors(t *testing.T) {
+    s := NewWebSocketServer()
+    s.StoreRetryDelay = time.Millisecond
+    var calls atomic.Int32
+    s.Store = storeFunc(func(ctx context.Context, query TransactionQueryPayload) ([]TransactionPayload, error) {
+        switch {
+        case query.TxID == "missing":
+            calls.Add(1)
+            return nil, ErrTransactionNotFound
+        case calls.Add(1) <= 2:
+            return nil, errors.New("connection reset")
+        }
+        return []TransactionPayload{{TxID: query.TxID}}, nil
+    })
+    client := newRegisteredClient(s)
+
+    s.HandleClientMessage(client, []byte(`{"type":"transaction_query","payload":{"tx_id":"tx-1"}}`))
+    response := readResponse(t, client)
+    assert.Equal(t, "transaction_query_response", response.Type)
+    assert.Equal(t, []string{"tx-1"}, txIDs(t, response))
+    assert.Equal(t, int32(3), calls.Load())
+    assert.Empty(t, client.Send, "expected a single response")
+
+    // Permanent failures are reported without retrying
+    calls.Store(0)
+    s.HandleClientMessage(client, []byte(`{"type":"transaction_query","payload":{"tx_id":"missing"}}`))
+    response = readResponse(t, client)
+    require.NotNil(t, response.Error)
+    assert.Equal(t, 404, response.Error.Code)
+    assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestBatchSubscribeReportsPerTopicStatus(t *testing.T) {
+    s := NewWebSocketServer()
+    s.MaxSubscriptionsPerClient = 3
+    s.Authorizer = testAuthorizer{}
+    client := newRegisteredClient(s)
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"agent-1"}}`))
+    require.True(t, readResponse(t, client).Success)
+
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topics":["agent-1","agent-2","secret-3","agent-2"," ","agent-4","agent-5"]}}`))
+    response := readResponse(t, client)
+    require.True(t, response.Success)
+    var statuses []string
+    for _, result := range response.Data.(map[string]interface{})["results"].([]interface{}) {
+        statuses = append(statuses, result.(map[string]interface{})["status"].(string))
+    }
+    assert.Equal(t, []string{"already", "subscribed", "denied", "already", "invalid", "subscribed", "limit_exceeded"}, statuses)
+    assert.Len(t, client.Subscriptions, 3)
+
+    // The single-topic form reports refusals as errors
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"secret-3"}}`))
+    assert.Equal(t, 403, readResponse(t, client).Error.Code)
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"agent-6"}}`))
+    assert.Equal(t, 429, readResponse(t, client).Error.Code)
+}
+
+func TestTransactionQueryIfModifiedSince(t *testing.T) {
+    s := NewWebSocketServer()
+    store := NewMemoryTransactionStore()
+    latest := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+    store.Add("agent-1", TransactionPayload{TxID: "tx-old", Timestamp: latest.Add(-time.Hour)})
+    store.Add("agent-1", TransactionPayload{TxID: "tx-new", Timestamp: latest})
+    s.Store = store
+    client := newRegisteredClient(s)
+
+    s.HandleClientMessage(client, []byte(`{"type":"transaction_query","payload":{"agent_id":"agent-1","if_modified_since":"2024-05-01T12:00:00Z"}}`))
+    response := readResponse(t, client)
+    assert.Equal(t, "transaction_query_not_modified", response.Type)
+    assert.True(t, response.Success)
+    assert.Nil(t, response.Data)
+
+    s.HandleClientMessage(client, []byte(`{"type":"transaction_query","payload":{"agent_id":"agent-1","if_modified_since":"2024-05-01T11:30:00Z"}}`))
+    response = readResponse(t, client)
+    assert.Equal(t, "transaction_query_response", response.Type)
+    assert.Equal(t, []string{"tx-new", "tx-old"}, txIDs(t, response))
+
+    s.HandleClientMessage(client, []byte(`{"type":"transaction_query","payload":{"agent_id":"agent-1","if_modified_since":"yesterday"}}`))
+    assert.Contains(t, readResponse(t, client).Error.Fields, "if_modified_since")
+}
+
+// testAuthorizer denies topics starting with "secret", lets principal "viewer" only start
+// agents, and fails for agent "broken".
+type testAuthorizer struct{}
+
+func (testAuthorizer) CanSubscribe(client *Client, topic string) bool {
+    return !strings.HasPrefix(topic, "secret")
+}
+
+func (testAuthorizer) CanControl(client *Client, agentID, command string) (bool, error) {
+    if agentID == "broken" {
+        return false, errors.New("policy store unavailable")
+    }
+    return client.Principal != "viewer" || command == "start", nil
+}
+
+func TestAgentControlAuthorization(t *testing.T) {
+    s := NewWebSocketServer()
+    go s.Start()
+    s.Authorizer = testAuthorizer{}
+    viewer := newRegisteredClient(s)
+    viewer.Principal = "viewer"
+
+    s.HandleClientMessage(viewer, []byte(`{"type":"agent_control","payload":{"agent_id":"agent-1","command":"start"}}`))
+    assert.Equal(t, "agent_control_ack", readResponse(t, viewer).Type)
+    // The agent_status broadcast and the response may arrive in either order
+    seen := map[string]bool{}
+    for i := 0; i < 2; i++ {
+        seen[readResponse(t, viewer).Type] = true
+    }
+    assert.True(t, seen["agent_control_response"])
+
+    s.HandleClientMessage(viewer, []byte(`{"type":"agent_control","payload":{"agent_id":"agent-1","command":"stop"}}`))
+    response := readResponse(t, viewer)
+    require.NotNil(t, response.Error)
+    assert.Equal(t, 403, response.Error.Code)
+    assert.Contains(t, response.Error.Message, "stop")
+
+    s.HandleClientMessage(viewer, []byte(`{"type":"agent_control","payload":{"agent_id":"broken","command":"start"}}`))
+    assert.Equal(t, 500, readResponse(t, viewer).Error.Code)
+}
+
+func TestOversizedResponseIsChunked(t *testing.T) {
+    s := NewWebSocketServer()
+    s.MaxFrameBytes = 300
+    store := NewMemoryTransactionStore()
+    for i := 0; i < 10; i++ {
+        store.Add("agent-1", TransactionPayload{TxID: fmt.Sprintf("tx-%d", i), Status: `"quoted" ünïcode`, Timestamp: time.Unix(int64(i), 0)})
+    }
+    s.Store = store
+    client := newRegisteredClient(s)
+
+    s.HandleClientMessage(client, []byte(`{"type":"transaction_query","payload":{"agent_id":"agent-1"}}`))
+
+    var assembled []byte
+    var chunkID string
+    for sequence := 1; ; sequence++ {
+        frame := (<-client.Send).Data
+        assert.LessOrEqual(t, len(frame), s.MaxFrameBytes)
+        var chunk struct {
+            Type    MessageType       `json:"type"`
+            Payload FrameChunkPayload `json:"payload"`
+        }
+        require.NoError(t, json.Unmarshal(frame, &chunk))
+        require.Equal(t, FrameChunk, chunk.Type)
+        if chunkID == "" {
+            chunkID = chunk.Payload.ChunkID
+        }
+        assert.Equal(t, chunkID, chunk.Payload.ChunkID)
+        assert.Equal(t, sequence, chunk.Payload.Sequence)
+        assembled = append(assembled, chunk.Payload.Data...)
+        if chunk.Payload.Final {
+            break
+        }
+    }
+
+    var response ResponseMessage
+    require.NoError(t, json.Unmarshal(assembled, &response))
+    assert.Equal(t, "transaction_query_response", response.Type)
+    assert.Len(t, txIDs(t, response), 10)
+
+    // Small responses are sent whole
+    s.HandleClientMessage(client, []byte(`{"type":"list_subscriptions"}`))
+    assert.Equal(t, "subscriptions_response", readResponse(t, client).Type)
+}
+
+func TestTopicStatsTracksSubscriptions(t *testing.T) {
+    s := NewWebSocketServer()
+    go s.Start()
+    clients := []*Client{newRegisteredClient(s), newRegisteredClient(s), newRegisteredClient(s)}
+    subscribe := func(client *Client, payload string) {
+        s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":`+payload+`}`))
+        readResponse(t, client)
+    }
+    subscribe(clients[0], `{"topic":"agent.1"}`)
+    subscribe(clients[0], `{"topic":"agent.*"}`)
+    subscribe(clients[0], `{"topic":"agent.*"}`) // Re-subscribing does not double count
+    subscribe(clients[1], `{"topic":"agent.1","max_messages":1}`)
+    subscribe(clients[2], `{"topic":"agent.*"}`)
+    assert.Equal(t, map[string]int{"agent.1": 2, "agent.*": 2}, s.TopicStats())
+
+    s.HandleClientMessage(clients[0], []byte(`{"type":"unsubscribe","payload":{"topic":"agent.*"}}`))
+    readResponse(t, clients[0])
+    s.UnregisterClient(clients[2])
+    assert.Equal(t, map[string]int{"agent.1": 2}, s.TopicStats())
+
+    // One-shot subscriptions leave the stats once used up
+    s.SendAgentStatusUpdate("agent.1", "active", "")
+    readMessage(t, clients[1])
+    readMessage(t, clients[1])
+    assert.Equal(t, map[string]int{"agent.1": 1}, s.TopicStats())
+}
+
+// handoffStore is a MemoryTransactionStore that runs hooks around its first query.
+type handoffStore struct {
+    *MemoryTransactionStore
+    beforeQuery, afterQuery func()
+    queried                 bool
+}
+
+func (h *handoffStore) QueryTransactions(ctx context.Context, query TransactionQueryPayload) ([]TransactionPayload, error) {
+    first := !h.queried
+    h.queried = true
+    if first {
+        h.beforeQuery()
+    }
+    transactions, err := h.MemoryTransactionStore.QueryTransactions(ctx, query)
+    if first {
+        h.afterQuery()
+    }
+    return transactions, err
+}
+
+func TestTailSubscribeDeliversOnlyNewTransactions(t *testing.T) {
+    s := NewWebSocketServer()
+    go s.Start()
+    store := NewMemoryTransactionStore()
+    s.Store = store
+    // Recorded before the subscribe, with its broadcast still to come
+    late := store.Add("agent-1", TransactionPayload{TxID: "tx-old", Status: "confirmed", Timestamp: time.Unix(1, 0)})
+    s.SendAgentStatusUpdate("agent-1", "active", "")
+    s.SendAgentStatusUpdate("unrelated", "idle", "") // Returns once the status above is delivered
+    client := newRegisteredClient(s)
+
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"agent-1","tail":true}}`))
+    assert.Equal(t, "subscribe_response", readResponse(t, client).Type, "a tail subscription gets no initial state")
+
+    s.Broadcast <- Message{Type: TransactionUpdate, Payload: late}
+    s.PublishTransaction("agent-1", TransactionPayload{TxID: "tx-new", Status: "confirmed", Timestamp: time.Unix(2, 0)})
+    message := readMessage(t, client)
+    assert.Equal(t, "tx-new", message["payload"].(map[string]interface{})["tx_id"])
+    assert.Empty(t, client.Send)
+
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"agent-2","tail":true,"history":5}}`))
+    response := readResponse(t, client)
+    require.NotNil(t, response.Error)
+    assert.Equal(t, "history cannot be combined with tail", response.Error.Fields["history"])
+}
+
+func TestHistorySubscribeHandsOffWithoutGapOrDuplicate(t *testing.T) {
+    s := NewWebSocketServer()
+    go s.Start()
+    store := &handoffStore{MemoryTransactionStore: NewMemoryTransactionStore()}
+    store.Add("agent-1", TransactionPayload{TxID: "tx-old", Timestamp: time.Unix(1, 0)})
+    s.Store = store
+
+    // The broadcast channel is unbuffered, so once a later send is accepted the earlier
+    // broadcast has been delivered (or held) for the subscriber
+    barrier := func() { s.SendAgentStatusUpdate("unrelated", "idle", "") }
+    store.beforeQuery = func() {
+        // Recorded and broadcast at the handoff, so it is both in the history and live
+        s.PublishTransaction("agent-1", TransactionPayload{TxID: "tx-handoff", Timestamp: time.Unix(2, 0)})
+        barrier()
+    }
+    store.afterQuery = func() {
+        // Recorded after the history was read, so it must arrive live
+        s.PublishTransaction("agent-1", TransactionPayload{TxID: "tx-after", Timestamp: time.Unix(3, 0)})
+        barrier()
+    }
+    client := newRegisteredClient(s)
+
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"agent-1","history":10}}`))
+    assert.Equal(t, "subscribe_response", readResponse(t, client).Type)
+
+    history := readResponse(t, client)
+    assert.Equal(t, "transaction_history", history.Type)
+    assert.Equal(t, []string{"tx-old", "tx-handoff"}, txIDs(t, history))
+
+    live := readMessage(t, client)
+    assert.Equal(t, "tx-after", live["payload"].(map[string]interface{})["tx_id"])
+
+    s.PublishTransaction("agent-1", TransactionPayload{TxID: "tx-live", Timestamp: time.Unix(4, 0)})
+    live = readMessage(t, client)
+    assert.Equal(t, "tx-live", live["payload"].(map[string]interface{})["tx_id"])
+    barrier()
+    assert.Empty(t, client.Send)
+}
+
+func TestInternalErrorsRedactedUnlessVerbose(t *testing.T) {
+    s := NewWebSocketServer()
+    s.StoreRetryAttempts = 1
+    s.Store = storeFunc(func(ctx context.Context, query TransactionQueryPayload) ([]TransactionPayload, error) {
+        return nil, errors.New("dial tcp db-primary:5432: connection refused")
+    })
+    client := newRegisteredClient(s)
+    query := []byte(`{"type":"transaction_query","payload":{"agent_id":"agent-1"}}`)
+
+    s.HandleClientMessage(client, query)
+    response := readResponse(t, client)
+    require.NotNil(t, response.Error)
+    assert.Equal(t, 503, response.Error.Code)
+    assert.Equal(t, "Transaction store unavailable", response.Error.Message)
+    assert.Equal(t, "err-1", response.Error.Details["correlation_id"])
+
+    s.Verbose = true
+    s.HandleClientMessage(client, query)
+    response = readResponse(t, client)
+    require.NotNil(t, response.Error)
+    assert.Equal(t, 503, response.Error.Code)
+    assert.Contains(t, response.Error.Message, "db-primary:5432: connection refused")
+    assert.Equal(t, "err-2", response.Error.Details["correlation_id"])
+}
+
+// testFleets is a FleetResolver over a mutable fleet membership table.
+type testFleets struct {
+    mu     sync.Mutex
+    fleets map[string][]string
+}
+
+func (f *testFleets) FleetAgents(fleet string) ([]string, error) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    agents, ok := f.fleets[fleet]
+    if !ok {
+        return nil, errors.New("no such fleet: " + fleet)
+    }
+    return agents, nil
+}
+
+func (f *testFleets) set(fleet string, agents ...string) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+    f.fleets[fleet] = agents
+}
+
+func TestFleetSubscriptionFollowsMembership(t *testing.T) {
+    s := NewWebSocketServer()
+    fleets := &testFleets{fleets: map[string][]string{"trading": {"agent-1", "agent-2"}}}
+    s.FleetResolver = fleets
+    go s.Start()
+    client := newRegisteredClient(s)
+
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"fleet:trading"}}`))
+    assert.Equal(t, "subscribe_response", readResponse(t, client).Type)
+    status := func() string { return readMessage(t, client)["payload"].(map[string]interface{})["agent_id"].(string) }
+
+    for _, agentID := range []string{"agent-1", "agent-3", "agent-2"} {
+        s.SendAgentStatusUpdate(agentID, "active", "")
+    }
+    assert.Equal(t, "agent-1", status())
+    assert.Equal(t, "agent-2", status())
+
+    // agent-3 joins and agent-1 leaves
+    fleets.set("trading", "agent-2", "agent-3")
+    require.NoError(t, s.RefreshFleet("trading"))
+    for _, agentID := range []string{"agent-1", "agent-3", "agent-2"} {
+        s.SendAgentStatusUpdate(agentID, "active", "")
+    }
+    assert.Equal(t, "agent-3", status())
+    assert.Equal(t, "agent-2", status())
+    s.SendAgentStatusUpdate("agent-1", "idle", "") // Ensures the earlier broadcasts were all delivered
+    assert.Empty(t, client.Send)
+
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"fleet:unknown"}}`))
+    response := readResponse(t, client)
+    require.NotNil(t, response.Error)
+    assert.Equal(t, 400, response.Error.Code)
+}
+
+func TestFleetSubscriptionSkipsDeniedMembers(t *testing.T) {
+    s := NewWebSocketServer()
+    s.Authorizer = testAuthorizer{}
+    fleets := &testFleets{fleets: map[string][]string{"trading": {"agent-1", "secret-agent"}}}
+    s.FleetResolver = fleets
+    go s.Start()
+    client := newRegisteredClient(s)
+
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"fleet:trading"}}`))
+    assert.Equal(t, "subscribe_response", readResponse(t, client).Type)
+    status := func() string { return readMessage(t, client)["payload"].(map[string]interface{})["agent_id"].(string) }
+
+    s.SendAgentStatusUpdate("secret-agent", "active", "")
+    s.SendAgentStatusUpdate("agent-1", "active", "")
+    assert.Equal(t, "agent-1", status())
+
+    // Members that join are checked too
+    fleets.set("trading", "agent-1", "secret-agent", "secret-other", "agent-2")
+    require.NoError(t, s.RefreshFleet("trading"))
+    for _, agentID := range []string{"secret-other", "secret-agent", "agent-2"} {
+        s.SendAgentStatusUpdate(agentID, "active", "")
+    }
+    assert.Equal(t, "agent-2", status())
+    s.SendAgentStatusUpdate("agent-1", "idle", "") // Ensures the earlier broadcasts were all delivered
+    assert.Equal(t, "agent-1", status())
+    assert.Empty(t, client.Send)
+}
+
+func TestTransactionQueryDistinguishesNotFoundFromEmpty(t *testing.T) {
+    s := NewWebSocketServer()
+    store := NewMemoryTransactionStore()
+    store.Add("agent-1", TransactionPayload{TxID: "tx-1", Blockchain: "Solana", Timestamp: time.Now()})
+    s.Store = store
+    client := newRegisteredClient(s)
+
+    s.HandleClientMessage(client, []byte(`{"type":"transaction_query","payload":{"tx_id":"tx-unknown"}}`))
+    response := readResponse(t, client)
+    require.NotNil(t, response.Error)
+    assert.Equal(t, 404, response.Error.Code)
+
+    // Unknown on every chain is still a 404; a transaction held on one chain is found
+    s.HandleClientMessage(client, []byte(`{"type":"transaction_query","payload":{"tx_id":"tx-unknown","blockchain":["Solana","Ethereum"]}}`))
+    response = readResponse(t, client)
+    require.NotNil(t, response.Error)
+    assert.Equal(t, 404, response.Error.Code)
+    s.HandleClientMessage(client, []byte(`{"type":"transaction_query","payload":{"tx_id":"tx-1","blockchain":["Solana","Ethereum"]}}`))
+    response = readResponse(t, client)
+    assert.Equal(t, []string{"tx-1"}, txIDs(t, response))
+    assert.Nil(t, response.Data.(map[string]interface{})["warnings"])
+
+    s.HandleClientMessage(client, []byte(`{"type":"transaction_query","payload":{"agent_id":"agent-idle"}}`))
+    response = readResponse(t, client)
+    require.True(t, response.Success)
+    data := response.Data.(map[string]interface{})
+    assert.Equal(t, []interface{}{}, data["transactions"])
+    assert.Equal(t, float64(0), data["count"])
+}
+
+// fakeLogSource hands out log tails fed by the test.
+type fakeLogSource struct {
+    lines   chan AgentLogLine
+    stopped chan struct{}
+}
+
+func (f *fakeLogSource) Tail(ctx context.Context, agentID string) (<-chan AgentLogLine, error) {
+    if agentID != "agent-1" {
+        return nil, errors.New("unknown agent")
+    }
+    go func() {
+        <-ctx.Done()
+        close(f.stopped)
+    }()
+    return f.lines, nil
+}
+
+func TestLogSubscriptionFiltersByLevel(t *testing.T) {
+    s := NewWebSocketServer()
+    source := &fakeLogSource{lines: make(chan AgentLogLine), stopped: make(chan struct{})}
+    s.LogSource = source
+    client := newRegisteredClient(s)
+
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"logs:agent-1","min_level":"warn"}}`))
+    assert.Equal(t, "subscribe_response", readResponse(t, client).Type)
+
+    now := time.Now()
+    for _, level := range []string{"debug", "warn", "info", "error"} {
+        source.lines <- AgentLogLine{Level: level, Message: level + " line", Timestamp: now}
+    }
+    for _, want := range []string{"warn", "error"} {
+        message := readMessage(t, client)
+        assert.Equal(t, string(AgentLog), message["type"])
+        payload := message["payload"].(map[string]interface{})
+        assert.Equal(t, "agent-1", payload["agent_id"])
+        assert.Equal(t, want, payload["level"])
+        assert.Equal(t, want+" line", payload["message"])
+    }
+
+    // Unsubscribing stops the tail
+    s.HandleClientMessage(client, []byte(`{"type":"unsubscribe","payload":{"topic":"logs:agent-1"}}`))
+    readResponse(t, client)
+    select {
+    case <-source.stopped:
+    case <-time.After(time.Second):
+        t.Fatal("log tail was not stopped")
+    }
+    assert.Empty(t, client.Send)
+
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"logs:agent-1","min_level":"loud"}}`))
+    response := readResponse(t, client)
+    require.NotNil(t, response.Error)
+    assert.Contains(t, response.Error.Fields, "min_level")
+}
+
+// fakeMempool hands out a pending transaction stream fed by the test.
+type fakeMempool struct {
+    txs     chan TransactionPayload
+    stopped chan struct{}
+}
+
+func (f *fakeMempool) Pending(ctx context.Context, blockchain string) (<-chan TransactionPayload, error) {
+    if blockchain != "solana" {
+        return nil, errors.New("unknown blockchain")
+    }
+    go func() {
+        <-ctx.Done()
+        close(f.stopped)
+    }()
+    return f.txs, nil
+}
+
+func TestMempoolSubscriptionFollowsPendingTransactions(t *testing.T) {
+    s := NewWebSocketServer()
+    go s.Start()
+    mempool := &fakeMempool{txs: make(chan TransactionPayload), stopped: make(chan struct{})}
+    s.Mempool = mempool
+    client := newRegisteredClient(s)
+
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"mempool:solana","agent_id":"agent-1"}}`))
+    assert.Equal(t, "subscribe_response", readResponse(t, client).Type)
+
+    mempool.txs <- TransactionPayload{TxID: "tx-2", AgentID: "agent-2", Amount: "3 SOL", Blockchain: "solana"}
+    mempool.txs <- TransactionPayload{TxID: "tx-1", AgentID: "agent-1", Amount: "1.5 SOL", Blockchain: "solana"}
+    pending := readMessage(t, client)
+    assert.Equal(t, "transaction_update", pending["type"])
+    payload := pending["payload"].(map[string]interface{})
+    assert.Equal(t, "tx-1", payload["tx_id"])
+    assert.Equal(t, "pending", payload["status"])
+
+    // Confirmation follows the transaction the subscription saw pending, and only that one
+    s.PublishTransaction("agent-2", TransactionPayload{TxID: "tx-2", Status: "confirmed", Amount: "3 SOL", Blockchain: "solana"})
+    s.PublishTransaction("agent-1", TransactionPayload{TxID: "tx-1", Status: "confirmed", Amount: "1.5 SOL", Blockchain: "solana"})
+    confirmed := readMessage(t, client)
+    assert.Equal(t, "tx-1", confirmed["payload"].(map[string]interface{})["tx_id"])
+    assert.Equal(t, "confirmed", confirmed["payload"].(map[string]interface{})["status"])
+    s.PublishTransaction("agent-1", TransactionPayload{TxID: "tx-1", Status: "finalized", Amount: "1.5 SOL", Blockchain: "solana"})
+    s.SendAgentStatusUpdate("unrelated", "idle", "")
+    assert.Empty(t, client.Send)
+
+    s.HandleClientMessage(client, []byte(`{"type":"unsubscribe","payload":{"topic":"mempool:solana"}}`))
+    readResponse(t, client)
+    select {
+    case <-mempool.stopped:
+    case <-time.After(time.Second):
+        t.Fatal("mempool stream was not stopped")
+    }
+
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"mempool:bitcoin"}}`))
+    response := readResponse(t, client)
+    require.NotNil(t, response.Error)
+
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"agent-1","address":"addr1"}}`))
+    assert.Contains(t, readResponse(t, client).Error.Fields, "agent_id")
+}
+
+func TestMempoolSubscriptionFiltersByAddressAndOwnsItsStream(t *testing.T) {
+    s := NewWebSocketServer()
+    go s.Start()
+    mempool := &fakeMempool{txs: make(chan TransactionPayload), stopped: make(chan struct{})}
+    s.Mempool = mempool
+    client := newRegisteredClient(s)
+    // A wildcard subscription on the client matches the mempool topic but opened no stream
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"mem*","max_messages":1}}`))
+    readResponse(t, client)
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"mempool:solana","address":"addr9"}}`))
+    readResponse(t, client)
+
+    mempool.txs <- TransactionPayload{TxID: "tx-1", AgentID: "agent-1", FromAddress: "addr1", ToAddress: "addr2", Blockchain: "solana"}
+    mempool.txs <- TransactionPayload{TxID: "tx-2", AgentID: "agent-2", FromAddress: "addr3", ToAddress: "addr9", Blockchain: "solana"}
+    mempool.txs <- TransactionPayload{TxID: "tx-3", AgentID: "agent-1", FromAddress: "addr9", ToAddress: "addr4", Blockchain: "solana"}
+    for _, txID := range []string{"tx-2", "tx-3"} {
+        message := readMessage(t, client)
+        assert.Equal(t, txID, message["payload"].(map[string]interface{})["tx_id"])
+        assert.Equal(t, "mempool:solana", message["matched_topic"])
+    }
+    s.Mutex.RLock()
+    for _, subscription := range client.Subscriptions {
+        if subscription.Pattern == "mem*" {
+            assert.Equal(t, 0, subscription.delivered, "the wildcard subscription was not delivered to")
+        }
+    }
+    assert.Len(t, client.Subscriptions, 2, "the wildcard subscription did not reach its max_messages")
+    s.Mutex.RUnlock()
+}
+
+func TestMempoolSubscriptionForgetsOldestUnsettledTransactions(t *testing.T) {
+    s := NewWebSocketServer()
+    go s.Start()
+    s.MaxMempoolPending = 2
+    mempool := &fakeMempool{txs: make(chan TransactionPayload), stopped: make(chan struct{})}
+    s.Mempool = mempool
+    client := newRegisteredClient(s)
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"mempool:solana"}}`))
+    readResponse(t, client)
+
+    // tx-1 is dropped from the mempool and never settles; following tx-3 forgets it
+    for _, txID := range []string{"tx-1", "tx-2", "tx-3"} {
+        mempool.txs <- TransactionPayload{TxID: txID, AgentID: "agent-1", Amount: "1 SOL", Blockchain: "solana"}
+        assert.Equal(t, txID, readMessage(t, client)["payload"].(map[string]interface{})["tx_id"])
+    }
+    s.Mutex.RLock()
+    for _, subscription := range client.Subscriptions {
+        assert.Equal(t, 2, len(subscription.pending.txs))
+        assert.False(t, subscription.pending.follows("tx-1"))
+    }
+    s.Mutex.RUnlock()
+
+    s.PublishTransaction("agent-1", TransactionPayload{TxID: "tx-1", Status: "confirmed", Amount: "1 SOL", Blockchain: "solana"})
+    s.PublishTransaction("agent-1", TransactionPayload{TxID: "tx-2", Status: "confirmed", Amount: "1 SOL", Blockchain: "solana"})
+    assert.Equal(t, "tx-2", readMessage(t, client)["payload"].(map[string]interface{})["tx_id"])
+    s.SendAgentStatusUpdate("unrelated", "idle", "")
+    assert.Empty(t, client.Send)
+}
+
+func TestSendErrorBuildsResponseAndCounts(t *testing.T) {
+    s := NewWebSocketServer()
+    client := newRegisteredClient(s)
+
+    s.HandleClientMessage(client, []byte(`{"type":"teleport"}`))
+    response := readResponse(t, client)
+    assert.Equal(t, "error", response.Type)
+    assert.False(t, response.Success)
+    require.NotNil(t, response.Error)
+    assert.Equal(t, 400, response.Error.Code)
+    assert.Equal(t, `Unknown message type: "teleport"`, response.Error.Message)
+    assert.Equal(t, map[string]interface{}{"received_type": "teleport"}, response.Error.Details)
+    assert.Equal(t, map[ErrorCode]uint64{CodeBadRequest: 1}, s.ErrorCounts())
+
+    // sendError takes its message from the code
+    s.sendError(client, CodeNotFound, nil)
+    assert.Equal(t, "Not Found", readResponse(t, client).Error.Message)
+    s.HandleClientMessage(client, []byte(`{"type":"ack","payload":{}}`))
+    assert.Equal(t, 422, readResponse(t, client).Error.Code)
+    assert.Equal(t, map[ErrorCode]uint64{CodeBadRequest: 1, CodeNotFound: 1, CodeValidationFailed: 1}, s.ErrorCounts())
+}
+
+func TestErrorResponsesThrottledThenDisconnected(t *testing.T) {
+    s := NewWebSocketServer()
+    s.MaxErrorsPerInterval = 5
+    s.ErrorInterval = time.Minute
+    s.Clock = &fakeClock{now: time.Now()}
+    client := newRegisteredClient(s)
+
+    for i := 0; i < 30; i++ {
+        s.HandleClientMessage(client, []byte(`{not json`))
+    }
+
+    errorsSent := 0
+    for frame := range client.Send {
+        var response ResponseMessage
+        require.NoError(t, json.Unmarshal(frame.Data, &response))
+        assert.Equal(t, "error", response.Type)
+        errorsSent++
+    }
+    assert.Equal(t, 5, errorsSent)
+    assert.Equal(t, DisconnectRateLimited, client.DisconnectReason())
+    _, connected := s.GetClient(client.ID)
+    assert.False(t, connected)
+}
+
+func TestTransactionQueryByManyIDs(t *testing.T) {
+    s := NewWebSocketServer()
+    store := NewMemoryTransactionStore()
+    store.Add("agent-1", TransactionPayload{TxID: "tx-1", Timestamp: time.Now()})
+    store.Add("agent-2", TransactionPayload{TxID: "tx-2", Timestamp: time.Now()})
+    s.Store = store
+    client := newRegisteredClient(s)
+    query := func(store TransactionStore) map[string]interface{} {
+        s.Store = store
+        s.HandleClientMessage(client, []byte(`{"type":"transaction_query","payload":{"tx_ids":["tx-1","tx-missing","tx-2","tx-1"]}}`))
+        response := readResponse(t, client)
+        require.True(t, response.Success, "query failed: %+v", response.Error)
+        assert.Equal(t, "transaction_batch_response", response.Type)
+        return response.Data.(map[string]interface{})
+    }
+
+    for _, backing := range []TransactionStore{store, storeFunc(store.QueryTransactions)} {
+        data := query(backing)
+        transactions := data["transactions"].(map[string]interface{})
+        assert.Len(t, transactions, 2)
+        assert.Equal(t, "tx-2", transactions["tx-2"].(map[string]interface{})["tx_id"])
+        assert.Equal(t, []interface{}{"tx-missing"}, data["not_found"])
+        assert.Equal(t, float64(2), data["count"])
+    }
+
+    s.HandleClientMessage(client, []byte(`{"type":"transaction_query","payload":{"tx_ids":["tx-1"],"agent_id":"agent-1"}}`))
+    response := readResponse(t, client)
+    require.NotNil(t, response.Error)
+    assert.Equal(t, "tx_ids cannot be combined with agent_id", response.Error.Fields["tx_ids"])
+}
+
+func TestLargeBlockHeightsKeepPrecision(t *testing.T) {
+    const height = uint64(1)<<53 + 1 // The first integer a float64 cannot hold
+    s := NewWebSocketServer()
+    go s.Start()
+    store := NewMemoryTransactionStore()
+    store.Add("agent-1", TransactionPayload{TxID: "tx-1", Blockchain: "Solana", BlockHeight: height, Timestamp: time.Now()})
+    s.Store = store
+    client := newRegisteredClient(s)
+
+    // Sparse query results are rebuilt from decoded fields
+    s.HandleClientMessage(client, []byte(`{"type":"transaction_query","payload":{"agent_id":"agent-1","fields":["block_height"]}}`))
+    var response struct {
+        Data struct {
+            Transactions []struct {
+                BlockHeight uint64 `json:"block_height"`
+            } `json:"transactions"`
+        } `json:"data"`
+    }
+    require.NoError(t, json.Unmarshal((<-client.Send).Data, &response))
+    require.Len(t, response.Data.Transactions, 1)
+    assert.Equal(t, height, response.Data.Transactions[0].BlockHeight)
+
+    // Filters compare such heights exactly rather than as the nearest float64
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"agent-1","filter":"block_height == 9007199254740993"}}`))
+    readResponse(t, client)
+    s.PublishTransaction("agent-1", TransactionPayload{TxID: "tx-2", BlockHeight: height - 1})
+    s.PublishTransaction("agent-1", TransactionPayload{TxID: "tx-3", BlockHeight: height})
+    var update struct {
+        Payload TransactionPayload `json:"payload"`
+    }
+    require.NoError(t, json.Unmarshal((<-client.Send).Data, &update))
+    assert.Equal(t, "tx-3", update.Payload.TxID)
+    assert.Equal(t, height, update.Payload.BlockHeight)
+}
+
+func TestTransactionQuerySparseFields(t *testing.T) {
+    s := NewWebSocketServer()
+    store := NewMemoryTransactionStore()
+    store.Add("agent-1", TransactionPayload{TxID: "tx-1", Status: "confirmed", Amount: "1.5", Blockchain: "Solana", FromAddress: "wallet-a", Timestamp: time.Now()})
+    s.Store = store
+    client := newRegisteredClient(s)
+
+    s.HandleClientMessage(client, []byte(`{"type":"transaction_query","payload":{"agent_id":"agent-1","fields":["status","amount","colour"]}}`))
+    response := readResponse(t, client)
+    require.True(t, response.Success, "query failed: %+v", response.Error)
+    data := response.Data.(map[string]interface{})
+    assert.Equal(t, []interface{}{map[string]interface{}{"tx_id": "tx-1", "status": "confirmed", "amount": "1.5"}}, data["transactions"])
+    assert.Equal(t, []interface{}{"unknown field ignored: colour"}, data["warnings"])
+
+    s.HandleClientMessage(client, []byte(`{"type":"transaction_query","payload":{"tx_ids":["tx-1"],"fields":["blockchain"]}}`))
+    response = readResponse(t, client)
+    require.True(t, response.Success, "query failed: %+v", response.Error)
+    assert.Equal(t, map[string]interface{}{"tx-1": map[string]interface{}{"tx_id": "tx-1", "blockchain": "Solana"}}, response.Data.(map[string]interface{})["transactions"])
+
+    s.HandleClientMessage(client, []byte(`{"type":"transaction_query","payload":{"agent_id":"agent-1","fields":"status"}}`))
+    response = readResponse(t, client)
+    require.NotNil(t, response.Error)
+    assert.Contains(t, response.Error.Fields, "fields")
+}
+
+func TestCompressedTransactionQuery(t *testing.T) {
+    s := NewWebSocketServer()
+    store := NewMemoryTransactionStore()
+    for i := 0; i < 50; i++ {
+        store.Add("agent-1", TransactionPayload{TxID: fmt.Sprintf("tx-%d", i), Status: "confirmed", Blockchain: "Solana", Timestamp: time.Now()})
+    }
+    s.Store = store
+    client := newRegisteredClient(s)
+
+    s.HandleClientMessage(client, []byte(`{"type":"transaction_query","payload":{"agent_id":"agent-1","limit":50}}`))
+    plain := readResponse(t, client)
+    require.True(t, plain.Success, "query failed: %+v", plain.Error)
+
+    s.HandleClientMessage(client, []byte(`{"type":"transaction_query","payload":{"agent_id":"agent-1","limit":50,"compress":true}}`))
+    var response struct {
+        Type string         `json:"type"`
+        Data CompressedData `json:"data"`
+    }
+    require.NoError(t, json.Unmarshal((<-client.Send).Data, &response))
+    assert.Equal(t, "transaction_query_response", response.Type)
+    assert.Equal(t, "gzip", response.Data.Encoding)
+
+    reader, err := gzip.NewReader(bytes.NewReader(response.Data.Data))
+    require.NoError(t, err)
+    var data interface{}
+    require.NoError(t, json.NewDecoder(reader).Decode(&data))
+    assert.Equal(t, plain.Data, data)
+    assert.Len(t, data.(map[string]interface{})["transactions"], 50)
+
+    s.HandleClientMessage(client, []byte(`{"type":"transaction_query","payload":{"agent_id":"agent-1","compress":true,"stream":true}}`))
+    assert.Contains(t, readResponse(t, client).Error.Fields, "compress")
+}
+
+func TestTransactionQueryServesStaleCacheWhenStoreFails(t *testing.T) {
+    s := NewWebSocketServer()
+    s.StoreRetryAttempts = 1
+    var calls atomic.Int32
+    var failing atomic.Bool
+    s.Store = storeFunc(func(ctx context.Context, query TransactionQueryPayload) ([]TransactionPayload, error) {
+        calls.Add(1)
+        if failing.Load() {
+            return nil, errors.New("connection refused")
+        }
+        return []TransactionPayload{{TxID: "tx-1", Status: "confirmed"}}, nil
+    })
+    client := newRegisteredClient(s)
+    query := []byte(`{"type":"transaction_query","payload":{"agent_id":"agent-1"}}`)
+
+    // Without a cache a failing store is a 503
+    failing.Store(true)
+    s.HandleClientMessage(client, query)
+    response := readResponse(t, client)
+    require.NotNil(t, response.Error)
+    assert.Equal(t, 503, response.Error.Code)
+
+    s.QueryCacheSize = 10
+    failing.Store(false)
+    s.HandleClientMessage(client, query)
+    response = readResponse(t, client)
+    require.True(t, response.Success, "query failed: %+v", response.Error)
+    assert.NotContains(t, response.Data, "stale")
+
+    failing.Store(true)
+    s.HandleClientMessage(client, query)
+    response = readResponse(t, client)
+    require.True(t, response.Success, "query failed: %+v", response.Error)
+    assert.Equal(t, true, response.Data.(map[string]interface{})["stale"])
+    assert.Equal(t, []string{"tx-1"}, txIDs(t, response))
+
+    // Within the TTL results come from the cache without asking the store
+    s.QueryCacheTTL = time.Minute
+    failing.Store(false)
+    s.HandleClientMessage(client, query)
+    readResponse(t, client)
+    before := calls.Load()
+    s.HandleClientMessage(client, query)
+    response = readResponse(t, client)
+    assert.Equal(t, before, calls.Load())
+    assert.NotContains(t, response.Data, "stale")
+}
+
+func TestQueryCacheCopiesResults(t *testing.T) {
+    cache := newQueryCache(1)
+    warnings := make([]string, 1, 4)
+    warnings[0] = "chain slow"
+    transactions := []TransactionPayload{{TxID: "tx-1"}}
+    cache.put(cachedResult{key: "k", transactions: transactions, warnings: warnings})
+
+    // Neither the stored slices nor those handed out alias the cache's own
+    transactions[0].TxID = "changed"
+    _ = append(warnings, "appended by caller")
+    cached, ok := cache.get("k")
+    require.True(t, ok)
+    cached.transactions[0].TxID = "changed again"
+    cached.warnings = append(cached.warnings[:1], "appended by caller")
+
+    cached, _ = cache.get("k")
+    assert.Equal(t, "tx-1", cached.transactions[0].TxID)
+    assert.Equal(t, []string{"chain slow"}, cached.warnings)
+}
+
+// logCapture collects log output while a test runs.
+type logCapture struct {
+    mu  sync.Mutex
+    buf bytes.Buffer
+}
+
+func (c *logCapture) Write(p []byte) (int, error) {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.buf.Write(p)
+}
+
+func (c *logCapture) String() string {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.buf.String()
+}
+
+// captureLogs redirects the standard logger for the rest of the test.
+func captureLogs(t *testing.T) *logCapture {
+    capture := &logCapture{}
+    log.SetOutput(capture)
+    t.Cleanup(func() { log.SetOutput(os.Stderr) })
+    return capture
+}
+
+func TestSlowHandlersAreTimedAndLogged(t *testing.T) {
+    s := NewWebSocketServer()
+    s.SlowHandlerThreshold = 20 * time.Millisecond
+    client := newRegisteredClient(s)
+    require.NoError(t, s.RegisterHandler("slow", func(client *Client, payload json.RawMessage) {
+        time.Sleep(50 * time.Millisecond)
+    }))
+    logs := captureLogs(t)
+
+    s.HandleClientMessage(client, []byte(`{"type":"ping","payload":{"timestamp":1}}`))
+    readResponse(t, client)
+    assert.NotContains(t, logs.String(), "Slow handler")
+
+    s.HandleClientMessage(client, []byte(`{"type":"slow"}`))
+    assert.Contains(t, logs.String(), "Slow handler: slow message from client "+client.ID)
+
+    durations := s.HandlerDurations()
+    assert.Equal(t, uint64(1), durations["ping"].Count)
+    slow := durations["slow"]
+    assert.Equal(t, uint64(1), slow.Count)
+    assert.GreaterOrEqual(t, slow.Sum, 50*time.Millisecond)
+    assert.Equal(t, uint64(1), slow.Buckets[3], "50ms falls in the 25ms-100ms bucket")
+
+    // Unhandled types share one histogram
+    s.HandleClientMessage(client, []byte(`{"type":"bogus-1"}`))
+    readResponse(t, client)
+    s.HandleClientMessage(client, []byte(`{"type":"bogus-2"}`))
+    readResponse(t, client)
+    assert.Equal(t, uint64(2), s.HandlerDurations()["unknown"].Count)
+    assert.NotContains(t, s.HandlerDurations(), ClientMessageType("bogus-1"))
+}
+
+func TestSubscribeMinAmount(t *testing.T) {
+    s := NewWebSocketServer()
+    go s.Start()
+    client := newRegisteredClient(s)
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"agent-1","min_amount":1}}`))
+    readResponse(t, client)
+    logs := captureLogs(t)
+
+    for i, amount := range []string{"0.5 SOL", "1 SOL", "2.75 ETH", "lots", "0.999"} {
+        s.PublishTransaction("agent-1", TransactionPayload{TxID: fmt.Sprintf("tx-%d", i), Amount: amount})
+    }
+    s.SendAgentStatusUpdate("agent-1", "active", "")
+
+    var delivered []string
+    for _, want := range []MessageType{TransactionUpdate, TransactionUpdate, TransactionUpdate, AgentStatusUpdate} {
+        message := readMessage(t, client)
+        require.Equal(t, string(want), message["type"])
+        if payload := message["payload"].(map[string]interface{}); want == TransactionUpdate {
+            delivered = append(delivered, payload["amount"].(string))
+        }
+    }
+    assert.Equal(t, []string{"1 SOL", "2.75 ETH", "lots"}, delivered)
+    assert.Empty(t, client.Send)
+    assert.Contains(t, logs.String(), `unparseable amount "lots"`)
+
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"agent-1","min_amount":-1}}`))
+    assert.Contains(t, readResponse(t, client).Error.Fields, "min_amount")
+}
+
+func TestSubscribeFlowDeliversOnlyThePair(t *testing.T) {
+    s := NewWebSocketServer()
+    go s.Start()
+    s.Authorizer = testAuthorizer{}
+    client := newRegisteredClient(s)
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"flow","from":"agent-1","to":"addr9"}}`))
+    response := readResponse(t, client)
+    require.Equal(t, "subscribe_response", response.Type)
+    assert.Equal(t, "flow:agent-1->addr9", response.Data.(map[string]interface{})["topic"])
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"flow","from":"addr3","to":"addr4"}}`))
+    readResponse(t, client)
+
+    s.PublishTransaction("agent-1", TransactionPayload{TxID: "tx-1", FromAddress: "addr1", ToAddress: "addr9"})
+    s.PublishTransaction("agent-1", TransactionPayload{TxID: "tx-2", FromAddress: "addr1", ToAddress: "addr8"})
+    s.PublishTransaction("agent-2", TransactionPayload{TxID: "tx-3", FromAddress: "addr2", ToAddress: "addr9"})
+    s.PublishTransaction("agent-2", TransactionPayload{TxID: "tx-4", FromAddress: "addr4", ToAddress: "addr3"}) // Reversed
+    s.PublishTransaction("agent-2", TransactionPayload{TxID: "tx-5", FromAddress: "addr3", ToAddress: "addr4"})
+
+    for _, want := range []struct{ txID, topic string }{{"tx-1", "flow:agent-1->addr9"}, {"tx-5", "flow:addr3->addr4"}} {
+        message := readMessage(t, client)
+        assert.Equal(t, want.txID, message["payload"].(map[string]interface{})["tx_id"])
+        assert.Equal(t, want.topic, message["matched_topic"])
+    }
+    assert.Empty(t, client.Send)
+
+    for payload, field := range map[string]string{
+        `{"topic":"flow","from":"agent-1"}`:             "to",
+        `{"topic":"agent-1","from":"agent-1","to":"x"}`: "from",
+        `{"topic":"flow","from":"agent-*","to":"x"}`:    "from",
+    } {
+        s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":`+payload+`}`))
+        assert.Contains(t, readResponse(t, client).Error.Fields, field, payload)
+    }
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"flow","from":"secret-agent","to":"addr9"}}`))
+    assert.Equal(t, 403, readResponse(t, client).Error.Code)
+
+    // Naming a flow topic directly would skip authorizing its parties
+    for payload, field := range map[string]string{
+        `{"topic":"flow:secret-agent->addr9"}`:     "topic",
+        `{"topic":" FLOW:secret-agent->addr9"}`:    "topic",
+        `{"topic":"flow:*"}`:                       "topic",
+        `{"topics":["agent-1","flow:agent-1->*"]}`: "topics",
+    } {
+        s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":`+payload+`}`))
+        assert.Contains(t, readResponse(t, client).Error.Fields, field, payload)
+    }
+    // Nor does a wildcard reach flows under another name
+    wildcard := newRegisteredClient(s)
+    s.HandleClientMessage(wildcard, []byte(`{"type":"subscribe","payload":{"topic":"f*"}}`))
+    require.True(t, readResponse(t, wildcard).Success)
+    s.PublishTransaction("secret-agent", TransactionPayload{TxID: "tx-6", FromAddress: "addr1", ToAddress: "addr9"})
+    s.SendAgentStatusUpdate("fx", "idle", "")
+    assert.Equal(t, "agent_status", readMessage(t, wildcard)["type"])
+    assert.Empty(t, wildcard.Send)
+}
+
+func TestSubscribeFlowIgnoresCaseWithCaseInsensitiveTopics(t *testing.T) {
+    s := NewWebSocketServer()
+    s.CaseInsensitiveTopics = true
+    go s.Start()
+    client := newRegisteredClient(s)
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"flow","from":"Agent-1","to":"ADDR9"}}`))
+    response := readResponse(t, client)
+    require.Equal(t, "subscribe_response", response.Type)
+    assert.Equal(t, "flow:agent-1->addr9", response.Data.(map[string]interface{})["topic"])
+
+    s.PublishTransaction("AGENT-1", TransactionPayload{TxID: "tx-1", FromAddress: "addr1", ToAddress: "Addr9"})
+    s.PublishTransaction("agent-2", TransactionPayload{TxID: "tx-2", FromAddress: "AGENT-1", ToAddress: "addr9"})
+    s.PublishTransaction("agent-2", TransactionPayload{TxID: "tx-3", FromAddress: "addr2", ToAddress: "addr9"})
+
+    for _, txID := range []string{"tx-1", "tx-2"} {
+        assert.Equal(t, txID, readMessage(t, client)["payload"].(map[string]interface{})["tx_id"])
+    }
+    s.SendAgentStatusUpdate("agent-1", "active", "")
+    assert.Empty(t, client.Send)
+}
+
+func TestTransactionAmountsAreStructured(t *testing.T) {
+    for amount, want := range map[string]struct {
+        value    float64
+        currency string
+    }{
+        "1.25 ETH": {1.25, "ETH"},
+        "0.5":      {0.5, ""},
+        "lots":     {0, ""},
+    } {
+        tx := TransactionPayload{Amount: amount}
+        tx.structureAmount()
+        assert.Equal(t, want.value, tx.AmountValue, amount)
+        assert.Equal(t, want.currency, tx.Currency, amount)
+    }
+
+    // Queries structure amounts even when the store does not
+    s := NewWebSocketServer()
+    s.Store = storeFunc(func(ctx context.Context, query TransactionQueryPayload) ([]TransactionPayload, error) {
+        return []TransactionPayload{{TxID: "tx-1", Amount: "1.25 ETH"}}, nil
+    })
+    client := newRegisteredClient(s)
+    s.HandleClientMessage(client, []byte(`{"type":"transaction_query","payload":{"tx_id":"tx-1"}}`))
+    response := readResponse(t, client)
+    require.True(t, response.Success, "query failed: %+v", response.Error)
+    tx := response.Data.(map[string]interface{})["transactions"].([]interface{})[0].(map[string]interface{})
+    assert.Equal(t, "1.25 ETH", tx["amount"])
+    assert.Equal(t, 1.25, tx["amount_value"])
+    assert.Equal(t, "ETH", tx["currency"])
+}
+
+// testSigningKeys gives each principal a fixed key.
+type testSigningKeys map[string][]byte
+
+func (k testSigningKeys) SigningKey(principal string) ([]byte, bool) {
+    key, ok := k[principal]
+    return key, ok
+}
+
+func TestSignedMessages(t *testing.T) {
+    s := NewWebSocketServer()
+    go s.Start()
+    key := []byte("secret")
+    s.SigningKeys = testSigningKeys{"trader": key}
+    client := newTestClient()
+    client.Principal = "trader"
+    s.RegisterClient(client)
+    signed := func(msgType, payload, signature string) []byte {
+        return []byte(`{"type":"` + msgType + `","payload":` + payload + `,"signature":"` + signature + `"}`)
+    }
+
+    payload := `{"agent_id":"agent-1","command":"start"}`
+    s.HandleClientMessage(client, signed("agent_control", payload, messageSignature(key, "agent_control", []byte(payload))))
+    assert.Equal(t, "agent_control_ack", readResponse(t, client).Type)
+    // Control results are signed for the client to verify; the status broadcast may arrive either side
+    var verified bool
+    for i := 0; i < 2; i++ {
+        var response struct {
+            Type      string          `json:"type"`
+            Data      json.RawMessage `json:"data"`
+            Signature string          `json:"signature"`
+        }
+        require.NoError(t, json.Unmarshal((<-client.Send).Data, &response))
+        if response.Type == "agent_control_response" {
+            assert.Equal(t, messageSignature(key, response.Type, response.Data), response.Signature)
+            verified = true
+        }
+    }
+    assert.True(t, verified, "no agent_control_response received")
+
+    assert.Empty(t, client.Send)
+
+    // A signature failure is refused, then the client is closed
+    for name, message := range map[string][]byte{
+        "tampered": signed("agent_control", `{"agent_id":"agent-2","command":"start"}`, messageSignature(key, "agent_control", []byte(payload))),
+        "retyped":  signed("subscribe", payload, messageSignature(key, "agent_control", []byte(payload))),
+        "unsigned": []byte(`{"type":"agent_control","payload":` + payload + `}`),
+    } {
+        client := newTestClient()
+        client.Principal = "trader"
+        s.RegisterClient(client)
+        s.HandleClientMessage(client, message)
+        response := readResponse(t, client)
+        require.NotNil(t, response.Error, name)
+        assert.Equal(t, 401, response.Error.Code, name)
+        _, open := <-client.Send
+        assert.False(t, open, name)
+        assert.Equal(t, DisconnectAuthFailed, client.DisconnectReason(), name)
+    }
+}
+
+func TestDisabledMessageTypesAreRejected(t *testing.T) {
+    s := NewWebSocketServer()
+    s.EnabledMessageTypes = map[ClientMessageType]bool{SubscribeRequest: true, TransactionQuery: true}
+    client := newRegisteredClient(s)
+
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"agent-1"}}`))
+    response := readResponse(t, client)
+    assert.True(t, response.Success)
+    assert.Equal(t, "subscribe_response", response.Type)
+
+    s.HandleClientMessage(client, []byte(`{"type":"agent_control","payload":{"agent_id":"agent-1","command":"stop"}}`))
+    response = readResponse(t, client)
+    require.NotNil(t, response.Error)
+    assert.Equal(t, 403, response.Error.Code)
+    assert.Empty(t, client.Send, "a disabled command is never dispatched")
+
+    // Unknown types are still reported as unknown
+    s.HandleClientMessage(client, []byte(`{"type":"bogus"}`))
+    assert.Equal(t, 400, readResponse(t, client).Error.Code)
+
+    // Protocol messages keep working without being listed
+    s.HandleClientMessage(client, []byte(`{"type":"health"}`))
+    assert.Equal(t, "health_response", readResponse(t, client).Type)
+    s.HandleClientMessage(client, []byte(`{"type":"ack","payload":{"message_id":"msg-unknown"}}`))
+    s.HandleClientMessage(client, []byte(`{"type":"pong"}`))
+    for len(client.Send) > 0 {
+        response = readResponse(t, client)
+        assert.False(t, response.Error != nil && response.Error.Code == 403, "protocol message refused: %+v", response.Error)
+    }
+
+    assert.Equal(t, []string{"ack", "health", "hello", "ping", "pong", "server_time", "subscribe", "transaction_query"}, s.messageTypes())
+}
+
+func TestPongPayloadReachesOnPong(t *testing.T) {
+    s := NewWebSocketServer()
+    type pong struct {
+        client  *Client
+        payload json.RawMessage
+    }
+    var pongs []pong
+    s.OnPong = func(client *Client, payload json.RawMessage) {
+        pongs = append(pongs, pong{client, payload})
+    }
+    client := newRegisteredClient(s)
+
+    s.HandleClientMessage(client, []byte(`{"type":"pong","payload":{"cpu":0.42,"battery":87}}`))
+    s.HandleClientMessage(client, []byte(`{"type":"pong"}`))
+
+    require.Len(t, pongs, 2)
+    assert.Same(t, client, pongs[0].client)
+    assert.JSONEq(t, `{"cpu":0.42,"battery":87}`, string(pongs[0].payload))
+    assert.Nil(t, pongs[1].payload, "a pong without data passes a nil payload")
+    assert.Empty(t, client.Send, "pongs are not answered")
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+    "encoding/json"
+    "log"
+    "net/http"
+    "time"
+
+    "github.com/gorilla/websocket"
+)
+
+// Limits applied to unauthenticated health probe connections, which are answered once and closed.
+const (
+    probeReadLimit = 512
+    probeTimeout   = 5 * time.Second
+)
+
+// HealthPayload is the reply to a health message. It is deliberately minimal because
+// unauthenticated probes may request it.
+type HealthPayload struct {
+    Status        string `json:"status"` // "ok", or "shutting_down" once Shutdown has begun
+    UptimeSeconds int64  `json:"uptime_seconds"`
+    Clients       int    `json:"clients"` // Connected, registered clients
+}
+
+// health reports the server's current status.
+func (s *WebSocketServer) health() HealthPayload {
+    s.Mutex.RLock()
+    clients := len(s.Clients)
+    s.Mutex.RUnlock()
+
+    status := "ok"
+    if s.shuttingDown.Load() {
+        status = "shutting_down"
+    }
+    return HealthPayload{
+        Status:        status,
+        UptimeSeconds: int64(s.Clock.Now().Sub(s.startedAt) / time.Second),
+        Clients:       clients,
+    }
+}
+
+// handleHealth answers a health message from a connected client.
+func (s *WebSocketServer) handleHealth(client *Client) {
+    s.sendResponseToClient(client, ResponseMessage{Type: "health_response", Success: true, Data: s.health()})
+}
+
+// serveHealthProbe upgrades an unauthenticated connection, answers a single health message on
+// it and closes it; any other message is refused with 401 and closed with CloseAuthFailed.
+// Probes are never registered, so they receive no broadcasts and take no client slot, but no
+// more than MaxHealthProbes are served at once.
+func (s *WebSocketServer) serveHealthProbe(w http.ResponseWriter, r *http.Request) {
+    if probes := s.probes.Add(1); s.MaxHealthProbes > 0 && probes > int64(s.MaxHealthProbes) {
+        s.probes.Add(-1)
+        http.Error(w, "Too many health probes", http.StatusServiceUnavailable)
+        return
+    }
+    defer s.probes.Add(-1)
+    ws, err := s.upgrade(w, r, nil)
+    if err != nil {
+        return
+    }
+    defer ws.Close()
+    ws.SetReadLimit(probeReadLimit)
+    ws.SetReadDeadline(time.Now().Add(probeTimeout))
+    _, data, err := ws.ReadMessage()
+    if err != nil {
+        return
+    }
+
+    response := ResponseMessage{
+        Type:    "error",
+        Success: false,
+        Error:   &ErrorResponse{Code: int(CodeUnauthorized), Message: CodeUnauthorized.Message()},
+    }
+    closeCode := CloseAuthFailed
+    var msg ClientMessage
+    if json.Unmarshal(data, &msg) == nil && msg.Type == HealthRequest {
+        response = ResponseMessage{Type: "health_response", Success: true, Data: s.health()}
+        closeCode = websocket.CloseNormalClosure
+    }
+
+    response.V = ResponseVersion
+    ws.SetWriteDeadline(time.Now().Add(probeTimeout))
+    if err := ws.WriteJSON(response); err != nil {
+        log.Printf("Failed to answer health probe: %v", err)
+        return
+    }
+    closeMsg := websocket.FormatCloseMessage(closeCode, "")
+    ws.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+}
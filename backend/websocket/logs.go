@@ -0,0 +1,124 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "strings"
+    "time"
+)
+
+// logsTopicPrefix marks topics tailing an agent's log, e.g. "logs:agent-1".
+const logsTopicPrefix = "logs:"
+
+// AgentLogLine is one line of an agent's log.
+type AgentLogLine struct {
+    Level     string    // One of debug, info, warn or error; other levels rank as info
+    Message   string
+    Timestamp time.Time
+}
+
+// AgentLogSource tails agent logs for "logs:<agent_id>" subscriptions.
+type AgentLogSource interface {
+    // Tail streams the agent's log lines as they are written until ctx is cancelled, then
+    // closes the channel.
+    Tail(ctx context.Context, agentID string) (<-chan AgentLogLine, error)
+}
+
+// AgentLogPayload carries one log line to a "logs:<agent_id>" subscriber.
+type AgentLogPayload struct {
+    SubscriptionID string    `json:"subscription_id"`
+    AgentID        string    `json:"agent_id"`
+    Level          string    `json:"level"`
+    Message        string    `json:"message"`
+    Timestamp      time.Time `json:"timestamp"`
+}
+
+// logLevels ranks the log levels a subscription's min_level may name.
+var logLevels = map[string]int32{
+    "debug": 0,
+    "info":  1,
+    "warn":  2,
+    "error": 3,
+}
+
+// logLevelRank returns the rank of a log line's level, treating unknown levels as info.
+func logLevelRank(level string) int32 {
+    if rank, ok := logLevels[strings.ToLower(level)]; ok {
+        return rank
+    }
+    return logLevels["info"]
+}
+
+// logsAgentID returns the agent a topic tails the log of, if it is a logs topic.
+func logsAgentID(topic string) (string, bool) {
+    if !strings.HasPrefix(topic, logsTopicPrefix) {
+        return "", false
+    }
+    return strings.TrimPrefix(topic, logsTopicPrefix), true
+}
+
+// logTail is an open tail of an agent's log, owned by the subscription it feeds.
+type logTail struct {
+    agentID string
+    lines   <-chan AgentLogLine
+    ctx     context.Context
+    stop    context.CancelFunc
+}
+
+// openLogTail starts tailing an agent's log for a new logs subscription.
+func (s *WebSocketServer) openLogTail(agentID string) (*logTail, error) {
+    if s.LogSource == nil {
+        return nil, fmt.Errorf("log streaming is not supported")
+    }
+    if agentID == "" || strings.Contains(agentID, "*") {
+        return nil, fmt.Errorf("logs topics must name a single agent")
+    }
+    ctx, cancel := context.WithCancel(context.Background())
+    lines, err := s.LogSource.Tail(ctx, agentID)
+    if err != nil {
+        cancel()
+        log.Printf("Failed to tail logs for agent %s: %v", agentID, err)
+        return nil, fmt.Errorf("cannot tail logs for agent %s", agentID)
+    }
+    return &logTail{agentID: agentID, lines: lines, ctx: ctx, stop: cancel}, nil
+}
+
+// streamLogs forwards a subscription's log lines at or above its minimum level to the client
+// as agent_log messages until the tail is stopped by unsubscribing.
+func (s *WebSocketServer) streamLogs(client *Client, subscription *Subscription, tail *logTail) {
+    for {
+        select {
+        case <-tail.ctx.Done():
+            return
+        case line, ok := <-tail.lines:
+            if !ok {
+                return
+            }
+            if logLevelRank(line.Level) < subscription.minLevel.Load() {
+                continue
+            }
+            s.sendLogLine(client, subscription.ID, tail.agentID, line)
+        }
+    }
+}
+
+// sendLogLine queues one agent_log message for the client.
+func (s *WebSocketServer) sendLogLine(client *Client, subscriptionID, agentID string, line AgentLogLine) {
+    jsonData, err := json.Marshal(Message{
+        Type: AgentLog,
+        Payload: AgentLogPayload{
+            SubscriptionID: subscriptionID,
+            AgentID:        agentID,
+            Level:          line.Level,
+            Message:        line.Message,
+            Timestamp:      line.Timestamp,
+        },
+    })
+    if err != nil {
+        log.Printf("Failed to marshal agent log line: %v", err)
+        return
+    }
+    s.queueToClient(client, jsonData)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+    "container/list"
+    "context"
+    "encoding/json"
+    "fmt"
+    "log"
+    "strings"
+)
+
+// mempoolTopicPrefix marks topics streaming a blockchain's pending transactions, e.g.
+// "mempool:solana".
+const mempoolTopicPrefix = "mempool:"
+
+// MempoolSource streams the pending transactions of a blockchain for "mempool:<blockchain>"
+// subscriptions.
+type MempoolSource interface {
+    // Pending streams transactions as they enter the blockchain's mempool until ctx is
+    // cancelled, then closes the channel.
+    Pending(ctx context.Context, blockchain string) (<-chan TransactionPayload, error)
+}
+
+// mempoolChain returns the blockchain a topic streams the mempool of, if it is a mempool topic.
+func mempoolChain(topic string) (string, bool) {
+    if !strings.HasPrefix(topic, mempoolTopicPrefix) {
+        return "", false
+    }
+    return strings.TrimPrefix(topic, mempoolTopicPrefix), true
+}
+
+// hasParty reports whether a transaction is of the subscription's agent_id and from or to its
+// address, where set. Only a mempool subscription sets them; other payloads are let through.
+func (sub *Subscription) hasParty(payload interface{}) bool {
+    if sub.AgentID == "" && sub.Address == "" {
+        return true
+    }
+    tx, ok := payload.(TransactionPayload)
+    if !ok {
+        return true
+    }
+    return (sub.AgentID == "" || tx.AgentID == sub.AgentID) && (sub.Address == "" || matchesAddress(tx, sub.Address, DirectionAny))
+}
+
+// mempoolStream is an open stream of a blockchain's pending transactions, owned by the
+// subscription it feeds.
+type mempoolStream struct {
+    blockchain string
+    txs        <-chan TransactionPayload
+    ctx        context.Context
+    stop       context.CancelFunc
+}
+
+// openMempoolStream starts streaming a blockchain's pending transactions for a new mempool
+// subscription.
+func (s *WebSocketServer) openMempoolStream(blockchain string) (*mempoolStream, error) {
+    if s.Mempool == nil {
+        return nil, fmt.Errorf("mempool streaming is not supported")
+    }
+    if blockchain == "" || strings.Contains(blockchain, "*") {
+        return nil, fmt.Errorf("mempool topics must name a single blockchain")
+    }
+    ctx, cancel := context.WithCancel(context.Background())
+    txs, err := s.Mempool.Pending(ctx, blockchain)
+    if err != nil {
+        cancel()
+        log.Printf("Failed to stream mempool of %s: %v", blockchain, err)
+        return nil, fmt.Errorf("cannot stream mempool of %s", blockchain)
+    }
+    return &mempoolStream{blockchain: blockchain, txs: txs, ctx: ctx, stop: cancel}, nil
+}
+
+// streamMempool delivers a subscription's pending transactions to the client, marked
+// "pending", until the stream is stopped by unsubscribing. Each one the subscription's filter
+// admits is remembered, so the transaction's next update, such as its confirmation, follows
+// it to the subscription.
+func (s *WebSocketServer) streamMempool(client *Client, subscription *Subscription, stream *mempoolStream) {
+    for {
+        select {
+        case <-stream.ctx.Done():
+            return
+        case tx, ok := <-stream.txs:
+            if !ok {
+                return
+            }
+            tx.Status = "pending"
+            tx.structureAmount()
+            s.deliverPending(client, subscription, tx)
+        }
+    }
+}
+
+// deliverPending delivers one pending transaction through the send path, under the same lock
+// as broadcasts so it reaches the client ahead of any later update to the transaction.
+func (s *WebSocketServer) deliverPending(client *Client, subscription *Subscription, tx TransactionPayload) {
+    message := Message{Type: TransactionUpdate, Payload: tx}
+    jsonData, err := json.Marshal(message)
+    if err != nil {
+        log.Printf("Failed to marshal pending transaction %s: %v", tx.TxID, err)
+        return
+    }
+    frames := &broadcastFrames{message: message, plain: jsonData, byTopic: make(map[string][]byte)}
+    fields := &payloadFields{payload: tx}
+
+    s.Mutex.Lock()
+    if client.Subscriptions[subscription.ID] != subscription {
+        s.Mutex.Unlock()
+        return
+    }
+    if txID, err := s.normalizeTopic(tx.TxID); err == nil && subscription.admits(fields) {
+        subscription.pending.follow(txID)
+    }
+    // Only the subscription that opened the stream receives it, not others on the same pattern
+    queued := s.deliverToLocked(client, []*Subscription{subscription}, []string{subscription.Pattern}, "", frames, fields)
+    s.Mutex.Unlock()
+
+    if !queued {
+        s.disconnectSlowClient(client)
+    }
+}
+
+// stopStreams stops the log tail and mempool stream opened for a subscribe that failed.
+func stopStreams(tail *logTail, mempool *mempoolStream) {
+    if tail != nil {
+        tail.stop()
+    }
+    if mempool != nil {
+        mempool.stop()
+    }
+}
+
+// settleMempoolLocked forgets the pending transaction a broadcast settles, once delivered to
+// the mempool subscriptions that followed it. The caller must hold the write lock.
+func settleMempoolLocked(subscriptions []*Subscription, payload interface{}, topics []string) {
+    tx, ok := payload.(TransactionPayload)
+    if !ok || tx.Status == "pending" || len(topics) == 0 {
+        return
+    }
+    for _, subscription := range subscriptions {
+        if subscription.pending != nil {
+            subscription.pending.settle(topics[0])
+        }
+    }
+}
+
+// pendingTxs is the set of pending transactions a mempool subscription follows. Transactions
+// dropped from the mempool or replaced never settle, so once limit are followed the one first
+// seen longest ago is forgotten.
+type pendingTxs struct {
+    limit int
+    txs   map[string]*list.Element
+    order *list.List // First seen longest ago first; values are transaction IDs
+}
+
+// newPendingTxs creates a set following up to limit transactions; zero or less is unbounded.
+func newPendingTxs(limit int) *pendingTxs {
+    return &pendingTxs{limit: limit, txs: make(map[string]*list.Element), order: list.New()}
+}
+
+// follow adds a transaction seen pending, forgetting the oldest when the set is full.
+func (p *pendingTxs) follow(txID string) {
+    if _, ok := p.txs[txID]; ok {
+        return
+    }
+    p.txs[txID] = p.order.PushBack(txID)
+    if p.limit > 0 && p.order.Len() > p.limit {
+        p.settle(p.order.Front().Value.(string))
+    }
+}
+
+// follows reports whether the transaction is followed.
+func (p *pendingTxs) follows(txID string) bool {
+    _, ok := p.txs[txID]
+    return ok
+}
+
+// settle stops following a transaction.
+func (p *pendingTxs) settle(txID string) {
+    if element, ok := p.txs[txID]; ok {
+        p.order.Remove(element)
+        delete(p.txs, txID)
+    }
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+    "log"
+    "time"
+)
+
+// handlerDurationBuckets are the upper bounds of the buckets handler durations are counted in.
+var handlerDurationBuckets = []time.Duration{
+    time.Millisecond,
+    5 * time.Millisecond,
+    25 * time.Millisecond,
+    100 * time.Millisecond,
+    500 * time.Millisecond,
+    time.Second,
+    5 * time.Second,
+}
+
+// DurationHistogram counts handler durations. Buckets[i] counts durations up to
+// handlerDurationBuckets[i] not counted in an earlier bucket; the last bucket counts the rest.
+type DurationHistogram struct {
+    Buckets []uint64
+    Count   uint64
+    Sum     time.Duration
+}
+
+// observe counts one duration.
+func (h *DurationHistogram) observe(d time.Duration) {
+    i := 0
+    for i < len(handlerDurationBuckets) && d > handlerDurationBuckets[i] {
+        i++
+    }
+    h.Buckets[i]++
+    h.Count++
+    h.Sum += d
+}
+
+// observeHandler records how long the handler for msgType took with a client's message,
+// warning about handlers slower than SlowHandlerThreshold. Types without a handler are
+// recorded as "unknown" so clients cannot create histograms at will.
+func (s *WebSocketServer) observeHandler(client *Client, msgType ClientMessageType, d time.Duration) {
+    if _, registered := s.registeredHandler(msgType); !registered && !builtinMessageTypes[msgType] {
+        msgType = "unknown"
+    }
+    if s.SlowHandlerThreshold > 0 && d > s.SlowHandlerThreshold {
+        log.Printf("Slow handler: %s message from client %s took %v", msgType, client.ID, d)
+    }
+
+    s.handlerTimesMu.Lock()
+    defer s.handlerTimesMu.Unlock()
+    histogram, ok := s.handlerTimes[msgType]
+    if !ok {
+        histogram = &DurationHistogram{Buckets: make([]uint64, len(handlerDurationBuckets)+1)}
+        s.handlerTimes[msgType] = histogram
+    }
+    histogram.observe(d)
+}
+
+// HandlerDurations returns a histogram of how long message handlers have taken, by message type.
+func (s *WebSocketServer) HandlerDurations() map[ClientMessageType]DurationHistogram {
+    s.handlerTimesMu.Lock()
+    defer s.handlerTimesMu.Unlock()
+    durations := make(map[ClientMessageType]DurationHistogram, len(s.handlerTimes))
+    for msgType, histogram := range s.handlerTimes {
+        copied := *histogram
+        copied.Buckets = append([]uint64(nil), histogram.Buckets...)
+        durations[msgType] = copied
+    }
+    return durations
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+    "net/http"
+    "net/url"
+    "strings"
+)
+
+// originAllowed reports whether the request's Origin header may connect: it must match one of
+// AllowedOrigins, or the request's own host when none are configured.
+func (s *WebSocketServer) originAllowed(r *http.Request) bool {
+    origin := r.Header.Get("Origin")
+    if origin == "" {
+        return true
+    }
+    u, err := url.Parse(strings.ToLower(origin))
+    if err != nil || u.Host == "" {
+        return false
+    }
+
+    if len(s.AllowedOrigins) == 0 {
+        return strings.EqualFold(u.Host, r.Host)
+    }
+    for _, allowed := range s.AllowedOrigins {
+        if originMatches(allowed, u) {
+            return true
+        }
+    }
+    return false
+}
+
+// originMatches reports whether origin matches the allowed origin pattern. Scheme and port
+// must be equal, and the hosts must have the same labels, where a '*' label in the pattern
+// matches any one DNS label: "https://*.example.com" admits "https://eu.example.com" but
+// neither "https://a.b.example.com" nor "https://example.com.evil.io".
+func originMatches(allowed string, origin *url.URL) bool {
+    pattern, err := url.Parse(strings.ToLower(allowed))
+    if err != nil || pattern.Scheme != origin.Scheme || pattern.Port() != origin.Port() {
+        return false
+    }
+    patternLabels := strings.Split(pattern.Hostname(), ".")
+    labels := strings.Split(origin.Hostname(), ".")
+    if len(patternLabels) != len(labels) {
+        return false
+    }
+    for i, label := range patternLabels {
+        if labels[i] == "" || (label != "*" && label != labels[i]) {
+            return false
+        }
+    }
+    return true
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+    "encoding/json"
+    "log"
+)
+
+// handlePause stops deliveries to one of the client's subscriptions without removing it.
+// Broadcasts it alone would have received are skipped, or buffered when the request sets
+// buffer, until the subscription is resumed.
+func (s *WebSocketServer) handlePause(client *Client, payload json.RawMessage) {
+    data, ok := s.payloadObject(client, payload, "pause", &PausePayload{})
+    if !ok {
+        return
+    }
+
+    request, errs := validatePause(data)
+    if len(errs) > 0 {
+        s.sendValidationErrorToClient(client, errs)
+        return
+    }
+
+    topic, ok := s.targetTopic(client, request.Topic, request.SubscriptionID)
+    if !ok {
+        return
+    }
+
+    s.Mutex.Lock()
+    subscription := client.targetSubscription(topic, request.SubscriptionID)
+    if subscription != nil {
+        subscription.paused = true
+        subscription.buffering = request.Buffer
+        if !request.Buffer {
+            subscription.buffered = nil
+        }
+    }
+    s.Mutex.Unlock()
+
+    if subscription == nil {
+        s.sendUnknownTarget(client, topic, request.SubscriptionID)
+        return
+    }
+    log.Printf("Client paused subscription to topic: %s (%s)", subscription.Pattern, subscription.ID)
+    s.sendResponseToClient(client, ResponseMessage{
+        Type:    "pause_response",
+        Success: true,
+        Data: map[string]interface{}{
+            "topic":           subscription.Pattern,
+            "subscription_id": subscription.ID,
+            "buffer":          request.Buffer,
+        },
+    })
+}
+
+// handleResume restarts a paused subscription. Broadcasts it buffered while paused are
+// queued, oldest first, before the resume_response and before any later broadcast.
+func (s *WebSocketServer) handleResume(client *Client, payload json.RawMessage) {
+    data, ok := s.payloadObject(client, payload, "resume", &UnsubscribePayload{})
+    if !ok {
+        return
+    }
+
+    request, errs := validateUnsubscribe(data)
+    if len(errs) > 0 {
+        s.sendValidationErrorToClient(client, errs)
+        return
+    }
+
+    topic, ok := s.targetTopic(client, request.Topic, request.SubscriptionID)
+    if !ok {
+        return
+    }
+
+    replayed := 0
+    overflowed := false
+    s.Mutex.Lock()
+    subscription := client.targetSubscription(topic, request.SubscriptionID)
+    if subscription != nil {
+        for _, frame := range subscription.buffered {
+            if !s.enqueue(client, frame) {
+                overflowed = true
+                break
+            }
+            replayed++
+        }
+        subscription.paused = false
+        subscription.buffering = false
+        subscription.buffered = nil
+    }
+    s.Mutex.Unlock()
+
+    if subscription == nil {
+        s.sendUnknownTarget(client, topic, request.SubscriptionID)
+        return
+    }
+    if overflowed {
+        s.disconnectSlowClient(client)
+        return
+    }
+    log.Printf("Client resumed subscription to topic: %s (%s), replayed %d broadcasts", subscription.Pattern, subscription.ID, replayed)
+    s.sendResponseToClient(client, ResponseMessage{
+        Type:    "resume_response",
+        Success: true,
+        Data: map[string]interface{}{
+            "topic":           subscription.Pattern,
+            "subscription_id": subscription.ID,
+            "replayed":        replayed,
+        },
+    })
+}
+
+// targetTopic returns the normalized topic naming a pause or resume target, or "" when a
+// subscription ID names it instead, reporting a malformed topic to the client.
+func (s *WebSocketServer) targetTopic(client *Client, topic, subscriptionID string) (string, bool) {
+    if subscriptionID != "" {
+        return "", true
+    }
+    normalized, err := s.normalizeTopic(topic)
+    if err != nil {
+        s.sendErrorMessage(client, CodeBadRequest, err.Error(), nil)
+        return "", false
+    }
+    return normalized, true
+}
+
+// targetSubscription returns the subscription with subscriptionID if set, or else the one
+// with exactly pattern, or nil. The caller must hold the server mutex.
+func (c *Client) targetSubscription(pattern, subscriptionID string) *Subscription {
+    if subscriptionID != "" {
+        return c.Subscriptions[subscriptionID]
+    }
+    return c.subscriptionByPattern(pattern)
+}
+
+// sendUnknownTarget reports a pause or resume naming no subscription the client holds.
+func (s *WebSocketServer) sendUnknownTarget(client *Client, topic, subscriptionID string) {
+    if subscriptionID != "" {
+        s.sendErrorMessage(client, CodeNotFound, "Unknown subscription_id: "+subscriptionID, nil)
+        return
+    }
+    s.sendErrorMessage(client, CodeNotFound, "Not subscribed to topic: "+topic, nil)
+}
+
+// bufferPausedLocked keeps a frame for replay when the paused subscription resumes, dropping
+// the oldest buffered frame once PausedBufferSize are kept. The caller must hold the write lock.
+func (s *WebSocketServer) bufferPausedLocked(subscription *Subscription, frame []byte) {
+    if s.PausedBufferSize <= 0 {
+        return
+    }
+    if len(subscription.buffered) >= s.PausedBufferSize {
+        subscription.buffered = subscription.buffered[1:]
+    }
+    subscription.buffered = append(subscription.buffered, frame)
+}
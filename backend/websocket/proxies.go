@@ -0,0 +1,95 @@
+package main
+
+import (
+    "net"
+    "net/http"
+    "strings"
+)
+
+// clientIP returns the address of the client behind a request. When the direct peer is one of
+// TrustedProxies, the Forwarded header, or else X-Forwarded-For, is walked from the nearest hop
+// outwards past any further trusted proxies, and the first untrusted address is the client's.
+// Headers from untrusted peers are ignored, as anyone can send them.
+func (s *WebSocketServer) clientIP(r *http.Request) string {
+    peer := r.RemoteAddr
+    if host, _, err := net.SplitHostPort(peer); err == nil {
+        peer = host
+    }
+    if !s.trustedProxy(peer) {
+        return peer
+    }
+
+    hops := forwardedFor(r.Header.Values("Forwarded"))
+    if len(hops) == 0 {
+        for _, header := range r.Header.Values("X-Forwarded-For") {
+            for _, hop := range strings.Split(header, ",") {
+                hops = append(hops, strings.TrimSpace(hop))
+            }
+        }
+    }
+    client := peer
+    for i := len(hops) - 1; i >= 0; i-- {
+        // An unknown or obfuscated hop ends the chain at the last address known
+        if net.ParseIP(hops[i]) == nil {
+            break
+        }
+        client = hops[i]
+        if !s.trustedProxy(client) {
+            break
+        }
+    }
+    return client
+}
+
+// forwardedFor returns the for= addresses of RFC 7239 Forwarded headers, farthest hop first,
+// without quotes, brackets or ports.
+func forwardedFor(headers []string) []string {
+    var hops []string
+    for _, header := range headers {
+        for _, element := range strings.Split(header, ",") {
+            for _, pair := range strings.Split(element, ";") {
+                name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+                if !ok || !strings.EqualFold(name, "for") {
+                    continue
+                }
+                value = strings.Trim(value, `"`)
+                if host, _, err := net.SplitHostPort(value); err == nil {
+                    value = host
+                }
+                hops = append(hops, strings.Trim(value, "[]"))
+            }
+        }
+    }
+    return hops
+}
+
+// trustedProxy reports whether ip matches one of TrustedProxies, given as addresses or CIDR
+// ranges. Entries that parse as neither never match.
+func (s *WebSocketServer) trustedProxy(ip string) bool {
+    addr := net.ParseIP(ip)
+    if addr == nil {
+        return false
+    }
+    for _, proxy := range s.TrustedProxies {
+        if _, network, err := net.ParseCIDR(proxy); err == nil {
+            if network.Contains(addr) {
+                return true
+            }
+        } else if trusted := net.ParseIP(proxy); trusted != nil && trusted.Equal(addr) {
+            return true
+        }
+    }
+    return false
+}
+
+// connectionsFromLocked returns the number of registered clients connected from ip. The
+// caller must hold the server mutex.
+func (s *WebSocketServer) connectionsFromLocked(ip string) int {
+    count := 0
+    for client := range s.Clients {
+        if client.RemoteIP == ip {
+            count++
+        }
+    }
+    return count
+}
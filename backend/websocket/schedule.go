@@ -0,0 +1,182 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "sort"
+    "time"
+)
+
+// scheduledCommand is an agent control request waiting for its execute_at time. It runs even
+// if the client that sent it has disconnected by then, as the principal that sent it.
+type scheduledCommand struct {
+    id        string
+    principal string
+    request   AgentControlPayload
+    issued    time.Time // When the command was received
+}
+
+// CancelCommandPayload defines the payload of a cancel_command request.
+type CancelCommandPayload struct {
+    CommandID string `json:"command_id"`
+}
+
+// scheduleAgentCommand holds an authorized command with execute_at set until it is due and
+// tells the client the command_id it can cancel it with. It is refused with 429 if the
+// client's principal or the agent already has as many commands scheduled as allowed.
+func (s *WebSocketServer) scheduleAgentCommand(client *Client, request AgentControlPayload) {
+    command := &scheduledCommand{
+        id:        fmt.Sprintf("cmd-%d", s.commandSeq.Add(1)),
+        principal: client.Principal,
+        request:   request,
+        issued:    s.Clock.Now(),
+    }
+    s.scheduledMu.Lock()
+    byPrincipal, byAgent := 0, 0
+    for _, scheduled := range s.scheduled {
+        if scheduled.principal == command.principal {
+            byPrincipal++
+        }
+        if scheduled.request.AgentID == request.AgentID {
+            byAgent++
+        }
+    }
+    var refusal string
+    switch {
+    case s.MaxScheduled > 0 && byPrincipal >= s.MaxScheduled:
+        refusal = fmt.Sprintf("At most %d commands may be scheduled at once", s.MaxScheduled)
+    case s.MaxScheduledPerAgent > 0 && byAgent >= s.MaxScheduledPerAgent:
+        refusal = fmt.Sprintf("At most %d commands may be scheduled for agent %s", s.MaxScheduledPerAgent, request.AgentID)
+    default:
+        s.scheduled[command.id] = command
+    }
+    s.scheduledMu.Unlock()
+    if refusal != "" {
+        s.logCommand(client.Principal, command.issued, request, "schedule_full", nil)
+        s.sendErrorMessage(client, CodeTooManyRequests, refusal, nil)
+        return
+    }
+
+    log.Printf("Scheduled agent control command %s for agent %s at %s (%s)", request.Command, request.AgentID, request.ExecuteAt.Format(time.RFC3339), command.id)
+    s.sendResponseToClient(client, ResponseMessage{
+        Type:    "agent_control_ack",
+        Success: true,
+        Data: map[string]interface{}{
+            "agent_id":   request.AgentID,
+            "command":    request.Command,
+            "status":     "scheduled",
+            "command_id": command.id,
+            "execute_at": request.ExecuteAt,
+        },
+    })
+}
+
+// runDueCommands queues every scheduled command whose execute_at has passed on its agent's
+// queue, earliest first, where it runs like a command sent at that moment by the principal
+// that scheduled it. Each is authorized again first, since the principal's rights may have
+// changed meanwhile.
+func (s *WebSocketServer) runDueCommands() {
+    now := s.Clock.Now()
+    var due []*scheduledCommand
+    s.scheduledMu.Lock()
+    for id, command := range s.scheduled {
+        if !command.request.ExecuteAt.After(now) {
+            due = append(due, command)
+            delete(s.scheduled, id)
+        }
+    }
+    s.scheduledMu.Unlock()
+
+    sort.Slice(due, func(i, j int) bool {
+        return due[i].request.ExecuteAt.Before(*due[j].request.ExecuteAt)
+    })
+    for _, command := range due {
+        client := s.principalClient(command.principal)
+        request := command.request
+        allowed, err := s.canControl(client, request.AgentID, request.Command)
+        if err != nil {
+            s.logCommand(command.principal, command.issued, request, "failed", err)
+            s.sendInternalErrorToClient(client, CodeInternal, "Authorization check failed", err)
+            continue
+        }
+        if !allowed {
+            log.Printf("Dropped scheduled command %s: principal %q may no longer %s agent %s", command.id, command.principal, request.Command, request.AgentID)
+            s.logCommand(command.principal, command.issued, request, "forbidden", nil)
+            s.sendErrorMessage(client, CodeForbidden, fmt.Sprintf("Not authorized to %s agent %s", request.Command, request.AgentID), nil)
+            continue
+        }
+        log.Printf("Running scheduled command %s", command.id)
+        s.queueAgentCommand(client, request)
+    }
+}
+
+// principalClient returns the newest connection of principal, which a due scheduled command
+// answers. With none connected it returns an unregistered client carrying only the principal,
+// so the command still runs but its responses are dropped.
+func (s *WebSocketServer) principalClient(principal string) *Client {
+    s.Mutex.RLock()
+    defer s.Mutex.RUnlock()
+    if connections := s.principals[principal]; len(connections) > 0 {
+        return connections[len(connections)-1]
+    }
+    return &Client{ID: "scheduler", Principal: principal, Subscriptions: make(map[string]*Subscription)}
+}
+
+// handleCancelCommand cancels a scheduled command before it runs. Any client allowed to send
+// the command to its agent may cancel it, not only the one that scheduled it.
+func (s *WebSocketServer) handleCancelCommand(client *Client, payload json.RawMessage) {
+    data, ok := s.payloadObject(client, payload, "cancel command", &CancelCommandPayload{})
+    if !ok {
+        return
+    }
+
+    errs := FieldErrors{}
+    commandID := data.requireString("command_id", errs)
+    if len(errs) > 0 {
+        s.sendValidationErrorToClient(client, errs)
+        return
+    }
+
+    s.scheduledMu.Lock()
+    command, found := s.scheduled[commandID]
+    s.scheduledMu.Unlock()
+    if !found {
+        s.sendErrorMessage(client, CodeNotFound, "No scheduled command with command_id: "+commandID, nil)
+        return
+    }
+
+    request := command.request
+    allowed, err := s.canControl(client, request.AgentID, request.Command)
+    if err != nil {
+        s.sendInternalErrorToClient(client, CodeInternal, "Authorization check failed", err)
+        return
+    }
+    if !allowed {
+        s.sendErrorMessage(client, CodeForbidden, fmt.Sprintf("Not authorized to %s agent %s", request.Command, request.AgentID), nil)
+        return
+    }
+
+    // The command may have fallen due while authorization was checked
+    s.scheduledMu.Lock()
+    _, found = s.scheduled[commandID]
+    delete(s.scheduled, commandID)
+    s.scheduledMu.Unlock()
+    if !found {
+        s.sendErrorMessage(client, CodeNotFound, "No scheduled command with command_id: "+commandID, nil)
+        return
+    }
+
+    s.logCommand(client.Principal, command.issued, request, "cancelled", nil)
+    log.Printf("Cancelled scheduled command %s", commandID)
+    s.sendResponseToClient(client, ResponseMessage{
+        Type:    "cancel_command_response",
+        Success: true,
+        Data: map[string]interface{}{
+            "command_id": commandID,
+            "agent_id":   request.AgentID,
+            "command":    request.Command,
+            "status":     "cancelled",
+        },
+    })
+}
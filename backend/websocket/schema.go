@@ -0,0 +1,149 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "math"
+    "sort"
+    "strings"
+)
+
+// ParamSchema is the subset of JSON Schema used to validate agent control params: type,
+// properties, required, additionalProperties, enum, minimum, maximum, minLength, maxLength and
+// items. It is usually loaded from a schema document with json.Unmarshal.
+type ParamSchema struct {
+    Type                 string                  `json:"type,omitempty"` // object, array, string, number, integer or boolean
+    Properties           map[string]*ParamSchema `json:"properties,omitempty"`
+    Required             []string                `json:"required,omitempty"`
+    AdditionalProperties *bool                   `json:"additionalProperties,omitempty"` // Unset allows unlisted properties
+    Enum                 []interface{}           `json:"enum,omitempty"`
+    Minimum              *float64                `json:"minimum,omitempty"`
+    Maximum              *float64                `json:"maximum,omitempty"`
+    MinLength            *int                    `json:"minLength,omitempty"`
+    MaxLength            *int                    `json:"maxLength,omitempty"`
+    Items                *ParamSchema            `json:"items,omitempty"`
+}
+
+// validate checks value against the schema, recording each violation under its path.
+func (schema *ParamSchema) validate(value interface{}, path string, errs FieldErrors) {
+    if !schema.typeMatches(value) {
+        errs.add(path, path+" must be "+article(schema.Type))
+        return
+    }
+
+    if len(schema.Enum) > 0 && !schema.inEnum(value) {
+        errs.add(path, fmt.Sprintf("%s must be one of %s", path, formatEnum(schema.Enum)))
+    }
+
+    switch v := value.(type) {
+    case map[string]interface{}:
+        for _, name := range schema.Required {
+            if _, ok := v[name]; !ok {
+                errs.add(path+"."+name, path+"."+name+" is required")
+            }
+        }
+        names := make([]string, 0, len(v))
+        for name := range v {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+        for _, name := range names {
+            if property, ok := schema.Properties[name]; ok {
+                property.validate(v[name], path+"."+name, errs)
+            } else if schema.AdditionalProperties != nil && !*schema.AdditionalProperties {
+                errs.add(path+"."+name, path+"."+name+" is not a recognized parameter")
+            }
+        }
+    case []interface{}:
+        if schema.Items != nil {
+            for i, item := range v {
+                schema.Items.validate(item, fmt.Sprintf("%s[%d]", path, i), errs)
+            }
+        }
+    case string:
+        if schema.MinLength != nil && len(v) < *schema.MinLength {
+            errs.add(path, fmt.Sprintf("%s must be at least %d characters", path, *schema.MinLength))
+        }
+        if schema.MaxLength != nil && len(v) > *schema.MaxLength {
+            errs.add(path, fmt.Sprintf("%s must be at most %d characters", path, *schema.MaxLength))
+        }
+    case float64:
+        if schema.Minimum != nil && v < *schema.Minimum {
+            errs.add(path, fmt.Sprintf("%s must be at least %v", path, *schema.Minimum))
+        }
+        if schema.Maximum != nil && v > *schema.Maximum {
+            errs.add(path, fmt.Sprintf("%s must be at most %v", path, *schema.Maximum))
+        }
+    }
+}
+
+// typeMatches reports whether value, as decoded from JSON, has the schema's type.
+func (schema *ParamSchema) typeMatches(value interface{}) bool {
+    switch schema.Type {
+    case "":
+        return true
+    case "object":
+        _, ok := value.(map[string]interface{})
+        return ok
+    case "array":
+        _, ok := value.([]interface{})
+        return ok
+    case "string":
+        _, ok := value.(string)
+        return ok
+    case "number":
+        _, ok := value.(float64)
+        return ok
+    case "integer":
+        n, ok := value.(float64)
+        return ok && n == math.Trunc(n)
+    case "boolean":
+        _, ok := value.(bool)
+        return ok
+    }
+    return false
+}
+
+// inEnum reports whether value equals one of the schema's enum values.
+func (schema *ParamSchema) inEnum(value interface{}) bool {
+    encoded, _ := json.Marshal(value)
+    for _, allowed := range schema.Enum {
+        if candidate, _ := json.Marshal(allowed); string(candidate) == string(encoded) {
+            return true
+        }
+    }
+    return false
+}
+
+// formatEnum lists enum values as JSON, e.g. `"low", "high"`.
+func formatEnum(values []interface{}) string {
+    parts := make([]string, len(values))
+    for i, value := range values {
+        encoded, _ := json.Marshal(value)
+        parts[i] = string(encoded)
+    }
+    return strings.Join(parts, ", ")
+}
+
+// article prefixes a schema type name with "a" or "an".
+func article(typeName string) string {
+    if strings.IndexAny(typeName, "aeiou") == 0 {
+        return "an " + typeName
+    }
+    return "a " + typeName
+}
+
+// validateCommandParams checks agent control params against the schema registered for the
+// command in CommandSchemas. Commands without a schema are not checked.
+func (s *WebSocketServer) validateCommandParams(command string, params map[string]interface{}) FieldErrors {
+    errs := FieldErrors{}
+    schema, ok := s.CommandSchemas[command]
+    if !ok {
+        return errs
+    }
+    if params == nil {
+        params = map[string]interface{}{}
+    }
+    schema.validate(params, "params", errs)
+    return errs
+}
@@ -1,11 +1,19 @@
 package main  
            
 import (
+    "context"
     "encoding/json"
+    "errors"
+    "fmt"
     "log" 
+    "math"
+    "math/rand"
     "net/http" 
     "os"
+    "sort"
+    "strings"
     "sync" 
+    "sync/atomic"
     "time" 
    
     "github.com/gorilla/websocket"
@@ -15,16 +23,42 @@ import (
 type MessageType string
 
 const (
-    AgentStatusUpdate  MessageType = "agent_status"
-    TransactionUpdate  MessageType = "transaction_update"
-    HeartbeatPing      MessageType = "ping"
-    HeartbeatPong      MessageType = "pong" 
+    AgentStatusUpdate   MessageType = "agent_status"
+    TransactionUpdate   MessageType = "transaction_update"
+    AgentConfigUpdate   MessageType = "agent_config_update"
+    FlowControl         MessageType = "flow_control"
+    AutoUnsubscribed    MessageType = "auto_unsubscribed"
+    SubscriptionExpired MessageType = "subscription_expired"
+    HeartbeatPing       MessageType = "ping"
+    Welcome             MessageType = "welcome"
+    FrameChunk          MessageType = "frame_chunk"
+    AgentLog            MessageType = "agent_log"
+    Reconnect           MessageType = "reconnect"
+    TopicClosed         MessageType = "topic_closed"
+    InitialState        MessageType = "initial_state"      // Latest state of a topic, sent when subscribing to it
+    MetricUpdate        MessageType = "metric_update"      // An agent's aggregated transaction metrics for one window
+    StateDiff           MessageType = "state_diff"         // States that changed while a restored session was disconnected
+    AgentStatusDelta    MessageType = "agent_status_delta" // The fields of an agent's status that changed, when StatusSnapshotEvery is set
 )
 
+// ProtocolVersion is the version of the message protocol announced in the welcome message.
+const ProtocolVersion = "1"
+
 // Message represents the structure of a WebSocket message.
 type Message struct {  
-    Type    MessageType `json:"type"`
-    Payload interface{} `json:"payload"`
+    Type       MessageType `json:"type"`
+    Payload    interface{} `json:"payload"`
+    RequireAck bool        `json:"require_ack,omitempty"` // Client must reply with an ack carrying MessageID
+    MessageID  string      `json:"message_id,omitempty"`  // Assigned by the server when RequireAck is set
+    Sequence   uint64      `json:"seq,omitempty"`         // Broadcast order, assigned as Start takes the message off Broadcast
+
+    // TTL, if set, bounds how long a broadcast may wait in a client's queue; the writer drops
+    // it unwritten once it has waited longer, as a status that has since changed is not worth sending.
+    TTL time.Duration `json:"-"`
+
+    // MatchedTopic is the concrete topic a client's subscription matched, e.g. "agent-1" for
+    // a subscription to "agent-*". Unset for clients receiving every broadcast.
+    MatchedTopic string `json:"matched_topic,omitempty"`
 } 
 
 // AgentStatusPayload defines the payload for agent status updates.
@@ -35,208 +69,1557 @@ type AgentStatusPayload struct {
     Details     string    `json:"details"`
 }
 
+// AgentConfigPayload defines the payload for agent configuration pushes. Version increases
+// with every push for an agent so clients can discard stale updates.
+type AgentConfigPayload struct {
+    AgentID   string                 `json:"agent_id"`
+    Version   int64                  `json:"version"`
+    Config    map[string]interface{} `json:"config"`
+    UpdatedAt time.Time              `json:"updated_at"`
+}
+
+// FlowControlPayload warns a client that its outbound queue is nearly full. Clients should
+// reduce their subscriptions or read faster; once it fills up, at_most_once broadcasts are
+// dropped and the client is disconnected if at_least_once broadcasts keep backing up.
+type FlowControlPayload struct {
+    Queued   int `json:"queued"`
+    Capacity int `json:"capacity"`
+}
+
+// ReconnectPayload is sent to every client as the server shuts down, suggesting how long to
+// wait before reconnecting so clients do not all return at once.
+type ReconnectPayload struct {
+    BackoffMs       int64  `json:"backoff_ms"`
+    AlternateServer string `json:"alternate_server,omitempty"` // Another server to reconnect to, if any
+}
+
+// TopicClosedPayload tells a subscriber that a topic was closed by EvictTopic, e.g. because
+// its agent was decommissioned. Subscriptions to exactly the topic have been removed.
+type TopicClosedPayload struct {
+    Topic           string   `json:"topic"`
+    Reason          string   `json:"reason"`
+    SubscriptionIDs []string `json:"subscription_ids,omitempty"` // The client's subscriptions that were removed
+}
+
+// WelcomePayload describes the server to a newly connected client so generic clients can
+// adapt to its configuration.
+type WelcomePayload struct {
+    ClientID        string        `json:"client_id"`
+    SessionToken    string        `json:"session_token,omitempty"` // Restores this connection's subscriptions via hello after a reconnect
+    ProtocolVersion string        `json:"protocol_version"`
+    Subprotocol     string        `json:"subprotocol,omitempty"`
+    MessageTypes    []string      `json:"message_types"` // Client message types the server handles
+    Blockchains     []string      `json:"blockchains"`   // Chains accepted in transaction queries
+    Limits          WelcomeLimits `json:"limits"`
+}
+
+// WelcomeLimits lists the per-client limits in force; zero or less means unlimited.
+type WelcomeLimits struct {
+    MaxSubscriptions     int   `json:"max_subscriptions"`
+    MaxMessageBytes      int64 `json:"max_message_bytes"`
+    MaxConcurrentQueries int   `json:"max_concurrent_queries"`
+}
+
 // TransactionPayload defines the payload for transaction updates.
 type TransactionPayload struct {
     TxID        string    `json:"tx_id"`
     Status      string    `json:"status"`
     Timestamp   time.Time `json:"timestamp"`
-    Amount      string    `json:"amount"`
+    Amount      string    `json:"amount"`                 // As reported, e.g. "0.5 SOL"
+    AmountValue float64   `json:"amount_value,omitempty"` // Numeric part of Amount; unset if it cannot be parsed
+    Currency    string    `json:"currency,omitempty"`     // Currency part of Amount, e.g. "SOL"
     Blockchain  string    `json:"blockchain"`
     FromAddress string    `json:"from_address"`
     ToAddress   string    `json:"to_address"`
+    BlockHeight uint64    `json:"block_height,omitempty"` // Height of the block that included the transaction, if known
+    AgentID     string    `json:"agent_id,omitempty"`     // Agent that issued the transaction, if known
+    Sequence    uint64    `json:"sequence,omitempty"`     // Position in the store's recording order, if recorded
+}
+
+// Frame is a serialized message queued for a client's writer.
+type Frame struct {
+    Data    []byte
+    Expires time.Time // When a broadcast with a TTL goes stale and is dropped unsent; zero if never
+}
+
+// expired reports whether the frame went stale before now.
+func (f Frame) expired(now time.Time) bool {
+    return !f.Expires.IsZero() && now.After(f.Expires)
 }
 
 // Client represents a connected WebSocket client.
 type Client struct {
-    Conn       *websocket.Conn
-    Send       chan Message
-    Topics     map[string]bool // Topics or channels the client is subscribed to (e.g., agent_id or tx_id)
-    LastActive time.Time
+    ID            string // Server-assigned identifier, set on registration if empty
+    SessionToken  string // Presented in a hello after reconnecting to restore subscriptions; set on registration if empty
+    Conn          *websocket.Conn
+    Send          chan Frame               // Frames drained by the client's writePump
+    Subscriptions map[string]*Subscription // Subscriptions keyed by ID; patterns match agent_id or tx_id topics
+    LastActive    time.Time
+    Principal     string   // Authenticated identity the connection belongs to
+    Subprotocol   string   // Subprotocol negotiated during the upgrade; empty if none was agreed
+    Metadata      Metadata // Application data attached to the connection
+    RemoteIP      string   // Client's address, from forwarding headers when connected through a trusted proxy
+
+    priority   chan Frame  // Errors and control frames, written ahead of Send; nil sends them on Send
+    flowWarned atomic.Bool // Set while a flow_control warning is outstanding for the send queue
+    engaged    atomic.Bool // Set once the client sends a message other than a ping or pong
+
+    querySlots chan struct{} // Semaphore bounding in-flight transaction queries; nil means unlimited
+    writerDone chan struct{} // Closed when the client's writePump exits; nil for clients without one
+    session    *session      // Session restored by a hello, guarded by the server mutex
+
+    retained      []Frame       // at_least_once broadcasts waiting for room, oldest first, guarded by mu
+    retainedReady chan struct{} // Wakes the writer when a frame is retained; nil for clients without one
+
+    dispatchMu sync.Mutex // Held by HandleClientMessage so the client's messages are handled one at a time
+
+    // Traffic counters, updated by the read and write loops
+    messagesIn  atomic.Uint64
+    messagesOut atomic.Uint64
+    bytesIn     atomic.Uint64
+    bytesOut    atomic.Uint64
+
+    mu               sync.Mutex
+    lastError        *ClientError
+    pendingAcks      map[string]*pendingAck // Unacknowledged require_ack broadcasts by message ID
+    disconnectReason DisconnectReason       // Why the client left; the first reason recorded wins
+    closeMessage     []byte                 // Close frame the writer sends once Send is closed; empty if unset
+    errorWindow      time.Time              // Start of the current error rate window
+    errorsInWindow   int                    // Errors raised for the client since errorWindow
+}
+
+// ClientTraffic counts the data frames a client has sent and been sent over its connection.
+// Control frames such as pings are not counted.
+type ClientTraffic struct {
+    MessagesIn  uint64 `json:"messages_in"`
+    MessagesOut uint64 `json:"messages_out"`
+    BytesIn     uint64 `json:"bytes_in"`
+    BytesOut    uint64 `json:"bytes_out"`
+}
+
+// Traffic returns the client's traffic so far, for spotting heavy clients.
+func (c *Client) Traffic() ClientTraffic {
+    return ClientTraffic{
+        MessagesIn:  c.messagesIn.Load(),
+        MessagesOut: c.messagesOut.Load(),
+        BytesIn:     c.bytesIn.Load(),
+        BytesOut:    c.bytesOut.Load(),
+    }
+}
+
+// Metadata holds application data attached to a connection, such as a tenant ID or feature
+// flags. It is safe for concurrent use and independent of the server lock.
+type Metadata struct {
+    mu     sync.RWMutex
+    values map[string]interface{}
+}
+
+// Set stores value under key, replacing any previous value.
+func (m *Metadata) Set(key string, value interface{}) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if m.values == nil {
+        m.values = make(map[string]interface{})
+    }
+    m.values[key] = value
+}
+
+// Get returns the value stored under key and whether it was set.
+func (m *Metadata) Get(key string) (interface{}, bool) {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+    value, ok := m.values[key]
+    return value, ok
+}
+
+// ClientError records an error response sent to a client.
+type ClientError struct {
+    Code      int       `json:"code"`
+    Message   string    `json:"message"`
+    Timestamp time.Time `json:"timestamp"`
+}
+
+// LastError returns the most recent error sent to the client, or nil if there has been none.
+func (c *Client) LastError() *ClientError {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.lastError
+}
+
+// recordError replaces the client's last error.
+func (c *Client) recordError(code int, message string, at time.Time) {
+    c.mu.Lock()
+    c.lastError = &ClientError{Code: code, Message: message, Timestamp: at}
+    c.mu.Unlock()
+}
+
+// setCloseMessage sets the close frame the writer sends after draining the queue.
+func (c *Client) setCloseMessage(message []byte) {
+    c.mu.Lock()
+    c.closeMessage = message
+    c.mu.Unlock()
+}
+
+// closingMessage returns the close frame the writer sends after draining the queue.
+func (c *Client) closingMessage() []byte {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if c.closeMessage == nil {
+        return []byte{}
+    }
+    return c.closeMessage
+}
+
+// countError counts an error raised for the client in the current window of length interval,
+// starting a new window if the last one has passed, and returns the count so far.
+func (c *Client) countError(at time.Time, interval time.Duration) int {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if at.Sub(c.errorWindow) >= interval {
+        c.errorWindow, c.errorsInWindow = at, 0
+    }
+    c.errorsInWindow++
+    return c.errorsInWindow
+}
+
+// DisconnectReason returns why the client left the server, or "" while it is connected.
+func (c *Client) DisconnectReason() DisconnectReason {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.disconnectReason
+}
+
+// setDisconnectReason records why the client is leaving unless a reason is already recorded,
+// so the path that initiated a close is not masked by the read error it causes.
+func (c *Client) setDisconnectReason(reason DisconnectReason) {
+    c.mu.Lock()
+    if c.disconnectReason == "" {
+        c.disconnectReason = reason
+    }
+    c.mu.Unlock()
+}
+
+// acquireQuerySlot reserves a transaction query slot without blocking.
+func (c *Client) acquireQuerySlot() bool {
+    if c.querySlots == nil {
+        return true
+    }
+    select {
+    case c.querySlots <- struct{}{}:
+        return true
+    default:
+        return false
+    }
+}
+
+// releaseQuerySlot frees a slot reserved by acquireQuerySlot.
+func (c *Client) releaseQuerySlot() {
+    if c.querySlots != nil {
+        <-c.querySlots
+    }
+}
+
+// Clock reports the current time. The server reads time through it so tests can control
+// timeouts and timestamps; network deadlines always use the system clock.
+type Clock interface {
+    Now() time.Time
+}
+
+// realClock reads the system clock.
+type realClock struct{}
+
+// Now returns the current system time.
+func (realClock) Now() time.Time {
+    return time.Now()
+}
+
+// serverClock reads whichever Clock the server currently has, so parts built along with the
+// server follow a Clock swapped in afterwards, as tests do.
+type serverClock struct {
+    server *WebSocketServer
+}
+
+// Now returns the server Clock's current time.
+func (c serverClock) Now() time.Time {
+    return c.server.Clock.Now()
+}
+
+// DisconnectReason describes why a client left the server.
+type DisconnectReason string
+
+const (
+    DisconnectClientClosed    DisconnectReason = "client_closed"    // The client sent a close frame
+    DisconnectConnectionLost  DisconnectReason = "connection_lost"  // Reading from or writing to the connection failed
+    DisconnectTimeout         DisconnectReason = "timeout"          // The client went quiet past a heartbeat or idle timeout
+    DisconnectPolicyViolation DisconnectReason = "policy_violation" // Displaced by a newer connection for the same principal
+    DisconnectSlowConsumer    DisconnectReason = "slow_consumer"    // The client's send queue overflowed
+    DisconnectRateLimited     DisconnectReason = "rate_limited"     // The client sent more than it is allowed to
+    DisconnectAuthFailed      DisconnectReason = "auth_failed"      // The client's credentials or message signature were refused
+    DisconnectOverloaded      DisconnectReason = "overloaded"       // The server shed the client to relieve load
+    DisconnectShutdown        DisconnectReason = "server_shutdown"  // The server is shutting down
+    DisconnectServerClosed    DisconnectReason = "server_closed"    // Removed by the server for no more specific reason
+)
+
+// Application close codes, from the 4000-4999 range RFC 6455 leaves for private use, tell a
+// disconnected client how to react:
+//
+//   4000 CloseRateLimited  sent more than allowed, e.g. too many errors; back off before reconnecting
+//   4001 CloseAuthFailed   credentials or a message signature refused; re-authenticate before reconnecting
+//   4002 CloseOverloaded   server at capacity or shedding load; reconnect later
+//
+// Other disconnects keep the standard codes, such as 1001 on shutdown and 1008 when idle.
+const (
+    CloseRateLimited = 4000
+    CloseAuthFailed  = 4001
+    CloseOverloaded  = 4002
+)
+
+// disconnectCloseCodes maps the disconnect reasons sent to the client in a close frame to
+// the frame's code.
+var disconnectCloseCodes = map[DisconnectReason]int{
+    DisconnectRateLimited: CloseRateLimited,
+    DisconnectAuthFailed:  CloseAuthFailed,
+    DisconnectOverloaded:  CloseOverloaded,
+    DisconnectTimeout:     websocket.ClosePolicyViolation,
+}
+
+// ConnectionLimitPolicy selects how the server enforces MaxConnectionsPerPrincipal.
+type ConnectionLimitPolicy int
+
+const (
+    // RejectNewest refuses a connection that would exceed the limit.
+    RejectNewest ConnectionLimitPolicy = iota
+    // CloseOldest disconnects the principal's oldest connection to make room for the new one.
+    CloseOldest
+)
+
+// ErrTooManyConnections is returned by RegisterClient when a principal is at its connection limit.
+var ErrTooManyConnections = errors.New("too many connections for principal")
+
+// ErrServerFull is returned by RegisterClient when the server already holds MaxClients clients.
+var ErrServerFull = errors.New("server at client capacity")
+
+// overCapacityRetryAfter is the Retry-After hint, in seconds, given to connections refused at capacity.
+const overCapacityRetryAfter = "30"
+
+// ServerConfig sizes the connection buffers and per-client queues of a WebSocketServer.
+type ServerConfig struct {
+    ReadBufferSize  int // Upgrader read buffer size in bytes
+    WriteBufferSize int // Upgrader write buffer size in bytes
+    SendQueueSize   int // Capacity of each client's outbound message channel
+}
+
+// DefaultServerConfig returns the buffer sizes used by NewWebSocketServer.
+func DefaultServerConfig() ServerConfig {
+    return ServerConfig{
+        ReadBufferSize:  1024,
+        WriteBufferSize: 1024,
+        SendQueueSize:   256,
+    }
 }
 
 // WebSocketServer manages WebSocket connections and message broadcasting.
 type WebSocketServer struct {
-    Clients    map[*Client]bool
-    Broadcast  chan Message
-    Register   chan *Client
-    Unregister chan *Client
-    Mutex      sync.RWMutex
-    Upgrader   websocket.Upgrader
+    Clients   map[*Client]bool
+    Broadcast chan Message
+    Mutex     sync.RWMutex
+    Upgrader  websocket.Upgrader
+    Clock     Clock
+
+    // AllowedOrigins lists the browser origins, such as "https://app.example.com", allowed to
+    // connect. Scheme and port must match exactly, and a '*' label matches any one DNS label,
+    // e.g. "https://*.example.com". When empty only same-origin pages may connect. Requests without an Origin header, as sent by non-browser
+    // clients, are always allowed.
+    AllowedOrigins []string
+    // Subprotocols lists the WebSocket subprotocols the server speaks, most preferred first.
+    Subprotocols []string
+    // RequireSubprotocol rejects upgrades whose Sec-WebSocket-Protocol header offers none of
+    // Subprotocols. When unset, such clients connect without a subprotocol.
+    RequireSubprotocol bool
+    // SendQueueSize is the capacity of each new client's Send channel.
+    SendQueueSize int
+    // SendQueueHighWater is the fraction of a client's send queue at which a flow_control
+    // warning is sent. Once the queue is full, broadcasts for at_most_once subscriptions are
+    // dropped and those for at_least_once subscriptions are retained; clients without
+    // subscriptions are disconnected.
+    SendQueueHighWater float64
+    // MaxRetainedFrames caps the at_least_once broadcasts retained for a client whose send
+    // queue is full; a client exceeding it is disconnected. Zero or less means unlimited.
+    MaxRetainedFrames int
+    // Authorizer, if set, decides which topics a client may subscribe to and which agent
+    // commands it may send. A nil Authorizer allows everything.
+    Authorizer Authorizer
+    // MaxMessageBytes caps the size of a message read from a client; larger messages close
+    // the connection. Zero or less, the default, means unlimited.
+    MaxMessageBytes int64
+    // MaxFrameBytes, when positive, splits responses larger than this into frame_chunk
+    // messages no larger than it, for clients and proxies that reject big frames.
+    MaxFrameBytes int
+    // MaxSubscriptionsPerClient caps the subscriptions a client may hold; zero or less means unlimited.
+    MaxSubscriptionsPerClient int
+    // CoalesceInterval, when positive, holds topic broadcasts for up to this long and sends
+    // only the latest of each type per topic, for rapidly changing state where only the
+    // newest value matters. Messages with RequireAck set are never coalesced.
+    CoalesceInterval time.Duration
+    // StatusSnapshotEvery, when positive, sends agent status updates as agent_status_delta
+    // messages carrying only the fields that changed since the agent's previous update, with
+    // every Nth update per agent, and the first, sent in full so clients can resynchronize.
+    // initial_state and state_diff always carry the full status.
+    StatusSnapshotEvery int
+    // CaseInsensitiveTopics lowercases topics on subscribe and broadcast so "Agent-1" and
+    // "agent-1" match. Surrounding whitespace is always trimmed.
+    CaseInsensitiveTopics bool
+    // StrictDecoding rejects client messages and payloads carrying fields the server does
+    // not recognize, surfacing client-side typos. Off by default.
+    StrictDecoding bool
+    // Verbose includes the underlying error in the message of 5xx error responses. Off by
+    // default, so clients see only a generic message and a correlation ID to quote, while the
+    // detail is logged under that ID.
+    Verbose bool
+    // SlowHandlerThreshold, when positive, logs a warning for each client message whose
+    // handler takes longer than this.
+    SlowHandlerThreshold time.Duration
+    // SigningKeys, if set, requires every client message to be signed with its principal's
+    // key, refusing others with 401, and signs agent control results with the same key.
+    SigningKeys SigningKeySource
+    // EnabledMessageTypes, if set, lists the application message types the server accepts;
+    // others are refused with 403 before dispatch and left out of the welcome message. Protocol
+    // types such as pong, ack, hello and health are always accepted. Nil enables every type,
+    // built-in or registered.
+    EnabledMessageTypes map[ClientMessageType]bool
+    // AllowHandlerOverride lets RegisterHandler replace the handlers of built-in message types.
+    AllowHandlerOverride bool
+    // SupportedBlockchains lists the chains accepted in transaction queries.
+    SupportedBlockchains []string
+    // Store backs transaction queries.
+    Store TransactionStore
+    // MaxTxLimit is the largest limit a transaction query may ask for; larger limits are
+    // rejected rather than clamped. Zero or less means no cap.
+    MaxTxLimit int
+    // QueryTimeout bounds how long a transaction query, including store retries, may take;
+    // zero or less means no timeout.
+    QueryTimeout time.Duration
+    // StoreRetryAttempts is the most times a transiently failing store query is tried.
+    StoreRetryAttempts int
+    // StoreRetryDelay is the backoff before the first store retry; it doubles for each retry after.
+    StoreRetryDelay time.Duration
+    // QueryCacheSize, when positive, caches the results of up to this many transaction queries,
+    // so a query the store cannot answer is served its last result, flagged stale.
+    QueryCacheSize int
+    // QueryCacheTTL is how long a cached query result is served without asking the store;
+    // zero or less always asks it, using the cache only when the store is unavailable.
+    QueryCacheTTL time.Duration
+    // StreamChunkSize bounds the transactions carried by each transaction_chunk of a streamed query.
+    StreamChunkSize int
+    // FleetResolver, if set, resolves "fleet:<name>" topics to the agents in the fleet.
+    FleetResolver FleetResolver
+    // LogSource, if set, backs "logs:<agent_id>" subscriptions that tail an agent's log.
+    LogSource AgentLogSource
+    // Mempool, if set, backs "mempool:<blockchain>" subscriptions to pending transactions.
+    Mempool MempoolSource
+    // MaxMempoolPending caps the pending transactions each mempool subscription follows to
+    // their confirmation; past it the one first seen longest ago is forgotten. Zero or less
+    // means unlimited.
+    MaxMempoolPending int
+    // Controller executes agent control commands.
+    Controller AgentController
+    // CommandLog, if set, records agent control commands for command_history requests. Nil,
+    // the default, records nothing and refuses command_history.
+    CommandLog CommandLog
+    // CommandSchemas maps agent control commands to the schema their params must satisfy;
+    // commands without a schema accept any params.
+    CommandSchemas map[string]*ParamSchema
+    // MetricsWindow is the length of the windows "metrics:<agent_id>" topics aggregate
+    // confirmed transactions over; windows without any are not reported. Zero or less, the
+    // default, disables the aggregation.
+    MetricsWindow time.Duration
+    // PausedBufferSize caps the broadcasts a paused subscription buffers for replay on resume;
+    // the oldest are dropped beyond it.
+    PausedBufferSize int
+    // EvictionCooldown is how long subscribes to a topic closed by EvictTopic are refused.
+    EvictionCooldown time.Duration
+    // AgentQueueDepth bounds the commands waiting per agent; zero or less means unbounded.
+    AgentQueueDepth int
+    // AgentCommandTimeout bounds how long the Controller may take over one command before its
+    // context is cancelled and the next queued command runs; zero or less means no timeout.
+    AgentCommandTimeout time.Duration
+    // MaxScheduled and MaxScheduledPerAgent cap the commands waiting for their execute_at
+    // that one principal may have scheduled, and that may be scheduled for one agent; further
+    // ones are refused with 429. Zero or less means unlimited.
+    MaxScheduled         int
+    MaxScheduledPerAgent int
+    // MaxScheduleHorizon bounds how far ahead execute_at may be; zero or less means unbounded.
+    MaxScheduleHorizon time.Duration
+    // MaxConcurrentQueries caps in-flight transaction queries per client; zero or less disables the cap.
+    MaxConcurrentQueries int
+    // IdleConnectTimeout closes connections that send nothing but pings and pongs for this long
+    // after connecting; zero or less disables it.
+    IdleConnectTimeout time.Duration
+    // MaxClients caps the total number of connected clients; zero or less means unlimited.
+    // Upgrades beyond the cap are refused with 503 Service Unavailable.
+    MaxClients int
+    // MaxConnectionsPerPrincipal caps simultaneous connections per principal; zero or less means unlimited.
+    MaxConnectionsPerPrincipal int
+    // MaxConnectionsPerIP caps simultaneous connections from one client address, checked at
+    // the upgrade and refused with 429 Too Many Requests; zero or less means unlimited.
+    MaxConnectionsPerIP int
+    // TrustedProxies lists the addresses or CIDR ranges, such as "10.0.0.0/8", of reverse
+    // proxies whose Forwarded and X-Forwarded-For headers name the real client address. The
+    // headers of other peers are ignored.
+    TrustedProxies []string
+    // ConnectionLimit selects what happens when a principal exceeds MaxConnectionsPerPrincipal.
+    ConnectionLimit ConnectionLimitPolicy
+    // MaxErrorsPerInterval caps the error responses sent to a client per ErrorInterval, so
+    // malformed traffic cannot be reflected back at full rate; further errors are dropped.
+    // A client raising twice as many errors in one interval is closed as a policy violation.
+    // Zero or less disables the cap.
+    MaxErrorsPerInterval int
+    // ErrorInterval is the window MaxErrorsPerInterval applies to.
+    ErrorInterval time.Duration
+    // AckTimeout is how long a client has to acknowledge a require_ack broadcast before it is resent.
+    AckTimeout time.Duration
+    // AckRetries is how many times an unacknowledged broadcast is resent before it is logged as undelivered.
+    AckRetries int
+    // OnUndelivered, if set, is called with the message ID of each require_ack broadcast a
+    // client never acknowledged.
+    OnUndelivered func(client *Client, messageID string)
+    // OnHandshake, if set, is called with the upgrade request for every new client before it
+    // is registered, so applications can populate its Metadata.
+    OnHandshake func(r *http.Request, client *Client)
+    // SessionTTL is how long a disconnected client's subscriptions are kept for it to restore
+    // with a hello carrying its session token; zero or less disables sessions.
+    SessionTTL time.Duration
+    // SessionTokenGrace is how long a session token keeps working after a hello has rotated
+    // the session onto the new connection's token.
+    SessionTokenGrace time.Duration
+    // HealthProbes admits connections without a valid token so they can send a single health
+    // message, as load balancers do; anything else they send is refused with 401. When off,
+    // the default, such upgrades are rejected with 401 Unauthorized. Probes are refused like
+    // other connections at capacity and during shutdown.
+    HealthProbes bool
+    // MaxHealthProbes caps the health probes served at once; more are refused with 503.
+    // Zero or less means unlimited.
+    MaxHealthProbes int
+    // ReconnectBackoff is the least backoff suggested to clients in the reconnect message sent
+    // on Shutdown.
+    ReconnectBackoff time.Duration
+    // ReconnectJitter is the range of the random delay added to ReconnectBackoff for each
+    // client, spreading out their reconnects.
+    ReconnectJitter time.Duration
+    // AlternateServer, if set, is suggested to clients on Shutdown as a server to reconnect to.
+    AlternateServer string
+    // OnDisconnect, if set, is called once for every client leaving the registry, after its
+    // topics have been cleared, with the reason it left. It runs outside the server lock.
+    OnDisconnect func(client *Client, reason DisconnectReason)
+    // OnPong, if set, is called with the payload of each application-level pong message, so
+    // clients can report liveness data such as CPU load or battery level alongside the
+    // heartbeat. payload is nil when the pong has none. It runs on the client's read loop,
+    // outside the server lock.
+    OnPong func(client *Client, payload json.RawMessage)
+
+    configVersions  map[string]int64                     // Last pushed config version per agent, guarded by Mutex
+    principals      map[string][]*Client                 // Connections per principal, oldest first, guarded by Mutex
+    clientsByID     map[string]*Client                   // Registered clients by ID, guarded by Mutex
+    topicCounts     map[string]int                       // Subscriptions per pattern, guarded by Mutex
+    evictedTopics   map[string]time.Time                 // End of the subscribe cooldown per evicted topic, guarded by Mutex
+    clientSeq       atomic.Uint64                        // Source of client IDs
+    subscriptionSeq atomic.Uint64                        // Source of subscription IDs
+    querySeq        atomic.Uint64                        // Source of streamed query IDs
+    messageSeq      atomic.Uint64                        // Source of require_ack message IDs
+    broadcastSeq    atomic.Uint64                        // Source of broadcast sequence numbers
+    chunkSeq        atomic.Uint64                        // Source of frame chunk IDs
+    goroutines      atomic.Int64                         // Per-client goroutines running, see ActiveGoroutines
+    errorSeq        atomic.Uint64                        // Source of internal error correlation IDs
+    agentQueues     map[string]*agentQueue               // Command queue per agent, guarded by agentQueuesMu
+    agentQueuesMu   sync.Mutex
+    scheduled       map[string]*scheduledCommand         // Commands waiting for execute_at by command_id, guarded by scheduledMu
+    scheduledMu     sync.Mutex
+    commandSeq      atomic.Uint64                        // Source of scheduled command IDs
+    handlers        map[ClientMessageType]MessageHandler // Application handlers by message type, guarded by handlersMu
+    handlersMu      sync.RWMutex
+    coalesced       map[coalesceKey]Message              // Latest held broadcast per type and topic, guarded by coalesceMu
+    coalesceMu      sync.Mutex
+    lastState       map[coalesceKey]Message              // Latest stateful broadcast per type and topic, guarded by Mutex; pruned by EvictTopic
+    volumes         volumeAggregator                     // Open metrics windows per agent
+    statuses        statusTracker                        // Last status sent per agent, for StatusSnapshotEvery
+    shuttingDown    atomic.Bool                          // Set by Shutdown; new connections are refused
+    probes          atomic.Int64                         // Health probes being served
+    flushing        atomic.Bool                          // Set while ended metrics windows are being broadcast
+    startedAt       time.Time                            // When the server was created by its Clock, for uptime
+    errorCounts     map[ErrorCode]uint64                 // Error responses sent by code, guarded by errorCountsMu
+    errorCountsMu   sync.Mutex
+    handlerTimes    map[ClientMessageType]*DurationHistogram // Handler durations by message type, guarded by handlerTimesMu
+    handlerTimesMu  sync.Mutex
+    sessions        map[string]*sessionToken             // Saved subscriptions by session token, guarded by Mutex
+    queryCache      *queryCache                          // Cached query results, created on first use when QueryCacheSize is positive
+    queryCacheOnce  sync.Once
 }
 
-// NewWebSocketServer creates a new WebSocket server instance.
+// NewWebSocketServer creates a new WebSocket server instance with the default configuration.
 func NewWebSocketServer() *WebSocketServer {
-    return &WebSocketServer{
-        Clients:    make(map[*Client]bool),
-        Broadcast:  make(chan Message),
-        Register:   make(chan *Client),
-        Unregister: make(chan *Client),
+    return NewWebSocketServerWithConfig(DefaultServerConfig())
+}
+
+// NewWebSocketServerWithConfig creates a new WebSocket server instance using the given buffer sizes.
+func NewWebSocketServerWithConfig(config ServerConfig) *WebSocketServer {
+    s := &WebSocketServer{
+        Clients:              make(map[*Client]bool),
+        Broadcast:            make(chan Message),
+        Clock:                realClock{},
+        SendQueueSize:        config.SendQueueSize,
+        SendQueueHighWater:   0.8,
+        MaxRetainedFrames:    1024,
+        Subprotocols:         []string{"polyone.v1"},
+        SupportedBlockchains: []string{"Solana", "Ethereum"},
+        QueryTimeout:         10 * time.Second,
+        MaxTxLimit:           1000,
+        StoreRetryAttempts:   3,
+        StoreRetryDelay:      100 * time.Millisecond,
+        StreamChunkSize:      100,
+        MaxMempoolPending:    1000,
+        AgentQueueDepth:      16,
+        AgentCommandTimeout:  30 * time.Second,
+        MaxScheduled:         16,
+        MaxScheduledPerAgent: 16,
+        MaxScheduleHorizon:   24 * time.Hour,
+        MaxConcurrentQueries: 4,
+        IdleConnectTimeout:   30 * time.Second,
+        AckTimeout:           5 * time.Second,
+        AckRetries:           3,
+        MaxErrorsPerInterval: 20,
+        ErrorInterval:        10 * time.Second,
+        MaxHealthProbes:      8,
+        SlowHandlerThreshold: 500 * time.Millisecond,
+        ReconnectBackoff:     time.Second,
+        ReconnectJitter:      5 * time.Second,
+        SessionTTL:           2 * time.Minute,
+        SessionTokenGrace:    30 * time.Second,
+        EvictionCooldown:     time.Minute,
+        PausedBufferSize:     100,
+        configVersions:       make(map[string]int64),
+        principals:           make(map[string][]*Client),
+        clientsByID:          make(map[string]*Client),
+        topicCounts:          make(map[string]int),
+        evictedTopics:        make(map[string]time.Time),
+        sessions:             make(map[string]*sessionToken),
+        errorCounts:          make(map[ErrorCode]uint64),
+        handlerTimes:         make(map[ClientMessageType]*DurationHistogram),
+        agentQueues:          make(map[string]*agentQueue),
+        scheduled:            make(map[string]*scheduledCommand),
+        handlers:             make(map[ClientMessageType]MessageHandler),
+        coalesced:            make(map[coalesceKey]Message),
+        lastState:            make(map[coalesceKey]Message),
+        volumes:              volumeAggregator{windows: make(map[string]*volumeWindow)},
+        statuses:             statusTracker{last: make(map[string]AgentStatusPayload), sinceFull: make(map[string]int)},
         Upgrader: websocket.Upgrader{
-            ReadBufferSize:  1024,
-            WriteBufferSize: 1024,
+            ReadBufferSize:  config.ReadBufferSize,
+            WriteBufferSize: config.WriteBufferSize,
             CheckOrigin: func(r *http.Request) bool {
-                return true // Allow all origins for simplicity; restrict in production
+                return true // HandleConnections checks origins against AllowedOrigins before upgrading
             },
         },
     }
+    s.startedAt = s.Clock.Now()
+    s.Store = mockTransactionStore{clock: serverClock{s}}
+    s.Controller = newPlaceholderAgentController(serverClock{s})
+    return s
 }
 
-// Start runs the WebSocket server event loop for managing clients and messages.
-func (s *WebSocketServer) Start() {
-    for {
-        select {
-        case client := <-s.Register:
-            s.Mutex.Lock()
-            s.Clients[client] = true
+// RegisterClient adds a client to the server's registry so it starts receiving broadcasts.
+// It returns ErrTooManyConnections when the client's principal is at its connection limit
+// under the RejectNewest policy; under CloseOldest the oldest connection is dropped instead.
+// It returns ErrServerFull when MaxClients clients are already registered.
+func (s *WebSocketServer) RegisterClient(client *Client) error {
+    s.Mutex.Lock()
+    if s.atCapacityLocked() {
+        s.Mutex.Unlock()
+        log.Printf("Rejecting connection: server at capacity of %d clients", s.MaxClients)
+        return ErrServerFull
+    }
+    var evicted *Client
+    if s.MaxConnectionsPerPrincipal > 0 && len(s.principals[client.Principal]) >= s.MaxConnectionsPerPrincipal {
+        if s.ConnectionLimit != CloseOldest {
             s.Mutex.Unlock()
-            log.Printf("New client connected. Total clients: %d", len(s.Clients))
+            log.Printf("Rejecting connection for principal %q: limit of %d reached", client.Principal, s.MaxConnectionsPerPrincipal)
+            return ErrTooManyConnections
+        }
+        evicted = s.principals[client.Principal][0]
+        evicted.setDisconnectReason(DisconnectPolicyViolation)
+        s.unregisterLocked(evicted)
+    }
+
+    if client.querySlots == nil && s.MaxConcurrentQueries > 0 {
+        client.querySlots = make(chan struct{}, s.MaxConcurrentQueries)
+    }
+    if client.ID == "" {
+        client.ID = fmt.Sprintf("client-%d", s.clientSeq.Add(1))
+    }
+    if client.SessionToken == "" && s.SessionTTL > 0 {
+        client.SessionToken = newSessionToken()
+    }
+    s.Clients[client] = true
+    s.clientsByID[client.ID] = client
+    s.principals[client.Principal] = append(s.principals[client.Principal], client)
+    total := len(s.Clients)
+    s.Mutex.Unlock()
+
+    if evicted != nil {
+        log.Printf("Closed oldest connection for principal %q to stay within limit", client.Principal)
+        s.notifyDisconnect(evicted)
+    }
+    log.Printf("New client connected. Total clients: %d", total)
+    return nil
+}
+
+// atCapacityLocked reports whether the registry holds MaxClients clients. The caller must hold s.Mutex.
+func (s *WebSocketServer) atCapacityLocked() bool {
+    return s.MaxClients > 0 && len(s.Clients) >= s.MaxClients
+}
+
+// UnregisterClient removes a client from the registry, clears its topics and closes its
+// send channel, which stops the client's writePump. It is safe to call more than once.
+func (s *WebSocketServer) UnregisterClient(client *Client) {
+    s.Mutex.Lock()
+    removed := s.unregisterLocked(client)
+    total := len(s.Clients)
+    s.Mutex.Unlock()
+    if removed {
+        log.Printf("Client disconnected. Total clients: %d", total)
+        s.notifyDisconnect(client)
+    }
+}
+
+// Disconnect removes a client from the registry and closes its connection, recording reason
+// as why it left unless an earlier reason was recorded. Applications use it to kick clients,
+// for example with DisconnectRateLimited. Reasons with an application close code, and
+// timeouts with 1008, are sent to the client in a close frame first.
+func (s *WebSocketServer) Disconnect(client *Client, reason DisconnectReason) {
+    s.disconnectWith(client, reason, string(reason))
+}
+
+// disconnectWith is Disconnect with text as the close frame's reason.
+func (s *WebSocketServer) disconnectWith(client *Client, reason DisconnectReason, text string) {
+    // Recorded first so whoever sees the close frame also sees the reason
+    client.setDisconnectReason(reason)
+    if code, ok := disconnectCloseCodes[reason]; ok && client.Conn != nil {
+        closeMsg := websocket.FormatCloseMessage(code, text)
+        client.Conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+    }
+    s.UnregisterClient(client)
+    if client.Conn != nil {
+        client.Conn.Close()
+    }
+}
+
+// disconnectAfterQueued is disconnectWith for a client that must first receive what is
+// already queued for it, such as the error explaining why it is being closed: the writer
+// sends the close frame once it has drained the queue.
+func (s *WebSocketServer) disconnectAfterQueued(client *Client, reason DisconnectReason, text string) {
+    client.setDisconnectReason(reason)
+    if code, ok := disconnectCloseCodes[reason]; ok {
+        client.setCloseMessage(websocket.FormatCloseMessage(code, text))
+    }
+    s.UnregisterClient(client)
+}
+
+// Shutdown refuses new connections and closes every connected client with a reconnect hint
+// followed by a 1001 going-away close frame. The context's deadline, if any, bounds how long
+// the clients' writers may take to flush; by default they get a second.
+func (s *WebSocketServer) Shutdown(ctx context.Context) error {
+    s.shuttingDown.Store(true)
+
+    s.Mutex.RLock()
+    clients := make([]*Client, 0, len(s.Clients))
+    for client := range s.Clients {
+        clients = append(clients, client)
+    }
+    s.Mutex.RUnlock()
+
+    deadline, ok := ctx.Deadline()
+    if !ok {
+        deadline = time.Now().Add(time.Second)
+    }
+    closeMsg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+    for _, client := range clients {
+        // The writer sends the hint ahead of queued data, then the close frame once Send is closed
+        s.sendReconnectHint(client)
+        client.setCloseMessage(closeMsg)
+        client.setDisconnectReason(DisconnectShutdown)
+        s.UnregisterClient(client)
+    }
 
-        case client := <-s.Unregister:
-            s.Mutex.Lock()
-            if _, ok := s.Clients[client]; ok {
-                close(client.Send)
-                delete(s.Clients, client)
+    flushed, cancel := context.WithDeadline(context.Background(), deadline)
+    defer cancel()
+    for _, client := range clients {
+        if client.writerDone != nil {
+            select {
+            case <-client.writerDone:
+            case <-flushed.Done():
             }
-            s.Mutex.Unlock()
-            log.Printf("Client disconnected. Total clients: %d", len(s.Clients))
-
-        case message := <-s.Broadcast:
-            s.Mutex.RLock()
-            for client := range s.Clients {
-                // Optionally filter based on topics if payload contains relevant ID
-                shouldSend := true
-                if message.Type == AgentStatusUpdate {
-                    if payload, ok := message.Payload.(AgentStatusPayload); ok {
-                        if len(client.Topics) > 0 {
-                            shouldSend = client.Topics[payload.AgentID]
-                        }
-                    }
-                } else if message.Type == TransactionUpdate {
-                    if payload, ok := message.Payload.(TransactionPayload); ok {
-                        if len(client.Topics) > 0 {
-                            shouldSend = client.Topics[payload.TxID]
-                        }
-                    }
-                }
-
-                if shouldSend {
-                    select {
-                    case client.Send <- message:
-                    default:
-                        log.Printf("Client send channel full, skipping message for client")
-                    }
-                }
+        }
+        if client.Conn != nil {
+            client.Conn.Close()
+        }
+    }
+    log.Printf("Server shut down, closed %d clients", len(clients))
+    return ctx.Err()
+}
+
+// GetClient returns the registered client with the given ID, e.g. to inspect its Traffic.
+func (s *WebSocketServer) GetClient(id string) (*Client, bool) {
+    s.Mutex.RLock()
+    defer s.Mutex.RUnlock()
+    client, ok := s.clientsByID[id]
+    return client, ok
+}
+
+// notifyDisconnect logs why a client just left the registry and runs the OnDisconnect
+// callback, if any. Clients removed without a recorded reason are marked DisconnectServerClosed.
+func (s *WebSocketServer) notifyDisconnect(client *Client) {
+    client.setDisconnectReason(DisconnectServerClosed)
+    reason := client.DisconnectReason()
+    log.Printf("Client %s disconnected: %s", client.ID, reason)
+    if s.OnDisconnect != nil {
+        s.OnDisconnect(client, reason)
+    }
+}
+
+// unregisterLocked does the work of UnregisterClient; the caller must hold the write lock.
+func (s *WebSocketServer) unregisterLocked(client *Client) bool {
+    if _, ok := s.Clients[client]; !ok {
+        return false
+    }
+    delete(s.Clients, client)
+    delete(s.clientsByID, client.ID)
+
+    connections := s.principals[client.Principal]
+    for i, c := range connections {
+        if c == client {
+            connections = append(connections[:i], connections[i+1:]...)
+            break
+        }
+    }
+    if len(connections) == 0 {
+        delete(s.principals, client.Principal)
+    } else {
+        s.principals[client.Principal] = connections
+    }
+
+    s.saveSessionLocked(client)
+    for id := range client.Subscriptions {
+        s.removeSubscriptionLocked(client, id)
+    }
+    client.dropPendingAcks()
+    close(client.Send)
+    return true
+}
+
+// Start runs the WebSocket server event loop for broadcasting messages to clients.
+// Broadcasts are delivered in the order they are sent on Broadcast, whichever goroutines
+// send them, and numbered with their Sequence. Each client receives its broadcasts in that
+// order, except that coalesced broadcasts are delayed and require_ack broadcasts may be resent.
+func (s *WebSocketServer) Start() {
+    for message := range s.Broadcast {
+        message.Sequence = s.broadcastSeq.Add(1)
+        // Acknowledged messages must each be delivered, so they are never coalesced
+        if s.CoalesceInterval > 0 && !message.RequireAck {
+            if topics := broadcastTopics(message); len(topics) > 0 {
+                s.coalesce(topics[0], message)
+                continue
+            }
+        }
+        s.deliverBroadcast(message)
+    }
+}
+
+// deliverBroadcast sends a broadcast message to every client it is addressed to. A message
+// addressed only to topics that fail normalization is dropped.
+func (s *WebSocketServer) deliverBroadcast(message Message) {
+    if message.RequireAck && message.MessageID == "" {
+        message.MessageID = s.newMessageID()
+    }
+    // State and filters see the full message even when only a delta is sent
+    state := message
+    message = s.statusDelta(message)
+    jsonData, err := json.Marshal(message)
+    if err != nil {
+        log.Printf("Failed to marshal broadcast message: %v", err)
+        return
+    }
+    frames := &broadcastFrames{message: message, plain: jsonData, byTopic: make(map[string][]byte)}
+
+    addressed := broadcastTopics(message)
+    var topics []string
+    for _, topic := range addressed {
+        // Match against subscriptions the same way they were stored
+        if normalized, err := s.normalizeTopic(topic); err == nil {
+            topics = append(topics, normalized)
+        }
+    }
+    if len(addressed) > 0 && len(topics) == 0 {
+        // Without topics it would reach every client, not the ones it was addressed to
+        log.Printf("Dropped %s broadcast: no valid topic in %q", message.Type, addressed)
+        return
+    }
+    var overflowed []*Client
+    // The write lock is held because delivery updates per-subscription message counts
+    s.Mutex.Lock()
+    s.recordStateLocked(topics, state)
+    fields := &payloadFields{payload: state.Payload}
+    for client := range s.Clients {
+        if !s.deliverLocked(client, topics, message.MessageID, frames, fields) {
+            overflowed = append(overflowed, client)
+        }
+    }
+    s.Mutex.Unlock()
+
+    for _, client := range overflowed {
+        s.disconnectSlowClient(client)
+    }
+}
+
+// broadcastFrames holds the frames of one broadcast: the plain frame, and one per matched
+// topic, marshalled when first needed. The caller must hold the server mutex.
+type broadcastFrames struct {
+    message Message
+    plain   []byte
+    byTopic map[string][]byte
+}
+
+// forTopic returns the broadcast's frame carrying topic as its matched_topic.
+func (f *broadcastFrames) forTopic(topic string) []byte {
+    if frame, ok := f.byTopic[topic]; ok {
+        return frame
+    }
+    message := f.message
+    message.MatchedTopic = topic
+    frame, err := json.Marshal(message)
+    if err != nil {
+        log.Printf("Failed to marshal broadcast message for topic %s: %v", topic, err)
+        frame = f.plain
+    }
+    f.byTopic[topic] = frame
+    return frame
+}
+
+// coalesceKey identifies the broadcasts that replace one another while coalescing.
+type coalesceKey struct {
+    msgType MessageType
+    topic   string
+}
+
+// coalesce holds a broadcast until the end of its topic's CoalesceInterval window, replacing
+// any message of the same type already waiting for that topic.
+func (s *WebSocketServer) coalesce(topic string, message Message) {
+    key := coalesceKey{msgType: message.Type, topic: topic}
+    s.coalesceMu.Lock()
+    defer s.coalesceMu.Unlock()
+    if _, waiting := s.coalesced[key]; !waiting {
+        time.AfterFunc(s.CoalesceInterval, func() { s.flushCoalesced(key) })
+    }
+    s.coalesced[key] = message
+}
+
+// flushCoalesced delivers the latest broadcast held for key.
+func (s *WebSocketServer) flushCoalesced(key coalesceKey) {
+    s.coalesceMu.Lock()
+    message, ok := s.coalesced[key]
+    delete(s.coalesced, key)
+    s.coalesceMu.Unlock()
+    if ok {
+        s.deliverBroadcast(message)
+    }
+}
+
+// payloadFields lazily decodes a broadcast payload into a field map for subscription filters,
+// so broadcasts nobody filters on are never decoded.
+type payloadFields struct {
+    payload interface{}
+    fields  map[string]interface{}
+    decoded bool
+}
+
+// get returns the payload's fields keyed by JSON name, with numbers as json.Number.
+func (p *payloadFields) get() map[string]interface{} {
+    if !p.decoded {
+        p.decoded = true
+        if data, err := json.Marshal(p.payload); err == nil {
+            unmarshalNumbers(data, &p.fields)
+        }
+    }
+    return p.fields
+}
+
+// deliverLocked sends a broadcast frame to the client if one of its subscriptions matches one
+// of the topics and admits the payload (or the client has no subscriptions), then retires
+// subscriptions that have reached their max_messages. The frame is sent once however many
+// overlapping subscriptions match, naming the first topic they matched as matched_topic;
+// each of them counts the delivery. Frames only a catching-up
+// subscription wants are held for it instead, and frames only a paused subscription wants are
+// buffered for it if it asked to buffer, or skipped. A full send queue drops the frame unless a
+// matching subscription is at_least_once, in which case it is retained. A non-empty
+// messageID marks a require_ack frame whose acknowledgment is then awaited. It returns false
+// if the client must be disconnected as a slow consumer. The caller must hold the write lock.
+func (s *WebSocketServer) deliverLocked(client *Client, topics []string, messageID string, frames *broadcastFrames, fields *payloadFields) bool {
+    var candidates []*Subscription
+    if len(topics) > 0 {
+        candidates = client.matchingSubscriptions(topics...)
+    }
+    return s.deliverToLocked(client, candidates, topics, messageID, frames, fields)
+}
+
+// deliverToLocked is deliverLocked for the given subscriptions of the client, which must
+// match the topics, rather than all of its subscriptions that do.
+func (s *WebSocketServer) deliverToLocked(client *Client, candidates []*Subscription, topics []string, messageID string, frames *broadcastFrames, fields *payloadFields) bool {
+    jsonData := frames.plain
+    // Filter on subscriptions if the payload carries a relevant ID
+    var matched []*Subscription
+    if len(topics) > 0 && len(client.Subscriptions) > 0 {
+        var catchingUp, paused *Subscription
+        sequence := transactionSequence(fields.payload)
+        for _, subscription := range candidates {
+            switch {
+            case !subscription.admits(fields):
+            case subscription.paused:
+                paused = subscription
+            case subscription.catchingUp:
+                catchingUp = subscription
+            case sequence == 0 || sequence > subscription.watermark:
+                matched = append(matched, subscription)
+            }
+        }
+        if len(matched) == 0 {
+            switch {
+            case catchingUp != nil:
+                frame := frames.forTopic(matchedTopic(topics, catchingUp))
+                catchingUp.held = append(catchingUp.held, heldFrame{frame: frame, sequence: sequence})
+            case paused != nil && paused.buffering:
+                s.bufferPausedLocked(paused, frames.forTopic(matchedTopic(topics, paused)))
             }
-            s.Mutex.RUnlock()
+            return true
+        }
+        jsonData = frames.forTopic(matchedTopic(topics, matched...))
+    }
+
+    qos := QoSAtMostOnce
+    for _, subscription := range matched {
+        if subscription.QoS == QoSAtLeastOnce {
+            qos = QoSAtLeastOnce
+        }
+    }
+    frame := Frame{Data: jsonData}
+    if ttl := frames.message.TTL; ttl > 0 {
+        frame.Expires = s.Clock.Now().Add(ttl)
+    }
+    switch {
+    case qos == QoSAtLeastOnce:
+        if !s.enqueueRetained(client, frame) {
+            return false
+        }
+    case len(matched) > 0:
+        // Queuing ahead of retained frames would reorder broadcasts, so the client is behind
+        if client.hasRetained() || !s.enqueueFrame(client, frame) {
+            log.Printf("Client send queue full, dropped at_most_once broadcast")
+            return true
+        }
+    default:
+        if !s.enqueueFrame(client, frame) {
+            return false
+        }
+    }
+    if messageID != "" {
+        s.trackAckLocked(client, messageID, jsonData)
+    }
+    settleMempoolLocked(matched, fields.payload, topics)
+
+    for _, subscription := range matched {
+        if subscription.MaxMessages <= 0 {
+            continue
+        }
+        subscription.delivered++
+        if subscription.delivered < subscription.MaxMessages {
+            continue
+        }
+
+        s.removeSubscriptionLocked(client, subscription.ID)
+        log.Printf("Auto-unsubscribed client from topic %s after %d messages", subscription.Pattern, subscription.delivered)
+        notice, err := json.Marshal(Message{Type: AutoUnsubscribed, Payload: subscription})
+        if err != nil {
+            log.Printf("Failed to marshal auto-unsubscribe notice: %v", err)
+            continue
+        }
+        if !s.enqueue(client, notice) {
+            return false
         }
     }
+    return true
+}
+
+// enqueue places a frame on the client's send queue without blocking, sending a one-off
+// flow_control warning once the queue reaches the high-water mark. It returns false if the
+// queue is full. The caller must hold s.Mutex, read or write, so Send cannot be closed underneath it.
+func (s *WebSocketServer) enqueue(client *Client, jsonData []byte) bool {
+    return s.enqueueFrame(client, Frame{Data: jsonData})
+}
+
+// enqueueFrame is enqueue for a frame that may carry a TTL.
+func (s *WebSocketServer) enqueueFrame(client *Client, frame Frame) bool {
+    select {
+    case client.Send <- frame:
+    default:
+        return false
+    }
+
+    capacity := cap(client.Send)
+    highWater := int(math.Ceil(s.SendQueueHighWater * float64(capacity)))
+    queued := len(client.Send)
+    if queued < highWater {
+        client.flowWarned.Store(false)
+        return true
+    }
+    if client.flowWarned.Swap(true) {
+        return true
+    }
+
+    warning, err := json.Marshal(Message{
+        Type:    FlowControl,
+        Payload: FlowControlPayload{Queued: queued, Capacity: capacity},
+    })
+    if err != nil {
+        log.Printf("Failed to marshal flow control message: %v", err)
+        return true
+    }
+    if !s.enqueuePriority(client, warning) {
+        return false
+    }
+    log.Printf("Client send queue at %d/%d, sent flow control warning", queued, capacity)
+    return true
+}
+
+// enqueueRetained places an at_least_once frame on the client's send queue, or retains it for
+// the writer to send once the queue has drained. Frames are retained, rather than queued,
+// while any are already waiting, so they keep their order. It returns false if the client
+// already has MaxRetainedFrames retained. The caller must hold s.Mutex, read or write.
+func (s *WebSocketServer) enqueueRetained(client *Client, frame Frame) bool {
+    client.mu.Lock()
+    defer client.mu.Unlock()
+    if len(client.retained) == 0 && s.enqueueFrame(client, frame) {
+        return true
+    }
+    if s.MaxRetainedFrames > 0 && len(client.retained) >= s.MaxRetainedFrames {
+        return false
+    }
+    client.retained = append(client.retained, frame)
+    select {
+    case client.retainedReady <- struct{}{}:
+    default:
+    }
+    return true
+}
+
+// enqueuePriority places an error or control frame on the client's priority lane without
+// blocking, so it is written ahead of data already queued on Send. Clients without a
+// priority lane get the frame on Send. It returns false if the lane is full. The caller must
+// hold s.Mutex, read or write.
+func (s *WebSocketServer) enqueuePriority(client *Client, jsonData []byte) bool {
+    if client.priority == nil {
+        select {
+        case client.Send <- Frame{Data: jsonData}:
+            return true
+        default:
+            return false
+        }
+    }
+    select {
+    case client.priority <- Frame{Data: jsonData}:
+        return true
+    default:
+        return false
+    }
+}
+
+// disconnectSlowClient drops a client whose send queue overflowed.
+func (s *WebSocketServer) disconnectSlowClient(client *Client) {
+    log.Printf("Client send queue full, disconnecting slow client")
+    s.Disconnect(client, DisconnectSlowConsumer)
+}
+
+// broadcastTopics returns the topics a broadcast message is addressed to, primary topic
+// first. Transactions are addressed to their tx_id and, when known, their agent, then to the
+// flows they belong to.
+func broadcastTopics(message Message) []string {
+    switch payload := message.Payload.(type) {
+    case AgentStatusPayload:
+        return []string{payload.AgentID}
+    case AgentStatusDeltaPayload:
+        return []string{payload.AgentID}
+    case AgentConfigPayload:
+        return []string{payload.AgentID}
+    case AgentMetricsPayload:
+        return []string{metricsTopic(payload.AgentID)}
+    case TransactionPayload:
+        topics := []string{payload.TxID}
+        if payload.AgentID != "" {
+            topics = append(topics, payload.AgentID)
+        }
+        return append(topics, flowTopics(payload)...)
+    }
+    return nil
+}
+
+// upgrade upgrades the request to a WebSocket connection. A request that is not a valid
+// upgrade, such as a plain HTTP GET, is logged with its remote address and answered with the
+// status the Upgrader chose, 400 for bad or missing upgrade headers, and a body giving the
+// reason, unless the Upgrader has an Error handler of its own.
+func (s *WebSocketServer) upgrade(w http.ResponseWriter, r *http.Request, header http.Header) (*websocket.Conn, error) {
+    upgrader := s.Upgrader
+    if upgrader.Error == nil {
+        upgrader.Error = func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+            log.Printf("Failed to upgrade connection from %s to WebSocket: %v", s.clientIP(r), reason)
+            http.Error(w, "WebSocket upgrade failed: "+strings.TrimPrefix(reason.Error(), "websocket: "), status)
+        }
+    }
+    return upgrader.Upgrade(w, r, header)
 }
 
 // HandleConnections handles incoming WebSocket connection requests.
 func (s *WebSocketServer) HandleConnections(w http.ResponseWriter, r *http.Request) {
+    // Refuse cross-site pages before anything else so they cannot ride on a user's credentials
+    remoteIP := s.clientIP(r)
+    if !s.originAllowed(r) {
+        log.Printf("Rejecting connection from %s with disallowed origin %q", remoteIP, r.Header.Get("Origin"))
+        http.Error(w, "Origin not allowed", http.StatusForbidden)
+        return
+    }
+
     // Basic authentication check (placeholder; integrate with real auth system)
     token := r.URL.Query().Get("token")
-    if token == "" || !validateToken(token) {
+    authenticated := token != "" && validateToken(token)
+    if !authenticated && !s.HealthProbes {
         http.Error(w, "Unauthorized", http.StatusUnauthorized)
         return
     }
 
-    // Upgrade HTTP connection to WebSocket
-    ws, err := s.Upgrader.Upgrade(w, r, nil)
+    if s.shuttingDown.Load() {
+        http.Error(w, "Server shutting down", http.StatusServiceUnavailable)
+        return
+    }
+
+    // Refuse before upgrading when full so the client sees a retryable HTTP error, not a dropped socket
+    s.Mutex.RLock()
+    full := s.atCapacityLocked()
+    fromIP := s.connectionsFromLocked(remoteIP)
+    s.Mutex.RUnlock()
+    if full {
+        w.Header().Set("Retry-After", overCapacityRetryAfter)
+        http.Error(w, "Server at capacity", http.StatusServiceUnavailable)
+        return
+    }
+    if !authenticated {
+        // Unauthenticated connections may only ask for health
+        s.serveHealthProbe(w, r)
+        return
+    }
+    if s.MaxConnectionsPerIP > 0 && fromIP >= s.MaxConnectionsPerIP {
+        log.Printf("Rejecting connection from %s: limit of %d connections reached", remoteIP, s.MaxConnectionsPerIP)
+        http.Error(w, "Too many connections from this address", http.StatusTooManyRequests)
+        return
+    }
+
+    // Negotiate a subprotocol before upgrading so a strict server can refuse with a plain HTTP error
+    subprotocol := s.selectSubprotocol(r)
+    if subprotocol == "" && s.RequireSubprotocol {
+        http.Error(w, "Unsupported subprotocol", http.StatusBadRequest)
+        return
+    }
+    var header http.Header
+    if subprotocol != "" {
+        header = http.Header{"Sec-WebSocket-Protocol": {subprotocol}}
+    }
+
+    // Upgrade HTTP connection to WebSocket; a failed upgrade has already been answered
+    ws, err := s.upgrade(w, r, header)
     if err != nil {
-        log.Printf("Failed to upgrade connection to WebSocket: %v", err)
-        http.Error(w, "Failed to upgrade connection", http.StatusInternalServerError)
         return
     }
 
-    // Create a new client
-    client := &Client{
-        Conn:       ws,
-        Send:       make(chan Message, 256),
-        Topics:     make(map[string]bool),
-        LastActive: time.Now(),
+    // Create a new client; tokens identify principals until real auth is integrated
+    client := s.newClient(ws, token)
+    client.Subprotocol = subprotocol
+    client.RemoteIP = remoteIP
+    if s.OnHandshake != nil {
+        s.OnHandshake(r, client)
     }
 
     // Register the client
-    s.Register <- client
+    if err := s.RegisterClient(client); err != nil {
+        // Capacity can still be reached between the check above and registration
+        code := websocket.ClosePolicyViolation
+        if errors.Is(err, ErrServerFull) {
+            code = CloseOverloaded
+        }
+        closeMsg := websocket.FormatCloseMessage(code, err.Error())
+        ws.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+        ws.Close()
+        return
+    }
+
+    s.sendWelcome(client)
+
+    if s.IdleConnectTimeout > 0 {
+        time.AfterFunc(s.IdleConnectTimeout, func() { s.closeIfIdle(client) })
+    }
 
     // Start client read and write goroutines
-    go s.writePump(client)
-    go s.readPump(client)
+    s.goClient(func() { s.writePump(client) })
+    s.goClient(func() { s.readPump(client) })
+}
+
+// goClient runs fn, one of a client's goroutines, counting it in ActiveGoroutines until it
+// returns. Every such goroutine must end once its client is unregistered.
+func (s *WebSocketServer) goClient(fn func()) {
+    s.goroutines.Add(1)
+    go func() {
+        defer s.goroutines.Add(-1)
+        fn()
+    }()
+}
+
+// ActiveGoroutines returns the number of per-client goroutines running: read and write loops,
+// log tails, mempool streams, history catch-ups and transaction queries. It returns to zero
+// once every client has disconnected and their queries have finished, so a count that stays
+// up points to a leak.
+func (s *WebSocketServer) ActiveGoroutines() int64 {
+    return s.goroutines.Load()
+}
+
+// sendReconnectHint queues a reconnect message for a client of a server shutting down, with a
+// backoff of ReconnectBackoff plus a random share of ReconnectJitter.
+func (s *WebSocketServer) sendReconnectHint(client *Client) {
+    backoff := s.ReconnectBackoff
+    if s.ReconnectJitter > 0 {
+        backoff += time.Duration(rand.Int63n(int64(s.ReconnectJitter)))
+    }
+    hint, err := json.Marshal(Message{
+        Type:    Reconnect,
+        Payload: ReconnectPayload{BackoffMs: backoff.Milliseconds(), AlternateServer: s.AlternateServer},
+    })
+    if err != nil {
+        log.Printf("Failed to marshal reconnect message: %v", err)
+        return
+    }
+    s.queuePriorityToClient(client, hint)
+}
+
+// sendWelcome queues the welcome message describing the server's configuration for a newly
+// registered client.
+func (s *WebSocketServer) sendWelcome(client *Client) {
+    welcome, err := json.Marshal(Message{
+        Type: Welcome,
+        Payload: WelcomePayload{
+            ClientID:        client.ID,
+            SessionToken:    client.SessionToken,
+            ProtocolVersion: ProtocolVersion,
+            Subprotocol:     client.Subprotocol,
+            MessageTypes:    s.messageTypes(),
+            Blockchains:     s.SupportedBlockchains,
+            Limits: WelcomeLimits{
+                MaxSubscriptions:     s.MaxSubscriptionsPerClient,
+                MaxMessageBytes:      s.MaxMessageBytes,
+                MaxConcurrentQueries: s.MaxConcurrentQueries,
+            },
+        },
+    })
+    if err != nil {
+        log.Printf("Failed to marshal welcome message: %v", err)
+        return
+    }
+    s.queueToClient(client, welcome)
+}
+
+// messageTypes returns the enabled built-in and registered client message types, sorted.
+func (s *WebSocketServer) messageTypes() []string {
+    types := make([]string, 0, len(builtinMessageTypes))
+    for msgType := range builtinMessageTypes {
+        if s.messageTypeEnabled(msgType) {
+            types = append(types, string(msgType))
+        }
+    }
+    s.handlersMu.RLock()
+    for msgType := range s.handlers {
+        if !builtinMessageTypes[msgType] && s.messageTypeEnabled(msgType) {
+            types = append(types, string(msgType))
+        }
+    }
+    s.handlersMu.RUnlock()
+    sort.Strings(types)
+    return types
+}
+
+// closeIfIdle closes a connection that has not sent a meaningful message since connecting.
+func (s *WebSocketServer) closeIfIdle(client *Client) {
+    if client.engaged.Load() {
+        return
+    }
+    if _, connected := s.GetClient(client.ID); !connected {
+        return
+    }
+    log.Printf("Closing client %s: no messages within %v of connecting", client.ID, s.IdleConnectTimeout)
+    s.disconnectWith(client, DisconnectTimeout, "idle connection")
+}
+
+// selectSubprotocol returns the server's most preferred subprotocol among those the request
+// offers, or "" when there is no match.
+func (s *WebSocketServer) selectSubprotocol(r *http.Request) string {
+    offered := websocket.Subprotocols(r)
+    for _, supported := range s.Subprotocols {
+        for _, candidate := range offered {
+            if candidate == supported {
+                return supported
+            }
+        }
+    }
+    return ""
+}
+
+// priorityQueueSize is the capacity of each client's priority lane. Errors and control
+// frames are small and rare, so it does not scale with SendQueueSize.
+const priorityQueueSize = 32
+
+// newClient constructs a client for an upgraded connection, sized by the server's configuration.
+func (s *WebSocketServer) newClient(conn *websocket.Conn, principal string) *Client {
+    return &Client{
+        Conn:          conn,
+        Send:          make(chan Frame, s.SendQueueSize),
+        priority:      make(chan Frame, priorityQueueSize),
+        retainedReady: make(chan struct{}, 1),
+        writerDone:    make(chan struct{}),
+        Subscriptions: make(map[string]*Subscription),
+        LastActive:    s.Clock.Now(),
+        Principal:     principal,
+    }
+}
+
+// hasRetained reports whether at_least_once frames are waiting for room in the send queue.
+func (c *Client) hasRetained() bool {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return len(c.retained) > 0
 }
 
-// writePump handles sending messages to the client.
+// nextFrame returns the next frame for the writer without blocking: the priority lane first,
+// then Send, then retained at_least_once frames. open is false once Send has been closed and
+// drained; ready is false if no frame is waiting.
+func (c *Client) nextFrame() (frame Frame, open, ready bool) {
+    select {
+    case frame = <-c.priority:
+        return frame, true, true
+    default:
+    }
+    select {
+    case frame, open = <-c.Send:
+        return frame, open, open
+    default:
+    }
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    if len(c.retained) == 0 {
+        return Frame{}, true, false
+    }
+    frame = c.retained[0]
+    c.retained = c.retained[1:]
+    return frame, true, true
+}
+
+// writePump handles sending messages to the client, draining the priority lane before each
+// frame from Send and Send before retained frames. A failed write means the connection is
+// gone, so the writer stops and the client is unregistered, clearing its subscriptions.
 func (s *WebSocketServer) writePump(client *Client) {
     defer func() {
         client.Conn.Close()
-        s.Unregister <- client
+        s.UnregisterClient(client)
+        if client.writerDone != nil {
+            close(client.writerDone)
+        }
     }()
 
     for {
-        select {
-        case message, ok := <-client.Send:
-            if !ok {
-                client.Conn.WriteMessage(websocket.CloseMessage, []byte{})
-                return
-            }
-
-            jsonData, err := json.Marshal(message)
-            if err != nil {
-                log.Printf("Failed to marshal message: %v", err)
+        frame, open, ready := client.nextFrame()
+        if open && !ready {
+            select {
+            case frame = <-client.priority:
+            case frame, open = <-client.Send:
+            case <-client.retainedReady:
                 continue
             }
+        }
+        if !open {
+            client.Conn.WriteMessage(websocket.CloseMessage, client.closingMessage())
+            return
+        }
+        if frame.expired(s.Clock.Now()) {
+            log.Printf("Dropped broadcast that outlived its TTL in client %s's queue", client.ID)
+            continue
+        }
+        jsonData := frame.Data
 
-            if err := client.Conn.WriteMessage(websocket.TextMessage, jsonData); err != nil {
-                log.Printf("Failed to write message to client: %v", err)
-                return
-            }
-            client.LastActive = time.Now()
+        if err := client.Conn.WriteMessage(websocket.TextMessage, jsonData); err != nil {
+            log.Printf("Failed to write message to client: %v", err)
+            client.setDisconnectReason(DisconnectConnectionLost)
+            return
         }
+        client.messagesOut.Add(1)
+        client.bytesOut.Add(uint64(len(jsonData)))
     }
 }
 
 // readPump handles reading messages from the client.
 func (s *WebSocketServer) readPump(client *Client) {
     defer func() {
+        // A panicking handler must not skip cleanup or take down the server
+        if r := recover(); r != nil {
+            log.Printf("Recovered from panic in client read loop: %v", r)
+        }
         client.Conn.Close()
-        s.Unregister <- client
+        s.UnregisterClient(client)
     }()
 
+    if s.MaxMessageBytes > 0 {
+        client.Conn.SetReadLimit(s.MaxMessageBytes)
+    }
+
     // Set read deadline and pong handler for heartbeat
     client.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
     client.Conn.SetPongHandler(func(string) error {
-        client.LastActive = time.Now()
+        client.LastActive = s.Clock.Now()
         client.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
         return nil
     })
 
     for {
-        _, message, err := client.Conn.ReadMessage()
+        frameType, message, err := client.Conn.ReadMessage()
         if err != nil {
             log.Printf("Failed to read message from client: %v", err)
+            // gorilla reports a dropped connection as an abnormal closure; only a real close frame counts
+            var closeErr *websocket.CloseError
+            if errors.As(err, &closeErr) && closeErr.Code != websocket.CloseAbnormalClosure {
+                client.setDisconnectReason(DisconnectClientClosed)
+            } else {
+                client.setDisconnectReason(DisconnectConnectionLost)
+            }
             break
         }
-
-        client.LastActive = time.Now()
-
-        // Handle incoming messages (e.g., subscription to topics)
-        var msg Message
-        if err := json.Unmarshal(message, &msg); err != nil {
-            log.Printf("Failed to unmarshal client message: %v", err)
+        client.messagesIn.Add(1)
+        client.bytesIn.Add(uint64(len(message)))
+        // Messages are JSON text; there is no binary codec to decode other frames with
+        if frameType != websocket.TextMessage {
+            log.Printf("Rejecting non-text frame of type %d from client %s", frameType, client.ID)
+            s.sendErrorMessage(client, CodeUnsupportedMediaType, "Unsupported frame type: messages must be sent as JSON text frames", nil)
             continue
         }
 
-        if msg.Type == "subscribe" {
-            if topic, ok := msg.Payload.(string); ok {
-                client.Topics[topic] = true
-                log.Printf("Client subscribed to topic: %s", topic)
-            }
-        } else if msg.Type == "unsubscribe" {
-            if topic, ok := msg.Payload.(string); ok {
-                delete(client.Topics, topic)
-                log.Printf("Client unsubscribed from topic: %s", topic)
-            }
-        }
+        // Dispatch incoming messages (subscriptions, agent control, queries)
+        s.HandleClientMessage(client, message)
     }
 }
 
@@ -245,7 +1628,7 @@ func (s *WebSocketServer) SendAgentStatusUpdate(agentID, status, details string)
     payload := AgentStatusPayload{
         AgentID:     agentID,
         Status:      status,
-        LastUpdated: time.Now(),
+        LastUpdated: s.Clock.Now(),
         Details:     details,
     }
     message := Message{
@@ -256,17 +1639,69 @@ func (s *WebSocketServer) SendAgentStatusUpdate(agentID, status, details string)
     log.Printf("Broadcasted agent status update for agent %s with status %s", agentID, status)
 }
 
+// SendAgentConfigUpdate broadcasts an agent's new configuration to clients subscribed to the agent.
+func (s *WebSocketServer) SendAgentConfigUpdate(agentID string, config map[string]interface{}) {
+    s.Mutex.Lock()
+    s.configVersions[agentID]++
+    version := s.configVersions[agentID]
+    s.Mutex.Unlock()
+
+    payload := AgentConfigPayload{
+        AgentID:   agentID,
+        Version:   version,
+        Config:    config,
+        UpdatedAt: s.Clock.Now(),
+    }
+    message := Message{
+        Type:    AgentConfigUpdate,
+        Payload: payload,
+    }
+    s.Broadcast <- message
+    log.Printf("Broadcasted config update for agent %s at version %d", agentID, version)
+}
+
+// BroadcastAll queues msg for every connected client regardless of their subscriptions, for
+// operator announcements such as maintenance banners. It goes through each client's send
+// queue like any broadcast, so a client whose queue is full is disconnected as a slow consumer.
+func (s *WebSocketServer) BroadcastAll(msg ResponseMessage) {
+    jsonData, err := json.Marshal(msg)
+    if err != nil {
+        log.Printf("Failed to marshal announcement: %v", err)
+        return
+    }
+    frames := s.splitFrame(jsonData)
+
+    var overflowed []*Client
+    s.Mutex.RLock()
+    for client := range s.Clients {
+        for _, frame := range frames {
+            if !s.enqueue(client, frame) {
+                overflowed = append(overflowed, client)
+                break
+            }
+        }
+    }
+    total := len(s.Clients)
+    s.Mutex.RUnlock()
+
+    for _, client := range overflowed {
+        s.disconnectSlowClient(client)
+    }
+    log.Printf("Broadcasted %s announcement to %d clients", msg.Type, total-len(overflowed))
+}
+
 // SendTransactionUpdate broadcasts a transaction update to connected clients.
 func (s *WebSocketServer) SendTransactionUpdate(txID, status, amount, blockchain, fromAddr, toAddr string) {
     payload := TransactionPayload{
         TxID:        txID,
         Status:      status,
-        Timestamp:   time.Now(),
+        Timestamp:   s.Clock.Now(),
         Amount:      amount,
         Blockchain:  blockchain,
         FromAddress: fromAddr,
         ToAddress:   toAddr,
     }
+    payload.structureAmount()
     message := Message{
         Type:    TransactionUpdate,
         Payload: payload,
@@ -275,29 +1710,64 @@ func (s *WebSocketServer) SendTransactionUpdate(txID, status, amount, blockchain
     log.Printf("Broadcasted transaction update for tx %s with status %s", txID, status)
 }
 
+// PublishTransaction records a transaction issued by agentID, when the Store can record
+// transactions, and broadcasts it to subscribers of the transaction and of the agent.
+// Confirmed transactions also count towards the agent's "metrics:<agent_id>" topic.
+func (s *WebSocketServer) PublishTransaction(agentID string, tx TransactionPayload) {
+    tx.AgentID = agentID
+    tx.structureAmount()
+    if recorder, ok := s.Store.(TransactionRecorder); ok {
+        tx = recorder.Add(agentID, tx)
+    }
+    s.recordVolume(tx)
+    s.Broadcast <- Message{Type: TransactionUpdate, Payload: tx}
+    log.Printf("Published transaction %s for agent %s at sequence %d", tx.TxID, agentID, tx.Sequence)
+}
+
 // Heartbeat runs a periodic check to send ping messages and close inactive connections.
+// Subscriptions past their ttl_seconds are expired, ended metrics windows flushed, and scheduled
+// agent commands that have fallen due queued, every second.
 func (s *WebSocketServer) Heartbeat() {
     ticker := time.NewTicker(30 * time.Second)
     defer ticker.Stop()
+    expiry := time.NewTicker(time.Second)
+    defer expiry.Stop()
 
-    for range ticker.C {
-        s.Mutex.RLock()
-        for client := range s.Clients {
-            if time.Since(client.LastActive) > 60*time.Second {
-                log.Printf("Client inactive for too long, closing connection")
-                s.Unregister <- client
-                client.Conn.Close()
-                continue
-            }
+    for {
+        select {
+        case <-ticker.C:
+            s.sweepClients()
+        case <-expiry.C:
+            s.expireSubscriptions()
+            s.flushMetricsAsync()
+            s.runDueCommands()
+        }
+    }
+}
 
-            err := client.Conn.WriteMessage(websocket.PingMessage, nil)
-            if err != nil {
-                log.Printf("Failed to send ping to client: %v", err)
-                s.Unregister <- client
-                client.Conn.Close()
-            }
+// sweepClients closes connections idle for over a minute and pings the rest.
+func (s *WebSocketServer) sweepClients() {
+    now := s.Clock.Now()
+    stale := make(map[*Client]DisconnectReason)
+    s.Mutex.RLock()
+    for client := range s.Clients {
+        if now.Sub(client.LastActive) > 60*time.Second {
+            log.Printf("Client inactive for too long, closing connection")
+            stale[client] = DisconnectTimeout
+            continue
         }
-        s.Mutex.RUnlock()
+
+        err := client.Conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second))
+        if err != nil {
+            log.Printf("Failed to send ping to client: %v", err)
+            stale[client] = DisconnectConnectionLost
+        }
+    }
+    s.Mutex.RUnlock()
+
+    // Disconnect outside the read lock; unregistering takes the write lock
+    for client, reason := range stale {
+        s.Disconnect(client, reason)
     }
 }
 
@@ -0,0 +1,1715 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/gorilla/websocket"
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+)
+
+// newTestClient builds a client without a network connection; responses queued for it
+// can be read straight from its Send channel.
+func newTestClient() *Client {
+    return &Client{
+        Send:          make(chan Frame, 256),
+        Subscriptions: make(map[string]*Subscription),
+        LastActive:    time.Now(),
+    }
+}
+
+// dialTestServer starts an HTTP test server for s and opens a WebSocket connection to it.
+func dialTestServer(t *testing.T, s *WebSocketServer) (*httptest.Server, *websocket.Conn) {
+    t.Helper()
+    ts := httptest.NewServer(http.HandlerFunc(s.HandleConnections))
+    t.Cleanup(ts.Close)
+
+    return ts, dialURL(t, "ws"+strings.TrimPrefix(ts.URL, "http")+"/ws?token=valid-token")
+}
+
+// dialURL opens a WebSocket connection to url and consumes the welcome message.
+func dialURL(t *testing.T, url string) *websocket.Conn {
+    t.Helper()
+    conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+    require.NoError(t, err)
+    t.Cleanup(func() { conn.Close() })
+
+    var welcome Message
+    require.NoError(t, conn.ReadJSON(&welcome))
+    require.Equal(t, Welcome, welcome.Type)
+    return conn
+}
+
+// waitForClients polls until the registry holds n clients.
+func waitForClients(t *testing.T, s *WebSocketServer, n int) []*Client {
+    t.Helper()
+    var clients []*Client
+    require.Eventually(t, func() bool {
+        s.Mutex.RLock()
+        defer s.Mutex.RUnlock()
+        clients = clients[:0]
+        for client := range s.Clients {
+            clients = append(clients, client)
+        }
+        return len(clients) == n
+    }, 2*time.Second, 10*time.Millisecond)
+    return clients
+}
+
+func TestRegisterAndUnregisterClient(t *testing.T) {
+    s := NewWebSocketServer()
+    client := newTestClient()
+
+    s.RegisterClient(client)
+    s.Mutex.Lock()
+    client.Subscriptions["sub-a"] = &Subscription{ID: "sub-a", Pattern: "agent-1"}
+    client.Subscriptions["sub-b"] = &Subscription{ID: "sub-b", Pattern: "tx-*"}
+    s.Mutex.Unlock()
+    assert.True(t, s.Clients[client])
+
+    s.UnregisterClient(client)
+    assert.NotContains(t, s.Clients, client)
+    assert.Empty(t, client.Subscriptions)
+    _, open := <-client.Send
+    assert.False(t, open, "send channel should be closed")
+
+    // A second unregister, as issued by the other pump, must be a no-op
+    assert.NotPanics(t, func() { s.UnregisterClient(client) })
+}
+
+func TestWriteErrorDisconnectsClient(t *testing.T) {
+    s := NewWebSocketServer()
+    reasons := make(chan DisconnectReason, 1)
+    s.OnDisconnect = func(client *Client, reason DisconnectReason) { reasons <- reason }
+    clients := make(chan *Client, 1)
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        ws, err := s.Upgrader.Upgrade(w, r, nil)
+        if err != nil {
+            return
+        }
+        client := s.newClient(ws, "tester")
+        s.RegisterClient(client)
+        // Only the writer runs, and its connection is already broken
+        ws.UnderlyingConn().Close()
+        clients <- client
+        s.writePump(client)
+    }))
+    t.Cleanup(ts.Close)
+    conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+    require.NoError(t, err)
+    t.Cleanup(func() { conn.Close() })
+    client := <-clients
+
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"agent-1"}}`))
+
+    select {
+    case reason := <-reasons:
+        assert.Equal(t, DisconnectConnectionLost, reason)
+    case <-time.After(2 * time.Second):
+        t.Fatal("client was not disconnected after a failed write")
+    }
+    waitForClients(t, s, 0)
+    assert.Empty(t, s.TopicStats())
+}
+
+func TestUnregisterClientStopsWriter(t *testing.T) {
+    s := NewWebSocketServer()
+    _, conn := dialTestServer(t, s)
+    client := waitForClients(t, s, 1)[0]
+
+    s.UnregisterClient(client)
+
+    conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+    _, _, err := conn.ReadMessage()
+    assert.True(t, websocket.IsCloseError(err, websocket.CloseNoStatusReceived), "unexpected error: %v", err)
+    waitForClients(t, s, 0)
+}
+
+// readMessage decodes the next broadcast frame queued for client.
+func readMessage(t *testing.T, client *Client) map[string]interface{} {
+    t.Helper()
+    select {
+    case frame := <-client.Send:
+        var message map[string]interface{}
+        require.NoError(t, json.Unmarshal(frame.Data, &message))
+        return message
+    case <-time.After(2 * time.Second):
+        t.Fatal("timed out waiting for message")
+        return nil
+    }
+}
+
+func TestSendAgentConfigUpdateReachesSubscribers(t *testing.T) {
+    s := NewWebSocketServer()
+    go s.Start()
+    subscriber := newRegisteredClient(s)
+    other := newRegisteredClient(s)
+    s.HandleClientMessage(subscriber, []byte(`{"type":"subscribe","payload":{"topic":"agent-1"}}`))
+    s.HandleClientMessage(other, []byte(`{"type":"subscribe","payload":{"topic":"agent-2"}}`))
+    readResponse(t, subscriber)
+    readResponse(t, other)
+
+    s.SendAgentConfigUpdate("agent-1", map[string]interface{}{"risk": "low"})
+    s.SendAgentConfigUpdate("agent-1", map[string]interface{}{"risk": "high"})
+
+    for _, want := range []struct {
+        version float64
+        risk    string
+    }{{1, "low"}, {2, "high"}} {
+        message := readMessage(t, subscriber)
+        assert.Equal(t, "agent_config_update", message["type"])
+        payload := message["payload"].(map[string]interface{})
+        assert.Equal(t, "agent-1", payload["agent_id"])
+        assert.Equal(t, want.version, payload["version"])
+        assert.Equal(t, want.risk, payload["config"].(map[string]interface{})["risk"])
+    }
+    assert.Empty(t, other.Send)
+}
+
+func TestConnectionsPerPrincipalRejectNewest(t *testing.T) {
+    s := NewWebSocketServer()
+    s.MaxConnectionsPerPrincipal = 2
+
+    for i := 0; i < 2; i++ {
+        client := newTestClient()
+        client.Principal = "alice"
+        require.NoError(t, s.RegisterClient(client))
+    }
+    extra := newTestClient()
+    extra.Principal = "alice"
+    assert.ErrorIs(t, s.RegisterClient(extra), ErrTooManyConnections)
+    assert.NotContains(t, s.Clients, extra)
+
+    other := newTestClient()
+    other.Principal = "bob"
+    assert.NoError(t, s.RegisterClient(other))
+    assert.Len(t, s.Clients, 3)
+}
+
+func TestConnectionsPerPrincipalCloseOldest(t *testing.T) {
+    s := NewWebSocketServer()
+    s.MaxConnectionsPerPrincipal = 2
+    s.ConnectionLimit = CloseOldest
+
+    var clients []*Client
+    for i := 0; i < 3; i++ {
+        client := newTestClient()
+        client.Principal = "alice"
+        require.NoError(t, s.RegisterClient(client))
+        clients = append(clients, client)
+    }
+
+    assert.NotContains(t, s.Clients, clients[0])
+    _, open := <-clients[0].Send
+    assert.False(t, open, "oldest connection should be closed")
+    assert.Equal(t, []*Client{clients[1], clients[2]}, s.principals["alice"])
+
+    // Disconnecting frees the principal's slot entirely
+    s.UnregisterClient(clients[1])
+    s.UnregisterClient(clients[2])
+    assert.NotContains(t, s.principals, "alice")
+}
+
+func TestOnDisconnectFiresOnForcedClose(t *testing.T) {
+    s := NewWebSocketServer()
+    disconnected := make(chan *Client, 1)
+    s.OnDisconnect = func(client *Client, reason DisconnectReason) {
+        assert.Empty(t, client.Subscriptions, "subscriptions should be cleared before the callback")
+        assert.Equal(t, DisconnectConnectionLost, reason)
+        disconnected <- client
+    }
+    _, conn := dialTestServer(t, s)
+    client := waitForClients(t, s, 1)[0]
+    require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"subscribe","payload":{"topic":"agent-1"}}`)))
+    conn.ReadMessage()
+
+    // Drop the TCP connection without a close handshake
+    conn.UnderlyingConn().Close()
+
+    select {
+    case got := <-disconnected:
+        assert.Same(t, client, got)
+    case <-time.After(2 * time.Second):
+        t.Fatal("OnDisconnect was not called")
+    }
+    assert.Empty(t, disconnected, "callback should fire exactly once")
+}
+
+func TestServerConfigPropagates(t *testing.T) {
+    s := NewWebSocketServerWithConfig(ServerConfig{
+        ReadBufferSize:  4096,
+        WriteBufferSize: 8192,
+        SendQueueSize:   16,
+    })
+    assert.Equal(t, 4096, s.Upgrader.ReadBufferSize)
+    assert.Equal(t, 8192, s.Upgrader.WriteBufferSize)
+
+    dialTestServer(t, s)
+    client := waitForClients(t, s, 1)[0]
+    assert.Equal(t, 16, cap(client.Send))
+}
+
+func TestFlowControlWarnsBeforeDisconnect(t *testing.T) {
+    s := NewWebSocketServer()
+    go s.Start()
+    client := &Client{Send: make(chan Frame, 10), Subscriptions: make(map[string]*Subscription)}
+    s.RegisterClient(client)
+
+    for i := 0; i < 10; i++ {
+        s.SendAgentStatusUpdate("agent-1", "active", "")
+    }
+    waitForClients(t, s, 0)
+
+    var types []string
+    for frame := range client.Send {
+        var message Message
+        require.NoError(t, json.Unmarshal(frame.Data, &message))
+        types = append(types, string(message.Type))
+    }
+    require.Len(t, types, 10)
+    assert.Equal(t, "flow_control", types[8], "warning should follow the frame that crossed the high-water mark")
+    for i, typ := range types {
+        if i != 8 {
+            assert.Equal(t, "agent_status", typ)
+        }
+    }
+}
+
+func TestGetClientExposesLastError(t *testing.T) {
+    s := NewWebSocketServer()
+    client := newRegisteredClient(s)
+    require.NotEmpty(t, client.ID)
+
+    got, ok := s.GetClient(client.ID)
+    require.True(t, ok)
+    assert.Nil(t, got.LastError())
+
+    s.HandleClientMessage(got, []byte(`not json`))
+    s.HandleClientMessage(got, []byte(`{"type":"bogus"}`))
+
+    lastError := got.LastError()
+    require.NotNil(t, lastError)
+    assert.Equal(t, 400, lastError.Code)
+    assert.Contains(t, lastError.Message, "bogus")
+    assert.WithinDuration(t, time.Now(), lastError.Timestamp, time.Second)
+
+    s.UnregisterClient(client)
+    _, ok = s.GetClient(client.ID)
+    assert.False(t, ok)
+}
+
+func TestSubprotocolNegotiation(t *testing.T) {
+    for _, tc := range []struct {
+        name    string
+        offered []string
+        strict  bool
+        want    string
+        reject  bool
+    }{
+        {name: "matching", offered: []string{"other", "polyone.v1"}, want: "polyone.v1"},
+        {name: "non-matching", offered: []string{"other"}},
+        {name: "absent"},
+        {name: "non-matching strict", offered: []string{"other"}, strict: true, reject: true},
+        {name: "absent strict", strict: true, reject: true},
+        {name: "matching strict", offered: []string{"polyone.v1"}, strict: true, want: "polyone.v1"},
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            s := NewWebSocketServer()
+            s.RequireSubprotocol = tc.strict
+            ts := httptest.NewServer(http.HandlerFunc(s.HandleConnections))
+            defer ts.Close()
+
+            dialer := websocket.Dialer{Subprotocols: tc.offered}
+            conn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws?token=valid-token", nil)
+            if tc.reject {
+                require.Error(t, err)
+                assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+                assert.Empty(t, s.Clients)
+                return
+            }
+            require.NoError(t, err)
+            defer conn.Close()
+            assert.Equal(t, tc.want, conn.Subprotocol())
+            assert.Equal(t, tc.want, waitForClients(t, s, 1)[0].Subprotocol)
+        })
+    }
+}
+
+func TestRequireAckRetriesUntilGiveUp(t *testing.T) {
+    s := NewWebSocketServer()
+    s.AckTimeout = 100 * time.Millisecond
+    s.AckRetries = 2
+    undelivered := make(chan string, 2)
+    s.OnUndelivered = func(client *Client, messageID string) {
+        undelivered <- client.ID + " " + messageID
+    }
+    go s.Start()
+    acking := newRegisteredClient(s)
+    silent := newRegisteredClient(s)
+
+    s.Broadcast <- Message{
+        Type:       AgentStatusUpdate,
+        Payload:    AgentStatusPayload{AgentID: "agent-1", Status: "active"},
+        RequireAck: true,
+    }
+
+    message := readMessage(t, acking)
+    assert.Equal(t, true, message["require_ack"])
+    messageID, _ := message["message_id"].(string)
+    require.NotEmpty(t, messageID)
+    s.HandleClientMessage(acking, []byte(`{"type":"ack","payload":{"message_id":"`+messageID+`"}}`))
+
+    // The silent client gets the original delivery plus AckRetries resends, then is given up on
+    for i := 0; i < 3; i++ {
+        assert.Equal(t, messageID, readMessage(t, silent)["message_id"])
+    }
+    select {
+    case got := <-undelivered:
+        assert.Equal(t, silent.ID+" "+messageID, got)
+    case <-time.After(2 * time.Second):
+        t.Fatal("OnUndelivered was not called")
+    }
+
+    time.Sleep(3 * s.AckTimeout)
+    assert.Empty(t, acking.Send, "acknowledged message should not be resent")
+    assert.Empty(t, silent.Send, "no resends after giving up")
+    assert.Empty(t, undelivered)
+}
+
+// fakeClock is a Clock that only moves when advanced.
+type fakeClock struct {
+    mu  sync.Mutex
+    now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+    return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+    c.mu.Lock()
+    c.now = c.now.Add(d)
+    c.mu.Unlock()
+}
+
+func TestHeartbeatSweepUsesClock(t *testing.T) {
+    s := NewWebSocketServer()
+    clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+    s.Clock = clock
+    _, conn := dialTestServer(t, s)
+    client := waitForClients(t, s, 1)[0]
+    assert.Equal(t, clock.Now(), client.LastActive)
+
+    clock.Advance(59 * time.Second)
+    s.sweepClients()
+    waitForClients(t, s, 1)
+
+    // A heartbeat timeout is reported to the client with a 1008 close frame; the server closes
+    // the connection right away, so the close is not echoed
+    conn.SetCloseHandler(func(int, string) error { return nil })
+    clock.Advance(2 * time.Second)
+    s.sweepClients()
+    assert.NotContains(t, s.Clients, client)
+    assert.Equal(t, DisconnectTimeout, client.DisconnectReason())
+    conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+    var err error
+    for err == nil {
+        _, _, err = conn.ReadMessage()
+    }
+    assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation), "unexpected error: %v", err)
+}
+
+func TestQueryTimestampsUseClock(t *testing.T) {
+    s := NewWebSocketServer()
+    clock := &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+    s.Clock = clock
+    client := newRegisteredClient(s)
+
+    s.HandleClientMessage(client, []byte(`{"type":"transaction_query","payload":{"tx_id":"tx-1"}}`))
+    response := readResponse(t, client)
+    require.True(t, response.Success, "query failed: %+v", response.Error)
+    transactions := response.Data.(map[string]interface{})["transactions"].([]interface{})
+    require.Len(t, transactions, 1)
+    assert.Equal(t, "2024-01-01T11:50:00Z", transactions[0].(map[string]interface{})["timestamp"])
+}
+
+func TestMaxClientsRefusesUpgrade(t *testing.T) {
+    s := NewWebSocketServer()
+    s.MaxClients = 2
+    ts, first := dialTestServer(t, s)
+    url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws?token=valid-token"
+    dialURL(t, url)
+    waitForClients(t, s, 2)
+
+    _, resp, err := websocket.DefaultDialer.Dial(url, nil)
+    require.ErrorIs(t, err, websocket.ErrBadHandshake)
+    assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+    assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+
+    // Existing clients keep working
+    require.NoError(t, first.WriteMessage(websocket.TextMessage, []byte(`{"type":"list_subscriptions"}`)))
+    _, _, err = first.ReadMessage()
+    assert.NoError(t, err)
+    waitForClients(t, s, 2)
+
+    extra := newTestClient()
+    assert.ErrorIs(t, s.RegisterClient(extra), ErrServerFull)
+}
+
+func TestBinaryFrameRejected(t *testing.T) {
+    s := NewWebSocketServer()
+    _, conn := dialTestServer(t, s)
+
+    require.NoError(t, conn.WriteMessage(websocket.BinaryMessage, []byte(`{"type":"list_subscriptions"}`)))
+    var response ResponseMessage
+    require.NoError(t, conn.ReadJSON(&response))
+    require.NotNil(t, response.Error)
+    assert.Equal(t, 415, response.Error.Code)
+
+    // The connection stays usable for text frames
+    require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"list_subscriptions"}`)))
+    var listed ResponseMessage
+    require.NoError(t, conn.ReadJSON(&listed))
+    assert.True(t, listed.Success)
+}
+
+func TestMetadataSetAtHandshake(t *testing.T) {
+    s := NewWebSocketServer()
+    s.OnHandshake = func(r *http.Request, client *Client) {
+        client.Metadata.Set("tenant", r.URL.Query().Get("tenant"))
+    }
+    require.NoError(t, s.RegisterHandler("whoami", func(client *Client, payload json.RawMessage) {
+        tenant, _ := client.Metadata.Get("tenant")
+        s.sendResponseToClient(client, ResponseMessage{Type: "whoami_response", Success: true, Data: tenant})
+    }))
+    ts := httptest.NewServer(http.HandlerFunc(s.HandleConnections))
+    defer ts.Close()
+
+    conn := dialURL(t, "ws"+strings.TrimPrefix(ts.URL, "http")+"/ws?token=valid-token&tenant=acme")
+
+    require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"whoami"}`)))
+    var response ResponseMessage
+    require.NoError(t, conn.ReadJSON(&response))
+    assert.Equal(t, "acme", response.Data)
+
+    _, ok := newTestClient().Metadata.Get("tenant")
+    assert.False(t, ok)
+}
+
+func TestCoalescedBroadcastsSendLatestPerInterval(t *testing.T) {
+    s := NewWebSocketServer()
+    s.CoalesceInterval = 200 * time.Millisecond
+    go s.Start()
+    client := newRegisteredClient(s)
+
+    for i := 0; i < 20; i++ {
+        s.SendAgentStatusUpdate("agent-1", fmt.Sprintf("step-%d", i), "")
+        s.SendAgentStatusUpdate("agent-2", fmt.Sprintf("step-%d", i), "")
+    }
+
+    latest := map[string]string{}
+    for i := 0; i < 2; i++ {
+        payload := readMessage(t, client)["payload"].(map[string]interface{})
+        latest[payload["agent_id"].(string)] = payload["status"].(string)
+    }
+    assert.Equal(t, map[string]string{"agent-1": "step-19", "agent-2": "step-19"}, latest)
+
+    time.Sleep(2 * s.CoalesceInterval)
+    assert.Empty(t, client.Send, "each topic should be delivered once per interval")
+
+    // A later update opens a new window
+    s.SendAgentStatusUpdate("agent-1", "done", "")
+    assert.Equal(t, "done", readMessage(t, client)["payload"].(map[string]interface{})["status"])
+}
+
+func TestIdleConnectTimeoutClosesSilentConnections(t *testing.T) {
+    s := NewWebSocketServer()
+    s.IdleConnectTimeout = 300 * time.Millisecond
+    reasons := make(chan DisconnectReason, 2)
+    s.OnDisconnect = func(client *Client, reason DisconnectReason) { reasons <- reason }
+    ts, silent := dialTestServer(t, s)
+    active := dialURL(t, "ws"+strings.TrimPrefix(ts.URL, "http")+"/ws?token=valid-token")
+    require.NoError(t, active.WriteMessage(websocket.TextMessage, []byte(`{"type":"subscribe","payload":{"topic":"agent-1"}}`)))
+    _, _, err := active.ReadMessage()
+    require.NoError(t, err)
+
+    silent.SetReadDeadline(time.Now().Add(2 * time.Second))
+    _, _, err = silent.ReadMessage()
+    assert.True(t, websocket.IsCloseError(err, websocket.ClosePolicyViolation), "unexpected error: %v", err)
+    waitForClients(t, s, 1)
+    assert.Equal(t, DisconnectTimeout, <-reasons)
+
+    // The engaged connection outlives the timeout
+    require.NoError(t, active.WriteMessage(websocket.TextMessage, []byte(`{"type":"list_subscriptions"}`)))
+    _, _, err = active.ReadMessage()
+    assert.NoError(t, err)
+}
+
+func TestDisconnectReasons(t *testing.T) {
+    s := NewWebSocketServer()
+    reasons := make(chan DisconnectReason, 3)
+    s.OnDisconnect = func(client *Client, reason DisconnectReason) {
+        reasons <- reason
+    }
+    ts, conn := dialTestServer(t, s)
+    url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws?token=valid-token"
+    waitFor := func(want DisconnectReason) {
+        t.Helper()
+        select {
+        case got := <-reasons:
+            assert.Equal(t, want, got)
+        case <-time.After(2 * time.Second):
+            t.Fatalf("no disconnect reported, want %s", want)
+        }
+    }
+
+    // Client-initiated close
+    require.NoError(t, conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")))
+    waitFor(DisconnectClientClosed)
+
+    // Application kick for rate limiting
+    dialURL(t, url)
+    client := waitForClients(t, s, 1)[0]
+    s.Disconnect(client, DisconnectRateLimited)
+    waitFor(DisconnectRateLimited)
+    assert.Equal(t, DisconnectRateLimited, client.DisconnectReason())
+
+    // Server shutdown sends a going-away close and refuses new connections
+    remaining := dialURL(t, url)
+    waitForClients(t, s, 1)
+    require.NoError(t, s.Shutdown(context.Background()))
+    waitFor(DisconnectShutdown)
+    remaining.SetReadDeadline(time.Now().Add(2 * time.Second))
+    assert.Equal(t, string(Reconnect), readJSONType(t, remaining))
+    _, _, err := remaining.ReadMessage()
+    assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "unexpected error: %v", err)
+
+    _, resp, err := websocket.DefaultDialer.Dial(url, nil)
+    require.Error(t, err)
+    assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
+
+func TestWelcomeDescribesConfiguration(t *testing.T) {
+    s := NewWebSocketServer()
+    s.SupportedBlockchains = []string{"Solana"}
+    s.MaxSubscriptionsPerClient = 20
+    s.MaxMessageBytes = 4096
+    require.NoError(t, s.RegisterHandler("echo", func(*Client, json.RawMessage) {}))
+    ts := httptest.NewServer(http.HandlerFunc(s.HandleConnections))
+    defer ts.Close()
+
+    conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws?token=valid-token", nil)
+    require.NoError(t, err)
+    defer conn.Close()
+
+    var welcome struct {
+        Type    MessageType    `json:"type"`
+        Payload WelcomePayload `json:"payload"`
+    }
+    require.NoError(t, conn.ReadJSON(&welcome))
+    assert.Equal(t, Welcome, welcome.Type)
+    client := waitForClients(t, s, 1)[0]
+    assert.Equal(t, client.ID, welcome.Payload.ClientID)
+    assert.Equal(t, ProtocolVersion, welcome.Payload.ProtocolVersion)
+    assert.Equal(t, []string{"Solana"}, welcome.Payload.Blockchains)
+    assert.Contains(t, welcome.Payload.MessageTypes, "subscribe")
+    assert.Contains(t, welcome.Payload.MessageTypes, "echo")
+    assert.Equal(t, WelcomeLimits{MaxSubscriptions: 20, MaxMessageBytes: 4096, MaxConcurrentQueries: 4}, welcome.Payload.Limits)
+}
+
+func TestMaxMessageBytesIsOptIn(t *testing.T) {
+    large := []byte(`{"type":"ping","payload":{"client_timestamp":1,"pad":"` + strings.Repeat("x", 128*1024) + `"}}`)
+
+    // Unlimited by default
+    s := NewWebSocketServer()
+    _, conn := dialTestServer(t, s)
+    require.NoError(t, conn.WriteMessage(websocket.TextMessage, large))
+    conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+    _, _, err := conn.ReadMessage()
+    assert.NoError(t, err)
+
+    s = NewWebSocketServer()
+    s.MaxMessageBytes = 1024
+    _, conn = dialTestServer(t, s)
+    // The server may close before the whole message is written
+    conn.WriteMessage(websocket.TextMessage, large)
+    conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+    _, _, err = conn.ReadMessage()
+    assert.Error(t, err)
+    waitForClients(t, s, 0)
+}
+
+func TestOverlappingSubscriptionsDeliverOnce(t *testing.T) {
+    s := NewWebSocketServer()
+    go s.Start()
+    client := newRegisteredClient(s)
+    for _, topic := range []string{"agent.1", "agent.*", "*.1"} {
+        s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"`+topic+`"}}`))
+        readResponse(t, client)
+    }
+
+    s.SendAgentStatusUpdate("agent.1", "active", "")
+    s.SendAgentStatusUpdate("agent.2", "idle", "")
+    assert.Equal(t, "active", readMessage(t, client)["payload"].(map[string]interface{})["status"])
+    assert.Equal(t, "idle", readMessage(t, client)["payload"].(map[string]interface{})["status"])
+
+    s.SendAgentStatusUpdate("other.3", "idle", "")
+    s.SendAgentStatusUpdate("agent.1", "done", "")
+    assert.Equal(t, "done", readMessage(t, client)["payload"].(map[string]interface{})["status"])
+    assert.Empty(t, client.Send)
+}
+
+func TestBroadcastsCarryMatchedTopic(t *testing.T) {
+    s := NewWebSocketServer()
+    go s.Start()
+    subscribed := newRegisteredClient(s)
+    s.HandleClientMessage(subscribed, []byte(`{"type":"subscribe","payload":{"topic":"agent-*"}}`))
+    readResponse(t, subscribed)
+    all := newRegisteredClient(s)
+
+    s.SendAgentStatusUpdate("agent-1", "active", "")
+    s.SendAgentStatusUpdate("agent-2", "idle", "")
+    s.PublishTransaction("agent-2", TransactionPayload{TxID: "tx-1"})
+
+    for _, want := range []string{"agent-1", "agent-2", "agent-2"} {
+        assert.Equal(t, want, readMessage(t, subscribed)["matched_topic"])
+    }
+    for i := 0; i < 3; i++ {
+        assert.NotContains(t, readMessage(t, all), "matched_topic", "clients without subscriptions match no topic")
+    }
+}
+
+func TestPausedSubscriptionBuffersAndReplaysOnResume(t *testing.T) {
+    s := NewWebSocketServer()
+    s.PausedBufferSize = 2
+    go s.Start()
+    paused := newRegisteredClient(s)
+    s.HandleClientMessage(paused, []byte(`{"type":"subscribe","payload":{"topic":"agent-1"}}`))
+    readResponse(t, paused)
+    watcher := newRegisteredClient(s)
+    s.HandleClientMessage(watcher, []byte(`{"type":"subscribe","payload":{"topic":"agent-1"}}`))
+    readResponse(t, watcher)
+
+    s.HandleClientMessage(paused, []byte(`{"type":"pause","payload":{"topic":"agent-1","buffer":true}}`))
+    response := readResponse(t, paused)
+    require.True(t, response.Success)
+    assert.Equal(t, "pause_response", response.Type)
+
+    statuses := []string{"active", "idle", "error"}
+    for _, status := range statuses {
+        s.SendAgentStatusUpdate("agent-1", status, "")
+    }
+    for range statuses {
+        readMessage(t, watcher)
+    }
+    assert.Empty(t, paused.Send, "a paused subscription receives nothing")
+    s.Mutex.RLock()
+    assert.Len(t, paused.Subscriptions, 1, "pausing keeps the subscription")
+    s.Mutex.RUnlock()
+
+    s.HandleClientMessage(paused, []byte(`{"type":"resume","payload":{"topic":"agent-1"}}`))
+    for _, want := range []string{"idle", "error"} {
+        payload := readMessage(t, paused)["payload"].(map[string]interface{})
+        assert.Equal(t, want, payload["status"], "the buffer keeps the newest broadcasts")
+    }
+    response = readResponse(t, paused)
+    require.True(t, response.Success)
+    assert.Equal(t, "resume_response", response.Type)
+    assert.EqualValues(t, 2, response.Data.(map[string]interface{})["replayed"])
+
+    s.SendAgentStatusUpdate("agent-1", "active", "")
+    payload := readMessage(t, paused)["payload"].(map[string]interface{})
+    assert.Equal(t, "active", payload["status"], "broadcasts flow again after resume")
+
+    s.HandleClientMessage(paused, []byte(`{"type":"pause","payload":{"subscription_id":"missing"}}`))
+    response = readResponse(t, paused)
+    assert.False(t, response.Success)
+    assert.Equal(t, 404, response.Error.Code)
+}
+
+func TestSubscribeDeliversInitialState(t *testing.T) {
+    s := NewWebSocketServer()
+    go s.Start()
+    s.SendAgentStatusUpdate("agent-1", "active", "")
+    s.SendAgentStatusUpdate("agent-1", "idle", "")
+    s.SendAgentStatusUpdate("agent-2", "error", "rpc down")
+    // The broadcast channel is unbuffered, so this send waits for the updates to be delivered
+    s.SendAgentStatusUpdate("unrelated", "idle", "")
+    client := newRegisteredClient(s)
+
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"agent-*"}}`))
+    for _, want := range []struct{ topic, status string }{{"agent-1", "idle"}, {"agent-2", "error"}} {
+        message := readMessage(t, client)
+        require.Equal(t, "initial_state", message["type"])
+        payload := message["payload"].(map[string]interface{})
+        assert.Equal(t, want.topic, payload["topic"])
+        assert.Equal(t, "agent_status", payload["state_type"])
+        assert.Equal(t, want.status, payload["state"].(map[string]interface{})["status"], "only the latest state is kept")
+    }
+    assert.Equal(t, "subscribe_response", readResponse(t, client).Type)
+
+    // Re-subscribing refreshes the subscription without resending the state
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"agent-*"}}`))
+    assert.Equal(t, "subscribe_response", readResponse(t, client).Type)
+
+    s.SendAgentStatusUpdate("agent-1", "stopped", "")
+    message := readMessage(t, client)
+    assert.Equal(t, "agent_status", message["type"], "live updates follow the initial state")
+}
+
+func TestRapidSubscribeToggleEndsInLastState(t *testing.T) {
+    s := NewWebSocketServer()
+    go s.Start()
+    _, conn := dialTestServer(t, s)
+    client := waitForClients(t, s, 1)[0]
+
+    const toggles = 50
+    for i := 0; i < toggles; i++ {
+        require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"subscribe","payload":{"topic":"agent-1"}}`)))
+        require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"unsubscribe","payload":{"topic":"agent-1"}}`)))
+    }
+    // A final subscribe wins however quickly it follows the last unsubscribe
+    require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"subscribe","payload":{"topic":"agent-1"}}`)))
+    require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"list_subscriptions"}`)))
+
+    var types []string
+    for {
+        var response ResponseMessage
+        require.NoError(t, conn.ReadJSON(&response))
+        if response.Type == "subscriptions_response" {
+            assert.Equal(t, []interface{}{"agent-1"}, response.Data.(map[string]interface{})["subscriptions"])
+            break
+        }
+        types = append(types, response.Type)
+    }
+    require.Len(t, types, 2*toggles+1)
+    for i, responseType := range types {
+        want := "subscribe_response"
+        if i%2 == 1 {
+            want = "unsubscribe_response"
+        }
+        assert.Equal(t, want, responseType, "responses follow the order messages were sent")
+    }
+
+    assert.Equal(t, map[string]int{"agent-1": 1}, s.TopicStats())
+    s.Mutex.RLock()
+    defer s.Mutex.RUnlock()
+    assert.Len(t, client.Subscriptions, 1)
+}
+
+func TestMetricsTopicAggregatesConfirmedVolume(t *testing.T) {
+    s := NewWebSocketServer()
+    start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+    clock := &fakeClock{now: start.Add(10 * time.Second)}
+    s.Clock = clock
+    s.MetricsWindow = time.Minute
+    go s.Start()
+    client := newRegisteredClient(s)
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"metrics:agent-1"}}`))
+    readResponse(t, client)
+
+    s.PublishTransaction("agent-1", TransactionPayload{TxID: "tx-1", Status: "confirmed", Amount: "1.5 SOL"})
+    s.PublishTransaction("agent-1", TransactionPayload{TxID: "tx-2", Status: "confirmed", Amount: "2 SOL"})
+    s.PublishTransaction("agent-1", TransactionPayload{TxID: "tx-3", Status: "pending", Amount: "10 SOL"})
+    s.PublishTransaction("agent-1", TransactionPayload{TxID: "tx-4", Status: "confirmed", Amount: "100 USDC"})
+    s.PublishTransaction("agent-2", TransactionPayload{TxID: "tx-5", Status: "confirmed", Amount: "7 SOL"})
+
+    s.flushMetrics()
+    assert.Empty(t, client.Send, "the window is still open")
+
+    clock.Advance(time.Minute)
+    s.flushMetrics()
+    message := readMessage(t, client)
+    require.Equal(t, "metric_update", message["type"])
+    assert.Equal(t, "metrics:agent-1", message["matched_topic"])
+    assert.Equal(t, map[string]interface{}{
+        "agent_id":     "agent-1",
+        "window_start": start.Format(time.RFC3339),
+        "window_end":   start.Add(time.Minute).Format(time.RFC3339),
+        "confirmed":    float64(3),
+        "volume":       map[string]interface{}{"SOL": 3.5, "USDC": float64(100)},
+    }, message["payload"])
+
+    // Each window is reported once, and agent-2's metrics go to its own topic
+    s.flushMetrics()
+    s.SendAgentStatusUpdate("unrelated", "idle", "")
+    assert.Empty(t, client.Send)
+}
+
+func TestMetricsAreOptInAndFlushedWithoutBlocking(t *testing.T) {
+    s := NewWebSocketServer()
+    assert.Zero(t, s.MetricsWindow, "metrics aggregation should be opt-in")
+    s.flushMetricsAsync() // Nothing to do, and no goroutine started
+    assert.False(t, s.flushing.Load())
+
+    start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+    clock := &fakeClock{now: start}
+    s.Clock = clock
+    s.MetricsWindow = time.Minute
+    client := newRegisteredClient(s)
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"metrics:agent-1"}}`))
+    readResponse(t, client)
+    s.recordVolume(TransactionPayload{TxID: "tx-1", AgentID: "agent-1", Status: "confirmed", Amount: "1 SOL"})
+    clock.Advance(time.Minute)
+
+    // Nothing receives from Broadcast yet, so a synchronous flush would block
+    flushed := make(chan struct{})
+    go func() {
+        s.flushMetricsAsync()
+        s.flushMetricsAsync()
+        close(flushed)
+    }()
+    select {
+    case <-flushed:
+    case <-time.After(time.Second):
+        t.Fatal("flushMetricsAsync blocked on Broadcast")
+    }
+
+    go s.Start()
+    assert.Equal(t, "metric_update", readMessage(t, client)["type"])
+    assert.Eventually(t, func() bool { return !s.flushing.Load() }, time.Second, 10*time.Millisecond)
+    s.SendAgentStatusUpdate("unrelated", "idle", "")
+    assert.Empty(t, client.Send, "the window is reported once")
+}
+
+func TestClientTrafficCounters(t *testing.T) {
+    s := NewWebSocketServer()
+    ts := httptest.NewServer(http.HandlerFunc(s.HandleConnections))
+    t.Cleanup(ts.Close)
+    conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws?token=valid-token", nil)
+    require.NoError(t, err)
+    t.Cleanup(func() { conn.Close() })
+    client := waitForClients(t, s, 1)[0]
+
+    sent := [][]byte{
+        []byte(`{"type":"ping","payload":{"client_timestamp":1}}`),
+        []byte(`{"type":"server_time"}`),
+    }
+    var bytesIn, bytesOut int
+    for _, message := range sent {
+        require.NoError(t, conn.WriteMessage(websocket.TextMessage, message))
+        bytesIn += len(message)
+    }
+    // The welcome message and one reply to each request
+    for i := 0; i < 1+len(sent); i++ {
+        _, data, err := conn.ReadMessage()
+        require.NoError(t, err)
+        bytesOut += len(data)
+    }
+
+    registered, ok := s.GetClient(client.ID)
+    require.True(t, ok)
+    want := ClientTraffic{
+        MessagesIn:  2,
+        MessagesOut: 3,
+        BytesIn:     uint64(bytesIn),
+        BytesOut:    uint64(bytesOut),
+    }
+    // The writer counts a frame just after writing it, so the last may lag the read
+    assert.Eventually(t, func() bool { return registered.Traffic() == want }, time.Second, 5*time.Millisecond)
+    assert.Equal(t, want, registered.Traffic())
+}
+
+func TestPlainHTTPRequestGetsUpgradeError(t *testing.T) {
+    s := NewWebSocketServer()
+    ts := httptest.NewServer(http.HandlerFunc(s.HandleConnections))
+    t.Cleanup(ts.Close)
+    logs := captureLogs(t)
+
+    resp, err := http.Get(ts.URL + "/ws?token=valid-token")
+    require.NoError(t, err)
+    defer resp.Body.Close()
+    body, err := io.ReadAll(resp.Body)
+    require.NoError(t, err)
+
+    assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+    assert.Equal(t, "WebSocket upgrade failed: the client is not using the websocket protocol: 'upgrade' token not found in 'Connection' header\n", string(body))
+    assert.Contains(t, logs.String(), "Failed to upgrade connection from 127.0.0.1 to WebSocket")
+    assert.Empty(t, s.Clients)
+}
+
+func TestErrorsAreWrittenAheadOfQueuedData(t *testing.T) {
+    s := NewWebSocketServer()
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        ws, err := s.Upgrader.Upgrade(w, r, nil)
+        if err != nil {
+            return
+        }
+        client := s.newClient(ws, "tester")
+        s.RegisterClient(client)
+        // Queue a backlog of data and then an error before the writer starts draining
+        for i := 0; i < 5; i++ {
+            s.sendResponseToClient(client, ResponseMessage{Type: "transaction_query_response", Success: true})
+        }
+        s.sendError(client, CodeTooManyRequests, nil)
+        s.writePump(client)
+    }))
+    t.Cleanup(ts.Close)
+    conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+    require.NoError(t, err)
+    t.Cleanup(func() { conn.Close() })
+
+    var types []string
+    for i := 0; i < 6; i++ {
+        var response ResponseMessage
+        require.NoError(t, conn.ReadJSON(&response))
+        types = append(types, response.Type)
+    }
+    assert.Equal(t, "error", types[0])
+    assert.NotContains(t, types[1:], "error")
+}
+
+func TestQueuedBroadcastsPastTheirTTLAreDropped(t *testing.T) {
+    s := NewWebSocketServer()
+    clock := &fakeClock{now: time.Now()}
+    s.Clock = clock
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        ws, err := s.Upgrader.Upgrade(w, r, nil)
+        if err != nil {
+            return
+        }
+        client := s.newClient(ws, "tester")
+        s.RegisterClient(client)
+        // Queue behind a writer that has not started, then let time pass before it drains
+        s.deliverBroadcast(Message{Type: AgentStatusUpdate, Payload: AgentStatusPayload{AgentID: "agent-1", Status: "stale"}, TTL: time.Second})
+        s.deliverBroadcast(Message{Type: AgentStatusUpdate, Payload: AgentStatusPayload{AgentID: "agent-1", Status: "fresh"}, TTL: time.Minute})
+        s.deliverBroadcast(Message{Type: AgentStatusUpdate, Payload: AgentStatusPayload{AgentID: "agent-1", Status: "lasting"}})
+        clock.Advance(2 * time.Second)
+        s.writePump(client)
+    }))
+    t.Cleanup(ts.Close)
+    conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+    require.NoError(t, err)
+    t.Cleanup(func() { conn.Close() })
+
+    var statuses []string
+    for i := 0; i < 2; i++ {
+        var message struct {
+            Payload AgentStatusPayload `json:"payload"`
+        }
+        require.NoError(t, conn.ReadJSON(&message))
+        statuses = append(statuses, message.Payload.Status)
+    }
+    assert.Equal(t, []string{"fresh", "lasting"}, statuses)
+}
+
+func TestSlowClientDropsAtMostOnceAndRetainsAtLeastOnce(t *testing.T) {
+    s := NewWebSocketServer()
+    s.SendQueueSize = 4
+    ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        ws, err := s.Upgrader.Upgrade(w, r, nil)
+        if err != nil {
+            return
+        }
+        client := s.newClient(ws, "tester")
+        s.RegisterClient(client)
+        s.subscribe(client, "telemetry", SubscribePayload{QoS: QoSAtMostOnce}, nil)
+        s.subscribe(client, "alerts", SubscribePayload{QoS: QoSAtLeastOnce}, nil)
+        // Broadcast well past the queue's capacity before the writer starts draining it
+        for i := 1; i <= 10; i++ {
+            s.deliverBroadcast(Message{Type: AgentStatusUpdate, Payload: AgentStatusPayload{AgentID: "telemetry", Status: fmt.Sprint(i)}})
+            s.deliverBroadcast(Message{Type: AgentStatusUpdate, Payload: AgentStatusPayload{AgentID: "alerts", Status: fmt.Sprint(i)}})
+        }
+        s.writePump(client)
+    }))
+    t.Cleanup(ts.Close)
+    conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+    require.NoError(t, err)
+    t.Cleanup(func() { conn.Close() })
+    conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+    received := map[string][]string{}
+    for len(received["alerts"]) < 10 {
+        var message struct {
+            Type    MessageType        `json:"type"`
+            Payload AgentStatusPayload `json:"payload"`
+        }
+        require.NoError(t, conn.ReadJSON(&message))
+        if message.Type == AgentStatusUpdate {
+            received[message.Payload.AgentID] = append(received[message.Payload.AgentID], message.Payload.Status)
+        }
+    }
+    assert.Equal(t, []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10"}, received["alerts"])
+    assert.Equal(t, []string{"1", "2"}, received["telemetry"], "telemetry beyond the queue's capacity should be dropped")
+    assert.Len(t, waitForClients(t, s, 1), 1, "the slow client should stay connected")
+}
+
+func TestConcurrentBroadcastsKeepPerClientOrder(t *testing.T) {
+    s := NewWebSocketServer()
+    go s.Start()
+    all := newRegisteredClient(s)
+    subscribed := newRegisteredClient(s)
+    s.HandleClientMessage(subscribed, []byte(`{"type":"subscribe","payload":{"topic":"agent-*"}}`))
+    readResponse(t, subscribed)
+
+    const senders, perSender = 8, 25
+    var wg sync.WaitGroup
+    for i := 0; i < senders; i++ {
+        wg.Add(1)
+        go func(agentID string) {
+            defer wg.Done()
+            for n := 0; n < perSender; n++ {
+                s.SendAgentStatusUpdate(agentID, fmt.Sprint(n), "")
+            }
+        }(fmt.Sprintf("agent-%d", i))
+    }
+    wg.Wait()
+
+    for _, client := range []*Client{all, subscribed} {
+        var lastSeq uint64
+        lastStatus := map[string]int{}
+        for i := 0; i < senders*perSender; i++ {
+            var message struct {
+                Sequence uint64             `json:"seq"`
+                Payload  AgentStatusPayload `json:"payload"`
+            }
+            require.NoError(t, json.Unmarshal((<-client.Send).Data, &message))
+            assert.Greater(t, message.Sequence, lastSeq, "broadcasts must arrive in sequence order")
+            lastSeq = message.Sequence
+
+            var status int
+            fmt.Sscan(message.Payload.Status, &status)
+            if previous, seen := lastStatus[message.Payload.AgentID]; seen {
+                assert.Equal(t, previous+1, status, "updates for %s arrived out of order", message.Payload.AgentID)
+            }
+            lastStatus[message.Payload.AgentID] = status
+        }
+    }
+}
+
+func TestUnauthenticatedHealthProbe(t *testing.T) {
+    s := NewWebSocketServer()
+    s.HealthProbes = true
+    clock := &fakeClock{now: s.startedAt}
+    s.Clock = clock
+    clock.Advance(90 * time.Second)
+    ts, _ := dialTestServer(t, s)
+    waitForClients(t, s, 1)
+    probeURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws"
+
+    probe, _, err := websocket.DefaultDialer.Dial(probeURL, nil)
+    require.NoError(t, err)
+    defer probe.Close()
+    require.NoError(t, probe.WriteJSON(map[string]string{"type": "health"}))
+    var response struct {
+        Type    string                 `json:"type"`
+        Success bool                   `json:"success"`
+        Data    map[string]interface{} `json:"data"`
+    }
+    require.NoError(t, probe.ReadJSON(&response))
+    assert.Equal(t, "health_response", response.Type)
+    assert.True(t, response.Success)
+    assert.Equal(t, map[string]interface{}{"status": "ok", "uptime_seconds": float64(90), "clients": float64(1)}, response.Data)
+    _, _, err = probe.ReadMessage()
+    assert.True(t, websocket.IsCloseError(err, websocket.CloseNormalClosure), "unexpected error: %v", err)
+
+    // Probes are never registered and may ask for nothing else
+    other, _, err := websocket.DefaultDialer.Dial(probeURL, nil)
+    require.NoError(t, err)
+    defer other.Close()
+    require.NoError(t, other.WriteJSON(map[string]string{"type": "list_subscriptions"}))
+    var refusal ResponseMessage
+    require.NoError(t, other.ReadJSON(&refusal))
+    require.NotNil(t, refusal.Error)
+    assert.Equal(t, 401, refusal.Error.Code)
+    _, _, err = other.ReadMessage()
+    assert.True(t, websocket.IsCloseError(err, CloseAuthFailed), "unexpected error: %v", err)
+    waitForClients(t, s, 1)
+
+    s.HealthProbes = false
+    _, resp, err := websocket.DefaultDialer.Dial(probeURL, nil)
+    require.Error(t, err)
+    assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestHealthProbesAreBounded(t *testing.T) {
+    s := NewWebSocketServer()
+    assert.False(t, s.HealthProbes, "probes should be opt-in")
+    s.HealthProbes = true
+    s.MaxHealthProbes = 1
+    ts, _ := dialTestServer(t, s)
+    waitForClients(t, s, 1)
+    probeURL := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws"
+
+    // A probe that sends nothing holds the only slot
+    held, _, err := websocket.DefaultDialer.Dial(probeURL, nil)
+    require.NoError(t, err)
+    _, resp, err := websocket.DefaultDialer.Dial(probeURL, nil)
+    require.Error(t, err)
+    assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+    held.Close()
+
+    // Probes are refused at capacity and during shutdown like any other connection
+    s.MaxHealthProbes = 0
+    s.MaxClients = 1
+    _, resp, err = websocket.DefaultDialer.Dial(probeURL, nil)
+    require.Error(t, err)
+    assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+    s.MaxClients = 0
+    s.shuttingDown.Store(true)
+    _, resp, err = websocket.DefaultDialer.Dial(probeURL, nil)
+    require.Error(t, err)
+    assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
+
+func TestSessionTokenRestoresSubscriptions(t *testing.T) {
+    s := NewWebSocketServer()
+    ts := httptest.NewServer(http.HandlerFunc(s.HandleConnections))
+    t.Cleanup(ts.Close)
+    url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws?token=valid-token"
+    connect := func() (*websocket.Conn, WelcomePayload) {
+        conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+        require.NoError(t, err)
+        t.Cleanup(func() { conn.Close() })
+        var welcome struct {
+            Type    MessageType    `json:"type"`
+            Payload WelcomePayload `json:"payload"`
+        }
+        require.NoError(t, conn.ReadJSON(&welcome))
+        require.Equal(t, Welcome, welcome.Type)
+        return conn, welcome.Payload
+    }
+    request := func(conn *websocket.Conn, message string) ResponseMessage {
+        require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(message)))
+        var response ResponseMessage
+        require.NoError(t, conn.ReadJSON(&response))
+        return response
+    }
+
+    first, welcome := connect()
+    require.NotEmpty(t, welcome.SessionToken)
+    request(first, `{"type":"subscribe","payload":{"topic":"agent-1"}}`)
+    request(first, `{"type":"subscribe","payload":{"topic":"tx-*","filter":"amount > 1"}}`)
+    first.Close()
+    waitForClients(t, s, 0)
+
+    second, _ := connect()
+    response := request(second, `{"type":"hello","payload":{"session_token":"`+welcome.SessionToken+`"}}`)
+    assert.Equal(t, "hello_response", response.Type)
+    assert.Len(t, response.Data.(map[string]interface{})["results"], 2)
+    response = request(second, `{"type":"list_subscriptions"}`)
+    assert.Equal(t, []interface{}{"agent-1", "tx-*"}, response.Data.(map[string]interface{})["subscriptions"])
+
+    // A session is restored only once
+    response = request(second, `{"type":"hello","payload":{"session_token":"`+welcome.SessionToken+`"}}`)
+    require.NotNil(t, response.Error)
+    assert.Equal(t, 404, response.Error.Code)
+}
+
+func TestSessionTokensRotateOnReconnect(t *testing.T) {
+    s := NewWebSocketServer()
+    clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+    s.Clock = clock
+    s.SessionTokenGrace = 10 * time.Second
+    hello := func(client *Client, token string) ResponseMessage {
+        s.HandleClientMessage(client, []byte(`{"type":"hello","payload":{"session_token":"`+token+`"}}`))
+        return readResponse(t, client)
+    }
+
+    first := newRegisteredClient(s)
+    s.HandleClientMessage(first, []byte(`{"type":"subscribe","payload":{"topic":"agent-1"}}`))
+    readResponse(t, first)
+    s.UnregisterClient(first)
+
+    // The first reconnect rotates the session onto the new connection's token
+    second := newRegisteredClient(s)
+    response := hello(second, first.SessionToken)
+    require.Equal(t, "hello_response", response.Type)
+    assert.Equal(t, second.SessionToken, response.Data.(map[string]interface{})["session_token"])
+    s.HandleClientMessage(second, []byte(`{"type":"subscribe","payload":{"topic":"agent-2"}}`))
+    readResponse(t, second)
+    s.UnregisterClient(second)
+
+    // Within the grace period the first token still restores the latest subscriptions
+    clock.Advance(5 * time.Second)
+    third := newRegisteredClient(s)
+    response = hello(third, first.SessionToken)
+    require.Equal(t, "hello_response", response.Type)
+    assert.Len(t, response.Data.(map[string]interface{})["results"], 2)
+    s.UnregisterClient(third)
+
+    clock.Advance(10 * time.Second)
+    fourth := newRegisteredClient(s)
+    for _, token := range []string{first.SessionToken, second.SessionToken} {
+        response = hello(fourth, token)
+        require.NotNil(t, response.Error, "rotated token should have retired")
+        assert.Equal(t, 404, response.Error.Code)
+    }
+    assert.Equal(t, "hello_response", hello(fourth, third.SessionToken).Type)
+}
+
+func TestRestoredSessionGetsStateDiff(t *testing.T) {
+    s := NewWebSocketServer()
+    go s.Start()
+    barrier := func() { s.SendAgentStatusUpdate("unrelated", "idle", "") }
+    for _, agentID := range []string{"agent-1", "agent-2", "agent-3"} {
+        s.SendAgentStatusUpdate(agentID, "active", "")
+    }
+    barrier()
+
+    first := newRegisteredClient(s)
+    s.HandleClientMessage(first, []byte(`{"type":"subscribe","payload":{"topic":"agent-*"}}`))
+    for i := 0; i < 3; i++ {
+        assert.Equal(t, "initial_state", readMessage(t, first)["type"])
+    }
+    readResponse(t, first)
+    s.UnregisterClient(first)
+
+    // While the client is away two agents change and one appears
+    s.SendAgentStatusUpdate("agent-1", "error", "rpc down")
+    s.SendAgentStatusUpdate("agent-3", "stopped", "")
+    s.SendAgentStatusUpdate("agent-4", "active", "")
+    barrier()
+
+    second := newRegisteredClient(s)
+    s.HandleClientMessage(second, []byte(`{"type":"hello","payload":{"session_token":"`+first.SessionToken+`"}}`))
+    message := readMessage(t, second)
+    require.Equal(t, "state_diff", message["type"])
+    var changed []string
+    for _, change := range message["payload"].(map[string]interface{})["changes"].([]interface{}) {
+        change := change.(map[string]interface{})
+        state := change["state"].(map[string]interface{})
+        changed = append(changed, change["topic"].(string)+"="+state["status"].(string))
+    }
+    assert.Equal(t, []string{"agent-1=error", "agent-3=stopped", "agent-4=active"}, changed)
+    assert.Equal(t, "hello_response", readResponse(t, second).Type)
+    assert.Empty(t, second.Send, "unchanged states are not replayed")
+}
+
+func TestAllowedOrigins(t *testing.T) {
+    s := NewWebSocketServer()
+    ts := httptest.NewServer(http.HandlerFunc(s.HandleConnections))
+    t.Cleanup(ts.Close)
+    url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws?token=valid-token"
+    dial := func(origin string) int {
+        conn, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {origin}})
+        if err != nil {
+            require.NotNil(t, resp, "dial failed: %v", err)
+            return resp.StatusCode
+        }
+        conn.Close()
+        return resp.StatusCode
+    }
+
+    // Without a configured list only the server's own origin may connect
+    assert.Equal(t, http.StatusSwitchingProtocols, dial(ts.URL))
+    assert.Equal(t, http.StatusForbidden, dial("https://evil.example"))
+
+    s.AllowedOrigins = []string{"https://app.example.com", "https://*.trusted.io"}
+    assert.Equal(t, http.StatusSwitchingProtocols, dial("https://app.example.com"))
+    assert.Equal(t, http.StatusSwitchingProtocols, dial("https://EU.trusted.io"))
+    assert.Equal(t, http.StatusForbidden, dial("https://app.example.com.evil.example"))
+    assert.Equal(t, http.StatusForbidden, dial("https://trusted.io.evil.example"))
+    assert.Equal(t, http.StatusForbidden, dial(ts.URL))
+
+    // '*' is one DNS label, and scheme and port must match exactly
+    s.AllowedOrigins = []string{"https://*.example.com", "https://*.example.com:8443"}
+    assert.Equal(t, http.StatusSwitchingProtocols, dial("https://eu.example.com"))
+    assert.Equal(t, http.StatusSwitchingProtocols, dial("https://eu.example.com:8443"))
+    assert.Equal(t, http.StatusForbidden, dial("https://evil.com.example.com:8443"))
+    assert.Equal(t, http.StatusForbidden, dial("https://attacker.example.com.evil.io"))
+    assert.Equal(t, http.StatusForbidden, dial("https://example.com"))
+    assert.Equal(t, http.StatusForbidden, dial("http://eu.example.com"))
+    assert.Equal(t, http.StatusForbidden, dial("https://eu.example.com:9443"))
+    assert.Equal(t, http.StatusForbidden, dial("null"))
+}
+
+// readJSONType reads the next frame from conn and returns its type field.
+func readJSONType(t *testing.T, conn *websocket.Conn) string {
+    t.Helper()
+    var message struct {
+        Type string `json:"type"`
+    }
+    require.NoError(t, conn.ReadJSON(&message))
+    return message.Type
+}
+
+func TestShutdownSendsReconnectHintBeforeClose(t *testing.T) {
+    s := NewWebSocketServer()
+    s.ReconnectBackoff = 2 * time.Second
+    s.ReconnectJitter = 3 * time.Second
+    s.AlternateServer = "wss://ws2.example.com/ws"
+    _, conn := dialTestServer(t, s)
+    waitForClients(t, s, 1)
+
+    require.NoError(t, s.Shutdown(context.Background()))
+
+    conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+    var hint struct {
+        Type    MessageType      `json:"type"`
+        Payload ReconnectPayload `json:"payload"`
+    }
+    require.NoError(t, conn.ReadJSON(&hint))
+    assert.Equal(t, Reconnect, hint.Type)
+    assert.GreaterOrEqual(t, hint.Payload.BackoffMs, int64(2000))
+    assert.Less(t, hint.Payload.BackoffMs, int64(5000))
+    assert.Equal(t, "wss://ws2.example.com/ws", hint.Payload.AlternateServer)
+
+    _, _, err := conn.ReadMessage()
+    assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "unexpected error: %v", err)
+}
+
+func TestSubscriptionTTLExpires(t *testing.T) {
+    s := NewWebSocketServer()
+    go s.Start()
+    clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+    s.Clock = clock
+    client := newRegisteredClient(s)
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"agent-1","ttl_seconds":10}}`))
+    readResponse(t, client)
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"agent-2","ttl_seconds":10}}`))
+    readResponse(t, client)
+
+    // Re-subscribing restarts the lifetime
+    clock.Advance(6 * time.Second)
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"agent-2","ttl_seconds":10}}`))
+    readResponse(t, client)
+    s.expireSubscriptions()
+    assert.Empty(t, client.Send)
+
+    clock.Advance(4 * time.Second)
+    s.expireSubscriptions()
+    message := readMessage(t, client)
+    assert.Equal(t, string(SubscriptionExpired), message["type"])
+    assert.Equal(t, "agent-1", message["payload"].(map[string]interface{})["topic"])
+    assert.Empty(t, client.Send)
+    assert.Equal(t, map[string]int{"agent-2": 1}, s.TopicStats())
+
+    s.SendAgentStatusUpdate("agent-1", "active", "")
+    s.SendAgentStatusUpdate("agent-2", "active", "")
+    assert.Equal(t, "agent-2", readMessage(t, client)["payload"].(map[string]interface{})["agent_id"])
+
+    clock.Advance(6 * time.Second)
+    s.expireSubscriptions()
+    assert.Equal(t, string(SubscriptionExpired), readMessage(t, client)["type"])
+    assert.Empty(t, s.TopicStats())
+}
+
+func TestEvictTopicNotifiesAndClearsSubscribers(t *testing.T) {
+    s := NewWebSocketServer()
+    go s.Start()
+    clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+    s.Clock = clock
+    statesOf := func(topic string) int {
+        s.Mutex.RLock()
+        defer s.Mutex.RUnlock()
+        count := 0
+        for key := range s.lastState {
+            if key.topic == topic {
+                count++
+            }
+        }
+        return count
+    }
+    // Recorded before anyone subscribes, so only the state is kept
+    s.SendAgentStatusUpdate("agent-1", "active", "")
+    s.SendAgentStatusUpdate("agent-2", "active", "")
+    require.Eventually(t, func() bool { return statesOf("agent-2") == 1 }, time.Second, 10*time.Millisecond)
+    exact := newRegisteredClient(s)
+    s.HandleClientMessage(exact, []byte(`{"type":"subscribe","payload":{"topic":"agent-1"}}`))
+    readMessage(t, exact) // Initial state
+    subscriptionID := readResponse(t, exact).Data.(map[string]interface{})["subscription_id"]
+    wildcard := newRegisteredClient(s)
+    s.HandleClientMessage(wildcard, []byte(`{"type":"subscribe","payload":{"topic":"agent-*"}}`))
+    readMessage(t, wildcard)
+    readMessage(t, wildcard)
+    readResponse(t, wildcard)
+    other := newRegisteredClient(s)
+    s.HandleClientMessage(other, []byte(`{"type":"subscribe","payload":{"topic":"agent-2"}}`))
+    readMessage(t, other)
+    readResponse(t, other)
+
+    s.EvictTopic("agent-1", "decommissioned")
+    assert.Zero(t, statesOf("agent-1"), "an evicted topic's state is dropped")
+    assert.Equal(t, 1, statesOf("agent-2"))
+    message := readMessage(t, exact)
+    assert.Equal(t, string(TopicClosed), message["type"])
+    assert.Equal(t, map[string]interface{}{
+        "topic":            "agent-1",
+        "reason":           "decommissioned",
+        "subscription_ids": []interface{}{subscriptionID},
+    }, message["payload"])
+    assert.Empty(t, exact.Subscriptions)
+    message = readMessage(t, wildcard)
+    assert.Equal(t, string(TopicClosed), message["type"])
+    assert.Len(t, wildcard.Subscriptions, 1, "wildcard subscriptions cover other topics and are kept")
+    assert.Empty(t, other.Send)
+    assert.Equal(t, map[string]int{"agent-*": 1, "agent-2": 1}, s.TopicStats())
+
+    // Subscribes are refused until the cooldown ends
+    s.HandleClientMessage(exact, []byte(`{"type":"subscribe","payload":{"topic":"agent-1"}}`))
+    response := readResponse(t, exact)
+    require.NotNil(t, response.Error)
+    assert.Equal(t, 503, response.Error.Code)
+    clock.Advance(s.EvictionCooldown)
+    s.HandleClientMessage(exact, []byte(`{"type":"subscribe","payload":{"topic":"agent-1"}}`))
+    assert.True(t, readResponse(t, exact).Success)
+}
+
+func TestDisconnectsUseApplicationCloseCodes(t *testing.T) {
+    for reason, code := range map[DisconnectReason]int{
+        DisconnectRateLimited: CloseRateLimited,
+        DisconnectAuthFailed:  CloseAuthFailed,
+        DisconnectOverloaded:  CloseOverloaded,
+    } {
+        t.Run(string(reason), func(t *testing.T) {
+            s := NewWebSocketServer()
+            _, conn := dialTestServer(t, s)
+            client := waitForClients(t, s, 1)[0]
+
+            s.Disconnect(client, reason)
+            conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+            _, _, err := conn.ReadMessage()
+            assert.True(t, websocket.IsCloseError(err, code), "unexpected error: %v", err)
+            assert.Equal(t, reason, client.DisconnectReason())
+        })
+    }
+
+    // A client that keeps raising errors is closed as rate limited
+    s := NewWebSocketServer()
+    s.MaxErrorsPerInterval = 1
+    s.ErrorInterval = time.Minute
+    _, conn := dialTestServer(t, s)
+    for i := 0; i < 3; i++ {
+        require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{not json`)))
+    }
+    conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+    var err error
+    for err == nil {
+        _, _, err = conn.ReadMessage()
+    }
+    assert.True(t, websocket.IsCloseError(err, CloseRateLimited), "unexpected error: %v", err)
+    assert.Contains(t, err.Error(), "too many errors")
+
+    // A connection that finds the server full by the time it registers is closed as overloaded
+    s = NewWebSocketServer()
+    s.MaxClients = 1
+    s.OnHandshake = func(r *http.Request, client *Client) { s.RegisterClient(newTestClient()) }
+    ts := httptest.NewServer(http.HandlerFunc(s.HandleConnections))
+    defer ts.Close()
+    conn, _, err = websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws?token=valid-token", nil)
+    require.NoError(t, err)
+    defer conn.Close()
+    conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+    _, _, err = conn.ReadMessage()
+    assert.True(t, websocket.IsCloseError(err, CloseOverloaded), "unexpected error: %v", err)
+
+    // A message failing its signature is refused, then the client is closed for auth failure
+    s = NewWebSocketServer()
+    s.SigningKeys = testSigningKeys{"valid-token": []byte("secret")}
+    reasons := make(chan DisconnectReason, 1)
+    s.OnDisconnect = func(client *Client, reason DisconnectReason) { reasons <- reason }
+    _, conn = dialTestServer(t, s)
+    require.NoError(t, conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"list_subscriptions"}`)))
+    conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+    var refusal ResponseMessage
+    require.NoError(t, conn.ReadJSON(&refusal))
+    require.NotNil(t, refusal.Error)
+    assert.Equal(t, 401, refusal.Error.Code)
+    _, _, err = conn.ReadMessage()
+    assert.True(t, websocket.IsCloseError(err, CloseAuthFailed), "unexpected error: %v", err)
+    assert.Equal(t, DisconnectAuthFailed, <-reasons)
+}
+
+func TestAgentStatusUpdatesSentAsDeltas(t *testing.T) {
+    s := NewWebSocketServer()
+    s.Clock = &fakeClock{now: time.Now()}
+    s.StatusSnapshotEvery = 3
+    go s.Start()
+    client := newRegisteredClient(s)
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"agent-1"}}`))
+    readMessage(t, client)
+
+    s.SendAgentStatusUpdate("agent-1", "running", "warming up")
+    first := readMessage(t, client)
+    assert.Equal(t, "agent_status", first["type"])
+    assert.Equal(t, "running", first["payload"].(map[string]interface{})["status"])
+
+    // Only the details changed
+    s.SendAgentStatusUpdate("agent-1", "running", "synced")
+    second := readMessage(t, client)
+    assert.Equal(t, "agent_status_delta", second["type"])
+    assert.Equal(t, map[string]interface{}{
+        "agent_id": "agent-1",
+        "changes":  map[string]interface{}{"details": "synced"},
+    }, second["payload"])
+
+    s.SendAgentStatusUpdate("agent-1", "error", "synced")
+    assert.Equal(t, map[string]interface{}{"status": "error"}, readMessage(t, client)["payload"].(map[string]interface{})["changes"])
+
+    // Every third update is a full snapshot
+    s.SendAgentStatusUpdate("agent-1", "error", "synced")
+    third := readMessage(t, client)
+    assert.Equal(t, "agent_status", third["type"])
+    assert.Equal(t, "error", third["payload"].(map[string]interface{})["status"])
+
+    // New subscribers still get the full state
+    late := newRegisteredClient(s)
+    s.HandleClientMessage(late, []byte(`{"type":"subscribe","payload":{"topic":"agent-1"}}`))
+    state := readMessage(t, late)
+    assert.Equal(t, "initial_state", state["type"])
+    assert.Equal(t, "error", state["payload"].(map[string]interface{})["state"].(map[string]interface{})["status"])
+}
+
+func TestBroadcastAllReachesEveryClient(t *testing.T) {
+    s := NewWebSocketServer()
+    subscribed := newRegisteredClient(s)
+    s.HandleClientMessage(subscribed, []byte(`{"type":"subscribe","payload":{"topic":"agent-1"}}`))
+    readMessage(t, subscribed)
+    idle := newRegisteredClient(s)
+    full := newTestClient()
+    full.Send = make(chan Frame, 1)
+    full.Send <- Frame{Data: []byte(`{}`)}
+    s.RegisterClient(full)
+
+    s.BroadcastAll(ResponseMessage{Type: "announcement", Success: true, Data: map[string]interface{}{"banner": "Maintenance at 02:00 UTC"}})
+
+    for _, client := range []*Client{subscribed, idle} {
+        message := readMessage(t, client)
+        assert.Equal(t, "announcement", message["type"])
+        assert.Equal(t, map[string]interface{}{"banner": "Maintenance at 02:00 UTC"}, message["data"])
+    }
+    // A client with no room left is dropped rather than waited on
+    assert.Equal(t, DisconnectSlowConsumer, full.DisconnectReason())
+    _, connected := s.GetClient(full.ID)
+    assert.False(t, connected)
+}
+
+func TestSubscribeFiltersAgentStatusUpdatesByStatus(t *testing.T) {
+    s := NewWebSocketServer()
+    go s.Start()
+    client := newRegisteredClient(s)
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"agent-*","statuses":["error"]}}`))
+    readMessage(t, client)
+
+    s.SendAgentStatusUpdate("agent-1", "running", "")
+    s.SendAgentStatusUpdate("agent-2", "error", "rpc unreachable")
+    s.SendAgentStatusUpdate("agent-1", "idle", "")
+    s.SendAgentStatusUpdate("agent-1", "error", "out of funds")
+
+    for _, expected := range []string{"agent-2", "agent-1"} {
+        payload := readMessage(t, client)["payload"].(map[string]interface{})
+        assert.Equal(t, expected, payload["agent_id"])
+        assert.Equal(t, "error", payload["status"])
+    }
+    // Other broadcasts on the topics are unaffected
+    s.SendAgentConfigUpdate("agent-3", map[string]interface{}{"risk": "low"})
+    assert.Equal(t, "agent_config_update", readMessage(t, client)["type"])
+    assert.Empty(t, client.Send)
+
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"agent-1","statuses":[]}}`))
+    assert.Equal(t, 422, readResponse(t, client).Error.Code)
+}
+
+func TestClientIPBehindProxies(t *testing.T) {
+    s := NewWebSocketServer()
+    s.TrustedProxies = []string{"10.0.0.0/8", "192.0.2.7"}
+    request := func(peer string, header http.Header) *http.Request {
+        r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+        r.RemoteAddr = peer
+        for name, values := range header {
+            r.Header[name] = values
+        }
+        return r
+    }
+
+    // A direct connection is its own peer, whatever headers it sends
+    assert.Equal(t, "203.0.113.9", s.clientIP(request("203.0.113.9:5000", nil)))
+    assert.Equal(t, "203.0.113.9", s.clientIP(request("203.0.113.9:5000", http.Header{"X-Forwarded-For": {"198.51.100.1"}})))
+
+    // Through trusted proxies the nearest untrusted hop is the client
+    assert.Equal(t, "198.51.100.1", s.clientIP(request("10.1.2.3:443", http.Header{"X-Forwarded-For": {"198.51.100.1"}})))
+    assert.Equal(t, "198.51.100.1", s.clientIP(request("192.0.2.7:443", http.Header{"X-Forwarded-For": {"203.0.113.66, 198.51.100.1, 10.4.4.4"}})))
+    assert.Equal(t, "2001:db8::1", s.clientIP(request("10.1.2.3:443", http.Header{"Forwarded": {`for="[2001:db8::1]:4711";proto=https, for=10.4.4.4`}})))
+    assert.Equal(t, "198.51.100.1", s.clientIP(request("10.1.2.3:443", http.Header{
+        "Forwarded":       {"for=198.51.100.1"},
+        "X-Forwarded-For": {"203.0.113.66"},
+    })))
+
+    // Missing or unknown hops leave the nearest address known
+    assert.Equal(t, "10.1.2.3", s.clientIP(request("10.1.2.3:443", nil)))
+    assert.Equal(t, "10.4.4.4", s.clientIP(request("10.1.2.3:443", http.Header{"Forwarded": {"for=unknown, for=10.4.4.4"}})))
+}
+
+func TestMaxConnectionsPerIPUsesForwardedAddress(t *testing.T) {
+    s := NewWebSocketServer()
+    s.TrustedProxies = []string{"127.0.0.1"}
+    s.MaxConnectionsPerIP = 1
+    ts := httptest.NewServer(http.HandlerFunc(s.HandleConnections))
+    t.Cleanup(ts.Close)
+    url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws?token=valid-token"
+    dial := func(client string) (*websocket.Conn, *http.Response, error) {
+        return websocket.DefaultDialer.Dial(url, http.Header{"X-Forwarded-For": {client}})
+    }
+
+    first, _, err := dial("198.51.100.1")
+    require.NoError(t, err)
+    defer first.Close()
+    assert.Equal(t, "198.51.100.1", waitForClients(t, s, 1)[0].RemoteIP)
+
+    // Clients behind the same proxy are told apart by their forwarded address
+    second, _, err := dial("198.51.100.2")
+    require.NoError(t, err)
+    defer second.Close()
+    waitForClients(t, s, 2)
+
+    _, resp, err := dial("198.51.100.1")
+    require.Error(t, err)
+    assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+}
+
+// quietLogSource hands out log tails that never produce a line.
+type quietLogSource struct{}
+
+func (quietLogSource) Tail(ctx context.Context, agentID string) (<-chan AgentLogLine, error) {
+    return make(chan AgentLogLine), nil
+}
+
+func TestClientGoroutinesEndOnEveryDisconnect(t *testing.T) {
+    s := NewWebSocketServer()
+    s.LogSource = quietLogSource{}
+    ts := httptest.NewServer(http.HandlerFunc(s.HandleConnections))
+    t.Cleanup(ts.Close)
+    url := "ws" + strings.TrimPrefix(ts.URL, "http") + "/ws?token=valid-token"
+
+    conns := make([]*websocket.Conn, 30)
+    for i := range conns {
+        conns[i] = dialURL(t, url)
+        require.NoError(t, conns[i].WriteMessage(websocket.TextMessage, []byte(fmt.Sprintf(`{"type":"subscribe","payload":{"topics":["agent-%d","logs:agent-%d"]}}`, i, i))))
+        _, _, err := conns[i].ReadMessage()
+        require.NoError(t, err)
+    }
+    clients := waitForClients(t, s, len(conns))
+    // Two loops per client plus its log tail
+    assert.Equal(t, int64(3*len(conns)), s.ActiveGoroutines())
+
+    // Clients leave by closing, by being kicked, and by the server shutting down
+    for _, conn := range conns[:10] {
+        conn.Close()
+    }
+    for _, client := range clients[:10] {
+        s.Disconnect(client, DisconnectRateLimited)
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+    defer cancel()
+    s.Shutdown(ctx)
+    assert.Eventually(t, func() bool { return s.ActiveGoroutines() == 0 }, 2*time.Second, 10*time.Millisecond, "leaked %d goroutines", s.ActiveGoroutines())
+
+    // A subscribe handled after its client disconnected starts no tail
+    client := newRegisteredClient(s)
+    s.UnregisterClient(client)
+    s.HandleClientMessage(client, []byte(`{"type":"subscribe","payload":{"topic":"logs:agent-1"}}`))
+    assert.Empty(t, client.Subscriptions)
+    assert.Equal(t, int64(0), s.ActiveGoroutines())
+}
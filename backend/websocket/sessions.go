@@ -0,0 +1,171 @@
+package main
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "log"
+    "math"
+    "time"
+)
+
+// session is the subscription set a disconnected client may restore by presenting its
+// session token in a hello message before the session expires. Each restore rotates the
+// session onto the restoring connection's token, a new generation; earlier tokens keep
+// working for SessionTokenGrace, in case the client never learned the new one.
+type session struct {
+    principal     string
+    subscriptions []SubscribePayload
+    expires       time.Time
+    active        bool                   // Restored by a connected client, which saves into it on leaving
+    generation    int                    // Generation of the newest token
+    seen          map[coalesceKey]uint64 // Sequence of each state the subscriptions covered on leaving
+}
+
+// sessionToken is one generation of a session's tokens.
+type sessionToken struct {
+    session    *session
+    generation int
+    retiresAt  time.Time // When a rotated token stops working; zero for the newest token
+}
+
+// usable reports whether the token may restore its session at now.
+func (t *sessionToken) usable(now time.Time) bool {
+    if !t.retiresAt.IsZero() && !now.Before(t.retiresAt) {
+        return false
+    }
+    return t.session.active || now.Before(t.session.expires)
+}
+
+// HelloPayload defines the payload of a hello message, sent by a reconnecting client to
+// restore the subscriptions of its previous connection.
+type HelloPayload struct {
+    SessionToken string `json:"session_token"`
+}
+
+// newSessionToken returns an unguessable session token.
+func newSessionToken() string {
+    b := make([]byte, 16)
+    if _, err := rand.Read(b); err != nil {
+        log.Printf("Failed to generate session token: %v", err)
+        return ""
+    }
+    return hex.EncodeToString(b)
+}
+
+// saveSessionLocked keeps a leaving client's subscriptions for SessionTTL, in the session it
+// restored or else in a new one under its session token, and drops tokens that have expired
+// or retired. The caller must hold the write lock.
+func (s *WebSocketServer) saveSessionLocked(client *Client) {
+    now := s.Clock.Now()
+    for token, entry := range s.sessions {
+        if !entry.usable(now) {
+            delete(s.sessions, token)
+        }
+    }
+    if client.SessionToken == "" || s.SessionTTL <= 0 {
+        return
+    }
+    saved := client.session
+    if saved == nil {
+        if len(client.Subscriptions) == 0 {
+            return
+        }
+        saved = &session{principal: client.Principal, generation: 1}
+        s.sessions[client.SessionToken] = &sessionToken{session: saved, generation: 1}
+    }
+
+    saved.active = false
+    saved.expires = now.Add(s.SessionTTL)
+    saved.seen = s.seenStatesLocked(client)
+    saved.subscriptions = nil
+    for _, subscription := range client.Subscriptions {
+        request := SubscribePayload{Topic: subscription.Pattern, Filter: subscription.Filter, MinLevel: subscription.MinLevel, QoS: subscription.QoS, MinAmount: subscription.MinAmount, Statuses: subscription.Statuses, From: subscription.From, To: subscription.To, AgentID: subscription.AgentID, Address: subscription.Address}
+        if subscription.MaxMessages > 0 {
+            // Only the unused part of the message budget carries over
+            request.MaxMessages = subscription.MaxMessages - subscription.delivered
+        }
+        if !subscription.expiresAt.IsZero() {
+            // As does the unexpired part of the lifetime
+            remaining := subscription.expiresAt.Sub(now)
+            if remaining <= 0 {
+                continue
+            }
+            request.TTLSeconds = int(math.Ceil(remaining.Seconds()))
+        }
+        saved.subscriptions = append(saved.subscriptions, request)
+    }
+}
+
+// takeSession restores the session for token to client, if the token is usable, the client's
+// principal owns the session and no connected client holds it. The session is rotated onto
+// the client's own token, and its earlier tokens retire after SessionTokenGrace. A client
+// restores at most one session. It returns the session's subscriptions and the states they
+// covered when it was saved.
+func (s *WebSocketServer) takeSession(token string, client *Client) ([]SubscribePayload, map[coalesceKey]uint64, bool) {
+    s.Mutex.Lock()
+    defer s.Mutex.Unlock()
+    now := s.Clock.Now()
+    entry, ok := s.sessions[token]
+    if !ok || !entry.usable(now) || entry.session.principal != client.Principal || entry.session.active || client.session != nil {
+        return nil, nil, false
+    }
+
+    saved := entry.session
+    for _, other := range s.sessions {
+        if other.session == saved && other.retiresAt.IsZero() {
+            other.retiresAt = now.Add(s.SessionTokenGrace)
+        }
+    }
+    saved.active = true
+    saved.generation++
+    s.sessions[client.SessionToken] = &sessionToken{session: saved, generation: saved.generation}
+    client.session = saved
+    return saved.subscriptions, saved.seen, true
+}
+
+// handleHello restores the subscriptions saved under a previous connection's session token.
+// Each is subscribed again, so authorization and limits apply as for a new subscribe. Rather
+// than the initial state of each, the client is sent a state_diff of any states that changed
+// while it was gone, ahead of the hello_response.
+func (s *WebSocketServer) handleHello(client *Client, payload json.RawMessage) {
+    data, ok := s.payloadObject(client, payload, "hello", &HelloPayload{})
+    if !ok {
+        return
+    }
+
+    token, errs := validateHello(data)
+    if len(errs) > 0 {
+        s.sendValidationErrorToClient(client, errs)
+        return
+    }
+
+    subscriptions, seen, ok := s.takeSession(token, client)
+    if !ok {
+        s.sendErrorMessage(client, CodeNotFound, "Unknown or expired session", nil)
+        return
+    }
+
+    results := make([]SubscribeResult, 0, len(subscriptions))
+    for _, request := range subscriptions {
+        var filter subscriptionFilter
+        if request.Filter != "" {
+            // Saved filters were parsed when first subscribed
+            filter, _ = parseFilter(request.Filter)
+        }
+        request.restored = true
+        results = append(results, s.subscribe(client, request.Topic, request, filter))
+    }
+    s.Mutex.Lock()
+    s.sendStateDiffLocked(client, seen)
+    s.Mutex.Unlock()
+    log.Printf("Restored %d subscriptions for client %s from its session", len(results), client.ID)
+    s.sendResponseToClient(client, ResponseMessage{
+        Type:    "hello_response",
+        Success: true,
+        Data: map[string]interface{}{
+            "results":       results,
+            "session_token": client.SessionToken, // Replaces the token presented, which soon retires
+        },
+    })
+}
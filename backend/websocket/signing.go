@@ -0,0 +1,63 @@
+package main
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "log"
+)
+
+// SigningKeySource provides the keys messages are signed with, one per principal.
+type SigningKeySource interface {
+    // SigningKey returns the HMAC key for principal; ok is false if the principal has none.
+    SigningKey(principal string) (key []byte, ok bool)
+}
+
+// messageSignature returns the hex HMAC-SHA256 of a message type and its JSON body, joined
+// by a '.', so a signed payload cannot be replayed under another type.
+func messageSignature(key []byte, msgType string, body []byte) string {
+    mac := hmac.New(sha256.New, key)
+    mac.Write([]byte(msgType))
+    mac.Write([]byte("."))
+    mac.Write(body)
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifySignature checks a client message's signature against the key of the client's
+// principal when SigningKeys is set. Unsigned and mis-signed messages are refused with a 401,
+// after which the client is closed as DisconnectAuthFailed.
+func (s *WebSocketServer) verifySignature(client *Client, msg ClientMessage) bool {
+    if s.SigningKeys == nil {
+        return true
+    }
+    key, ok := s.SigningKeys.SigningKey(client.Principal)
+    if ok {
+        expected := messageSignature(key, string(msg.Type), msg.Payload)
+        if hmac.Equal([]byte(expected), []byte(msg.Signature)) {
+            return true
+        }
+    }
+    log.Printf("Rejected %s message from client %s: invalid or missing signature", msg.Type, client.ID)
+    s.sendErrorMessage(client, CodeUnauthorized, "Invalid message signature", nil)
+    s.disconnectAfterQueued(client, DisconnectAuthFailed, "invalid message signature")
+    return false
+}
+
+// sendSignedResponseToClient sends a response whose data is signed with the key of the
+// client's principal, for results clients must be able to trust. Without SigningKeys, or a
+// key for the principal, it is sent unsigned.
+func (s *WebSocketServer) sendSignedResponseToClient(client *Client, response ResponseMessage) {
+    if s.SigningKeys != nil {
+        if key, ok := s.SigningKeys.SigningKey(client.Principal); ok {
+            data, err := json.Marshal(response.Data)
+            if err != nil {
+                log.Printf("Failed to marshal response data for signing: %v", err)
+                return
+            }
+            response.Data = json.RawMessage(data)
+            response.Signature = messageSignature(key, response.Type, data)
+        }
+    }
+    s.sendResponseToClient(client, response)
+}
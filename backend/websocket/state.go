@@ -0,0 +1,139 @@
+package main
+
+import (
+    "encoding/json"
+    "log"
+    "sort"
+)
+
+// statefulMessageTypes lists the broadcasts that carry a topic's current state, so the latest
+// one is worth sending to a client as soon as it subscribes.
+var statefulMessageTypes = map[MessageType]bool{
+    AgentStatusUpdate: true,
+    AgentConfigUpdate: true,
+}
+
+// InitialStatePayload carries the latest stateful broadcast for a topic, sent to a new
+// subscription before any live update.
+type InitialStatePayload struct {
+    Topic     string      `json:"topic"`
+    StateType MessageType `json:"state_type"` // Type of the broadcast the state came from, e.g. "agent_status"
+    State     interface{} `json:"state"`      // That broadcast's payload
+}
+
+// StateDiffPayload lists the states that changed while a client was disconnected, sent when
+// it restores its session instead of the initial state of every restored subscription.
+type StateDiffPayload struct {
+    Changes []InitialStatePayload `json:"changes"`
+}
+
+// recordStateLocked keeps a stateful broadcast as the latest state of each of its topics.
+// The caller must hold the write lock.
+func (s *WebSocketServer) recordStateLocked(topics []string, message Message) {
+    if !statefulMessageTypes[message.Type] {
+        return
+    }
+    for _, topic := range topics {
+        s.lastState[coalesceKey{msgType: message.Type, topic: topic}] = message
+    }
+}
+
+// forgetStateLocked drops the latest states recorded for topic, e.g. once it is evicted, so
+// states are not kept for topics that are gone. The caller must hold the write lock.
+func (s *WebSocketServer) forgetStateLocked(topic string) {
+    for key := range s.lastState {
+        if key.topic == topic {
+            delete(s.lastState, key)
+        }
+    }
+}
+
+// stateKeysLocked returns the keys of the latest states one of subscriptions covers, ordered
+// by topic and type. The caller must hold the server mutex.
+func (s *WebSocketServer) stateKeysLocked(subscriptions ...*Subscription) []coalesceKey {
+    var keys []coalesceKey
+    for key, message := range s.lastState {
+        fields := &payloadFields{payload: message.Payload}
+        for _, subscription := range subscriptions {
+            if subscription.matches(key.topic) && subscription.admits(fields) {
+                keys = append(keys, key)
+                break
+            }
+        }
+    }
+    sort.Slice(keys, func(i, j int) bool {
+        if keys[i].topic != keys[j].topic {
+            return keys[i].topic < keys[j].topic
+        }
+        return keys[i].msgType < keys[j].msgType
+    })
+    return keys
+}
+
+// seenStatesLocked returns the broadcast sequence of every latest state the client's
+// subscriptions cover, for diffing when the client's session is restored. The caller must
+// hold the server mutex.
+func (s *WebSocketServer) seenStatesLocked(client *Client) map[coalesceKey]uint64 {
+    subscriptions := make([]*Subscription, 0, len(client.Subscriptions))
+    for _, subscription := range client.Subscriptions {
+        subscriptions = append(subscriptions, subscription)
+    }
+    seen := make(map[coalesceKey]uint64)
+    for _, key := range s.stateKeysLocked(subscriptions...) {
+        seen[key] = s.lastState[key].Sequence
+    }
+    return seen
+}
+
+// sendStateDiffLocked queues a state_diff listing the latest states the client's restored
+// subscriptions cover that changed, or appeared, since seen was taken; nothing is sent if none
+// did. Like initial_state it reaches the client ahead of any later live update. The caller
+// must hold the write lock.
+func (s *WebSocketServer) sendStateDiffLocked(client *Client, seen map[coalesceKey]uint64) {
+    var changes []InitialStatePayload
+    for key, sequence := range s.seenStatesLocked(client) {
+        if previous, ok := seen[key]; !ok || previous != sequence {
+            changes = append(changes, InitialStatePayload{Topic: key.topic, StateType: key.msgType, State: s.lastState[key].Payload})
+        }
+    }
+    if len(changes) == 0 {
+        return
+    }
+    sort.Slice(changes, func(i, j int) bool {
+        if changes[i].Topic != changes[j].Topic {
+            return changes[i].Topic < changes[j].Topic
+        }
+        return changes[i].StateType < changes[j].StateType
+    })
+
+    frame, err := json.Marshal(Message{Type: StateDiff, Payload: StateDiffPayload{Changes: changes}})
+    if err != nil {
+        log.Printf("Failed to marshal state diff: %v", err)
+        return
+    }
+    if !s.enqueue(client, frame) {
+        log.Printf("Client send queue full, dropped state diff")
+    }
+}
+
+// sendInitialStateLocked queues the latest state of every topic a new subscription covers,
+// ordered by topic and type. Being queued under the same lock as broadcast delivery, it
+// reaches the client ahead of any live update to the subscription. The caller must hold the
+// write lock.
+func (s *WebSocketServer) sendInitialStateLocked(client *Client, subscription *Subscription) {
+    for _, key := range s.stateKeysLocked(subscription) {
+        frame, err := json.Marshal(Message{
+            Type:         InitialState,
+            Payload:      InitialStatePayload{Topic: key.topic, StateType: key.msgType, State: s.lastState[key].Payload},
+            MatchedTopic: key.topic,
+        })
+        if err != nil {
+            log.Printf("Failed to marshal initial state for topic %s: %v", key.topic, err)
+            continue
+        }
+        if !s.enqueue(client, frame) {
+            log.Printf("Client send queue full, dropped initial state for topic %s", key.topic)
+            return
+        }
+    }
+}
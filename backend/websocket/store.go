@@ -0,0 +1,336 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "log"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// TransactionStore provides the transaction data behind transaction queries.
+type TransactionStore interface {
+    // QueryTransactions returns transactions matching the query, newest first. A query whose
+    // tx_id names a transaction the store does not hold fails with ErrTransactionNotFound;
+    // any other query matching nothing returns an empty slice.
+    QueryTransactions(ctx context.Context, query TransactionQueryPayload) ([]TransactionPayload, error)
+}
+
+// TransactionRecorder is implemented by stores that PublishTransaction can record new
+// transactions in.
+type TransactionRecorder interface {
+    // Add records a transaction issued by agentID and returns it as stored, with its
+    // AgentID and Sequence set.
+    Add(agentID string, tx TransactionPayload) TransactionPayload
+}
+
+// TransactionSequencer is implemented by stores that number the transactions they record,
+// so a tail subscription can skip any recorded before it.
+type TransactionSequencer interface {
+    // LastSequence returns the Sequence of the most recently recorded transaction, or 0.
+    LastSequence() uint64
+}
+
+// TransactionBatchStore is implemented by stores that can look up many transactions in one call.
+type TransactionBatchStore interface {
+    // GetTransactions returns the transactions among ids that the store holds, keyed by tx_id.
+    GetTransactions(ctx context.Context, ids []string) (map[string]TransactionPayload, error)
+}
+
+// Errors a TransactionStore returns for queries that would fail the same way if repeated.
+// Any other error is treated as transient and the query is retried.
+var (
+    ErrTransactionNotFound = errors.New("transaction not found")
+    ErrInvalidQuery        = errors.New("invalid transaction query")
+)
+
+// isRetryable reports whether a failed store query may succeed if repeated.
+func isRetryable(err error) bool {
+    return !errors.Is(err, ErrTransactionNotFound) &&
+        !errors.Is(err, ErrInvalidQuery) &&
+        !errors.Is(err, context.Canceled) &&
+        !errors.Is(err, context.DeadlineExceeded)
+}
+
+// queryStore runs a query against the store, retrying transient failures with exponential
+// backoff starting at StoreRetryDelay, for at most StoreRetryAttempts calls in total. It gives
+// up early rather than sleep past the context's deadline. Results have their amounts
+// structured, whether or not the store did so.
+func (s *WebSocketServer) queryStore(ctx context.Context, query TransactionQueryPayload) ([]TransactionPayload, error) {
+    delay := s.StoreRetryDelay
+    for attempt := 1; ; attempt++ {
+        transactions, err := s.Store.QueryTransactions(ctx, query)
+        if err == nil {
+            for i := range transactions {
+                transactions[i].structureAmount()
+            }
+            return transactions, nil
+        }
+        if attempt >= s.StoreRetryAttempts || !isRetryable(err) {
+            return transactions, err
+        }
+        if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+            return nil, err
+        }
+
+        log.Printf("Transaction store query failed (attempt %d of %d), retrying in %v: %v", attempt, s.StoreRetryAttempts, delay, err)
+        timer := time.NewTimer(delay)
+        select {
+        case <-ctx.Done():
+            timer.Stop()
+            return nil, err
+        case <-timer.C:
+        }
+        delay *= 2
+    }
+}
+
+// mockTransactionStore serves simulated transactions until a real blockchain-backed store is
+// wired in, timestamping them by clock.
+type mockTransactionStore struct {
+    clock Clock
+}
+
+// QueryTransactions returns a single transaction for tx_id lookups and up to three per agent.
+func (m mockTransactionStore) QueryTransactions(ctx context.Context, query TransactionQueryPayload) ([]TransactionPayload, error) {
+    transactions := []TransactionPayload{}
+    if query.TxID != "" {
+        transactions = append(transactions, TransactionPayload{
+            TxID:        query.TxID,
+            Status:      "confirmed",
+            Timestamp:   m.clock.Now().Add(-10 * time.Minute),
+            Amount:      "0.5 SOL",
+            Blockchain:  "Solana",
+            FromAddress: "addr1",
+            ToAddress:   "addr2",
+        })
+    } else if query.AgentID != "" {
+        for i := 0; i < query.Limit && i < 3; i++ {
+            transactions = append(transactions, TransactionPayload{
+                TxID:        fmt.Sprintf("tx-%s-%d", query.AgentID, i),
+                Status:      "confirmed",
+                Timestamp:   m.clock.Now().Add(time.Duration(-i-1) * time.Hour),
+                Amount:      "0.1 SOL",
+                Blockchain:  "Solana",
+                FromAddress: "addr1",
+                ToAddress:   "addr2",
+            })
+        }
+    }
+    return transactions, nil
+}
+
+// matchesAddress reports whether address appears on the given side of a transaction.
+func matchesAddress(tx TransactionPayload, address string, direction AddressDirection) bool {
+    switch direction {
+    case DirectionFrom:
+        return tx.FromAddress == address
+    case DirectionTo:
+        return tx.ToAddress == address
+    default:
+        return tx.FromAddress == address || tx.ToAddress == address
+    }
+}
+
+// inBlockRange reports whether height lies within the inclusive range from..to; a nil bound
+// leaves that side open.
+func inBlockRange(height uint64, from, to *uint64) bool {
+    return (from == nil || height >= *from) && (to == nil || height <= *to)
+}
+
+// MemoryTransactionStore is an in-memory TransactionStore, useful for tests and local runs.
+type MemoryTransactionStore struct {
+    mu       sync.RWMutex
+    records  []storedTransaction
+    sequence uint64 // Sequence assigned to the most recently added transaction
+}
+
+// storedTransaction associates a transaction with the agent that issued it.
+type storedTransaction struct {
+    agentID string
+    tx      TransactionPayload
+}
+
+// NewMemoryTransactionStore creates an empty in-memory store.
+func NewMemoryTransactionStore() *MemoryTransactionStore {
+    return &MemoryTransactionStore{}
+}
+
+// Add records a transaction issued by agentID, assigning it the next sequence number.
+func (m *MemoryTransactionStore) Add(agentID string, tx TransactionPayload) TransactionPayload {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.sequence++
+    tx.AgentID, tx.Sequence = agentID, m.sequence
+    tx.structureAmount()
+    m.records = append(m.records, storedTransaction{agentID: agentID, tx: tx})
+    return tx
+}
+
+// LastSequence returns the sequence assigned to the most recently added transaction.
+func (m *MemoryTransactionStore) LastSequence() uint64 {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+    return m.sequence
+}
+
+// QueryTransactions returns the stored transactions matching every filter set on the query.
+func (m *MemoryTransactionStore) QueryTransactions(ctx context.Context, query TransactionQueryPayload) ([]TransactionPayload, error) {
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+
+    transactions := []TransactionPayload{}
+    known := false // Whether a queried tx_id is held at all, whatever the other filters
+    for _, record := range m.records {
+        if query.TxID != "" && record.tx.TxID != query.TxID {
+            continue
+        }
+        known = true
+        if query.AgentID != "" && record.agentID != query.AgentID {
+            continue
+        }
+        if query.Address != "" && !matchesAddress(record.tx, query.Address, query.Direction) {
+            continue
+        }
+        if len(query.Blockchain) > 0 && !containsFold(query.Blockchain, record.tx.Blockchain) {
+            continue
+        }
+        if !inBlockRange(record.tx.BlockHeight, query.FromBlock, query.ToBlock) {
+            continue
+        }
+        transactions = append(transactions, record.tx)
+    }
+    if query.TxID != "" && !known {
+        return nil, ErrTransactionNotFound
+    }
+
+    sort.SliceStable(transactions, func(i, j int) bool {
+        return transactions[i].Timestamp.After(transactions[j].Timestamp)
+    })
+    if query.Limit > 0 && len(transactions) > query.Limit {
+        transactions = transactions[:query.Limit]
+    }
+    return transactions, nil
+}
+
+// GetTransactions returns the stored transactions among ids, keyed by tx_id.
+func (m *MemoryTransactionStore) GetTransactions(ctx context.Context, ids []string) (map[string]TransactionPayload, error) {
+    wanted := make(map[string]bool, len(ids))
+    for _, id := range ids {
+        wanted[id] = true
+    }
+
+    m.mu.RLock()
+    defer m.mu.RUnlock()
+    found := make(map[string]TransactionPayload)
+    for _, record := range m.records {
+        if wanted[record.tx.TxID] {
+            found[record.tx.TxID] = record.tx
+        }
+    }
+    return found, nil
+}
+
+// fetchTransactions looks up a batch of tx_ids, in one call when the Store is a
+// TransactionBatchStore and otherwise one query per id. Ids the store does not hold are
+// absent from the result.
+func (s *WebSocketServer) fetchTransactions(ctx context.Context, ids []string) (map[string]TransactionPayload, error) {
+    if batch, ok := s.Store.(TransactionBatchStore); ok {
+        found, err := batch.GetTransactions(ctx, ids)
+        for id, tx := range found {
+            tx.structureAmount()
+            found[id] = tx
+        }
+        return found, err
+    }
+
+    found := make(map[string]TransactionPayload, len(ids))
+    for _, id := range ids {
+        transactions, err := s.queryStore(ctx, TransactionQueryPayload{TxID: id, Direction: DirectionAny, Limit: 1})
+        if errors.Is(err, ErrTransactionNotFound) {
+            continue
+        }
+        if err != nil {
+            return nil, err
+        }
+        if len(transactions) > 0 {
+            found[id] = transactions[0]
+        }
+    }
+    return found, nil
+}
+
+// containsFold reports whether names contains name, ignoring case.
+func containsFold(names []string, name string) bool {
+    for _, candidate := range names {
+        if strings.EqualFold(candidate, name) {
+            return true
+        }
+    }
+    return false
+}
+
+// queryAcrossChains runs a query against the store once per requested blockchain and merges
+// the results newest first, applying the limit to the merged set. Chains that fail are
+// reported as warnings; an error is returned only when every chain fails. A chain not holding
+// the queried tx_id contributes nothing, and ErrTransactionNotFound is returned only when no
+// chain holds it.
+func (s *WebSocketServer) queryAcrossChains(ctx context.Context, query TransactionQueryPayload) ([]TransactionPayload, []string, error) {
+    if len(query.Blockchain) <= 1 {
+        transactions, err := s.queryStore(ctx, query)
+        return transactions, nil, err
+    }
+
+    type chainResult struct {
+        transactions []TransactionPayload
+        err          error
+    }
+    results := make([]chainResult, len(query.Blockchain))
+    var wg sync.WaitGroup
+    for i, chain := range query.Blockchain {
+        wg.Add(1)
+        go func(i int, chain string) {
+            defer wg.Done()
+            chainQuery := query
+            chainQuery.Blockchain = BlockchainList{chain}
+            transactions, err := s.queryStore(ctx, chainQuery)
+            results[i] = chainResult{transactions: transactions, err: err}
+        }(i, chain)
+    }
+    wg.Wait()
+
+    transactions := []TransactionPayload{}
+    var warnings []string
+    var lastErr error
+    notFound := 0
+    for i, result := range results {
+        if errors.Is(result.err, ErrTransactionNotFound) {
+            notFound++
+            continue
+        }
+        if result.err != nil {
+            log.Printf("Transaction store query failed for %s: %v", query.Blockchain[i], result.err)
+            warnings = append(warnings, fmt.Sprintf("%s: transaction store unavailable", query.Blockchain[i]))
+            lastErr = result.err
+            continue
+        }
+        transactions = append(transactions, result.transactions...)
+    }
+    if notFound == len(results) {
+        return nil, nil, ErrTransactionNotFound
+    }
+    if len(warnings) == len(results) {
+        return nil, nil, lastErr
+    }
+
+    sort.SliceStable(transactions, func(i, j int) bool {
+        return transactions[i].Timestamp.After(transactions[j].Timestamp)
+    })
+    if query.Limit > 0 && len(transactions) > query.Limit {
+        transactions = transactions[:query.Limit]
+    }
+    return transactions, warnings, nil
+}
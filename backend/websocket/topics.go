@@ -0,0 +1,306 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "strings"
+    "sync/atomic"
+    "time"
+    "unicode"
+)
+
+// errTopicControlChars is returned for topics containing control characters.
+var errTopicControlChars = errors.New("topic must not contain control characters")
+
+// errTopicBlank is returned for topics that are empty once whitespace is trimmed.
+var errTopicBlank = errors.New("topic must not be blank")
+
+// normalizeTopic trims surrounding whitespace from a topic and, when CaseInsensitiveTopics
+// is set, lowercases it. Subscriptions and broadcasts both go through it so they compare equal.
+func (s *WebSocketServer) normalizeTopic(topic string) (string, error) {
+    topic = strings.TrimSpace(topic)
+    if topic == "" {
+        return "", errTopicBlank
+    }
+    if strings.IndexFunc(topic, unicode.IsControl) >= 0 {
+        return "", errTopicControlChars
+    }
+    if s.CaseInsensitiveTopics {
+        topic = strings.ToLower(topic)
+    }
+    return topic, nil
+}
+
+// Subscription is a client's interest in every topic matching Pattern. Patterns may use '*'
+// as a wildcard for any run of characters, e.g. "agent.*", name a fleet, e.g.
+// "fleet:trading", to match every agent in it, or name a flow, e.g. "flow:agent-1->addr9".
+type Subscription struct {
+    ID          string   `json:"subscription_id"`
+    Pattern     string   `json:"topic"`
+    MaxMessages int      `json:"max_messages,omitempty"` // Auto-unsubscribe after this many deliveries; 0 is unlimited
+    Filter      string   `json:"filter,omitempty"`       // Expression each broadcast payload must satisfy
+    MinLevel    string   `json:"min_level,omitempty"`    // Lowest log level a logs subscription forwards
+    QoS         QoS      `json:"qos,omitempty"`          // Whether broadcasts are dropped or retained when the client falls behind
+    MinAmount   float64  `json:"min_amount,omitempty"`   // Lowest transaction amount delivered; 0 delivers all
+    TTLSeconds  int      `json:"ttl_seconds,omitempty"`  // Lifetime from the last subscribe; 0 never expires
+    Statuses    []string `json:"statuses,omitempty"`     // Agent statuses whose updates are delivered; empty delivers all
+    From        string   `json:"from,omitempty"`         // Sending agent or address of a flow subscription
+    To          string   `json:"to,omitempty"`           // Receiving address of a flow subscription
+    AgentID     string   `json:"agent_id,omitempty"`     // Agent whose transactions a mempool subscription delivers; empty delivers all
+    Address     string   `json:"address,omitempty"`      // Address a mempool subscription's transactions are from or to; empty delivers all
+
+    filter    subscriptionFilter // Compiled Filter; nil admits everything
+    foldCase  bool               // Whether From and To match transaction sides ignoring case, as with CaseInsensitiveTopics
+    delivered int                // Broadcasts delivered so far, guarded by the server mutex
+    agents    map[string]bool    // Agents of a fleet subscription, guarded by the server mutex; nil for other patterns
+    tail      *logTail           // Log tail of a logs subscription, stopped when it is removed
+    mempool   *mempoolStream     // Pending transaction stream of a mempool subscription, stopped when it is removed
+    pending   *pendingTxs        // Transactions a mempool subscription delivered pending and follows until settled, guarded by the server mutex
+    minLevel  atomic.Int32       // Lowest log level rank a logs subscription forwards
+    expiresAt time.Time          // When the subscription expires, guarded by the server mutex; zero if it has no TTL
+
+    // Catch-up state, guarded by the server mutex
+    catchingUp bool        // Set while history is being sent; live frames are held meanwhile
+    held       []heldFrame // Live frames held during catch-up
+    watermark  uint64      // Highest transaction sequence sent as history or preceding a tail subscribe; live transactions at or below it are dropped
+
+    // Pause state, guarded by the server mutex
+    paused    bool     // Set between pause and resume; the send path skips the subscription meanwhile
+    buffering bool     // Whether broadcasts skipped while paused are kept for replay
+    buffered  [][]byte // Frames kept while paused, oldest first, at most PausedBufferSize
+}
+
+// admits reports whether the subscription's min_amount, statuses, flow, agent_id, address and
+// filter, if any, accept the broadcast payload.
+func (sub *Subscription) admits(fields *payloadFields) bool {
+    if !sub.meetsMinAmount(fields.payload) || !sub.hasStatus(fields.payload) || !sub.inFlow(fields.payload) || !sub.hasParty(fields.payload) {
+        return false
+    }
+    return sub.filter == nil || sub.filter.eval(fields.get())
+}
+
+// hasStatus reports whether a broadcast payload passes the subscription's Statuses. Only
+// agent status updates are checked; other broadcasts on the topic are let through.
+func (sub *Subscription) hasStatus(payload interface{}) bool {
+    status, ok := payload.(AgentStatusPayload)
+    if len(sub.Statuses) == 0 || !ok {
+        return true
+    }
+    for _, wanted := range sub.Statuses {
+        if status.Status == wanted {
+            return true
+        }
+    }
+    return false
+}
+
+// topicMatches reports whether topic matches pattern, where '*' matches any run of characters.
+func topicMatches(pattern, topic string) bool {
+    if !strings.Contains(pattern, "*") {
+        return pattern == topic
+    }
+
+    parts := strings.Split(pattern, "*")
+    if !strings.HasPrefix(topic, parts[0]) {
+        return false
+    }
+    rest := topic[len(parts[0]):]
+    for _, part := range parts[1 : len(parts)-1] {
+        i := strings.Index(rest, part)
+        if i < 0 {
+            return false
+        }
+        rest = rest[i+len(part):]
+    }
+    return strings.HasSuffix(rest, parts[len(parts)-1])
+}
+
+// subscriptionByPattern returns the client's subscription for exactly pattern, if any.
+// The caller must hold the server mutex.
+func (c *Client) subscriptionByPattern(pattern string) *Subscription {
+    for _, subscription := range c.Subscriptions {
+        if subscription.Pattern == pattern {
+            return subscription
+        }
+    }
+    return nil
+}
+
+// matches reports whether the subscription covers topic. The caller must hold the server mutex.
+func (sub *Subscription) matches(topic string) bool {
+    if sub.agents != nil {
+        return sub.agents[topic]
+    }
+    if sub.pending != nil && sub.pending.follows(topic) {
+        return true
+    }
+    // Flows are followed only by the subscription naming them, never by a wildcard
+    if strings.HasPrefix(topic, flowTopicPrefix) && strings.Contains(sub.Pattern, "*") {
+        return false
+    }
+    return topicMatches(sub.Pattern, topic)
+}
+
+// matchingSubscriptions returns the client's subscriptions whose pattern matches any of the
+// topics. The caller must hold the server mutex.
+func (c *Client) matchingSubscriptions(topics ...string) []*Subscription {
+    var matched []*Subscription
+    for _, subscription := range c.Subscriptions {
+        for _, topic := range topics {
+            if subscription.matches(topic) {
+                matched = append(matched, subscription)
+                break
+            }
+        }
+    }
+    return matched
+}
+
+// matchedTopic returns the first of topics covered by any of the subscriptions. The caller
+// must hold the server mutex.
+func matchedTopic(topics []string, subscriptions ...*Subscription) string {
+    for _, topic := range topics {
+        for _, subscription := range subscriptions {
+            if subscription.matches(topic) {
+                return topic
+            }
+        }
+    }
+    return ""
+}
+
+// newSubscriptionID returns a server-unique subscription identifier.
+func (s *WebSocketServer) newSubscriptionID() string {
+    return fmt.Sprintf("sub-%d", s.subscriptionSeq.Add(1))
+}
+
+// addSubscriptionLocked attaches a new subscription to the client and counts it in the topic
+// stats. The caller must hold the write lock.
+func (s *WebSocketServer) addSubscriptionLocked(client *Client, subscription *Subscription) {
+    client.Subscriptions[subscription.ID] = subscription
+    s.topicCounts[subscription.Pattern]++
+}
+
+// removeSubscriptionLocked detaches a subscription from the client by ID and uncounts it,
+// returning the subscription if it existed. The caller must hold the write lock.
+func (s *WebSocketServer) removeSubscriptionLocked(client *Client, id string) (*Subscription, bool) {
+    subscription, ok := client.Subscriptions[id]
+    if !ok {
+        return nil, false
+    }
+    delete(client.Subscriptions, id)
+    if subscription.tail != nil {
+        subscription.tail.stop()
+    }
+    if subscription.mempool != nil {
+        subscription.mempool.stop()
+    }
+    if count, counted := s.topicCounts[subscription.Pattern]; counted {
+        if count <= 1 {
+            delete(s.topicCounts, subscription.Pattern)
+        } else {
+            s.topicCounts[subscription.Pattern] = count - 1
+        }
+    }
+    return subscription, true
+}
+
+// expireSubscriptions removes subscriptions whose ttl_seconds have elapsed without a
+// re-subscribe, sending each client a subscription_expired message for each. Clients whose
+// send queue overflows are disconnected.
+func (s *WebSocketServer) expireSubscriptions() {
+    now := s.Clock.Now()
+    var overflowed []*Client
+    s.Mutex.Lock()
+    for client := range s.Clients {
+        for id, subscription := range client.Subscriptions {
+            if subscription.expiresAt.IsZero() || now.Before(subscription.expiresAt) {
+                continue
+            }
+            s.removeSubscriptionLocked(client, id)
+            log.Printf("Subscription %s to topic %s expired after %ds", id, subscription.Pattern, subscription.TTLSeconds)
+            notice, err := json.Marshal(Message{Type: SubscriptionExpired, Payload: subscription})
+            if err != nil {
+                log.Printf("Failed to marshal subscription expiry notice: %v", err)
+                continue
+            }
+            if !s.enqueue(client, notice) {
+                overflowed = append(overflowed, client)
+                break
+            }
+        }
+    }
+    s.Mutex.Unlock()
+
+    for _, client := range overflowed {
+        s.disconnectSlowClient(client)
+    }
+}
+
+// EvictTopic closes a topic, e.g. when its agent is decommissioned: every client with a
+// subscription matching it is sent a topic_closed message with reason, subscriptions to
+// exactly the topic are removed, its recorded state is dropped, and new subscribes to it are
+// refused for EvictionCooldown.
+// Wildcard and fleet subscriptions that also cover other topics are kept. Clients whose
+// send queue overflows are disconnected.
+func (s *WebSocketServer) EvictTopic(topic, reason string) {
+    topic, err := s.normalizeTopic(topic)
+    if err != nil {
+        log.Printf("Cannot evict topic %q: %v", topic, err)
+        return
+    }
+
+    var overflowed []*Client
+    now := s.Clock.Now()
+    s.Mutex.Lock()
+    for evicted, until := range s.evictedTopics {
+        if !now.Before(until) {
+            delete(s.evictedTopics, evicted)
+        }
+    }
+    if s.EvictionCooldown > 0 {
+        s.evictedTopics[topic] = now.Add(s.EvictionCooldown)
+    }
+    s.forgetStateLocked(topic)
+    for client := range s.Clients {
+        matched := client.matchingSubscriptions(topic)
+        if len(matched) == 0 {
+            continue
+        }
+        payload := TopicClosedPayload{Topic: topic, Reason: reason}
+        for _, subscription := range matched {
+            if subscription.Pattern == topic {
+                s.removeSubscriptionLocked(client, subscription.ID)
+                payload.SubscriptionIDs = append(payload.SubscriptionIDs, subscription.ID)
+            }
+        }
+        notice, err := json.Marshal(Message{Type: TopicClosed, Payload: payload})
+        if err != nil {
+            log.Printf("Failed to marshal topic closed notice: %v", err)
+            continue
+        }
+        if !s.enqueue(client, notice) {
+            overflowed = append(overflowed, client)
+        }
+    }
+    s.Mutex.Unlock()
+    log.Printf("Evicted topic %s: %s", topic, reason)
+
+    for _, client := range overflowed {
+        s.disconnectSlowClient(client)
+    }
+}
+
+// TopicStats returns the number of subscriptions held per topic pattern. Wildcard patterns
+// are counted as themselves, not expanded into the topics they match.
+func (s *WebSocketServer) TopicStats() map[string]int {
+    s.Mutex.RLock()
+    defer s.Mutex.RUnlock()
+    stats := make(map[string]int, len(s.topicCounts))
+    for pattern, count := range s.topicCounts {
+        stats[pattern] = count
+    }
+    return stats
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "strings"
+)
+
+// FieldErrors collects validation failures keyed by payload field name so a client
+// learns about every bad field in a single response.
+type FieldErrors map[string]string
+
+// add records a message for a field, keeping the first message reported for it.
+func (f FieldErrors) add(field, message string) {
+    if _, exists := f[field]; !exists {
+        f[field] = message
+    }
+}
+
+// supportedCommands lists the agent control commands accepted by handleAgentControl.
+var supportedCommands = map[string]bool{
+    "start":         true,
+    "stop":          true,
+    "update_config": true,
+}
+
+// rawFields holds a payload object's fields undecoded so each can be decoded into its
+// typed destination and reported individually.
+type rawFields map[string]json.RawMessage
+
+// decode unmarshals the named field into v. present is false when the field is missing or
+// null; ok is false when it is present but does not fit v.
+func (f rawFields) decode(name string, v interface{}) (present, ok bool) {
+    raw, exists := f[name]
+    if !exists || bytes.Equal(bytes.TrimSpace(raw), []byte("null")) {
+        return false, true
+    }
+    return true, json.Unmarshal(raw, v) == nil
+}
+
+// The field helpers below record failures in a shared FieldErrors rather than each returning
+// an *ErrorResponse, so a validator runs every check and the client learns of every bad field
+// in one 422 response instead of only the first.
+
+// requireString returns the named string field, recording a field error when it is missing,
+// not a string or empty.
+func (f rawFields) requireString(name string, errs FieldErrors) string {
+    var value string
+    if _, ok := f.decode(name, &value); !ok || value == "" {
+        errs.add(name, name+" is required and must be a non-empty string")
+    }
+    return value
+}
+
+// optionalString returns the named string field, or "" when it is missing, recording a field
+// error when it is not a string.
+func (f rawFields) optionalString(name string, errs FieldErrors) string {
+    var value string
+    if present, ok := f.decode(name, &value); present && !ok {
+        errs.add(name, name+" must be a string")
+    }
+    return value
+}
+
+// requireInt returns the named integer field, recording a field error when it is missing or
+// not an integer.
+func (f rawFields) requireInt(name string, errs FieldErrors) int64 {
+    var value int64
+    if present, ok := f.decode(name, &value); !present || !ok {
+        errs.add(name, name+" is required and must be an integer")
+    }
+    return value
+}
+
+// optionalCount returns the named integer field, or 0 when it is missing, recording a field
+// error when it is not a non-negative integer.
+func (f rawFields) optionalCount(name string, errs FieldErrors) int {
+    var value int
+    if present, ok := f.decode(name, &value); present && (!ok || value < 0) {
+        errs.add(name, name+" must be a non-negative integer")
+    }
+    return value
+}
+
+// validateSubscribe validates a subscribe request payload.
+func validateSubscribe(data rawFields) (SubscribePayload, FieldErrors) {
+    var payload SubscribePayload
+    errs := FieldErrors{}
+
+    if present, ok := data.decode("topics", &payload.Topics); present && (!ok || len(payload.Topics) == 0) {
+        errs.add("topics", "topics must be a non-empty array of strings")
+    } else if present {
+        if _, exists := data["topic"]; exists {
+            errs.add("topics", "topics cannot be combined with topic")
+        }
+    } else {
+        payload.Topic = data.requireString("topic", errs)
+    }
+    if isFlowTopic(payload.Topic) {
+        errs.add("topic", `flows are subscribed with topic "flow", from and to`)
+    }
+    for _, topic := range payload.Topics {
+        if isFlowTopic(topic) {
+            errs.add("topics", `flows are subscribed with topic "flow", from and to`)
+            break
+        }
+    }
+
+    payload.From = data.optionalString("from", errs)
+    payload.To = data.optionalString("to", errs)
+    if payload.Topic == FlowTopic {
+        if payload.From == "" {
+            errs.add("from", "from is required for the flow topic")
+        }
+        if payload.To == "" {
+            errs.add("to", "to is required for the flow topic")
+        }
+        if strings.Contains(payload.From+payload.To, "*") {
+            errs.add("from", "from and to must each name a single agent or address")
+        }
+        payload.Topic = flowTopic(payload.From, payload.To)
+    } else if payload.From != "" || payload.To != "" {
+        errs.add("from", "from and to apply only to the flow topic")
+    }
+
+    payload.AgentID = data.optionalString("agent_id", errs)
+    payload.Address = data.optionalString("address", errs)
+    if payload.AgentID != "" || payload.Address != "" {
+        for _, topic := range append([]string{payload.Topic}, payload.Topics...) {
+            if _, ok := mempoolChain(topic); !ok && topic != "" {
+                errs.add("agent_id", "agent_id and address apply only to mempool topics")
+                break
+            }
+        }
+    }
+
+    payload.MaxMessages = data.optionalCount("max_messages", errs)
+    payload.Filter = data.optionalString("filter", errs)
+
+    payload.MinLevel = data.optionalString("min_level", errs)
+    if _, known := logLevels[payload.MinLevel]; payload.MinLevel != "" && !known {
+        errs.add("min_level", "min_level must be one of debug, info, warn or error")
+    }
+
+    payload.TTLSeconds = data.optionalCount("ttl_seconds", errs)
+
+    if present, ok := data.decode("min_amount", &payload.MinAmount); present && (!ok || payload.MinAmount < 0) {
+        errs.add("min_amount", "min_amount must be a non-negative number")
+    }
+
+    if present, ok := data.decode("statuses", &payload.Statuses); present && (!ok || len(payload.Statuses) == 0 || containsString(payload.Statuses, "")) {
+        errs.add("statuses", "statuses must be a non-empty array of non-empty strings")
+    }
+
+    if present, ok := data.decode("qos", &payload.QoS); present && !ok {
+        errs.add("qos", "qos must be a string")
+    } else if payload.QoS == "" {
+        payload.QoS = QoSAtMostOnce
+    } else if payload.QoS != QoSAtMostOnce && payload.QoS != QoSAtLeastOnce {
+        errs.add("qos", "qos must be at_most_once or at_least_once")
+    }
+
+    if present, ok := data.decode("tail", &payload.Tail); present && !ok {
+        errs.add("tail", "tail must be a boolean")
+    }
+
+    if payload.History = data.optionalCount("history", errs); payload.History > 0 {
+        switch {
+        case len(payload.Topics) > 0:
+            errs.add("history", "history cannot be combined with topics")
+        case strings.Contains(payload.Topic, "*"):
+            errs.add("history", "history requires a single agent topic, not a wildcard")
+        case payload.From != "":
+            errs.add("history", "history requires a single agent topic, not a flow")
+        case payload.MaxMessages > 0:
+            errs.add("history", "history cannot be combined with max_messages")
+        case payload.Tail:
+            errs.add("history", "history cannot be combined with tail")
+        }
+    }
+
+    return payload, errs
+}
+
+// validateUnsubscribe validates an unsubscribe payload, which names a topic or a subscription ID.
+func validateUnsubscribe(data rawFields) (UnsubscribePayload, FieldErrors) {
+    var payload UnsubscribePayload
+    errs := FieldErrors{}
+
+    payload.Topic = data.optionalString("topic", errs)
+    payload.SubscriptionID = data.optionalString("subscription_id", errs)
+
+    if payload.Topic == "" && payload.SubscriptionID == "" {
+        errs.add("topic", "topic or subscription_id is required")
+    }
+
+    return payload, errs
+}
+
+// validatePause validates a pause payload, which names a subscription as an unsubscribe does.
+func validatePause(data rawFields) (PausePayload, FieldErrors) {
+    target, errs := validateUnsubscribe(data)
+    payload := PausePayload{Topic: target.Topic, SubscriptionID: target.SubscriptionID}
+
+    if present, ok := data.decode("buffer", &payload.Buffer); present && !ok {
+        errs.add("buffer", "buffer must be a boolean")
+    }
+
+    return payload, errs
+}
+
+// validatePing validates a latency ping payload and returns its client timestamp.
+func validatePing(data rawFields) (int64, FieldErrors) {
+    errs := FieldErrors{}
+    return data.requireInt("client_timestamp", errs), errs
+}
+
+// validateAck validates an ack payload and returns the acknowledged message ID.
+func validateAck(data rawFields) (string, FieldErrors) {
+    errs := FieldErrors{}
+    return data.requireString("message_id", errs), errs
+}
+
+// validateHello validates a hello payload and returns its session token.
+func validateHello(data rawFields) (string, FieldErrors) {
+    errs := FieldErrors{}
+    return data.requireString("session_token", errs), errs
+}
+
+// validateCommandHistory validates a command_history payload. A missing or zero limit falls
+// back to the default of 10.
+func validateCommandHistory(data rawFields) (CommandHistoryPayload, FieldErrors) {
+    var payload CommandHistoryPayload
+    errs := FieldErrors{}
+
+    payload.AgentID = data.requireString("agent_id", errs)
+
+    if present, ok := data.decode("limit", &payload.Limit); present && (!ok || payload.Limit < 0) {
+        errs.add("limit", "limit must be a positive integer")
+    } else if payload.Limit > maxCommandHistory {
+        errs.add("limit", fmt.Sprintf("limit must be at most %d", maxCommandHistory))
+    }
+    if payload.Limit <= 0 {
+        payload.Limit = 10
+    }
+
+    return payload, errs
+}
+
+// maxCommandHistory bounds the entries of one command_history response.
+const maxCommandHistory = 100
+
+// validateAgentControl validates an agent control payload.
+func validateAgentControl(data rawFields) (AgentControlPayload, FieldErrors) {
+    var payload AgentControlPayload
+    errs := FieldErrors{}
+
+    payload.AgentID = data.requireString("agent_id", errs)
+
+    payload.Command = data.requireString("command", errs)
+    if payload.Command != "" && !supportedCommands[payload.Command] {
+        errs.add("command", "unsupported command: "+payload.Command)
+    }
+
+    if present, ok := data.decode("params", &payload.Params); present && !ok {
+        errs.add("params", "params must be an object")
+    }
+
+    if present, ok := data.decode("dry_run", &payload.DryRun); present && !ok {
+        errs.add("dry_run", "dry_run must be a boolean")
+    }
+
+    if present, ok := data.decode("execute_at", &payload.ExecuteAt); present && !ok {
+        errs.add("execute_at", "execute_at must be an RFC 3339 timestamp")
+    } else if payload.ExecuteAt != nil && payload.DryRun {
+        errs.add("execute_at", "execute_at cannot be combined with dry_run")
+    }
+
+    if present, ok := data.decode("mode", &payload.Mode); present && !ok {
+        errs.add("mode", "mode must be a string")
+    }
+    switch {
+    case payload.Mode == "":
+        if payload.Command == "update_config" {
+            payload.Mode = ConfigMerge
+        }
+    case payload.Command != "update_config":
+        errs.add("mode", "mode applies only to update_config")
+    case payload.Mode != ConfigMerge && payload.Mode != ConfigReplace:
+        errs.add("mode", "mode must be merge or replace")
+    }
+
+    return payload, errs
+}
+
+// validateTransactionQuery validates a transaction query payload against the server's
+// supported blockchains and MaxTxLimit. A missing or zero limit falls back to the default of 10.
+func (s *WebSocketServer) validateTransactionQuery(data rawFields) (TransactionQueryPayload, FieldErrors) {
+    var payload TransactionQueryPayload
+    errs := FieldErrors{}
+
+    payload.TxID = data.optionalString("tx_id", errs)
+    payload.AgentID = data.optionalString("agent_id", errs)
+    payload.Address = data.optionalString("address", errs)
+    payload.Direction = AddressDirection(data.optionalString("direction", errs))
+    switch payload.Direction {
+    case "":
+        payload.Direction = DirectionAny
+    case DirectionAny, DirectionFrom, DirectionTo:
+    default:
+        errs.add("direction", "direction must be one of from, to or any")
+    }
+
+    if present, ok := data.decode("blockchain", &payload.Blockchain); present && !ok {
+        errs.add("blockchain", "blockchain must be a string or an array of strings")
+    }
+    for i, name := range payload.Blockchain {
+        payload.Blockchain[i] = strings.TrimSpace(name)
+    }
+
+    if present, ok := data.decode("tx_ids", &payload.TxIDs); present {
+        payload.TxIDs = uniqueStrings(payload.TxIDs)
+        switch {
+        case !ok || len(payload.TxIDs) == 0 || containsString(payload.TxIDs, ""):
+            errs.add("tx_ids", "tx_ids must be a non-empty array of non-empty strings")
+        case len(payload.TxIDs) > maxBatchTxIDs:
+            errs.add("tx_ids", fmt.Sprintf("tx_ids may name at most %d transactions", maxBatchTxIDs))
+        }
+        for _, field := range []string{"tx_id", "agent_id", "address", "blockchain", "stream", "if_modified_since", "from_block", "to_block"} {
+            if _, exists := data[field]; exists {
+                errs.add("tx_ids", "tx_ids cannot be combined with "+field)
+            }
+        }
+    } else if payload.TxID == "" && payload.AgentID == "" && payload.Address == "" {
+        errs.add("tx_id", "tx_id, tx_ids, agent_id or address is required")
+    }
+
+    for _, name := range payload.Blockchain {
+        if !s.isSupportedBlockchain(name) {
+            errs.add("blockchain", "unsupported blockchain: "+name)
+        }
+    }
+
+    if present, ok := data.decode("fields", &payload.Fields); present && !ok {
+        errs.add("fields", "fields must be an array of strings")
+    }
+
+    if present, ok := data.decode("stream", &payload.Stream); present && !ok {
+        errs.add("stream", "stream must be a boolean")
+    }
+
+    if present, ok := data.decode("compress", &payload.Compress); present && !ok {
+        errs.add("compress", "compress must be a boolean")
+    } else if payload.Compress && payload.Stream {
+        errs.add("compress", "compress cannot be combined with stream")
+    }
+
+    if present, ok := data.decode("if_modified_since", &payload.IfModifiedSince); present && !ok {
+        errs.add("if_modified_since", "if_modified_since must be an RFC 3339 timestamp")
+    }
+
+    for field, dest := range map[string]**uint64{
+        "from_block": &payload.FromBlock,
+        "to_block":   &payload.ToBlock,
+    } {
+        if present, ok := data.decode(field, dest); present && !ok {
+            errs.add(field, field+" must be a non-negative integer")
+        } else if present && len(payload.Blockchain) != 1 {
+            errs.add(field, field+" requires a single blockchain")
+        }
+    }
+
+    // Decoding into an int rejects fractions, NaN-like strings and values beyond the int range
+    if present, ok := data.decode("limit", &payload.Limit); present && (!ok || payload.Limit < 0) {
+        errs.add("limit", "limit must be a positive integer")
+    } else if s.MaxTxLimit > 0 && payload.Limit > s.MaxTxLimit {
+        errs.add("limit", fmt.Sprintf("limit must be at most %d", s.MaxTxLimit))
+    }
+    if payload.Limit <= 0 {
+        payload.Limit = 10 // Default limit if not specified
+    }
+
+    return payload, errs
+}
+
+// maxBatchTxIDs bounds the tx_ids of one transaction query.
+const maxBatchTxIDs = 100
+
+// uniqueStrings returns values without repeats, keeping the first occurrence of each.
+func uniqueStrings(values []string) []string {
+    seen := make(map[string]bool, len(values))
+    unique := values[:0]
+    for _, value := range values {
+        if !seen[value] {
+            seen[value] = true
+            unique = append(unique, value)
+        }
+    }
+    return unique
+}
+
+// containsString reports whether values contains value.
+func containsString(values []string, value string) bool {
+    for _, candidate := range values {
+        if candidate == value {
+            return true
+        }
+    }
+    return false
+}
+
+// splitBlockchains parses a comma-separated list of chain names, dropping empty entries.
+func splitBlockchains(joined string) BlockchainList {
+    var names BlockchainList
+    for _, name := range strings.Split(joined, ",") {
+        if name = strings.TrimSpace(name); name != "" {
+            names = append(names, name)
+        }
+    }
+    return names
+}
+
+// isSupportedBlockchain reports whether name matches one of the configured blockchains,
+// ignoring case.
+func (s *WebSocketServer) isSupportedBlockchain(name string) bool {
+    return containsFold(s.SupportedBlockchains, name)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+    "encoding/json"
+    "testing"
+
+    "github.com/stretchr/testify/assert"
+    "github.com/stretchr/testify/require"
+)
+
+// fieldsOf decodes a JSON object into rawFields.
+func fieldsOf(t *testing.T, object string) rawFields {
+    t.Helper()
+    var data rawFields
+    require.NoError(t, json.Unmarshal([]byte(object), &data))
+    return data
+}
+
+func TestRequireString(t *testing.T) {
+    errs := FieldErrors{}
+    assert.Equal(t, "agent-1", fieldsOf(t, `{"agent_id":"agent-1"}`).requireString("agent_id", errs))
+    assert.Empty(t, errs)
+
+    for _, object := range []string{`{}`, `{"agent_id":null}`, `{"agent_id":7}`, `{"agent_id":""}`} {
+        errs := FieldErrors{}
+        fieldsOf(t, object).requireString("agent_id", errs)
+        assert.Equal(t, FieldErrors{"agent_id": "agent_id is required and must be a non-empty string"}, errs, object)
+    }
+}
+
+func TestOptionalString(t *testing.T) {
+    for object, expected := range map[string]string{
+        `{"topic":"agent-1"}`: "agent-1",
+        `{}`:                  "",
+        `{"topic":null}`:      "",
+        `{"topic":""}`:        "",
+    } {
+        errs := FieldErrors{}
+        assert.Equal(t, expected, fieldsOf(t, object).optionalString("topic", errs), object)
+        assert.Empty(t, errs, object)
+    }
+
+    errs := FieldErrors{}
+    fieldsOf(t, `{"topic":["agent-1"]}`).optionalString("topic", errs)
+    assert.Equal(t, FieldErrors{"topic": "topic must be a string"}, errs)
+}
+
+func TestRequireInt(t *testing.T) {
+    errs := FieldErrors{}
+    assert.Equal(t, int64(9007199254740993), fieldsOf(t, `{"client_timestamp":9007199254740993}`).requireInt("client_timestamp", errs))
+    assert.Equal(t, int64(-5), fieldsOf(t, `{"client_timestamp":-5}`).requireInt("client_timestamp", errs))
+    assert.Empty(t, errs)
+
+    for _, object := range []string{`{}`, `{"client_timestamp":null}`, `{"client_timestamp":"5"}`, `{"client_timestamp":1.5}`} {
+        errs := FieldErrors{}
+        fieldsOf(t, object).requireInt("client_timestamp", errs)
+        assert.Equal(t, FieldErrors{"client_timestamp": "client_timestamp is required and must be an integer"}, errs, object)
+    }
+}
+
+func TestOptionalCount(t *testing.T) {
+    for object, expected := range map[string]int{
+        `{"history":5}`:    5,
+        `{"history":0}`:    0,
+        `{}`:               0,
+        `{"history":null}`: 0,
+    } {
+        errs := FieldErrors{}
+        assert.Equal(t, expected, fieldsOf(t, object).optionalCount("history", errs), object)
+        assert.Empty(t, errs, object)
+    }
+
+    for _, object := range []string{`{"history":-1}`, `{"history":1.5}`, `{"history":"5"}`} {
+        errs := FieldErrors{}
+        fieldsOf(t, object).optionalCount("history", errs)
+        assert.Equal(t, FieldErrors{"history": "history must be a non-negative integer"}, errs, object)
+    }
+}